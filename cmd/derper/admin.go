@@ -0,0 +1,205 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"go4.org/mem"
+	"tailscale.com/derp"
+	"tailscale.com/types/key"
+)
+
+// defaultBanDuration is how long /debug/derp/ban bans a key for if
+// the request doesn't say.
+const defaultBanDuration = time.Hour
+
+// adminStatus is the JSON form of /debug/derp.
+type adminStatus struct {
+	Clients       []derp.ClientStatus
+	RemoteClients []derp.RemoteClient
+	Bans          []derp.Ban
+}
+
+// adminHandler returns the handler for /debug/derp, which lists the
+// clients of s, and for /debug/derp/{close,ban,unban}, which take a
+// POSTed key (in hex or base64) to act on.
+//
+// It doesn't check access; it's mounted under /debug/, whose
+// handler does.
+func adminHandler(s *derp.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		action := strings.TrimPrefix(r.URL.Path, "/debug/derp")
+		if action == "" || action == "/" {
+			if r.Method != "GET" {
+				http.Error(w, "GET required", http.StatusMethodNotAllowed)
+				return
+			}
+			st := adminStatus{
+				Clients:       s.Clients(),
+				RemoteClients: s.RemoteClients(),
+				Bans:          s.Bans(),
+			}
+			if wantJSON(r) {
+				w.Header().Set("Content-Type", "application/json")
+				e := json.NewEncoder(w)
+				e.SetIndent("", "\t")
+				e.Encode(st)
+				return
+			}
+			writeAdminHTML(w, &st)
+			return
+		}
+
+		if r.Method != "POST" {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		if !sameOrigin(r) {
+			http.Error(w, "cross-origin request", http.StatusForbidden)
+			return
+		}
+		k, err := parseAdminKey(r.FormValue("key"))
+		if err != nil {
+			http.Error(w, "bad key: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch action {
+		case "/close":
+			if !s.CloseClient(k) {
+				http.Error(w, "client not connected", http.StatusNotFound)
+				return
+			}
+		case "/ban":
+			d := defaultBanDuration
+			if v := r.FormValue("duration"); v != "" {
+				d, err = time.ParseDuration(v)
+				if err != nil || d <= 0 {
+					http.Error(w, "bad duration", http.StatusBadRequest)
+					return
+				}
+			}
+			s.BanClient(k, d)
+		case "/unban":
+			if !s.UnbanClient(k) {
+				http.Error(w, "key not banned", http.StatusNotFound)
+				return
+			}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		http.Redirect(w, r, "/debug/derp", http.StatusSeeOther)
+	})
+}
+
+// wantJSON reports whether r asks for JSON rather than HTML.
+func wantJSON(r *http.Request) bool {
+	return r.FormValue("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// sameOrigin reports whether r, if sent by a browser, came from a
+// page of this server, so other sites can't get a browser with
+// debug access to act on their behalf.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// parseAdminKey parses a client public key in hex (as the server
+// logs them) or base64.
+func parseAdminKey(s string) (key.Public, error) {
+	var k key.Public
+	if s == "" {
+		return k, errors.New("missing")
+	}
+	if len(s) == 64 {
+		return key.NewPublicFromHexMem(mem.S(s))
+	}
+	err := k.UnmarshalText([]byte(s))
+	return k, err
+}
+
+// dropsString formats a ClientStatus.PacketsDropped map, sorted by
+// reason.
+func dropsString(m map[string]int64) string {
+	var reasons []string
+	for r := range m {
+		reasons = append(reasons, r)
+	}
+	sort.Strings(reasons)
+	var sb strings.Builder
+	for i, r := range reasons {
+		if i > 0 {
+			sb.WriteString(" ")
+		}
+		fmt.Fprintf(&sb, "%s=%d", r, m[r])
+	}
+	return sb.String()
+}
+
+func writeAdminHTML(w http.ResponseWriter, st *adminStatus) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	f := func(format string, args ...interface{}) { fmt.Fprintf(w, format, args...) }
+	button := func(action string, k key.Public, label string) {
+		f(`<form method="POST" action="/debug/derp/%s" style="display:inline"><input type="hidden" name="key" value="%x"><input type="submit" value="%s"></form>`, action, k[:], label)
+	}
+	now := time.Now()
+
+	f("<html><body>\n<h1>DERP clients</h1>\n")
+	f("<p>%d connected; <a href=\"/debug/derp?format=json\">JSON</a></p>\n", len(st.Clients))
+	f("<table border=1 cellpadding=3>\n")
+	f("<tr><th>Key</th><th>Remote addr</th><th>Conn</th><th>Flags</th><th>Connected</th><th>Pkts in</th><th>Bytes in</th><th>Pkts out</th><th>Bytes out</th><th>Queued</th><th>Dropped</th><th></th></tr>\n")
+	for _, c := range st.Clients {
+		var flags []string
+		if c.Preferred {
+			flags = append(flags, "home")
+		}
+		if c.Mesh {
+			flags = append(flags, "mesh")
+		}
+		if c.Watcher {
+			flags = append(flags, "watcher")
+		}
+		f("<tr><td><tt>%x</tt></td><td>%s</td><td>%d</td><td>%s</td><td>%v ago</td><td>%d</td><td>%d</td><td>%d</td><td>%d</td><td>%d</td><td>%s</td><td>",
+			c.Key[:], html.EscapeString(c.RemoteAddr), c.ConnNum, strings.Join(flags, " "),
+			now.Sub(c.ConnectedAt).Round(time.Second),
+			c.PacketsRecv, c.BytesRecv, c.PacketsSent, c.BytesSent, c.SendQueueLen, dropsString(c.PacketsDropped))
+		button("close", c.Key, "close")
+		button("ban", c.Key, "ban 1h")
+		f("</td></tr>\n")
+	}
+	f("</table>\n")
+
+	f("<h2>Via mesh peers</h2>\n<ul>\n")
+	for _, rc := range st.RemoteClients {
+		local := ""
+		if rc.Local {
+			local = " (also local)"
+		}
+		f("<li><tt>%x</tt>%s: %s</li>\n", rc.Key[:], local, html.EscapeString(strings.Join(rc.Forwarders, ", ")))
+	}
+	f("</ul>\n")
+
+	f("<h2>Bans</h2>\n<ul>\n")
+	for _, b := range st.Bans {
+		f("<li><tt>%x</tt> for %v ", b.Key[:], b.Until.Sub(now).Round(time.Second))
+		button("unban", b.Key, "unban")
+		f("</li>\n")
+	}
+	f("</ul>\n</body></html>\n")
+}
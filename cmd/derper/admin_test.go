@@ -0,0 +1,79 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"tailscale.com/derp"
+	"tailscale.com/types/key"
+)
+
+func TestAdminHandler(t *testing.T) {
+	s := derp.NewServer(key.NewPrivate(), t.Logf)
+	defer s.Close()
+	h := adminHandler(s)
+	k := key.NewPrivate().Public()
+
+	do := func(method, path string, form url.Values, hdr ...string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		if method == "POST" {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		for i := 0; i+1 < len(hdr); i += 2 {
+			req.Header.Set(hdr[i], hdr[i+1])
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	status := func() adminStatus {
+		t.Helper()
+		rec := do("GET", "/debug/derp?format=json", nil)
+		var st adminStatus
+		if err := json.Unmarshal(rec.Body.Bytes(), &st); err != nil {
+			t.Fatalf("bad JSON %q: %v", rec.Body.Bytes(), err)
+		}
+		return st
+	}
+
+	if rec := do("GET", "/debug/derp", nil); rec.Code != 200 || !strings.Contains(rec.Body.String(), "DERP clients") {
+		t.Errorf("HTML status: %v, %q", rec.Code, rec.Body.String())
+	}
+	if rec := do("GET", "/debug/derp/ban", nil); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET of ban: %v; want 405", rec.Code)
+	}
+	if rec := do("POST", "/debug/derp/ban", url.Values{"key": {"nope"}}); rec.Code != http.StatusBadRequest {
+		t.Errorf("ban of bad key: %v; want 400", rec.Code)
+	}
+	hexKey := fmt.Sprintf("%x", k[:])
+	if rec := do("POST", "/debug/derp/ban", url.Values{"key": {hexKey}}, "Origin", "https://evil.example"); rec.Code != http.StatusForbidden {
+		t.Errorf("cross-origin ban: %v; want 403", rec.Code)
+	}
+	if rec := do("POST", "/debug/derp/close", url.Values{"key": {hexKey}}); rec.Code != http.StatusNotFound {
+		t.Errorf("close of unknown client: %v; want 404", rec.Code)
+	}
+
+	if rec := do("POST", "/debug/derp/ban", url.Values{"key": {hexKey}, "duration": {"10m"}}); rec.Code != http.StatusSeeOther {
+		t.Fatalf("ban: %v, %q", rec.Code, rec.Body.String())
+	}
+	if st := status(); len(st.Bans) != 1 || st.Bans[0].Key != k {
+		t.Errorf("bans after ban = %+v", st.Bans)
+	}
+	b64Key, _ := k.MarshalText()
+	if rec := do("POST", "/debug/derp/unban", url.Values{"key": {string(b64Key)}}); rec.Code != http.StatusSeeOther {
+		t.Fatalf("unban: %v, %q", rec.Code, rec.Body.String())
+	}
+	if st := status(); len(st.Bans) != 0 {
+		t.Errorf("bans after unban = %+v", st.Bans)
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// certPollInterval is how often the manual certificate files are
+// checked for changes.
+const certPollInterval = 30 * time.Second
+
+// manualCertStore serves certificates read from <dir>/<hostname>.crt
+// and <dir>/<hostname>.key for a fixed set of hostnames, picking one
+// by the TLS client's SNI.
+type manualCertStore struct {
+	dir   string
+	hosts []string // normalized; the first is used for clients without SNI
+
+	mu    sync.Mutex
+	certs map[string]*tls.Certificate // normalized hostname => cert
+	stamp string                      // file sizes and mtimes as of the last load
+}
+
+// newManualCertStore returns a manualCertStore for hosts, having
+// loaded all their certificates.
+func newManualCertStore(dir string, hosts []string) (*manualCertStore, error) {
+	if len(hosts) == 0 {
+		return nil, errors.New("no hostnames")
+	}
+	s := &manualCertStore{dir: dir}
+	for _, h := range hosts {
+		s.hosts = append(s.hosts, normalizeHostname(h))
+	}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func normalizeHostname(h string) string {
+	return strings.TrimSuffix(strings.ToLower(h), ".")
+}
+
+func (s *manualCertStore) files(host string) (certFile, keyFile string) {
+	return filepath.Join(s.dir, host+".crt"), filepath.Join(s.dir, host+".key")
+}
+
+// fileStamp returns a string that changes whenever any of the
+// certificate or key files do.
+func (s *manualCertStore) fileStamp() string {
+	var sb strings.Builder
+	for _, h := range s.hosts {
+		cf, kf := s.files(h)
+		for _, f := range []string{cf, kf} {
+			fi, err := os.Stat(f)
+			if err != nil {
+				fmt.Fprintf(&sb, "%s:missing;", f)
+				continue
+			}
+			fmt.Fprintf(&sb, "%s:%d:%d;", f, fi.Size(), fi.ModTime().UnixNano())
+		}
+	}
+	return sb.String()
+}
+
+// reload reads all the certificates and keys. If any fails to load,
+// the previously loaded certificates stay in use.
+func (s *manualCertStore) reload() error {
+	stamp := s.fileStamp()
+	s.mu.Lock()
+	s.stamp = stamp // even on failure, so we only retry once the files change again
+	s.mu.Unlock()
+
+	certs := make(map[string]*tls.Certificate)
+	for _, h := range s.hosts {
+		cf, kf := s.files(h)
+		cert, err := tls.LoadX509KeyPair(cf, kf)
+		if err != nil {
+			return fmt.Errorf("loading certificate for %s: %v", h, err)
+		}
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fmt.Errorf("parsing certificate for %s: %v", h, err)
+		}
+		certs[h] = &cert
+		log.Printf("derper: loaded certificate for %s, valid until %v", h, cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.certs = certs
+	return nil
+}
+
+// reloadIfChanged reloads the certificates if any of their files
+// changed since the last reload.
+func (s *manualCertStore) reloadIfChanged() (changed bool, err error) {
+	s.mu.Lock()
+	old := s.stamp
+	s.mu.Unlock()
+	if s.fileStamp() == old {
+		return false, nil
+	}
+	return true, s.reload()
+}
+
+// watch reloads the certificates on SIGHUP and whenever their files
+// change. It never returns.
+func (s *manualCertStore) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	t := time.NewTicker(certPollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-hup:
+			log.Printf("derper: got SIGHUP, reloading certificates")
+			if err := s.reload(); err != nil {
+				log.Printf("derper: %v; still using previous certificates", err)
+			}
+		case <-t.C:
+			if changed, err := s.reloadIfChanged(); changed && err != nil {
+				log.Printf("derper: %v; still using previous certificates", err)
+			}
+		}
+	}
+}
+
+// getCertificate implements tls.Config.GetCertificate.
+func (s *manualCertStore) getCertificate(hi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name := normalizeHostname(hi.ServerName)
+	if name == "" {
+		name = s.hosts[0]
+	}
+	if cert, ok := s.certs[name]; ok {
+		return cert, nil
+	}
+	return nil, fmt.Errorf("no certificate for %q", hi.ServerName)
+}
+
+// manualTLSConfig returns the TLS config for --certmode=manual,
+// serving the certificates for --hostname from --certdir and, with
+// --client-ca-file, requiring client certificates.
+func manualTLSConfig() (*tls.Config, error) {
+	certs, err := newManualCertStore(*certDir, strings.Split(*hostname, ","))
+	if err != nil {
+		return nil, err
+	}
+	go certs.watch()
+	conf := &tls.Config{GetCertificate: certs.getCertificate}
+	if *clientCAFile != "" {
+		pool, err := loadCertPool(*clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("--client-ca-file: %v", err)
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+		log.Printf("derper: requiring client certificates signed by %s", *clientCAFile)
+	}
+	return conf, nil
+}
+
+// loadCertPool returns a pool of the PEM certificates in file.
+func loadCertPool(file string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no PEM certificates in %s", file)
+	}
+	return pool, nil
+}
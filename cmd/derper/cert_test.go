@@ -0,0 +1,138 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a new self-signed certificate and key for host
+// into dir and returns the certificate's DER bytes.
+func writeTestCert(t *testing.T, dir, host string) []byte {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(filepath.Join(dir, host+".crt"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, host+".key"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+// bumpMtime moves the mtime of host's files forward, in case the
+// filesystem's timestamps are too coarse to notice a rewrite.
+func bumpMtime(t *testing.T, dir, host string, d time.Duration) {
+	t.Helper()
+	when := time.Now().Add(d)
+	for _, ext := range []string{".crt", ".key"} {
+		if err := os.Chtimes(filepath.Join(dir, host+ext), when, when); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestManualCertStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "derper-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	derA := writeTestCert(t, dir, "a.example.com")
+	derB := writeTestCert(t, dir, "b.example.com")
+
+	if _, err := newManualCertStore(dir, []string{"a.example.com", "missing.example.com"}); err == nil {
+		t.Fatal("newManualCertStore with a missing certificate succeeded")
+	}
+	s, err := newManualCertStore(dir, []string{"a.example.com", "B.example.com."})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(sni string, want []byte) {
+		t.Helper()
+		cert, err := s.getCertificate(&tls.ClientHelloInfo{ServerName: sni})
+		if want == nil {
+			if err == nil {
+				t.Errorf("getCertificate(%q) succeeded; want error", sni)
+			}
+			return
+		}
+		if err != nil {
+			t.Errorf("getCertificate(%q): %v", sni, err)
+			return
+		}
+		if !bytes.Equal(cert.Certificate[0], want) {
+			t.Errorf("getCertificate(%q) returned the wrong certificate", sni)
+		}
+	}
+	check("a.example.com", derA)
+	check("b.example.com", derB)
+	check("B.Example.COM", derB)
+	check("", derA)
+	check("c.example.com", nil)
+
+	if changed, err := s.reloadIfChanged(); changed || err != nil {
+		t.Fatalf("reloadIfChanged with no changes = %v, %v", changed, err)
+	}
+
+	// A renewed certificate is picked up.
+	derB2 := writeTestCert(t, dir, "b.example.com")
+	bumpMtime(t, dir, "b.example.com", time.Minute)
+	if changed, err := s.reloadIfChanged(); !changed || err != nil {
+		t.Fatalf("reloadIfChanged after renewal = %v, %v", changed, err)
+	}
+	check("b.example.com", derB2)
+
+	// A broken one isn't, and the old one stays in use.
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.example.com.key"), []byte("junk"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	bumpMtime(t, dir, "a.example.com", 2*time.Minute)
+	if changed, err := s.reloadIfChanged(); !changed || err == nil {
+		t.Fatalf("reloadIfChanged after breakage = %v, %v; want true, error", changed, err)
+	}
+	check("a.example.com", derA)
+	check("b.example.com", derB2)
+
+	// Not retried until the files change again.
+	if changed, _ := s.reloadIfChanged(); changed {
+		t.Error("reloadIfChanged retried a failed load with no changes")
+	}
+}
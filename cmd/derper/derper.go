@@ -6,6 +6,7 @@
 package main // import "tailscale.com/cmd/derper"
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -17,6 +18,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -40,12 +42,21 @@ var (
 	dev           = flag.Bool("dev", false, "run in localhost development mode")
 	addr          = flag.String("a", ":443", "server address")
 	configPath    = flag.String("c", "", "config file path")
-	certDir       = flag.String("certdir", tsweb.DefaultCertDir("derper-certs"), "directory to store LetsEncrypt certs, if addr's port is :443")
-	hostname      = flag.String("hostname", "derp.tailscale.com", "LetsEncrypt host name, if addr's port is :443")
+	certMode      = flag.String("certmode", "letsencrypt", "mode for getting a cert. possible options: manual, letsencrypt")
+	certDir       = flag.String("certdir", tsweb.DefaultCertDir("derper-certs"), "directory to store LetsEncrypt certs, if addr's port is :443; with --certmode=manual, directory of <hostname>.crt and <hostname>.key files")
+	hostname      = flag.String("hostname", "derp.tailscale.com", "LetsEncrypt host name, if addr's port is :443; with --certmode=manual, a comma-separated list of host names to serve by SNI, the first being the default")
+	clientCAFile  = flag.String("client-ca-file", "", "if non-empty, path to a PEM file of CA certificates; clients must present a TLS certificate signed by one of them (see --mesh-cert-file for meshed servers, and TS_DERP_CLIENT_CERT for tailscaled). Requires --certmode=manual")
 	logCollection = flag.String("logcollection", "", "If non-empty, logtail collection to log to")
 	runSTUN       = flag.Bool("stun", false, "also run a STUN server")
 	meshPSKFile   = flag.String("mesh-psk-file", defaultMeshPSKFile(), "if non-empty, path to file containing the mesh pre-shared key file. It should contain some hex string; whitespace is trimmed.")
 	meshWith      = flag.String("mesh-with", "", "optional comma-separated list of hostnames to mesh with; the server's own hostname can be in the list")
+	meshCertFile  = flag.String("mesh-cert-file", "", "if non-empty, path to a PEM file of the TLS client certificate to present to --mesh-with servers that require one. Requires --mesh-key-file")
+	meshKeyFile   = flag.String("mesh-key-file", "", "path to the PEM file of the private key of --mesh-cert-file")
+
+	allowlistFile   = flag.String("allowlist-file", "", "if non-empty, path to a file of client public keys (one per line, hex or base64) allowed to use this server")
+	verifyClientURL = flag.String("verify-client-url", "", "if non-empty, URL to ask whether a client may use this server; the client's hex public key is appended as the key query parameter, and any status other than 200 rejects the client")
+	clientBytesPS   = flag.Int("client-bytes-per-sec", 0, "if non-zero, per-client limit of bytes per second sent through this server")
+	clientPacketsPS = flag.Int("client-packets-per-sec", 0, "if non-zero, per-client limit of packets per second sent through this server")
 )
 
 type config struct {
@@ -119,7 +130,18 @@ func main() {
 
 	cfg := loadConfig()
 
-	letsEncrypt := tsweb.IsProd443(*addr)
+	var useTLS bool
+	switch *certMode {
+	case "letsencrypt":
+		useTLS = tsweb.IsProd443(*addr)
+		if *clientCAFile != "" {
+			log.Fatalf("--client-ca-file requires --certmode=manual")
+		}
+	case "manual":
+		useTLS = true
+	default:
+		log.Fatalf("unknown --certmode %q", *certMode)
+	}
 
 	s := derp.NewServer(key.Private(cfg.PrivateKey), log.Printf)
 
@@ -135,6 +157,26 @@ func main() {
 		s.SetMeshKey(key)
 		log.Printf("DERP mesh key configured")
 	}
+	if *allowlistFile != "" && *verifyClientURL != "" {
+		log.Fatalf("--allowlist-file and --verify-client-url are mutually exclusive")
+	}
+	if *allowlistFile != "" {
+		allow, err := derp.ReadAllowlistFile(*allowlistFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s.SetVerifyClient(allow.VerifyClient)
+		log.Printf("DERP client allowlist of %d keys configured", len(allow))
+	}
+	if *verifyClientURL != "" {
+		verify, err := verifyClientFunc(*verifyClientURL)
+		if err != nil {
+			log.Fatalf("--verify-client-url: %v", err)
+		}
+		s.SetVerifyClient(verify)
+		log.Printf("DERP client verification via %s configured", *verifyClientURL)
+	}
+	s.SetClientRateLimit(*clientBytesPS, *clientPacketsPS)
 	if err := startMesh(s); err != nil {
 		log.Fatalf("startMesh: %v", err)
 	}
@@ -170,29 +212,36 @@ func main() {
 	}
 
 	var err error
-	if letsEncrypt {
+	if useTLS {
 		if *certDir == "" {
 			log.Fatalf("missing required --certdir flag")
 		}
 		log.Printf("derper: serving on %s with TLS", *addr)
-		certManager := &autocert.Manager{
-			Prompt:     autocert.AcceptTOS,
-			HostPolicy: autocert.HostWhitelist(*hostname),
-			Cache:      autocert.DirCache(*certDir),
-		}
-		if *hostname == "derp.tailscale.com" {
-			certManager.HostPolicy = prodAutocertHostPolicy
-			certManager.Email = "security@tailscale.com"
-		}
-		httpsrv.TLSConfig = certManager.TLSConfig()
-		go func() {
-			err := http.ListenAndServe(":80", certManager.HTTPHandler(tsweb.Port80Handler{Main: mux}))
+		if *certMode == "manual" {
+			httpsrv.TLSConfig, err = manualTLSConfig()
 			if err != nil {
-				if err != http.ErrServerClosed {
-					log.Fatal(err)
-				}
+				log.Fatalf("derper: %v", err)
 			}
-		}()
+		} else {
+			certManager := &autocert.Manager{
+				Prompt:     autocert.AcceptTOS,
+				HostPolicy: autocert.HostWhitelist(*hostname),
+				Cache:      autocert.DirCache(*certDir),
+			}
+			if *hostname == "derp.tailscale.com" {
+				certManager.HostPolicy = prodAutocertHostPolicy
+				certManager.Email = "security@tailscale.com"
+			}
+			httpsrv.TLSConfig = certManager.TLSConfig()
+			go func() {
+				err := http.ListenAndServe(":80", certManager.HTTPHandler(tsweb.Port80Handler{Main: mux}))
+				if err != nil {
+					if err != http.ErrServerClosed {
+						log.Fatal(err)
+					}
+				}
+			}()
+		}
 		err = httpsrv.ListenAndServeTLS("", "")
 	} else {
 		log.Printf("derper: serving on %s", *addr)
@@ -203,8 +252,39 @@ func main() {
 	}
 }
 
+// verifyClientFunc returns a func for derp.Server.SetVerifyClient
+// that asks the server at urlStr whether each client may connect.
+func verifyClientFunc(urlStr string) (func(key.Public) error, error) {
+	base, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, err
+	}
+	c := &http.Client{Timeout: 5 * time.Second}
+	return func(k key.Public) error {
+		u := *base
+		q := u.Query()
+		q.Set("key", fmt.Sprintf("%x", k[:]))
+		u.RawQuery = q.Encode()
+		res, err := c.Get(u.String())
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1<<10))
+			return fmt.Errorf("verify client: %v: %s", res.Status, bytes.TrimSpace(msg))
+		}
+		return nil
+	}, nil
+}
+
 func debugHandler(s *derp.Server) http.Handler {
+	admin := adminHandler(s)
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/debug/derp" || strings.HasPrefix(r.URL.Path, "/debug/derp/") {
+			admin.ServeHTTP(w, r)
+			return
+		}
 		if r.RequestURI == "/debug/check" {
 			err := s.ConsistencyCheck()
 			if err != nil {
@@ -230,6 +310,7 @@ func debugHandler(s *derp.Server) http.Handler {
    <li><a href="/debug/pprof/goroutine?debug=1">/debug/pprof/goroutine</a> (collapsed)</li>
    <li><a href="/debug/pprof/goroutine?debug=2">/debug/pprof/goroutine</a> (full)</li>
    <li><a href="/debug/check">/debug/check</a> internal consistency check</li>
+   <li><a href="/debug/derp">/debug/derp</a> connected clients, to inspect, close or ban</li>
 <ul>
 </html>
 `)
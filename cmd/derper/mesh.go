@@ -23,6 +23,9 @@ func startMesh(s *derp.Server) error {
 	if !s.HasMeshKey() {
 		return errors.New("--mesh-with requires --mesh-psk-file")
 	}
+	if (*meshCertFile == "") != (*meshKeyFile == "") {
+		return errors.New("--mesh-cert-file and --mesh-key-file must be used together")
+	}
 	for _, host := range strings.Split(*meshWith, ",") {
 		if err := startMeshWithHost(s, host); err != nil {
 			return err
@@ -38,6 +41,8 @@ func startMeshWithHost(s *derp.Server, host string) error {
 		return err
 	}
 	c.MeshKey = s.MeshKey()
+	c.ClientCertFile = *meshCertFile
+	c.ClientKeyFile = *meshKeyFile
 	add := func(k key.Public) { s.AddPacketForwarder(k, c) }
 	remove := func(k key.Public) { s.RemovePacketForwarder(k, c) }
 	go c.RunWatchConnectionLoop(s.PublicKey(), add, remove)
@@ -0,0 +1,86 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The logtaild binary is a small, self-hostable log collection server.
+//
+// It accepts uploads from logtail clients, as configured with
+// tailscaled's --log-collector flag, at /c/<collection>/<private-id>.
+// Each instance's logs are appended, one JSON object per line, to
+// <dir>/<collection>/<public-id>.json; the private ID is never stored.
+package main // import "tailscale.com/cmd/logtaild"
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+	"tailscale.com/tsweb"
+)
+
+var (
+	addr        = flag.String("a", ":443", "server address")
+	dir         = flag.String("dir", "", "directory to store logs in")
+	collections = flag.String("collections", "", "if non-empty, comma-separated list of the only collections to accept, as in tailnode.log.tailscale.io")
+	certDir     = flag.String("certdir", tsweb.DefaultCertDir("logtaild-certs"), "directory to store LetsEncrypt certs, if addr's port is :443")
+	hostname    = flag.String("hostname", "", "LetsEncrypt host name, if addr's port is :443")
+)
+
+func main() {
+	flag.Parse()
+
+	if *dir == "" {
+		log.Fatalf("logtaild: -dir <path> not specified")
+	}
+
+	s := newServer(*dir, log.Printf)
+	if *collections != "" {
+		s.collections = make(map[string]bool)
+		for _, c := range strings.Split(*collections, ",") {
+			c = strings.TrimSpace(c)
+			if !validCollection(c) {
+				log.Fatalf("logtaild: -collections: invalid collection name %q", c)
+			}
+			s.collections[c] = true
+		}
+	}
+
+	mux := tsweb.NewMux(http.NotFoundHandler())
+	mux.Handle("/c/", s)
+
+	httpsrv := &http.Server{
+		Addr:    *addr,
+		Handler: mux,
+	}
+	var err error
+	if tsweb.IsProd443(*addr) {
+		if *hostname == "" {
+			log.Fatalf("logtaild: missing required --hostname flag")
+		}
+		if *certDir == "" {
+			log.Fatalf("logtaild: missing required --certdir flag")
+		}
+		log.Printf("logtaild: serving on %s with TLS", *addr)
+		certManager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(*hostname),
+			Cache:      autocert.DirCache(*certDir),
+		}
+		httpsrv.TLSConfig = certManager.TLSConfig()
+		go func() {
+			err := http.ListenAndServe(":80", certManager.HTTPHandler(tsweb.Port80Handler{Main: mux}))
+			if err != nil && err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+		err = httpsrv.ListenAndServeTLS("", "")
+	} else {
+		log.Printf("logtaild: serving on %s", *addr)
+		err = httpsrv.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatalf("logtaild: %v", err)
+	}
+}
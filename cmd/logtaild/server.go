@@ -0,0 +1,228 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/logtail"
+	"tailscale.com/smallzstd"
+	"tailscale.com/types/logger"
+)
+
+const (
+	// maxBodySize is the largest upload accepted, before decompression.
+	maxBodySize = 1 << 20
+	// maxDecodedSize is the largest upload accepted, after decompression.
+	// Clients send at most 256 KiB of logs at a time.
+	maxDecodedSize = 4 << 20
+)
+
+// server stores the logs uploaded by logtail clients.
+type server struct {
+	dir         string
+	collections map[string]bool // if non-nil, the only collections accepted
+	logf        logger.Logf
+	timeNow     func() time.Time
+
+	mu sync.Mutex // serializes writes to the log files
+}
+
+func newServer(dir string, logf logger.Logf) *server {
+	return &server{
+		dir:     dir,
+		logf:    logf,
+		timeNow: time.Now,
+	}
+}
+
+// validCollection reports whether name can be used as a collection
+// name, which is also a directory name.
+func validCollection(name string) bool {
+	if name == "" || name[0] == '.' {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '.', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func httpError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{msg})
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/c/"), "/")
+	if !strings.HasPrefix(r.URL.Path, "/c/") || len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	collection := parts[0]
+	if !validCollection(collection) || (s.collections != nil && !s.collections[collection]) {
+		httpError(w, http.StatusForbidden, "invalid collection name")
+		return
+	}
+	privID, err := logtail.ParsePrivateID(parts[1])
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "invalid instance ID")
+		return
+	}
+	pubID := privID.Public()
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "reading body failed")
+		return
+	}
+	if len(body) > maxBodySize {
+		httpError(w, http.StatusRequestEntityTooLarge, "body too large")
+		return
+	}
+	switch r.Header.Get("Content-Encoding") {
+	case "":
+	case "zstd":
+		body, err = decompress(body)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	default:
+		httpError(w, http.StatusUnsupportedMediaType, "unsupported Content-Encoding")
+		return
+	}
+
+	lines, parseErr := s.parseLogs(body)
+	if err := s.appendLogs(collection, pubID, lines); err != nil {
+		s.logf("logtaild: %s/%s: %v", collection, pubID, err)
+		httpError(w, http.StatusInternalServerError, "storing logs failed")
+		return
+	}
+	if parseErr != nil {
+		// The logs were stored anyway, with the error. Clients
+		// don't retry on 400, so they aren't uploaded again.
+		httpError(w, http.StatusBadRequest, parseErr.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// decompress returns the zstd-compressed body decompressed.
+func decompress(body []byte) ([]byte, error) {
+	dec, err := smallzstd.NewDecoder(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(dec, maxDecodedSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("invalid zstd body: %v", err)
+	}
+	if len(b) > maxDecodedSize {
+		return nil, fmt.Errorf("decompressed body larger than %d bytes", maxDecodedSize)
+	}
+	return b, nil
+}
+
+// parseLogs parses body, a JSON log object or array of them, into
+// lines of JSON to store, stamped with the server time.
+//
+// If body isn't valid, it's stored as the text of a log object with
+// the error, and the error is returned along with that object.
+func (s *server) parseLogs(body []byte) ([][]byte, error) {
+	now := s.timeNow().UTC().Format(time.RFC3339Nano)
+
+	var objs []map[string]interface{}
+	var err error
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(trimmed, &objs)
+	} else {
+		var obj map[string]interface{}
+		err = json.Unmarshal(trimmed, &obj)
+		objs = []map[string]interface{}{obj}
+	}
+	if err != nil {
+		err = fmt.Errorf("invalid log JSON: %v", err)
+		objs = []map[string]interface{}{{
+			"logtail": map[string]interface{}{"error": err.Error()},
+			"text":    string(body),
+		}}
+	}
+
+	lines := make([][]byte, 0, len(objs))
+	for _, obj := range objs {
+		if obj == nil {
+			// A JSON null; nothing to store.
+			continue
+		}
+		lt, ok := obj["logtail"].(map[string]interface{})
+		if !ok {
+			lt = make(map[string]interface{})
+			if v, exists := obj["logtail"]; exists {
+				lt["error_has_logtail"] = v
+			}
+			obj["logtail"] = lt
+		}
+		lt["server_time"] = now
+		line, merr := json.Marshal(obj)
+		if merr != nil {
+			// Can't happen with values from json.Unmarshal.
+			return nil, merr
+		}
+		lines = append(lines, append(line, '\n'))
+	}
+	return lines, err
+}
+
+// appendLogs appends lines to the log file of the instance pubID in
+// collection.
+func (s *server) appendLogs(collection string, pubID logtail.PublicID, lines [][]byte) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	dir := filepath.Join(s.dir, collection)
+	path := filepath.Join(dir, pubID.String()+".json")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(bytes.Join(lines, nil)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"tailscale.com/logtail"
+	"tailscale.com/smallzstd"
+)
+
+// readLogs returns the logs stored for the instance privID in collection.
+func readLogs(t *testing.T, dir, collection string, privID logtail.PrivateID) []map[string]interface{} {
+	t.Helper()
+	f, err := os.Open(filepath.Join(dir, collection, privID.Public().String()+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var logs []map[string]interface{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var obj map[string]interface{}
+		if err := json.Unmarshal(sc.Bytes(), &obj); err != nil {
+			t.Fatalf("invalid line %q: %v", sc.Bytes(), err)
+		}
+		logs = append(logs, obj)
+	}
+	return logs
+}
+
+func TestServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logtaild-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newServer(dir, t.Logf)
+	s.collections = map[string]bool{"test.example.com": true}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	privID, err := logtail.NewPrivateID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := logtail.Log(logtail.Config{
+		Collection: "test.example.com",
+		PrivateID:  privID,
+		BaseURL:    ts.URL,
+		NewZstdEncoder: func() logtail.Encoder {
+			w, err := smallzstd.NewEncoder(nil)
+			if err != nil {
+				panic(err)
+			}
+			return w
+		},
+	}, t.Logf)
+	l.Write([]byte("hello"))
+	l.Write([]byte(`{"text": "structured", "n": 1}`))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := l.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	logs := readLogs(t, dir, "test.example.com", privID)
+	texts := make(map[interface{}]bool)
+	for i, obj := range logs {
+		texts[obj["text"]] = true
+		lt, _ := obj["logtail"].(map[string]interface{})
+		if lt["client_time"] == nil || lt["server_time"] == nil {
+			t.Errorf("log %d logtail = %v; want client and server times", i, lt)
+		}
+	}
+	if !texts["hello"] || !texts["structured"] {
+		t.Errorf("logs = %v; want hello and structured", logs)
+	}
+
+	post := func(collection, id, body string) *http.Response {
+		t.Helper()
+		resp, err := http.Post(ts.URL+"/c/"+collection+"/"+id, "application/json", bytes.NewReader([]byte(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	if resp := post("other.example.com", privID.String(), `{"text": "x"}`); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("other collection: status = %d; want %d", resp.StatusCode, http.StatusForbidden)
+	}
+	if resp := post("test.example.com", "not-an-id", `{"text": "x"}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid ID: status = %d; want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	// Invalid logs are stored with the error, and rejected.
+	if resp := post("test.example.com", privID.String(), `{"text": `); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid JSON: status = %d; want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+	n := len(logs)
+	logs = readLogs(t, dir, "test.example.com", privID)
+	if len(logs) != n+1 {
+		t.Fatalf("got %d logs; want %d", len(logs), n+1)
+	}
+	last := logs[n]
+	lt, _ := last["logtail"].(map[string]interface{})
+	if last["text"] != `{"text": ` || lt["error"] == nil {
+		t.Errorf("invalid log stored as %v", last)
+	}
+}
@@ -0,0 +1,291 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"inet.af/netaddr"
+	"tailscale.com/atomicfile"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/tailcfg"
+)
+
+// user is a tailcontrol user. There is exactly one login per user.
+type user struct {
+	ID          tailcfg.UserID
+	LoginName   string // "alice@example.com" or any other unique name
+	DisplayName string
+	Created     time.Time
+}
+
+func (u *user) tailcfgUser() tailcfg.User {
+	return tailcfg.User{
+		ID:          u.ID,
+		LoginName:   u.LoginName,
+		DisplayName: u.DisplayName,
+		Logins:      []tailcfg.LoginID{tailcfg.LoginID(u.ID)},
+		Created:     u.Created,
+	}
+}
+
+func (u *user) tailcfgLogin() tailcfg.Login {
+	return tailcfg.Login{
+		ID:          tailcfg.LoginID(u.ID),
+		Provider:    "tailcontrol",
+		LoginName:   u.LoginName,
+		DisplayName: u.DisplayName,
+	}
+}
+
+func (u *user) profile() tailcfg.UserProfile {
+	return tailcfg.UserProfile{
+		ID:          u.ID,
+		LoginName:   u.LoginName,
+		DisplayName: u.DisplayName,
+	}
+}
+
+// authKey is a pre-generated key that registers nodes without
+// interactive login.
+type authKey struct {
+	Key      string
+	User     string // LoginName of the user the nodes are registered to
+	Reusable bool   // if false, the key can only be used once
+	Used     bool
+	Created  time.Time
+}
+
+// dbState is the JSON representation of the database on disk.
+type dbState struct {
+	PrivateKey wgcfg.PrivateKey
+	Users      []*user
+	Nodes      []*tailcfg.Node
+	AuthKeys   []*authKey
+}
+
+// db is tailcontrol's persistent store of users, nodes and auth keys.
+//
+// Methods with a Locked suffix require mu to be held;
+// the others acquire it themselves.
+type db struct {
+	path string // or empty to not persist
+
+	mu sync.Mutex
+	st dbState
+}
+
+// loadDB loads the database from path, creating it (and a new
+// server private key) if it doesn't exist yet.
+// If path is empty, the database is only kept in memory.
+func loadDB(path string) (*db, error) {
+	d := &db{path: path}
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		switch {
+		case err == nil:
+			if err := json.Unmarshal(b, &d.st); err != nil {
+				return nil, fmt.Errorf("db: %s: %v", path, err)
+			}
+			return d, nil
+		case os.IsNotExist(err):
+		default:
+			return nil, err
+		}
+	}
+	k, err := wgcfg.NewPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	d.st.PrivateKey = k
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.saveLocked(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *db) saveLocked() error {
+	if d.path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(d.st, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(d.path), 0700); err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(d.path, b, 0600)
+}
+
+// privateKey returns the server's private key.
+func (d *db) privateKey() wgcfg.PrivateKey {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.st.PrivateKey
+}
+
+var (
+	errUnknownAuthKey = errors.New("unknown auth key")
+	errUsedAuthKey    = errors.New("auth key already used")
+)
+
+// newAuthKey generates and stores a new auth key for the user with
+// the given login name.
+func (d *db) newAuthKey(loginName string, reusable bool, now time.Time) (*authKey, error) {
+	var b [24]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, err
+	}
+	ak := &authKey{
+		Key:      "tskey-" + hex.EncodeToString(b[:]),
+		User:     loginName,
+		Reusable: reusable,
+		Created:  now,
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.st.AuthKeys = append(d.st.AuthKeys, ak)
+	if err := d.saveLocked(); err != nil {
+		return nil, err
+	}
+	return ak, nil
+}
+
+// useAuthKeyLocked marks the auth key k as used and returns the login
+// name of the user it belongs to.
+// The change is only persisted by the next saveLocked.
+func (d *db) useAuthKeyLocked(k string) (loginName string, err error) {
+	for _, ak := range d.st.AuthKeys {
+		if ak.Key != k {
+			continue
+		}
+		if ak.Used && !ak.Reusable {
+			return "", errUsedAuthKey
+		}
+		ak.Used = true
+		return ak.User, nil
+	}
+	return "", errUnknownAuthKey
+}
+
+// userLocked returns the user with the given login name, creating it
+// if needed.
+func (d *db) userLocked(loginName string, now time.Time) *user {
+	var maxID tailcfg.UserID
+	for _, u := range d.st.Users {
+		if u.LoginName == loginName {
+			return u
+		}
+		if u.ID > maxID {
+			maxID = u.ID
+		}
+	}
+	u := &user{
+		ID:          maxID + 1,
+		LoginName:   loginName,
+		DisplayName: loginName,
+		Created:     now,
+	}
+	d.st.Users = append(d.st.Users, u)
+	return u
+}
+
+func (d *db) userByIDLocked(id tailcfg.UserID) *user {
+	for _, u := range d.st.Users {
+		if u.ID == id {
+			return u
+		}
+	}
+	return nil
+}
+
+func (d *db) nodeByMachineKeyLocked(mk tailcfg.MachineKey) *tailcfg.Node {
+	for _, n := range d.st.Nodes {
+		if n.Machine == mk {
+			return n
+		}
+	}
+	return nil
+}
+
+func (d *db) nodeByNodeKeyLocked(nk tailcfg.NodeKey) *tailcfg.Node {
+	for _, n := range d.st.Nodes {
+		if n.Key == nk {
+			return n
+		}
+	}
+	return nil
+}
+
+// addNodeLocked assigns n a node ID and a Tailscale IP address and
+// adds it to the database.
+func (d *db) addNodeLocked(n *tailcfg.Node) error {
+	used := map[netaddr.IP]bool{}
+	var maxID tailcfg.NodeID
+	for _, n := range d.st.Nodes {
+		if n.ID > maxID {
+			maxID = n.ID
+		}
+		for _, a := range n.Addresses {
+			if ip, ok := netaddr.FromStdIP(a.IP.IP()); ok {
+				used[ip.Unmap()] = true
+			}
+		}
+	}
+	ip, err := allocIP(used)
+	if err != nil {
+		return err
+	}
+	addr := wgcfg.CIDR{IP: wgcfg.IP{Addr: ip.As16()}, Mask: 32}
+	n.ID = maxID + 1
+	n.Addresses = []wgcfg.CIDR{addr}
+	n.AllowedIPs = []wgcfg.CIDR{addr}
+	d.st.Nodes = append(d.st.Nodes, n)
+	return nil
+}
+
+// allocIP returns the lowest Tailscale IP address in the CGNAT range
+// that isn't in used.
+func allocIP(used map[netaddr.IP]bool) (netaddr.IP, error) {
+	cgnat := tsaddr.CGNATRange()
+	b := cgnat.IP.As4()
+	base := binary.BigEndian.Uint32(b[:])
+	size := uint32(1) << (32 - cgnat.Bits)
+	// Skip the network and broadcast addresses.
+	for off := uint32(1); off < size-1; off++ {
+		binary.BigEndian.PutUint32(b[:], base+off)
+		ip := netaddr.IPv4(b[0], b[1], b[2], b[3])
+		if !tsaddr.IsTailscaleIP(ip) || ip == tsaddr.TailscaleServiceIP() || used[ip] {
+			continue
+		}
+		return ip, nil
+	}
+	return netaddr.IP{}, errors.New("no free Tailscale IP addresses")
+}
+
+// nodesLocked returns clones of all nodes, sorted by ID.
+func (d *db) nodesLocked() []*tailcfg.Node {
+	ret := make([]*tailcfg.Node, 0, len(d.st.Nodes))
+	for _, n := range d.st.Nodes {
+		ret = append(ret, n.Clone())
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+	return ret
+}
@@ -0,0 +1,417 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/control/controlserver"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+)
+
+// keepAliveInterval is how often a streaming map response sends a
+// keep-alive message, if the client asked for them.
+// The client gives up after two minutes of silence.
+const keepAliveInterval = 60 * time.Second
+
+// server is a control server speaking the tailcfg protocol.
+type server struct {
+	logf    logger.Logf
+	db      *db
+	privKey wgcfg.PrivateKey
+	pubKey  wgcfg.Key
+	timeNow func() time.Time
+
+	// Configuration; must not be changed once the server is serving.
+	domain       string               // MagicDNS domain of the tailnet
+	derpMap      *tailcfg.DERPMap     // sent to all nodes; may be nil
+	packetFilter []tailcfg.FilterRule // sent to all nodes; nil means allow all
+	dnsConfig    tailcfg.DNSConfig
+	keyExpiry    time.Duration // how long node keys are valid for; 0 means forever
+	// openLogin, if non-empty, is the login name new nodes
+	// are registered to when they don't present an auth key.
+	// If empty, an auth key is required.
+	openLogin string
+
+	codec *controlserver.Codec
+
+	mu      sync.Mutex
+	updates map[chan struct{}]bool // active map streams to notify of changes
+}
+
+func newServer(d *db, logf logger.Logf) *server {
+	priv := d.privateKey()
+	return &server{
+		logf:    logf,
+		db:      d,
+		privKey: priv,
+		pubKey:  priv.Public(),
+		codec:   controlserver.NewCodec(priv),
+		timeNow: time.Now,
+		domain:  "tailnet",
+		updates: make(map[chan struct{}]bool),
+	}
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/key" {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, s.pubKey.HexString())
+		return
+	}
+	mkey, isMap, ok := controlserver.ParseMachinePath(r.URL.Path)
+	if !ok {
+		s.serveStatus(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	if isMap {
+		s.serveMap(w, r, mkey)
+	} else {
+		s.serveRegister(w, r, mkey)
+	}
+}
+
+func (s *server) serveStatus(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	s.db.mu.Lock()
+	nodes := s.db.nodesLocked()
+	s.db.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<html><body><h1>tailcontrol</h1>\n<p>%d nodes</p>\n<ul>\n", len(nodes))
+	for _, n := range nodes {
+		var addr string
+		if len(n.Addresses) > 0 {
+			addr = n.Addresses[0].IP.String()
+		}
+		fmt.Fprintf(w, "<li>%s %s (%s)</li>\n", html.EscapeString(n.Name), addr, n.Key.ShortString())
+	}
+	io.WriteString(w, "</ul></body></html>\n")
+}
+
+func (s *server) serveRegister(w http.ResponseWriter, r *http.Request, mkey wgcfg.Key) {
+	var req tailcfg.RegisterRequest
+	if err := s.codec.Decode(r, mkey, &req); err != nil {
+		s.logf("register: %v: %v", mkey.ShortString(), err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res, err := s.register(tailcfg.MachineKey(mkey), &req)
+	if err != nil {
+		s.logf("register: %v: %v", mkey.ShortString(), err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	b, err := s.codec.Encode(mkey, false, res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
+// register handles a RegisterRequest from the machine mkey. It
+// refreshes or rotates the key of a known node, or adds a new node
+// if the request has a valid auth key.
+func (s *server) register(mkey tailcfg.MachineKey, req *tailcfg.RegisterRequest) (*tailcfg.RegisterResponse, error) {
+	if req.NodeKey.IsZero() {
+		return nil, errors.New("missing node key")
+	}
+	now := s.timeNow()
+
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	n := s.db.nodeByMachineKeyLocked(mkey)
+	expired := n != nil && keyExpired(n, now)
+	if n != nil && n.Key == req.NodeKey && expired {
+		s.logf("register: node %v key %v expired", n.ID, n.Key.ShortString())
+		return &tailcfg.RegisterResponse{NodeKeyExpired: true}, nil
+	}
+	// A known machine can refresh its current key or rotate from it
+	// to a new one, as long as it hasn't expired. Anything else
+	// needs to be authorized again.
+	known := n != nil && !expired &&
+		(n.Key == req.NodeKey || (!req.OldNodeKey.IsZero() && n.Key == req.OldNodeKey))
+
+	var u *user
+	if !known {
+		loginName := s.openLogin
+		if req.Auth.AuthKey != "" {
+			var err error
+			loginName, err = s.db.useAuthKeyLocked(req.Auth.AuthKey)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if loginName == "" {
+			return nil, errors.New("auth key required")
+		}
+		u = s.db.userLocked(loginName, now)
+	}
+
+	if n == nil {
+		n = &tailcfg.Node{
+			User:              u.ID,
+			Machine:           mkey,
+			Created:           now,
+			MachineAuthorized: true,
+		}
+		if err := s.db.addNodeLocked(n); err != nil {
+			return nil, err
+		}
+		s.logf("register: new node %v for %q at %v", n.ID, u.LoginName, n.Addresses[0].IP)
+	} else if u != nil {
+		n.User = u.ID
+	} else {
+		u = s.db.userByIDLocked(n.User)
+		if u == nil {
+			return nil, fmt.Errorf("node %v has unknown user %v", n.ID, n.User)
+		}
+	}
+	if n.Key != req.NodeKey || !known {
+		s.logf("register: node %v key %v -> %v", n.ID, n.Key.ShortString(), req.NodeKey.ShortString())
+		n.Key = req.NodeKey
+		n.KeyExpiry = time.Time{}
+		if s.keyExpiry > 0 {
+			n.KeyExpiry = now.Add(s.keyExpiry)
+		}
+	}
+	if req.Hostinfo != nil {
+		n.Hostinfo = *req.Hostinfo.Clone()
+	}
+	n.Name = s.nodeNameLocked(n)
+	if err := s.db.saveLocked(); err != nil {
+		return nil, err
+	}
+	go s.notifyAll()
+
+	return &tailcfg.RegisterResponse{
+		User:              u.tailcfgUser(),
+		Login:             u.tailcfgLogin(),
+		MachineAuthorized: n.MachineAuthorized,
+	}, nil
+}
+
+var nonDNSChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// nodeNameLocked returns a unique MagicDNS name for n, based on its
+// hostname.
+func (s *server) nodeNameLocked(n *tailcfg.Node) string {
+	base := nonDNSChars.ReplaceAllString(strings.ToLower(n.Hostinfo.Hostname), "-")
+	base = strings.Trim(base, "-")
+	if base == "" {
+		base = "node"
+	}
+	name := base
+	for i := 1; ; i++ {
+		taken := false
+		for _, o := range s.db.st.Nodes {
+			if o.ID != n.ID && o.Name == name+"."+s.domain {
+				taken = true
+				break
+			}
+		}
+		if !taken {
+			return name + "." + s.domain
+		}
+		name = fmt.Sprintf("%s-%d", base, i)
+	}
+}
+
+func (s *server) serveMap(w http.ResponseWriter, r *http.Request, mkey wgcfg.Key) {
+	ctx := r.Context()
+	var req tailcfg.MapRequest
+	if err := s.codec.Decode(r, mkey, &req); err != nil {
+		s.logf("map: %v: %v", mkey.ShortString(), err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	nodeID, err := s.updateNode(tailcfg.MachineKey(mkey), &req)
+	if err != nil {
+		s.logf("map: %v: %v", mkey.ShortString(), err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	updates := make(chan struct{}, 1)
+	if req.Stream {
+		s.mu.Lock()
+		s.updates[updates] = true
+		s.mu.Unlock()
+		defer func() {
+			s.mu.Lock()
+			delete(s.updates, updates)
+			s.mu.Unlock()
+		}()
+	}
+
+	compress := req.Compress == "zstd"
+	send := func(res *tailcfg.MapResponse) error {
+		return s.codec.SendMapResponse(w, mkey, compress, res)
+	}
+
+	res, err := s.mapResponse(nodeID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res.DERPMap = s.derpMap
+	if err := send(res); err != nil {
+		return
+	}
+	if !req.Stream {
+		return
+	}
+
+	var keepAlive <-chan time.Time
+	if req.KeepAlive {
+		t := time.NewTicker(keepAliveInterval)
+		defer t.Stop()
+		keepAlive = t.C
+	}
+	prevPeers := res.Peers
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-keepAlive:
+			if err := send(&tailcfg.MapResponse{KeepAlive: true}); err != nil {
+				return
+			}
+		case <-updates:
+			res, err := s.mapResponse(nodeID)
+			if err != nil {
+				s.logf("map: node %v: %v", nodeID, err)
+				return
+			}
+			peers := res.Peers
+			if req.DeltaPeers {
+				res.Peers = nil
+				res.PeersChanged, res.PeersRemoved = controlserver.DiffPeers(prevPeers, peers)
+			}
+			if err := send(res); err != nil {
+				return
+			}
+			prevPeers = peers
+		}
+	}
+}
+
+// keyExpired reports whether n's node key has expired at now.
+func keyExpired(n *tailcfg.Node, now time.Time) bool {
+	return !n.KeyExpiry.IsZero() && n.KeyExpiry.Before(now)
+}
+
+var errNodeKeyExpired = errors.New("node key expired")
+
+// updateNode records the endpoints, disco key and host info sent in a
+// MapRequest from mkey and returns the node's ID. Nodes whose key
+// has expired are refused until they register a new one.
+func (s *server) updateNode(mkey tailcfg.MachineKey, req *tailcfg.MapRequest) (tailcfg.NodeID, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	n := s.db.nodeByNodeKeyLocked(req.NodeKey)
+	if n == nil || n.Machine != mkey {
+		return 0, errors.New("unknown node key")
+	}
+	now := s.timeNow()
+	if keyExpired(n, now) {
+		return 0, errNodeKeyExpired
+	}
+	old := n.Clone()
+	n.LastSeen = &now
+	n.DiscoKey = req.DiscoKey
+	n.Endpoints = append([]string(nil), req.Endpoints...)
+	if req.Hostinfo != nil {
+		n.Hostinfo = *req.Hostinfo.Clone()
+		n.Name = s.nodeNameLocked(n)
+		n.AllowedIPs = append(n.Addresses[:len(n.Addresses):len(n.Addresses)], n.Hostinfo.RoutableIPs...)
+		if ni := n.Hostinfo.NetInfo; ni != nil && ni.PreferredDERP != 0 {
+			n.DERP = fmt.Sprintf("127.3.3.40:%d", ni.PreferredDERP)
+		}
+	}
+	old.LastSeen = n.LastSeen
+	if old.Equal(n) && old.DERP == n.DERP {
+		// Nothing but LastSeen changed, which isn't worth a
+		// write of the state file; it's saved with the next
+		// change.
+		return n.ID, nil
+	}
+	if err := s.db.saveLocked(); err != nil {
+		return 0, err
+	}
+	go s.notifyAll()
+	return n.ID, nil
+}
+
+// mapResponse returns a full MapResponse for the node with ID id.
+// Peers whose node key has expired are left out.
+func (s *server) mapResponse(id tailcfg.NodeID) (*tailcfg.MapResponse, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	now := s.timeNow()
+	res := &tailcfg.MapResponse{
+		Domain:       s.domain,
+		PacketFilter: s.packetFilter,
+		DNSConfig:    s.dnsConfig,
+	}
+	if res.PacketFilter == nil {
+		res.PacketFilter = tailcfg.FilterAllowAll
+	}
+	users := map[tailcfg.UserID]bool{}
+	for _, n := range s.db.nodesLocked() {
+		if n.ID == id {
+			res.Node = n
+		} else if !keyExpired(n, now) {
+			res.Peers = append(res.Peers, n)
+		}
+		if !users[n.User] {
+			users[n.User] = true
+			if u := s.db.userByIDLocked(n.User); u != nil {
+				res.UserProfiles = append(res.UserProfiles, u.profile())
+			}
+		}
+	}
+	if res.Node == nil {
+		return nil, errors.New("node deleted")
+	}
+	if keyExpired(res.Node, now) {
+		return nil, errNodeKeyExpired
+	}
+	return res, nil
+}
+
+// notifyAll wakes up all streaming map requests so they send their
+// nodes an updated network map.
+func (s *server) notifyAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.updates {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
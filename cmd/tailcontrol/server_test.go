@@ -0,0 +1,275 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"inet.af/netaddr"
+	"tailscale.com/control/controlclient"
+	"tailscale.com/smallzstd"
+	"tailscale.com/tailcfg"
+)
+
+func newTestClient(t *testing.T, serverURL, hostname, authKey string) *controlclient.Direct {
+	t.Helper()
+	c, err := controlclient.NewDirect(controlclient.Options{
+		ServerURL: serverURL,
+		AuthKey:   authKey,
+		Hostinfo: &tailcfg.Hostinfo{
+			Hostname:     hostname,
+			BackendLogID: "log-" + hostname,
+		},
+		NewDecompressor: func() (controlclient.Decompressor, error) {
+			return smallzstd.NewDecoder(nil)
+		},
+		Logf: t.Logf,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestEndToEnd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tailcontrol-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	statePath := filepath.Join(dir, "state.json")
+
+	d, err := loadDB(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ak, err := d.newAuthKey("alice@example.com", true, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(d, t.Logf)
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// A client without an auth key must not be able to register.
+	c0 := newTestClient(t, ts.URL, "intruder", "")
+	if _, err := c0.TryLogin(ctx, nil, controlclient.LoginDefault); err == nil || !strings.Contains(err.Error(), "auth key required") {
+		t.Fatalf("login without auth key: err = %v; want auth key required", err)
+	}
+
+	c1 := newTestClient(t, ts.URL, "one", ak.Key)
+	if url, err := c1.TryLogin(ctx, nil, controlclient.LoginDefault); err != nil || url != "" {
+		t.Fatalf("c1 login: url=%q, err=%v", url, err)
+	}
+	if got := c1.GetPersist().LoginName; got != "alice@example.com" {
+		t.Errorf("c1 LoginName = %q; want alice@example.com", got)
+	}
+
+	netMaps := make(chan *controlclient.NetworkMap, 10)
+	pollErr := make(chan error, 1)
+	go func() {
+		pollErr <- c1.PollNetMap(ctx, -1, func(nm *controlclient.NetworkMap) { netMaps <- nm })
+	}()
+
+	nextMap := func() *controlclient.NetworkMap {
+		t.Helper()
+		select {
+		case nm := <-netMaps:
+			return nm
+		case err := <-pollErr:
+			t.Fatalf("PollNetMap: %v", err)
+		case <-ctx.Done():
+			t.Fatal("timeout waiting for netmap")
+		}
+		return nil
+	}
+
+	nm := nextMap()
+	if nm.Name != "one.tailnet" {
+		t.Errorf("Name = %q; want one.tailnet", nm.Name)
+	}
+	if got, want := addrStrings(nm.Addresses), []string{"100.64.0.1/32"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Addresses = %q; want %q", got, want)
+	}
+	if len(nm.Peers) != 0 {
+		t.Errorf("got %d peers; want 0", len(nm.Peers))
+	}
+	if nm.DERPMap == nil {
+		t.Error("no DERP map in first netmap")
+	}
+
+	// Registering a second node must stream a delta to the first.
+	c2 := newTestClient(t, ts.URL, "two", ak.Key)
+	if _, err := c2.TryLogin(ctx, nil, controlclient.LoginDefault); err != nil {
+		t.Fatalf("c2 login: %v", err)
+	}
+	nm = nextMap()
+	for len(nm.Peers) == 0 {
+		nm = nextMap()
+	}
+	if len(nm.Peers) != 1 || nm.Peers[0].Name != "two.tailnet" {
+		t.Fatalf("peers = %+v; want two.tailnet", nm.Peers)
+	}
+	if got, want := addrStrings(nm.Peers[0].Addresses), []string{"100.64.0.2/32"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("peer Addresses = %q; want %q", got, want)
+	}
+	if nm.DERPMap == nil {
+		t.Error("DERP map lost in delta netmap")
+	}
+
+	// Endpoints sent by c2 show up at c1.
+	c2.SetEndpoints(41641, []string{"192.0.2.1:41641"})
+	var nm2 *controlclient.NetworkMap
+	if err := c2.PollNetMap(ctx, 1, func(nm *controlclient.NetworkMap) { nm2 = nm }); err != nil {
+		t.Fatalf("c2 PollNetMap: %v", err)
+	}
+	if len(nm2.Peers) != 1 || nm2.Peers[0].Name != "one.tailnet" {
+		t.Errorf("c2 peers = %+v; want one.tailnet", nm2.Peers)
+	}
+	for {
+		nm = nextMap()
+		if len(nm.Peers) == 1 && reflect.DeepEqual(nm.Peers[0].Endpoints, []string{"192.0.2.1:41641"}) {
+			break
+		}
+	}
+
+	// The state survives a restart.
+	d2, err := loadDB(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d2.privateKey() != d.privateKey() {
+		t.Error("server key changed after reload")
+	}
+	d2.mu.Lock()
+	nodes := d2.nodesLocked()
+	d2.mu.Unlock()
+	if len(nodes) != 2 {
+		t.Errorf("reloaded %d nodes; want 2", len(nodes))
+	}
+}
+
+func TestSingleUseAuthKey(t *testing.T) {
+	d, err := loadDB("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ak, err := d.newAuthKey("bob@example.com", false, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(newServer(d, t.Logf))
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c1 := newTestClient(t, ts.URL, "one", ak.Key)
+	if _, err := c1.TryLogin(ctx, nil, controlclient.LoginDefault); err != nil {
+		t.Fatalf("first login: %v", err)
+	}
+	// Re-login of the same node doesn't need the key again.
+	if _, err := c1.TryLogin(ctx, nil, controlclient.LoginDefault); err != nil {
+		t.Fatalf("re-login: %v", err)
+	}
+	c2 := newTestClient(t, ts.URL, "two", ak.Key)
+	if _, err := c2.TryLogin(ctx, nil, controlclient.LoginDefault); err == nil || !strings.Contains(err.Error(), errUsedAuthKey.Error()) {
+		t.Fatalf("second node login: err = %v; want %v", err, errUsedAuthKey)
+	}
+}
+
+func TestExpiredNodeKey(t *testing.T) {
+	d, err := loadDB("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ak, err := d.newAuthKey("carol@example.com", true, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		mu  sync.Mutex
+		now = time.Now()
+	)
+	s := newServer(d, t.Logf)
+	s.keyExpiry = time.Hour
+	s.timeNow = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c1 := newTestClient(t, ts.URL, "one", ak.Key)
+	c2 := newTestClient(t, ts.URL, "two", ak.Key)
+	for _, c := range []*controlclient.Direct{c1, c2} {
+		if _, err := c.TryLogin(ctx, nil, controlclient.LoginDefault); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c1.PollNetMap(ctx, 1, func(*controlclient.NetworkMap) {}); err != nil {
+		t.Fatalf("PollNetMap before expiry: %v", err)
+	}
+
+	// Extend c2's key so that only c1's expires.
+	d.mu.Lock()
+	d.st.Nodes[1].KeyExpiry = now.Add(3 * time.Hour)
+	d.mu.Unlock()
+	mu.Lock()
+	now = now.Add(2 * time.Hour)
+	mu.Unlock()
+
+	err = c1.PollNetMap(ctx, 1, func(*controlclient.NetworkMap) {})
+	if err == nil || !strings.Contains(err.Error(), errNodeKeyExpired.Error()) {
+		t.Errorf("PollNetMap after expiry: err = %v; want %v", err, errNodeKeyExpired)
+	}
+	var nm *controlclient.NetworkMap
+	if err := c2.PollNetMap(ctx, 1, func(m *controlclient.NetworkMap) { nm = m }); err != nil {
+		t.Fatalf("c2 PollNetMap: %v", err)
+	}
+	if len(nm.Peers) != 0 {
+		t.Errorf("c2 got %d peers; want expired c1 left out", len(nm.Peers))
+	}
+}
+
+func TestAllocIP(t *testing.T) {
+	used := map[netaddr.IP]bool{}
+	for _, want := range []string{"100.64.0.1", "100.64.0.2", "100.64.0.3"} {
+		ip, err := allocIP(used)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip.String() != want {
+			t.Errorf("allocIP = %v; want %v", ip, want)
+		}
+		used[ip] = true
+	}
+	delete(used, netaddr.IPv4(100, 64, 0, 2))
+	if ip, _ := allocIP(used); ip != netaddr.IPv4(100, 64, 0, 2) {
+		t.Errorf("allocIP = %v; want freed 100.64.0.2", ip)
+	}
+}
+
+func addrStrings(cidrs []wgcfg.CIDR) (ret []string) {
+	for _, c := range cidrs {
+		ret = append(ret, c.String())
+	}
+	return ret
+}
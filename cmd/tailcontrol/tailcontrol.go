@@ -0,0 +1,143 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The tailcontrol binary is a small, self-hostable control server.
+//
+// It speaks the same protocol as login.tailscale.com: clients fetch
+// the server's public key from /key, register their node keys at
+// /machine/<mkey> and long-poll network maps from /machine/<mkey>/map.
+// Nodes are authorized with pre-generated auth keys (see -new-authkey),
+// and users, nodes and keys are persisted to a JSON file.
+package main // import "tailscale.com/cmd/tailcontrol"
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+	"inet.af/netaddr"
+	"tailscale.com/derp/derpmap"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tsweb"
+)
+
+var (
+	dev          = flag.Bool("dev", false, "run in localhost development mode, with in-memory state and open registration")
+	addr         = flag.String("a", ":443", "server address")
+	statePath    = flag.String("state", "", "path of the JSON file that stores users, nodes and auth keys")
+	certDir      = flag.String("certdir", tsweb.DefaultCertDir("tailcontrol-certs"), "directory to store LetsEncrypt certs, if addr's port is :443")
+	hostname     = flag.String("hostname", "", "LetsEncrypt host name, if addr's port is :443")
+	domain       = flag.String("domain", "tailnet", "MagicDNS domain of the tailnet")
+	derpMapPath  = flag.String("derpmap", "", "if non-empty, path to a JSON tailcfg.DERPMap to send to nodes instead of Tailscale's DERP servers")
+	aclPath      = flag.String("acl", "", "if non-empty, path to a JSON list of tailcfg.FilterRule to send to nodes; the default allows all traffic")
+	nameservers  = flag.String("dns", "", "optional comma-separated list of DNS server IPs to send to nodes")
+	keyExpiry    = flag.Duration("key-expiry", 180*24*time.Hour, "how long node keys are valid for; 0 means forever")
+	openLogin    = flag.String("open-login", "", "if non-empty, register nodes without an auth key to this login name")
+	newAuthKey   = flag.String("new-authkey", "", "if non-empty, generate an auth key for this login name, print it and exit")
+	authReusable = flag.Bool("reusable", false, "with -new-authkey, allow the key to register more than one node")
+)
+
+func main() {
+	flag.Parse()
+
+	if *dev {
+		*addr = ":8080"
+		if *openLogin == "" {
+			*openLogin = "dev@localhost"
+		}
+		log.Printf("Running in dev mode.")
+		tsweb.DevMode = true
+	} else if *statePath == "" {
+		log.Fatalf("tailcontrol: -state <path> not specified")
+	}
+
+	d, err := loadDB(*statePath)
+	if err != nil {
+		log.Fatalf("tailcontrol: %v", err)
+	}
+
+	if *newAuthKey != "" {
+		ak, err := d.newAuthKey(*newAuthKey, *authReusable, time.Now())
+		if err != nil {
+			log.Fatalf("tailcontrol: %v", err)
+		}
+		fmt.Println(ak.Key)
+		return
+	}
+
+	s := newServer(d, log.Printf)
+	s.domain = *domain
+	s.keyExpiry = *keyExpiry
+	s.openLogin = *openLogin
+	s.derpMap = derpmap.Prod()
+	if *derpMapPath != "" {
+		s.derpMap = new(tailcfg.DERPMap)
+		mustLoadJSON(*derpMapPath, s.derpMap)
+	}
+	if *aclPath != "" {
+		mustLoadJSON(*aclPath, &s.packetFilter)
+	}
+	if *nameservers != "" {
+		for _, ns := range strings.Split(*nameservers, ",") {
+			ip, err := netaddr.ParseIP(strings.TrimSpace(ns))
+			if err != nil {
+				log.Fatalf("tailcontrol: -dns: %v", err)
+			}
+			s.dnsConfig.Nameservers = append(s.dnsConfig.Nameservers, ip)
+		}
+		s.dnsConfig.Domains = []string{*domain}
+	}
+
+	mux := tsweb.NewMux(http.NotFoundHandler())
+	mux.Handle("/", s)
+
+	httpsrv := &http.Server{
+		Addr:    *addr,
+		Handler: mux,
+	}
+	if tsweb.IsProd443(*addr) {
+		if *hostname == "" {
+			log.Fatalf("tailcontrol: missing required --hostname flag")
+		}
+		if *certDir == "" {
+			log.Fatalf("tailcontrol: missing required --certdir flag")
+		}
+		log.Printf("tailcontrol: serving on %s with TLS", *addr)
+		certManager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(*hostname),
+			Cache:      autocert.DirCache(*certDir),
+		}
+		httpsrv.TLSConfig = certManager.TLSConfig()
+		go func() {
+			err := http.ListenAndServe(":80", certManager.HTTPHandler(tsweb.Port80Handler{Main: mux}))
+			if err != nil && err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+		err = httpsrv.ListenAndServeTLS("", "")
+	} else {
+		log.Printf("tailcontrol: serving on %s", *addr)
+		err = httpsrv.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatalf("tailcontrol: %v", err)
+	}
+}
+
+func mustLoadJSON(path string, v interface{}) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatalf("tailcontrol: %v", err)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		log.Fatalf("tailcontrol: %s: %v", path, err)
+	}
+}
@@ -8,9 +8,14 @@ package cli
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
@@ -31,7 +36,7 @@ func ActLikeCLI() bool {
 		return false
 	}
 	switch os.Args[1] {
-	case "up", "status", "netcheck", "version",
+	case "up", "status", "netcheck", "forward", "version",
 		"-V", "--version", "-h", "--help":
 		return true
 	}
@@ -59,6 +64,7 @@ change in the future.
 			upCmd,
 			netcheckCmd,
 			statusCmd,
+			forwardCmd,
 			versionCmd,
 		},
 		FlagSet: rootfs,
@@ -121,3 +127,29 @@ func pump(ctx context.Context, bc *ipn.BackendClient, conn net.Conn) {
 		bc.GotNotifyMsg(msg)
 	}
 }
+
+// getLocalAPI GETs path, relative to /localapi/v0/, from the HTTP API
+// that tailscaled serves on its socket and decodes the JSON response
+// into v.
+func getLocalAPI(ctx context.Context, path string, v interface{}) error {
+	tr := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return safesocket.Connect(rootArgs.socket, 41112)
+		},
+	}
+	defer tr.CloseIdleConnections()
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://local-tailscaled.sock/localapi/v0/"+path, nil)
+	if err != nil {
+		return err
+	}
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		return fmt.Errorf("connecting to tailscaled: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1<<10))
+		return fmt.Errorf("tailscaled: %s: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
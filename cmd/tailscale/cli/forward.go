@@ -0,0 +1,226 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/safesocket"
+)
+
+const forwardUsage = "forward [-remove] <local-addr> <peer>:<port> | forward [-remove] -reverse <port> <local-addr>"
+
+var forwardCmd = &ffcli.Command{
+	Name:       "forward",
+	ShortUsage: forwardUsage,
+	ShortHelp:  "Forward a TCP port to or from a peer",
+	LongHelp: strings.TrimSpace(`
+"tailscale forward <local-addr> <peer>:<port>" has tailscaled listen
+on local-addr and forward each connection to port on peer, which is a
+host name or Tailscale IP as shown by "tailscale status". A local-addr
+of just a port listens on localhost.
+
+"tailscale forward -reverse <port> <local-addr>" has tailscaled accept
+the connections from peers to port on this node's Tailscale IPs and
+forward them to local-addr, exposing a local service to the rest of the
+network. local-addr must be a loopback address. These connections no
+longer reach the OS.
+
+The forward runs until this command exits. "tailscale forward -remove"
+with the same arguments stops a forward started by another frontend.
+
+tailscaled runs the forwarded connections in its own network stack, so
+forwarding works even when tailscaled runs without a TUN device (with
+--fake). The network's ACLs apply to them as to any other traffic.
+`),
+	Exec: runForward,
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("forward", flag.ExitOnError)
+		fs.BoolVar(&forwardArgs.reverse, "reverse", false, "forward connections from peers to a local address, instead of the other way around")
+		fs.BoolVar(&forwardArgs.remove, "remove", false, "stop a forward left running")
+		return fs
+	})(),
+}
+
+var forwardArgs struct {
+	reverse bool
+	remove  bool
+}
+
+// forwardTimeout is how long to wait for tailscaled to start or stop
+// a forward.
+const forwardTimeout = 10 * time.Second
+
+func runForward(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: " + forwardUsage)
+	}
+	var st ipnstate.Status
+	if err := getLocalAPI(ctx, "status", &st); err != nil {
+		return err
+	}
+	f, err := parseForward(&st, args, forwardArgs.reverse)
+	if err != nil {
+		return err
+	}
+	if !forwardArgs.remove && st.BackendState != ipn.Running.String() {
+		return fmt.Errorf("tailscaled is %s, not %s", st.BackendState, ipn.Running)
+	}
+
+	c, err := safesocket.Connect(rootArgs.socket, 41112)
+	if err != nil {
+		return fmt.Errorf("connecting to tailscaled: %v", err)
+	}
+	defer c.Close()
+	bc := ipn.NewBackendClient(log.Printf, func(b []byte) {
+		ipn.WriteMsg(c, b)
+	})
+	// The reply to each command: nil once f is running (for
+	// AddForward) or stopped (for RemoveForward), or an error.
+	replies := make(chan error, 1)
+	running := forwardArgs.remove // as last known, for the next reply
+	bc.SetNotifyCallback(func(n ipn.Notify) {
+		var reply error
+		switch {
+		case n.ErrMessage != nil:
+			reply = errors.New(*n.ErrMessage)
+		case n.Forwards != nil:
+			found := false
+			for _, f2 := range n.Forwards {
+				found = found || f2 == f
+			}
+			if found == running {
+				return
+			}
+			running = found
+		default:
+			return
+		}
+		select {
+		case replies <- reply:
+		default:
+		}
+	})
+	pumpDone := make(chan struct{})
+	go func() {
+		defer close(pumpDone)
+		for {
+			msg, err := ipn.ReadMsg(c)
+			if err != nil {
+				return
+			}
+			bc.GotNotifyMsg(msg)
+		}
+	}()
+	wait := func() error {
+		select {
+		case err := <-replies:
+			return err
+		case <-pumpDone:
+			return errors.New("lost connection to tailscaled")
+		case <-time.After(forwardTimeout):
+			return errors.New("timeout waiting for tailscaled")
+		}
+	}
+
+	if forwardArgs.remove {
+		bc.RemoveForward(f)
+		return wait()
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+
+	bc.AddForward(f)
+	if err := wait(); err != nil {
+		return err
+	}
+	log.Printf("forwarding %v; interrupt to stop", f)
+	select {
+	case <-interrupt:
+	case <-ctx.Done():
+	case <-pumpDone:
+		return errors.New("lost connection to tailscaled")
+	}
+	// Drop any error that came in meanwhile, about something else.
+	select {
+	case <-replies:
+	default:
+	}
+	bc.RemoveForward(f)
+	return wait()
+}
+
+// parseForward returns the forward that the command line args ask
+// for.
+func parseForward(st *ipnstate.Status, args []string, reverse bool) (ipn.Forward, error) {
+	if reverse {
+		if _, err := strconv.ParseUint(args[0], 10, 16); err != nil {
+			return ipn.Forward{}, fmt.Errorf("bad port %q", args[0])
+		}
+		return ipn.Forward{Listen: args[0], Target: localAddr(args[1]), Reverse: true}, nil
+	}
+	host, port, err := net.SplitHostPort(args[1])
+	if err != nil {
+		return ipn.Forward{}, fmt.Errorf("bad peer address %q: %v", args[1], err)
+	}
+	ip, err := resolvePeer(st, host)
+	if err != nil {
+		return ipn.Forward{}, err
+	}
+	return ipn.Forward{Listen: localAddr(args[0]), Target: net.JoinHostPort(ip, port)}, nil
+}
+
+// localAddr returns s, a host:port or just a port, as a host:port,
+// defaulting to localhost.
+func localAddr(s string) string {
+	if _, err := strconv.ParseUint(s, 10, 16); err == nil {
+		return net.JoinHostPort("127.0.0.1", s)
+	}
+	return s
+}
+
+// resolvePeer returns the Tailscale IP of the peer host, which is a
+// Tailscale IP or a peer's host name.
+func resolvePeer(st *ipnstate.Status, host string) (string, error) {
+	if ip, err := netaddr.ParseIP(host); err == nil {
+		if !tsaddr.IsTailscaleIP(ip) {
+			return "", fmt.Errorf("%v is not a Tailscale IP", ip)
+		}
+		return ip.String(), nil
+	}
+	var addrs []string
+	for _, k := range st.Peers() {
+		ps := st.Peer[k]
+		if strings.EqualFold(ps.SimpleHostName(), host) || strings.EqualFold(ps.HostName, host) {
+			addrs = append(addrs, ps.TailAddr)
+		}
+	}
+	switch len(addrs) {
+	case 0:
+		return "", fmt.Errorf("no peer named %q", host)
+	case 1:
+		return addrs[0], nil
+	default:
+		return "", fmt.Errorf("peer name %q is ambiguous; use one of its IPs: %s", host, strings.Join(addrs, ", "))
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"testing"
+
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/key"
+)
+
+func TestResolvePeer(t *testing.T) {
+	st := &ipnstate.Status{
+		Peer: map[key.Public]*ipnstate.PeerStatus{
+			{1}: {HostName: "alpha.local", TailAddr: "100.64.0.1"},
+			{2}: {HostName: "beta", TailAddr: "100.64.0.2"},
+			{3}: {HostName: "Beta", TailAddr: "100.64.0.3"},
+		},
+	}
+	tests := []struct {
+		host    string
+		want    string
+		wantErr bool
+	}{
+		{host: "alpha", want: "100.64.0.1"},
+		{host: "ALPHA.local", want: "100.64.0.1"},
+		{host: "100.100.1.2", want: "100.100.1.2"},
+		{host: "beta", wantErr: true},
+		{host: "gamma", wantErr: true},
+		{host: "10.0.0.1", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := resolvePeer(st, tt.host)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("resolvePeer(%q) error = %v; want error: %v", tt.host, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("resolvePeer(%q) = %q; want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestLocalAddr(t *testing.T) {
+	for in, want := range map[string]string{
+		"8080":           "127.0.0.1:8080",
+		":8080":          ":8080",
+		"[::1]:22":       "[::1]:22",
+		"10.1.2.3:12345": "10.1.2.3:12345",
+	} {
+		if got := localAddr(in); got != want {
+			t.Errorf("localAddr(%q) = %q; want %q", in, got, want)
+		}
+	}
+}
+
+func TestParseForward(t *testing.T) {
+	st := &ipnstate.Status{
+		Peer: map[key.Public]*ipnstate.PeerStatus{
+			{1}: {HostName: "alpha", TailAddr: "100.64.0.1"},
+		},
+	}
+	tests := []struct {
+		args    []string
+		reverse bool
+		want    ipn.Forward
+		wantErr bool
+	}{
+		{args: []string{"8080", "alpha:80"}, want: ipn.Forward{Listen: "127.0.0.1:8080", Target: "100.64.0.1:80"}},
+		{args: []string{":8080", "100.64.0.2:80"}, want: ipn.Forward{Listen: ":8080", Target: "100.64.0.2:80"}},
+		{args: []string{"8080", "alpha"}, wantErr: true},
+		{args: []string{"8080", "gamma:80"}, wantErr: true},
+		{args: []string{"80", "8080"}, reverse: true, want: ipn.Forward{Listen: "80", Target: "127.0.0.1:8080", Reverse: true}},
+		{args: []string{"http", "8080"}, reverse: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseForward(st, tt.args, tt.reverse)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseForward(%q, %v) error = %v; want error: %v", tt.args, tt.reverse, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseForward(%q, %v) = %+v; want %+v", tt.args, tt.reverse, got, tt.want)
+		}
+	}
+}
@@ -56,6 +56,7 @@ specify any flags, options are reset to their default.
 		upf.StringVar(&upArgs.authKey, "authkey", "", "node authorization key")
 		upf.StringVar(&upArgs.hostname, "hostname", "", "hostname to use instead of the one provided by the OS")
 		upf.BoolVar(&upArgs.enableDERP, "enable-derp", true, "enable the use of DERP servers")
+		upf.StringVar(&upArgs.staticEndpoints, "static-endpoints", "", "extra ip:port or host:port endpoints to advertise to peers (comma-separated)")
 		if runtime.GOOS == "linux" || isBSD(runtime.GOOS) || version.OS() == "macOS" {
 			upf.StringVar(&upArgs.advertiseRoutes, "advertise-routes", "", "routes to advertise to other nodes (comma-separated, e.g. 10.0.0.0/8,192.168.0.0/24)")
 		}
@@ -81,6 +82,7 @@ var upArgs struct {
 	netfilterMode   string
 	authKey         string
 	hostname        string
+	staticEndpoints string
 }
 
 // parseIPOrCIDR parses an IP address or a CIDR prefix. If the input
@@ -171,6 +173,16 @@ func runUp(ctx context.Context, args []string) error {
 		}
 	}
 
+	var staticEndpoints []string
+	if upArgs.staticEndpoints != "" {
+		staticEndpoints = strings.Split(upArgs.staticEndpoints, ",")
+		for _, ep := range staticEndpoints {
+			if err := ipn.CheckStaticEndpoint(ep); err != nil {
+				log.Fatalf("static endpoint: %q: %s", ep, err)
+			}
+		}
+	}
+
 	if len(upArgs.hostname) > 256 {
 		log.Fatalf("hostname too long: %d bytes (max 256)", len(upArgs.hostname))
 	}
@@ -189,6 +201,7 @@ func runUp(ctx context.Context, args []string) error {
 	prefs.NoSNAT = !upArgs.snat
 	prefs.DisableDERP = !upArgs.enableDERP
 	prefs.Hostname = upArgs.hostname
+	prefs.StaticEndpoints = staticEndpoints
 	if runtime.GOOS == "linux" {
 		switch upArgs.netfilterMode {
 		case "on":
@@ -11,6 +11,8 @@ package main // import "tailscale.com/cmd/tailscaled"
 
 import (
 	"context"
+	"expvar"
+	"fmt"
 	"log"
 	"net/http"
 	"net/http/pprof"
@@ -18,18 +20,24 @@ import (
 	"os/signal"
 	"runtime"
 	"runtime/debug"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/apenwarr/fixconsole"
 	"github.com/pborman/getopt/v2"
+	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnserver"
 	"tailscale.com/logpolicy"
+	"tailscale.com/net/netns"
 	"tailscale.com/paths"
 	"tailscale.com/types/logger"
 	"tailscale.com/wgengine"
+	"tailscale.com/wgengine/filter"
 	"tailscale.com/wgengine/magicsock"
 	"tailscale.com/wgengine/router"
+	"tailscale.com/wgengine/tsdns"
 )
 
 // globalStateKey is the ipn.StateKey that tailscaled loads on
@@ -60,6 +68,24 @@ var args struct {
 	port       uint16
 	statepath  string
 	socketpath string
+
+	routeTable       int
+	subnetRouteMark  string
+	bypassMark       string
+	multiInstance    bool
+	netfilterBackend string
+	staticEndpoints  string
+	dnsRoutes        string
+
+	conntrackTCPFlows   int
+	conntrackUDPFlows   int
+	conntrackICMPFlows  int
+	conntrackTCPTimeout string
+	conntrackUDPTimeout string
+
+	logCollector string
+	logLocalOnly bool
+	logOutput    string
 }
 
 func main() {
@@ -82,8 +108,23 @@ func main() {
 	getopt.FlagLong(&args.debug, "debug", 0, "address of debug server")
 	getopt.FlagLong(&args.tunname, "tun", 0, "tunnel interface name")
 	getopt.FlagLong(&args.port, "port", 'p', "WireGuard port (0=autoselect)")
-	getopt.FlagLong(&args.statepath, "state", 0, "path of state file")
+	getopt.FlagLong(&args.statepath, "state", 0, "path of state file; or kube:<secret-name> for a Kubernetes Secret, or encfile:<path> for a file encrypted with the hex key in $TS_STATE_KEY or the file named by $TS_STATE_KEY_FILE")
 	getopt.FlagLong(&args.socketpath, "socket", 's', "path of the service unix socket")
+	getopt.FlagLong(&args.routeTable, "route-table", 0, "Linux routing table for Tailscale routes (0=52 plus the number in the --tun name)")
+	getopt.FlagLong(&args.subnetRouteMark, "subnet-route-mark", 0, "Linux fwmark for packets to subnet routes (default 0x40000)")
+	getopt.FlagLong(&args.bypassMark, "bypass-mark", 0, "Linux fwmark for tailscaled's own packets (default 0x80000)")
+	getopt.FlagLong(&args.multiInstance, "multi-instance", 0, "leave out netfilter rules that break other tailscaled instances on this machine")
+	getopt.FlagLong(&args.netfilterBackend, "netfilter-backend", 0, "Linux netfilter backend: auto, iptables or nftables")
+	getopt.FlagLong(&args.staticEndpoints, "static-endpoints", 0, "extra ip:port or host:port endpoints to advertise to peers (comma-separated)")
+	getopt.FlagLong(&args.dnsRoutes, "dns-routes", 0, `nameservers for proxied DNS queries by domain suffix, overriding the control server's, as in "corp.example.com=10.0.0.53,10.0.0.54 .=https://1.1.1.1/dns-query,tls://1.0.0.1"`)
+	getopt.FlagLong(&args.conntrackTCPFlows, "conntrack-tcp-flows", 0, "maximum number of TCP connections tracked by the packet filter (0=4096)")
+	getopt.FlagLong(&args.conntrackUDPFlows, "conntrack-udp-flows", 0, "maximum number of UDP flows tracked by the packet filter (0=1024)")
+	getopt.FlagLong(&args.conntrackICMPFlows, "conntrack-icmp-flows", 0, "maximum number of ICMP echoes tracked by the packet filter (0=256)")
+	getopt.FlagLong(&args.conntrackTCPTimeout, "conntrack-tcp-timeout", 0, "how long the packet filter remembers idle, established TCP connections (default 120h)")
+	getopt.FlagLong(&args.conntrackUDPTimeout, "conntrack-udp-timeout", 0, "how long the packet filter remembers idle UDP flows (default 2m)")
+	getopt.FlagLong(&args.logCollector, "log-collector", 0, "base URL of the log server to upload logs to, instead of Tailscale's")
+	getopt.FlagLong(&args.logLocalOnly, "log-local-only", 0, "keep logs in local files instead of uploading them")
+	getopt.FlagLong(&args.logOutput, "log-output", 0, "where to also write logs as text: stderr, syslog or journald")
 
 	err := fixconsole.FixConsoleIfNeeded()
 	if err != nil {
@@ -103,16 +144,41 @@ func main() {
 		log.Fatalf("--socket is required")
 	}
 
+	if err := logOptions().Check(); err != nil {
+		log.Fatalf("--log-collector, --log-local-only, --log-output: %v", err)
+	}
+
+	if args.routeTable < 0 || args.routeTable > 252 {
+		log.Fatalf("--route-table must be between 1 and 252, or 0 for the default")
+	}
+
+	if args.staticEndpoints != "" {
+		for _, ep := range strings.Split(args.staticEndpoints, ",") {
+			if err := ipn.CheckStaticEndpoint(ep); err != nil {
+				log.Fatalf("--static-endpoints: %q: %v", ep, err)
+			}
+		}
+	}
+
 	if err := run(); err != nil {
 		// No need to log; the func already did
 		os.Exit(1)
 	}
 }
 
+// logOptions returns the log policy options given by the flags.
+func logOptions() logpolicy.Options {
+	return logpolicy.Options{
+		CollectorURL: args.logCollector,
+		LocalOnly:    args.logLocalOnly,
+		Output:       args.logOutput,
+	}
+}
+
 func run() error {
 	var err error
 
-	pol := logpolicy.New("tailnode.log.tailscale.io")
+	pol := logpolicy.NewWithOptions("tailnode.log.tailscale.io", logOptions())
 	defer func() {
 		// Finish uploading logs after closing everything else.
 		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
@@ -134,17 +200,41 @@ func run() error {
 		go runDebugServer(debugMux, args.debug)
 	}
 
+	ropts, err := routerOptions()
+	if err != nil {
+		logf("router options: %v", err)
+		return err
+	}
+	// The sockets of magicsock and the control client must carry the
+	// same bypass mark as the router's ip rules expect.
+	netns.SetBypassMark(ropts.BypassMark)
+
+	dnsRoutes, err := tsdns.ParseRoutes(args.dnsRoutes)
+	if err != nil {
+		logf("--dns-routes: %v", err)
+		return err
+	}
+	conntrackCfg, err := conntrackConfig()
+	if err != nil {
+		logf("conntrack options: %v", err)
+		return err
+	}
+
 	var e wgengine.Engine
 	if args.fake {
 		e, err = wgengine.NewFakeUserspaceEngine(logf, 0)
 	} else {
-		e, err = wgengine.NewUserspaceEngine(logf, args.tunname, args.port)
+		e, err = wgengine.NewUserspaceEngineWithRouterOptions(logf, args.tunname, args.port, ropts)
 	}
 	if err != nil {
 		logf("wgengine.New: %v", err)
 		return err
 	}
 	e = wgengine.NewWatchdog(e)
+	e.SetConntrackConfig(conntrackCfg)
+	if len(dnsRoutes) > 0 {
+		e.SetDNSRoutes(dnsRoutes)
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	// Exit gracefully by cancelling the ipnserver context in most common cases:
@@ -174,6 +264,9 @@ func run() error {
 		SurviveDisconnects: true,
 		DebugMux:           debugMux,
 	}
+	if args.staticEndpoints != "" {
+		opts.StaticEndpoints = strings.Split(args.staticEndpoints, ",")
+	}
 	err = ipnserver.Run(ctx, logf, pol.PublicID.String(), ipnserver.FixedEngine(e), opts)
 	// Cancelation is not an error: it is the only way to stop ipnserver.
 	if err != nil && err != context.Canceled {
@@ -184,8 +277,76 @@ func run() error {
 	return nil
 }
 
+// routerOptions returns the router options selected by the command
+// line flags.
+func routerOptions() (router.Options, error) {
+	opts := router.Options{
+		RouteTable:    args.routeTable,
+		MultiInstance: args.multiInstance,
+	}
+	var err error
+	if opts.SubnetRouteMark, err = parseMark(args.subnetRouteMark); err != nil {
+		return router.Options{}, fmt.Errorf("--subnet-route-mark: %w", err)
+	}
+	if opts.BypassMark, err = parseMark(args.bypassMark); err != nil {
+		return router.Options{}, fmt.Errorf("--bypass-mark: %w", err)
+	}
+	switch args.netfilterBackend {
+	case "", "auto":
+		opts.NetfilterBackend = router.NetfilterBackendAuto
+	case "iptables":
+		opts.NetfilterBackend = router.NetfilterBackendIPTables
+	case "nftables":
+		opts.NetfilterBackend = router.NetfilterBackendNFTables
+	default:
+		return router.Options{}, fmt.Errorf("--netfilter-backend: invalid value %q", args.netfilterBackend)
+	}
+	return opts, nil
+}
+
+// conntrackConfig returns the packet filter's connection tracking
+// configuration selected by the command line flags.
+func conntrackConfig() (filter.ConntrackConfig, error) {
+	cfg := filter.ConntrackConfig{
+		MaxTCPFlows:  args.conntrackTCPFlows,
+		MaxUDPFlows:  args.conntrackUDPFlows,
+		MaxICMPFlows: args.conntrackICMPFlows,
+	}
+	var err error
+	if cfg.TCPEstablishedTimeout, err = parseDuration(args.conntrackTCPTimeout); err != nil {
+		return filter.ConntrackConfig{}, fmt.Errorf("--conntrack-tcp-timeout: %w", err)
+	}
+	if cfg.UDPTimeout, err = parseDuration(args.conntrackUDPTimeout); err != nil {
+		return filter.ConntrackConfig{}, fmt.Errorf("--conntrack-udp-timeout: %w", err)
+	}
+	return cfg, nil
+}
+
+// parseDuration parses a duration such as "90s". The empty string
+// means the default, zero.
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// parseMark parses a packet mark such as "0x80000". The empty string
+// means the default, zero.
+func parseMark(s string) (uint32, error) {
+	if s == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(v), nil
+}
+
 func newDebugMux() *http.ServeMux {
 	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
 	mux.HandleFunc("/debug/pprof/", pprof.Index)
 	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
 	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
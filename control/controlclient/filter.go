@@ -11,25 +11,43 @@ import (
 	"tailscale.com/wgengine/filter"
 )
 
-func parseIP(host string, defaultBits int) (filter.Net, error) {
+// parseIP parses host, an IPv4 or IPv6 address or "*", into the
+// filter.Nets it covers. If bits is negative, the net is the single
+// address host; otherwise it's the prefix of that length.
+// "*" covers all addresses of both families.
+func parseIP(host string, bits int) ([]filter.Net, error) {
 	ip := net.ParseIP(host)
 	if ip != nil && ip.IsUnspecified() {
-		// For clarity, reject 0.0.0.0 as an input
-		return filter.NetNone, fmt.Errorf("ports=%#v: to allow all IP addresses, use *:port, not 0.0.0.0:port", host)
+		// For clarity, reject 0.0.0.0 and :: as inputs
+		return nil, fmt.Errorf("ports=%#v: to allow all IP addresses, use *:port, not %s:port", host, host)
 	} else if ip == nil && host == "*" {
 		// User explicitly requested wildcard dst ip
-		return filter.NetAny, nil
+		return []filter.Net{filter.NetAny, filter.NetAny6}, nil
+	} else if ip == nil {
+		return nil, fmt.Errorf("ports=%#v: invalid IP address", host)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		if bits < 0 {
+			bits = 32
+		}
+		if bits > 32 {
+			return nil, fmt.Errorf("ports=%#v: invalid IPv4 prefix length %d", host, bits)
+		}
+		return []filter.Net{{
+			IP:   filter.NewIP(ip4),
+			Mask: filter.Netmask(bits),
+		}}, nil
 	} else {
-		if ip != nil {
-			ip = ip.To4()
+		if bits < 0 {
+			bits = 128
 		}
-		if ip == nil || len(ip) != 4 {
-			return filter.NetNone, fmt.Errorf("ports=%#v: invalid IPv4 address", host)
+		if bits > 128 {
+			return nil, fmt.Errorf("ports=%#v: invalid IPv6 prefix length %d", host, bits)
 		}
-		return filter.Net{
-			IP:   filter.NewIP(ip),
-			Mask: filter.Netmask(defaultBits),
-		}, nil
+		return []filter.Net{{
+			IsIP6: true,
+			IP6:   filter.NewIP6(ip),
+			Mask6: filter.Netmask6(bits),
+		}}, nil
 	}
 }
 
@@ -43,35 +61,37 @@ func (c *Direct) parsePacketFilter(pf []tailcfg.FilterRule) filter.Matches {
 		m := filter.Match{}
 
 		for i, s := range r.SrcIPs {
-			bits := 32
+			bits := -1
 			if len(r.SrcBits) > i {
 				bits = r.SrcBits[i]
 			}
-			net, err := parseIP(s, bits)
+			nets, err := parseIP(s, bits)
 			if err != nil && erracc == nil {
 				erracc = err
 				continue
 			}
-			m.Srcs = append(m.Srcs, net)
+			m.Srcs = append(m.Srcs, nets...)
 		}
 
 		for _, d := range r.DstPorts {
-			bits := 32
+			bits := -1
 			if d.Bits != nil {
 				bits = *d.Bits
 			}
-			net, err := parseIP(d.IP, bits)
+			nets, err := parseIP(d.IP, bits)
 			if err != nil && erracc == nil {
 				erracc = err
 				continue
 			}
-			m.Dsts = append(m.Dsts, filter.NetPortRange{
-				Net: net,
-				Ports: filter.PortRange{
-					First: d.Ports.First,
-					Last:  d.Ports.Last,
-				},
-			})
+			for _, net := range nets {
+				m.Dsts = append(m.Dsts, filter.NetPortRange{
+					Net: net,
+					Ports: filter.PortRange{
+						First: d.Ports.First,
+						Last:  d.Ports.Last,
+					},
+				})
+			}
 		}
 
 		mm = append(mm, m)
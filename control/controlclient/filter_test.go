@@ -0,0 +1,61 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package controlclient
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/wgengine/filter"
+)
+
+func TestParsePacketFilter(t *testing.T) {
+	c := &Direct{logf: t.Logf}
+	bits := func(n int) *int { return &n }
+	pf := []tailcfg.FilterRule{
+		{
+			SrcIPs:  []string{"100.64.0.1", "fd7a:115c:a1e0::", "*"},
+			SrcBits: []int{32, 48},
+			DstPorts: []tailcfg.NetPortRange{
+				{IP: "100.64.0.2", Ports: tailcfg.PortRange{First: 22, Last: 22}},
+				{IP: "fd7a:115c:a1e0::2", Ports: tailcfg.PortRange{First: 80, Last: 443}},
+				{IP: "10.0.0.0", Bits: bits(8), Ports: tailcfg.PortRangeAny},
+			},
+		},
+		{
+			SrcIPs:   []string{"::", "fd7a::/ab"},
+			DstPorts: []tailcfg.NetPortRange{{IP: "*", Ports: tailcfg.PortRangeAny}},
+		},
+	}
+	got := c.parsePacketFilter(pf)
+
+	ip6 := func(s string) filter.Net {
+		return filter.Net{IsIP6: true, IP6: filter.NewIP6(net.ParseIP(s)), Mask6: filter.Netmask6(128)}
+	}
+	want := filter.Matches{
+		{
+			Srcs: []filter.Net{
+				{IP: filter.NewIP(net.ParseIP("100.64.0.1")), Mask: filter.Netmask(32)},
+				{IsIP6: true, IP6: filter.NewIP6(net.ParseIP("fd7a:115c:a1e0::")), Mask6: filter.Netmask6(48)},
+				filter.NetAny,
+				filter.NetAny6,
+			},
+			Dsts: []filter.NetPortRange{
+				{Net: filter.Net{IP: filter.NewIP(net.ParseIP("100.64.0.2")), Mask: filter.Netmask(32)}, Ports: filter.PortRange{First: 22, Last: 22}},
+				{Net: ip6("fd7a:115c:a1e0::2"), Ports: filter.PortRange{First: 80, Last: 443}},
+				{Net: filter.Net{IP: filter.NewIP(net.ParseIP("10.0.0.0")), Mask: filter.Netmask(8)}, Ports: filter.PortRangeAny},
+			},
+		},
+		{
+			// Both sources are invalid and dropped.
+			Dsts: []filter.NetPortRange{filter.NetPortRangeAny, filter.NetPortRangeAny6},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parsePacketFilter:\n got: %v\nwant: %v", got, want)
+	}
+}
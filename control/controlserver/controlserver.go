@@ -0,0 +1,161 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package controlserver contains the server side of the control
+// protocol's wire format: request URLs, message encryption and
+// compression, and streamed map responses.
+//
+// It's shared by the control servers in cmd/tailcontrol and
+// tstest/testcontrol.
+package controlserver
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"golang.org/x/crypto/nacl/box"
+	"tailscale.com/smallzstd"
+	"tailscale.com/tailcfg"
+)
+
+var machinePath = regexp.MustCompile(`^/machine/([0-9a-f]{64})(/map)?$`)
+
+// ParseMachinePath parses a request path of the form
+// /machine/<hex machine key> or /machine/<hex machine key>/map. It
+// reports whether path is one, and if so, whether it's a map request.
+func ParseMachinePath(path string) (mkey wgcfg.Key, isMap, ok bool) {
+	m := machinePath.FindStringSubmatch(path)
+	if m == nil {
+		return wgcfg.Key{}, false, false
+	}
+	mkey, err := wgcfg.ParseHexKey(m[1])
+	if err != nil {
+		return wgcfg.Key{}, false, false
+	}
+	return mkey, m[2] != "", true
+}
+
+// A Codec encrypts and decrypts the messages exchanged with clients,
+// using the server's private key.
+type Codec struct {
+	privKey wgcfg.PrivateKey
+
+	mu   sync.Mutex
+	zenc *zstd.Encoder // or nil if not yet created; EncodeAll is concurrency safe
+}
+
+// NewCodec returns a Codec for the server with private key priv.
+func NewCodec(priv wgcfg.PrivateKey) *Codec {
+	return &Codec{privKey: priv}
+}
+
+// Close releases the resources used by c.
+func (c *Codec) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.zenc != nil {
+		c.zenc.Close()
+		c.zenc = nil
+	}
+}
+
+// Decode reads and decrypts the request body from mkey into v.
+func (c *Codec) Decode(r *http.Request, mkey wgcfg.Key, v interface{}) error {
+	msg, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	var nonce [24]byte
+	if len(msg) < len(nonce)+1 {
+		return fmt.Errorf("request missing nonce, len=%d", len(msg))
+	}
+	copy(nonce[:], msg)
+	msg = msg[len(nonce):]
+	pub, pri := (*[32]byte)(&mkey), (*[32]byte)(&c.privKey)
+	decrypted, ok := box.Open(nil, msg, &nonce, pub, pri)
+	if !ok {
+		return errors.New("cannot decrypt request")
+	}
+	return json.Unmarshal(decrypted, v)
+}
+
+// Encode marshals v to JSON, optionally compresses it with zstd, and
+// encrypts it to mkey.
+func (c *Codec) Encode(mkey wgcfg.Key, compress bool, v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if compress {
+		c.mu.Lock()
+		if c.zenc == nil {
+			c.zenc, err = smallzstd.NewEncoder(nil)
+		}
+		zenc := c.zenc
+		c.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		b = zenc.EncodeAll(b, nil)
+	}
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+	pub, pri := (*[32]byte)(&mkey), (*[32]byte)(&c.privKey)
+	return box.Seal(nonce[:], b, &nonce, pub, pri), nil
+}
+
+// SendMapResponse writes res to w as one length-prefixed message of
+// a map response stream to mkey, and flushes it.
+func (c *Codec) SendMapResponse(w http.ResponseWriter, mkey wgcfg.Key, compress bool, res *tailcfg.MapResponse) error {
+	b, err := c.Encode(mkey, compress, res)
+	if err != nil {
+		return err
+	}
+	var siz [4]byte
+	binary.LittleEndian.PutUint32(siz[:], uint32(len(b)))
+	if _, err := w.Write(siz[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// DiffPeers returns the peers in cur that are new or changed since
+// prev, and the IDs of peers in prev that are no longer in cur, for
+// a MapResponse's PeersChanged and PeersRemoved.
+func DiffPeers(prev, cur []*tailcfg.Node) (changed []*tailcfg.Node, removed []tailcfg.NodeID) {
+	old := make(map[tailcfg.NodeID]*tailcfg.Node, len(prev))
+	for _, n := range prev {
+		old[n.ID] = n
+	}
+	for _, n := range cur {
+		if o, ok := old[n.ID]; !ok || !o.Equal(n) || o.DERP != n.DERP {
+			changed = append(changed, n)
+		}
+		delete(old, n.ID)
+	}
+	for _, n := range prev {
+		if _, ok := old[n.ID]; ok {
+			removed = append(removed, n.ID)
+		}
+	}
+	return changed, removed
+}
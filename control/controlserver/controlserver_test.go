@@ -0,0 +1,56 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package controlserver
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"tailscale.com/tailcfg"
+)
+
+func TestParseMachinePath(t *testing.T) {
+	hex := strings.Repeat("ab", 32)
+	tests := []struct {
+		path  string
+		isMap bool
+		ok    bool
+	}{
+		{"/machine/" + hex, false, true},
+		{"/machine/" + hex + "/map", true, true},
+		{"/machine/" + hex + "/foo", false, false},
+		{"/machine/" + hex[:62], false, false},
+		{"/key", false, false},
+	}
+	for _, tt := range tests {
+		mkey, isMap, ok := ParseMachinePath(tt.path)
+		if isMap != tt.isMap || ok != tt.ok {
+			t.Errorf("ParseMachinePath(%q) = _, %v, %v; want %v, %v", tt.path, isMap, ok, tt.isMap, tt.ok)
+		}
+		if ok && mkey.HexString() != hex {
+			t.Errorf("ParseMachinePath(%q) key = %v; want %v", tt.path, mkey.HexString(), hex)
+		}
+	}
+}
+
+func TestDiffPeers(t *testing.T) {
+	n := func(id tailcfg.NodeID, name string) *tailcfg.Node {
+		return &tailcfg.Node{ID: id, Name: name}
+	}
+	prev := []*tailcfg.Node{n(1, "a"), n(2, "b"), n(3, "c")}
+	cur := []*tailcfg.Node{n(1, "a"), n(3, "c2"), n(4, "d")}
+	changed, removed := DiffPeers(prev, cur)
+	var names []string
+	for _, n := range changed {
+		names = append(names, n.Name)
+	}
+	if want := []string{"c2", "d"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("changed = %q; want %q", names, want)
+	}
+	if want := []tailcfg.NodeID{2}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("removed = %v; want %v", removed, want)
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package derp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"tailscale.com/types/key"
+)
+
+// This file has the Server methods that let operators inspect and
+// manage the clients of a running server.
+
+// errBanned is returned for clients whose key is banned.
+var errBanned = errors.New("key is banned")
+
+// ClientStatus describes a client connected to a Server.
+type ClientStatus struct {
+	Key         key.Public
+	RemoteAddr  string
+	ConnNum     int64 // unique per connection
+	Version     int   // protocol version the client announced
+	Preferred   bool  // the client says this server is its home
+	Mesh        bool  // the client is a mesh peer, with the mesh key
+	Watcher     bool  // the mesh peer watches connections
+	ConnectedAt time.Time
+
+	PacketsRecv, BytesRecv int64 // from the client
+	PacketsSent, BytesSent int64 // to the client
+
+	// PacketsDropped counts, by reason, the packets that the client
+	// sent or that were for it that the server dropped. The reasons
+	// are those of the server's packets_dropped_reason counter.
+	// Reasons with no drops are omitted.
+	PacketsDropped map[string]int64
+
+	// SendQueueLen is the number of packets waiting to be written
+	// to the client.
+	SendQueueLen int
+}
+
+// RemoteClient describes a client that the Server can reach through
+// a mesh peer.
+type RemoteClient struct {
+	Key key.Public
+
+	// Local is whether the client is also connected directly.
+	Local bool
+
+	// Forwarders describes the packet forwarders for the client,
+	// in no particular order.
+	Forwarders []string
+}
+
+// Ban describes a client key banned from the Server.
+type Ban struct {
+	Key   key.Public
+	Until time.Time
+}
+
+// Clients returns the clients connected to s, sorted by key.
+func (s *Server) Clients() []ClientStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make([]ClientStatus, 0, len(s.clients))
+	for _, c := range s.clients {
+		ret = append(ret, ClientStatus{
+			Key:          c.key,
+			RemoteAddr:   c.remoteAddr,
+			ConnNum:      c.connNum,
+			Version:      c.info.Version,
+			Preferred:    c.preferred,
+			Mesh:         c.canMesh,
+			Watcher:      s.watchers[c],
+			ConnectedAt:  c.connectedAt,
+			PacketsRecv:  c.packetsRecv.Value(),
+			BytesRecv:    c.bytesRecv.Value(),
+			PacketsSent:  c.packetsSent.Value(),
+			BytesSent:    c.bytesSent.Value(),
+			SendQueueLen: c.sendQueue.len(),
+		})
+		cs := &ret[len(ret)-1]
+		for r := range c.dropped {
+			if n := c.dropped[r].Value(); n != 0 {
+				if cs.PacketsDropped == nil {
+					cs.PacketsDropped = map[string]int64{}
+				}
+				cs.PacketsDropped[dropReasonNames[r]] = n
+			}
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return bytes.Compare(ret[i].Key[:], ret[j].Key[:]) < 0
+	})
+	return ret
+}
+
+// RemoteClients returns the clients that s knows how to reach
+// through mesh peers, sorted by key.
+func (s *Server) RemoteClients() []RemoteClient {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ret []RemoteClient
+	for k, fwd := range s.clientsMesh {
+		if fwd == nil {
+			continue
+		}
+		rc := RemoteClient{Key: k}
+		_, rc.Local = s.clients[k]
+		if m, ok := fwd.(multiForwarder); ok {
+			for f := range m {
+				rc.Forwarders = append(rc.Forwarders, forwarderString(f))
+			}
+		} else {
+			rc.Forwarders = []string{forwarderString(fwd)}
+		}
+		ret = append(ret, rc)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return bytes.Compare(ret[i].Key[:], ret[j].Key[:]) < 0
+	})
+	return ret
+}
+
+// forwarderString describes fwd for RemoteClient.Forwarders.
+func forwarderString(fwd PacketForwarder) string {
+	if s, ok := fwd.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", fwd)
+}
+
+// CloseClient closes the connection of the local client with key k,
+// if any, and reports whether there was one. The client is free to
+// reconnect; see BanClient to prevent that.
+func (s *Server) CloseClient(k key.Public) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.clients[k]
+	if !ok {
+		return false
+	}
+	go c.nc.Close()
+	return true
+}
+
+// BanClient prevents the client with key k from connecting to s for
+// duration d, replacing any previous ban of k, and closes its
+// current connection. Bans apply to mesh peers too.
+func (s *Server) BanClient(k key.Public, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.banned[k] = time.Now().Add(d)
+	if c, ok := s.clients[k]; ok {
+		c.logf("banned for %v", d)
+		go c.nc.Close()
+	}
+}
+
+// UnbanClient lifts the ban on k, if any, and reports whether there
+// was one.
+func (s *Server) UnbanClient(k key.Public) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.banned[k]
+	delete(s.banned, k)
+	return ok
+}
+
+// Bans returns the unexpired bans, sorted by key.
+func (s *Server) Bans() []Ban {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var ret []Ban
+	for k, until := range s.banned {
+		if now.After(until) {
+			delete(s.banned, k)
+			continue
+		}
+		ret = append(ret, Ban{Key: k, Until: until})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return bytes.Compare(ret[i].Key[:], ret[j].Key[:]) < 0
+	})
+	return ret
+}
+
+// isBanned reports whether k is currently banned.
+func (s *Server) isBanned(k key.Public) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	until, ok := s.banned[k]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(s.banned, k)
+		return false
+	}
+	return true
+}
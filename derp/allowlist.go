@@ -0,0 +1,66 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package derp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"go4.org/mem"
+	"tailscale.com/types/key"
+)
+
+// Allowlist is a static set of client public keys allowed to use a
+// Server. Its VerifyClient method can be passed to
+// Server.SetVerifyClient.
+type Allowlist map[key.Public]bool
+
+// errNotAllowed is returned for client keys not in an Allowlist.
+var errNotAllowed = errors.New("key not in allowlist")
+
+// VerifyClient returns an error if k is not in a.
+func (a Allowlist) VerifyClient(k key.Public) error {
+	if !a[k] {
+		return errNotAllowed
+	}
+	return nil
+}
+
+// ReadAllowlistFile reads an Allowlist from the file at path.
+//
+// The file contains one public key per line, either in hex (as the
+// server logs them) or in base64. Blank lines and lines starting
+// with '#' are ignored.
+func ReadAllowlistFile(path string) (Allowlist, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseAllowlist(b)
+}
+
+func parseAllowlist(b []byte) (Allowlist, error) {
+	a := Allowlist{}
+	for i, line := range bytes.Split(b, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		var k key.Public
+		var err error
+		if len(line) == 64 {
+			k, err = key.NewPublicFromHexMem(mem.B(line))
+		} else {
+			err = k.UnmarshalText(line)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid key %q: %v", i+1, line, err)
+		}
+		a[k] = true
+	}
+	return a, nil
+}
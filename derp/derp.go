@@ -42,10 +42,13 @@ const (
 // protocolVersion is bumped whenever there's a wire-incompatible change.
 //   * version 1 (zero on wire): consistent box headers, in use by employee dev nodes a bit
 //   * version 2: received packets have src addrs in frameRecvPacket at beginning
-const protocolVersion = 2
+//
+// Version 3 added framePing and framePong.
+const protocolVersion = 3
 
 const (
 	protocolSrcAddrs = 2 // protocol version at which client expects src addresses
+	protocolPing     = 3 // protocol version at which server answers framePing with framePong
 )
 
 // frameType is the one byte frame type at the beginning of the frame
@@ -66,6 +69,7 @@ Steady state:
 * server occasionally sends frameKeepAlive
 * client sends frameSendPacket
 * server then sends frameRecvPacket to recipient
+* either side may send framePing, which the other answers with framePong
 */
 const (
 	frameServerKey     = frameType(0x01) // 8B magic + 32B public key + (0+ bytes future use)
@@ -74,7 +78,7 @@ const (
 	frameSendPacket    = frameType(0x04) // 32B dest pub key + packet bytes
 	frameForwardPacket = frameType(0x0a) // 32B src pub key + 32B dst pub key + packet bytes
 	frameRecvPacket    = frameType(0x05) // v0/1: packet bytes, v2: 32B src pub key + packet bytes
-	frameKeepAlive     = frameType(0x06) // no payload, no-op (to be replaced with ping/pong)
+	frameKeepAlive     = frameType(0x06) // no payload, no-op
 	frameNotePreferred = frameType(0x07) // 1 byte payload: 0x01 or 0x00 for whether this is client's home node
 
 	// framePeerGone is sent from server to client to signal that
@@ -101,8 +105,14 @@ const (
 	// connection. (To be used for cluster load balancing
 	// purposes, when clients end up on a non-ideal node)
 	frameClosePeer = frameType(0x11) // 32B pub key of peer to close.
+
+	framePing = frameType(0x12) // 8 byte ping payload, to be echoed back in framePong
+	framePong = frameType(0x13) // 8 byte payload, the contents of the ping being replied to
 )
 
+// pingLen is the length of the framePing and framePong payloads.
+const pingLen = 8
+
 var bin = binary.BigEndian
 
 func writeUint32(bw *bufio.Writer, v uint32) error {
@@ -287,6 +287,30 @@ func (c *Client) ClosePeer(target key.Public) error {
 	return writeFrame(c.bw, frameClosePeer, target[:])
 }
 
+// ErrPingUnsupported is returned by SendPing when the server is too
+// old to answer pings.
+var ErrPingUnsupported = errors.New("derp: server doesn't support ping")
+
+// SendPing sends a ping to the server, which answers with a
+// PongMessage carrying the same data.
+func (c *Client) SendPing(data [8]byte) error {
+	if c.protoVersion < protocolPing {
+		return ErrPingUnsupported
+	}
+	return c.sendPingOrPong(framePing, data)
+}
+
+// SendPong answers a PingMessage from the server.
+func (c *Client) SendPong(data [8]byte) error {
+	return c.sendPingOrPong(framePong, data)
+}
+
+func (c *Client) sendPingOrPong(t frameType, data [8]byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return writeFrame(c.bw, t, data[:])
+}
+
 // ReceivedMessage represents a type returned by Client.Recv. Unless
 // otherwise documented, the returned message aliases the byte slice
 // provided to Recv and thus the message is only as good as that
@@ -318,6 +342,18 @@ type PeerPresentMessage key.Public
 
 func (PeerPresentMessage) msg() {}
 
+// PingMessage is a ReceivedMessage that's a request from the server
+// for a pong with the same data, to be sent with Client.SendPong.
+type PingMessage [8]byte
+
+func (PingMessage) msg() {}
+
+// PongMessage is a ReceivedMessage that answers a ping sent with
+// Client.SendPing. It carries the same data.
+type PongMessage [8]byte
+
+func (PongMessage) msg() {}
+
 // Recv reads a message from the DERP server.
 //
 // The returned message may alias memory owned by the Client; it
@@ -383,9 +419,28 @@ func (c *Client) recvTimeout(timeout time.Duration) (m ReceivedMessage, err erro
 		default:
 			continue
 		case frameKeepAlive:
-			// TODO: eventually we'll have server->client pings that
-			// require ack pongs.
+			// A one-way keep-alive; unlike framePing, no reply
+			// is wanted.
 			continue
+
+		case framePing:
+			if n < pingLen {
+				c.logf("[unexpected] dropping short ping frame from DERP server")
+				continue
+			}
+			var pm PingMessage
+			copy(pm[:], b[:pingLen])
+			return pm, nil
+
+		case framePong:
+			if n < pingLen {
+				c.logf("[unexpected] dropping short pong frame from DERP server")
+				continue
+			}
+			var pm PongMessage
+			copy(pm[:], b[:pingLen])
+			return pm, nil
+
 		case framePeerGone:
 			if n < keyLen {
 				c.logf("[unexpected] dropping short peerGone frame from DERP server")
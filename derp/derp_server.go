@@ -17,6 +17,7 @@ import (
 	"io"
 	"io/ioutil"
 	"math/big"
+	"math/bits"
 	"os"
 	"runtime"
 	"strconv"
@@ -26,6 +27,7 @@ import (
 
 	"golang.org/x/crypto/nacl/box"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
 	"tailscale.com/metrics"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
@@ -39,6 +41,30 @@ const (
 	writeTimeout            = 2 * time.Second
 )
 
+// dropReason is why the server dropped a packet.
+type dropReason int
+
+const (
+	dropReasonUnknownDest      dropReason = iota // unknown dst pubkey
+	dropReasonUnknownDestOnFwd                   // unknown dst pubkey on forward
+	dropReasonGone                               // dst conn shutting down
+	dropReasonQueueHead                          // dst queue full, dropped a queued packet
+	dropReasonWriteError                         // error writing to dst conn
+	dropReasonRateLimited                        // src client over its rate limit
+	numDropReasons
+)
+
+// dropReasonNames are the labels of the dropReasons in the
+// packets_dropped_reason counter.
+var dropReasonNames = [numDropReasons]string{
+	dropReasonUnknownDest:      "unknown_dest",
+	dropReasonUnknownDestOnFwd: "unknown_dest_on_fwd",
+	dropReasonGone:             "gone",
+	dropReasonQueueHead:        "queue_head",
+	dropReasonWriteError:       "write_error",
+	dropReasonRateLimited:      "rate_limited",
+}
+
 const host64bit = (^uint(0) >> 32) & 1 // 1 on 64-bit, 0 on 32-bit
 
 // pad32bit is 4 on 32-bit machines and 0 on 64-bit.
@@ -58,6 +84,15 @@ type Server struct {
 	memSys0    uint64 // runtime.MemStats.Sys at start (or early-ish)
 	meshKey    string
 
+	// verifyClient, if non-nil, decides whether a client key may
+	// use the server. See SetVerifyClient.
+	verifyClient func(key.Public) error
+
+	// Per-client send limits; zero means unlimited. See
+	// SetClientRateLimit.
+	clientBytesPerSec   int
+	clientPacketsPerSec int
+
 	// Counters:
 	_                        [pad32bit]byte
 	packetsSent, bytesSent   expvar.Int
@@ -68,13 +103,15 @@ type Server struct {
 	packetsDroppedFwdUnknown *expvar.Int // unknown dst pubkey on forward
 	packetsDroppedGone       *expvar.Int // dst conn shutting down
 	packetsDroppedQueueHead  *expvar.Int // queue full, drop head packet
-	packetsDroppedQueueTail  *expvar.Int // queue full, drop tail packet
 	packetsDroppedWrite      *expvar.Int // error writing to dst conn
+	packetsDroppedRateLimit  *expvar.Int // src client over its rate limit
 	_                        [pad32bit]byte
 	packetsForwardedOut      expvar.Int
 	packetsForwardedIn       expvar.Int
 	peerGoneFrames           expvar.Int // number of peer gone frames sent
 	accepts                  expvar.Int
+	clientsRejected          expvar.Int // clients that failed verifyClient
+	clientsBanned            expvar.Int // clients rejected because of a ban
 	curClients               expvar.Int
 	curHomeClients           expvar.Int // ones with preferred
 	clientsReplaced          expvar.Int
@@ -84,6 +121,14 @@ type Server struct {
 	multiForwarderCreated    expvar.Int
 	multiForwarderDeleted    expvar.Int
 	removePktForwardOther    expvar.Int
+	gotPing                  expvar.Int // number of ping frames from client
+	sentPong                 expvar.Int // number of pong frames enqueued to client
+
+	// sendQueueDepth is a histogram of how many packets were
+	// already queued for their client when each packet joined the
+	// queue. sendQueueDepthBy has its counter for each depth.
+	sendQueueDepth   metrics.LabelMap
+	sendQueueDepthBy [perClientSendQueueDepth + 1]*expvar.Int
 
 	mu          sync.Mutex
 	closed      bool
@@ -102,6 +147,9 @@ type Server struct {
 	// because it includes intra-region forwarded packets as the
 	// src.
 	sentTo map[key.Public]map[key.Public]int64 // src => dst => dst's latest sclient.connNum
+	// banned maps client keys that may not connect to when
+	// their ban expires. See BanClient.
+	banned map[key.Public]time.Time
 }
 
 // PacketForwarder is something that can forward packets.
@@ -137,6 +185,7 @@ func NewServer(privateKey key.Private, logf logger.Logf) *Server {
 		publicKey:            privateKey.Public(),
 		logf:                 logf,
 		packetsDroppedReason: metrics.LabelMap{Label: "reason"},
+		sendQueueDepth:       metrics.LabelMap{Label: "depth"},
 		clients:              map[key.Public]*sclient{},
 		clientsEver:          map[key.Public]bool{},
 		clientsMesh:          map[key.Public]PacketForwarder{},
@@ -144,16 +193,58 @@ func NewServer(privateKey key.Private, logf logger.Logf) *Server {
 		memSys0:              ms.Sys,
 		watchers:             map[*sclient]bool{},
 		sentTo:               map[key.Public]map[key.Public]int64{},
+		banned:               map[key.Public]time.Time{},
+	}
+	s.packetsDroppedUnknown = s.packetsDroppedReason.Get(dropReasonNames[dropReasonUnknownDest])
+	s.packetsDroppedFwdUnknown = s.packetsDroppedReason.Get(dropReasonNames[dropReasonUnknownDestOnFwd])
+	s.packetsDroppedGone = s.packetsDroppedReason.Get(dropReasonNames[dropReasonGone])
+	s.packetsDroppedQueueHead = s.packetsDroppedReason.Get(dropReasonNames[dropReasonQueueHead])
+	s.packetsDroppedWrite = s.packetsDroppedReason.Get(dropReasonNames[dropReasonWriteError])
+	s.packetsDroppedRateLimit = s.packetsDroppedReason.Get(dropReasonNames[dropReasonRateLimited])
+	// Packets are no longer dropped from the tail of a queue, but
+	// the label stays, at zero, for whatever graphs and alerts on it.
+	s.packetsDroppedReason.Get("queue_tail")
+	for n := range s.sendQueueDepthBy {
+		s.sendQueueDepthBy[n] = s.sendQueueDepth.Get(queueDepthBucket(n))
 	}
-	s.packetsDroppedUnknown = s.packetsDroppedReason.Get("unknown_dest")
-	s.packetsDroppedFwdUnknown = s.packetsDroppedReason.Get("unknown_dest_on_fwd")
-	s.packetsDroppedGone = s.packetsDroppedReason.Get("gone")
-	s.packetsDroppedQueueHead = s.packetsDroppedReason.Get("queue_head")
-	s.packetsDroppedQueueTail = s.packetsDroppedReason.Get("queue_tail")
-	s.packetsDroppedWrite = s.packetsDroppedReason.Get("write_error")
 	return s
 }
 
+// queueDepthBucket returns the sendQueueDepth label for a queue
+// depth of n packets: "0", "1", then powers of two ranges like "2-3"
+// and "4-7", and "full".
+func queueDepthBucket(n int) string {
+	switch {
+	case n >= perClientSendQueueDepth:
+		return "full"
+	case n < 2:
+		return strconv.Itoa(n)
+	}
+	lo := 1 << (bits.Len(uint(n)) - 1)
+	return fmt.Sprintf("%d-%d", lo, 2*lo-1)
+}
+
+// recordDrop counts a packet dropped for reason r, server-wide and
+// against c, the client that sent it or that it was for.
+func (s *Server) recordDrop(c *sclient, r dropReason) {
+	s.packetsDropped.Add(1)
+	switch r {
+	case dropReasonUnknownDest:
+		s.packetsDroppedUnknown.Add(1)
+	case dropReasonUnknownDestOnFwd:
+		s.packetsDroppedFwdUnknown.Add(1)
+	case dropReasonGone:
+		s.packetsDroppedGone.Add(1)
+	case dropReasonQueueHead:
+		s.packetsDroppedQueueHead.Add(1)
+	case dropReasonWriteError:
+		s.packetsDroppedWrite.Add(1)
+	case dropReasonRateLimited:
+		s.packetsDroppedRateLimit.Add(1)
+	}
+	c.dropped[r].Add(1)
+}
+
 // SetMesh sets the pre-shared key that regional DERP servers used to mesh
 // amongst themselves.
 //
@@ -162,6 +253,27 @@ func (s *Server) SetMeshKey(v string) {
 	s.meshKey = v
 }
 
+// SetVerifyClient sets the admission policy for clients: f is called
+// with the public key of each connecting client, and the client is
+// rejected if f returns an error. Mesh peers presenting the mesh key
+// are not subject to f. A nil f, the default, admits all clients.
+//
+// It must be called before serving begins.
+func (s *Server) SetVerifyClient(f func(clientKey key.Public) error) {
+	s.verifyClient = f
+}
+
+// SetClientRateLimit limits how fast each client can send packets
+// through the server, in bytes and packets per second. Packets over
+// either limit are dropped. Zero values mean no limit. Mesh peers
+// are not limited.
+//
+// It must be called before serving begins.
+func (s *Server) SetClientRateLimit(bytesPerSec, packetsPerSec int) {
+	s.clientBytesPerSec = bytesPerSec
+	s.clientPacketsPerSec = packetsPerSec
+}
+
 // HasMeshKey reports whether the server is configured with a mesh key.
 func (s *Server) HasMeshKey() bool { return s.meshKey != "" }
 
@@ -351,7 +463,8 @@ func (s *Server) accept(nc Conn, brw *bufio.ReadWriter, remoteAddr string, connN
 	if err != nil {
 		return fmt.Errorf("receive client key: %v", err)
 	}
-	if err := s.verifyClient(clientKey, clientInfo); err != nil {
+	if err := s.verifyClientKey(clientKey, clientInfo); err != nil {
+		s.clientsRejected.Add(1)
 		return fmt.Errorf("client %x rejected: %v", clientKey, err)
 	}
 
@@ -372,12 +485,26 @@ func (s *Server) accept(nc Conn, brw *bufio.ReadWriter, remoteAddr string, connN
 		done:        ctx.Done(),
 		remoteAddr:  remoteAddr,
 		connectedAt: time.Now(),
-		sendQueue:   make(chan pkt, perClientSendQueueDepth),
+		sendQueue:   newSendQueue(perClientSendQueueDepth),
 		peerGone:    make(chan key.Public),
+		sendPongCh:  make(chan [8]byte, 1),
 		canMesh:     clientInfo.MeshKey != "" && clientInfo.MeshKey == s.meshKey,
 	}
 	if c.canMesh {
 		c.meshUpdate = make(chan struct{})
+	} else {
+		if s.clientBytesPerSec > 0 {
+			// The burst must fit at least one packet, or
+			// big packets would never be allowed.
+			burst := s.clientBytesPerSec
+			if burst < MaxPacketSize {
+				burst = MaxPacketSize
+			}
+			c.bytesLimiter = rate.NewLimiter(rate.Limit(s.clientBytesPerSec), burst)
+		}
+		if s.clientPacketsPerSec > 0 {
+			c.packetsLimiter = rate.NewLimiter(rate.Limit(s.clientPacketsPerSec), s.clientPacketsPerSec)
+		}
 	}
 	if clientInfo != nil {
 		c.info = *clientInfo
@@ -432,6 +559,8 @@ func (c *sclient) run(ctx context.Context) error {
 			err = c.handleFrameWatchConns(ft, fl)
 		case frameClosePeer:
 			err = c.handleFrameClosePeer(ft, fl)
+		case framePing:
+			err = c.handleFramePing(ft, fl)
 		default:
 			err = c.handleUnknownFrame(ft, fl)
 		}
@@ -458,6 +587,33 @@ func (c *sclient) handleFrameNotePreferred(ft frameType, fl uint32) error {
 	return nil
 }
 
+func (c *sclient) handleFramePing(ft frameType, fl uint32) error {
+	c.s.gotPing.Add(1)
+	if fl < pingLen {
+		return fmt.Errorf("short ping: %v", fl)
+	}
+	if fl > 1000 {
+		// Arbitrary, but a ping with a large body is suspicious.
+		return fmt.Errorf("ping body too large: %v", fl)
+	}
+	var m [8]byte
+	if _, err := io.ReadFull(c.br, m[:]); err != nil {
+		return err
+	}
+	if extra := int64(fl) - pingLen; extra > 0 {
+		if _, err := io.CopyN(ioutil.Discard, c.br, extra); err != nil {
+			return err
+		}
+	}
+	select {
+	case c.sendPongCh <- m:
+	default:
+		// The client is pinging faster than we can answer;
+		// drop this one.
+	}
+	return nil
+}
+
 func (c *sclient) handleFrameWatchConns(ft frameType, fl uint32) error {
 	if fl != 0 {
 		return fmt.Errorf("handleFrameWatchConns wrong size")
@@ -480,18 +636,11 @@ func (c *sclient) handleFrameClosePeer(ft frameType, fl uint32) error {
 	if _, err := io.ReadFull(c.br, targetKey[:]); err != nil {
 		return err
 	}
-	s := c.s
-
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	if target, ok := s.clients[targetKey]; ok {
+	if c.s.CloseClient(targetKey) {
 		c.logf("frameClosePeer closing peer %x", targetKey)
-		go target.nc.Close()
 	} else {
 		c.logf("frameClosePeer failed to find peer %x", targetKey)
 	}
-
 	return nil
 }
 
@@ -508,6 +657,8 @@ func (c *sclient) handleFrameForwardPacket(ft frameType, fl uint32) error {
 		return fmt.Errorf("client %x: recvForwardPacket: %v", c.key, err)
 	}
 	s.packetsForwardedIn.Add(1)
+	c.packetsRecv.Add(1)
+	c.bytesRecv.Add(int64(len(contents)))
 
 	s.mu.Lock()
 	dst := s.clients[dstKey]
@@ -517,8 +668,7 @@ func (c *sclient) handleFrameForwardPacket(ft frameType, fl uint32) error {
 	s.mu.Unlock()
 
 	if dst == nil {
-		s.packetsDropped.Add(1)
-		s.packetsDroppedFwdUnknown.Add(1)
+		s.recordDrop(c, dropReasonUnknownDestOnFwd)
 		if debug {
 			c.logf("dropping forwarded packet for unknown %x", dstKey)
 		}
@@ -551,6 +701,16 @@ func (c *sclient) handleFrameSendPacket(ft frameType, fl uint32) error {
 	if err != nil {
 		return fmt.Errorf("client %x: recvPacket: %v", c.key, err)
 	}
+	c.packetsRecv.Add(1)
+	c.bytesRecv.Add(int64(len(contents)))
+
+	if !c.allowSend(len(contents)) {
+		s.recordDrop(c, dropReasonRateLimited)
+		if debug {
+			c.logf("dropping packet for %x over rate limit", dstKey)
+		}
+		return nil
+	}
 
 	var fwd PacketForwarder
 	s.mu.Lock()
@@ -571,66 +731,55 @@ func (c *sclient) handleFrameSendPacket(ft frameType, fl uint32) error {
 			}
 			return nil
 		}
-		s.packetsDropped.Add(1)
-		s.packetsDroppedUnknown.Add(1)
+		s.recordDrop(c, dropReasonUnknownDest)
 		if debug {
 			c.logf("dropping packet for unknown %x", dstKey)
 		}
 		return nil
 	}
 
-	p := pkt{
-		bs: contents,
+	return c.sendPkt(dst, pkt{
+		bs:  contents,
+		src: c.key,
+	})
+}
+
+// allowSend reports whether c is within its rate limits to send a
+// packet of n bytes, and consumes its tokens if so.
+func (c *sclient) allowSend(n int) bool {
+	now := time.Now()
+	if c.packetsLimiter != nil && !c.packetsLimiter.AllowN(now, 1) {
+		return false
 	}
-	if dst.info.Version >= protocolSrcAddrs {
-		p.src = c.key
+	if c.bytesLimiter != nil && !c.bytesLimiter.AllowN(now, n) {
+		return false
 	}
-	return c.sendPkt(dst, p)
+	return true
 }
 
+// sendPkt queues p to be sent to dst. If dst's queue is full, the
+// oldest packet of the source with the most packets queued is
+// dropped to make room, to prioritize fresher packets without
+// letting one busy source crowd out the others.
 func (c *sclient) sendPkt(dst *sclient, p pkt) error {
 	s := c.s
-	dstKey := dst.key
-
-	// Attempt to queue for sending up to 3 times. On each attempt, if
-	// the queue is full, try to drop from queue head to prioritize
-	// fresher packets.
-	for attempt := 0; attempt < 3; attempt++ {
-		select {
-		case <-dst.done:
-			s.packetsDropped.Add(1)
-			s.packetsDroppedGone.Add(1)
-			if debug {
-				c.logf("dropping packet for shutdown client %x", dstKey)
-			}
-			return nil
-		default:
-		}
-		select {
-		case dst.sendQueue <- p:
-			return nil
-		default:
-		}
-
-		select {
-		case <-dst.sendQueue:
-			s.packetsDropped.Add(1)
-			s.packetsDroppedQueueHead.Add(1)
-			if debug {
-				c.logf("dropping packet from client %x queue head", dstKey)
-			}
-		default:
+	select {
+	case <-dst.done:
+		s.recordDrop(dst, dropReasonGone)
+		if debug {
+			c.logf("dropping packet for shutdown client %x", dst.key)
 		}
+		return nil
+	default:
 	}
-	// Failed to make room for packet. This can happen in a heavily
-	// contended queue with racing writers. Give up and tail-drop in
-	// this case to keep reader unblocked.
-	s.packetsDropped.Add(1)
-	s.packetsDroppedQueueTail.Add(1)
-	if debug {
-		c.logf("dropping packet from client %x queue tail", dstKey)
+	depth, dropped := dst.sendQueue.enqueue(p)
+	s.sendQueueDepthBy[depth].Add(1)
+	if dropped {
+		s.recordDrop(dst, dropReasonQueueHead)
+		if debug {
+			c.logf("dropping packet from client %x queue head", dst.key)
+		}
 	}
-
 	return nil
 }
 
@@ -654,10 +803,20 @@ func (c *sclient) requestMeshUpdate() {
 	}
 }
 
-func (s *Server) verifyClient(clientKey key.Public, info *clientInfo) error {
-	// TODO(crawshaw): implement policy constraints on who can use the DERP server
-	// TODO(bradfitz): ... and at what rate.
-	return nil
+// verifyClientKey reports whether the client with the given key
+// and info may use the server.
+func (s *Server) verifyClientKey(clientKey key.Public, info *clientInfo) error {
+	if s.isBanned(clientKey) {
+		s.clientsBanned.Add(1)
+		return errBanned
+	}
+	if s.meshKey != "" && info.MeshKey == s.meshKey {
+		return nil
+	}
+	if s.verifyClient == nil {
+		return nil
+	}
+	return s.verifyClient(clientKey)
 }
 
 func (s *Server) sendServerKey(bw *bufio.Writer) error {
@@ -784,6 +943,16 @@ func (s *Server) recvForwardPacket(br *bufio.Reader, frameLen uint32) (srcKey, d
 //
 // (The "s" prefix is to more explicitly distinguish it from Client in derp_client.go)
 type sclient struct {
+	// Per-client counters, reported by Server.Clients. They're
+	// first in the struct so they're 64-bit aligned for atomic
+	// access on 32-bit platforms.
+	packetsRecv, bytesRecv expvar.Int // from the client
+	packetsSent, bytesSent expvar.Int // to the client
+
+	// dropped counts the packets dropped that the client sent,
+	// or that were for it, by reason.
+	dropped [numDropReasons]expvar.Int
+
 	// Static after construction.
 	connNum    int64 // process-wide unique counter, incremented each Accept
 	s          *Server
@@ -793,15 +962,20 @@ type sclient struct {
 	logf       logger.Logf
 	done       <-chan struct{} // closed when connection closes
 	remoteAddr string          // usually ip:port from net.Conn.RemoteAddr().String()
-	sendQueue  chan pkt        // packets queued to this client; never closed
+	sendQueue  *sendQueue      // packets queued to this client
 	peerGone   chan key.Public // write request that a previous sender has disconnected (not used by mesh peers)
 	meshUpdate chan struct{}   // write request to write peerStateChange
+	sendPongCh chan [8]byte    // pong replies to send to the client; buffered
 	canMesh    bool            // clientInfo had correct mesh token for inter-region routing
 
+	// Owned by run, not thread-safe. Nil if unlimited.
+	bytesLimiter   *rate.Limiter
+	packetsLimiter *rate.Limiter
+
 	// Owned by run, not thread-safe.
 	br          *bufio.Reader
 	connectedAt time.Time
-	preferred   bool
+	preferred   bool // only written by run, with s.mu held
 
 	// Owned by sender, not thread-safe.
 	bw *bufio.Writer
@@ -838,7 +1012,9 @@ func (c *sclient) setPreferred(v bool) {
 	if c.preferred == v {
 		return
 	}
+	c.s.mu.Lock()
 	c.preferred = v
+	c.s.mu.Unlock()
 	var homeMove *expvar.Int
 	if v {
 		c.s.curHomeClients.Add(1)
@@ -866,17 +1042,12 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 		c.nc.Close()
 
 		// Drain the send queue to count dropped packets
-		for {
-			select {
-			case <-c.sendQueue:
-				c.s.packetsDropped.Add(1)
-				c.s.packetsDroppedGone.Add(1)
-				if debug {
-					c.logf("dropping packet for shutdown %x", c.key)
-				}
-			default:
-				return
-			}
+		n := c.sendQueue.drain()
+		for i := 0; i < n; i++ {
+			c.s.recordDrop(c, dropReasonGone)
+		}
+		if debug && n > 0 {
+			c.logf("dropping %d packets for shutdown %x", n, c.key)
 		}
 	}()
 
@@ -904,8 +1075,11 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 		case <-c.meshUpdate:
 			werr = c.sendMeshUpdates()
 			continue
-		case msg := <-c.sendQueue:
-			werr = c.sendPacket(msg.src, msg.bs)
+		case <-c.sendQueue.ready:
+			werr = c.sendQueuedPacket()
+			continue
+		case data := <-c.sendPongCh:
+			werr = c.sendPong(data)
 			continue
 		case <-keepAliveTick.C:
 			werr = c.sendKeepAlive()
@@ -927,8 +1101,10 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 		case <-c.meshUpdate:
 			werr = c.sendMeshUpdates()
 			continue
-		case msg := <-c.sendQueue:
-			werr = c.sendPacket(msg.src, msg.bs)
+		case <-c.sendQueue.ready:
+			werr = c.sendQueuedPacket()
+		case data := <-c.sendPongCh:
+			werr = c.sendPong(data)
 		case <-keepAliveTick.C:
 			werr = c.sendKeepAlive()
 		}
@@ -945,6 +1121,17 @@ func (c *sclient) sendKeepAlive() error {
 	return writeFrameHeader(c.bw, frameKeepAlive, 0)
 }
 
+// sendPong sends a pong reply, without flushing.
+func (c *sclient) sendPong(data [8]byte) error {
+	c.s.sentPong.Add(1)
+	c.setWriteDeadline()
+	if err := writeFrameHeader(c.bw, framePong, pingLen); err != nil {
+		return err
+	}
+	_, err := c.bw.Write(data[:])
+	return err
+}
+
 // sendPeerGone sends a peerGone frame, without flushing.
 func (c *sclient) sendPeerGone(peer key.Public) error {
 	c.s.peerGoneFrames.Add(1)
@@ -1009,6 +1196,20 @@ func (c *sclient) sendMeshUpdates() error {
 	return nil
 }
 
+// sendQueuedPacket writes the next packet in the client's send
+// queue, if any, without flushing.
+func (c *sclient) sendQueuedPacket() error {
+	p, ok := c.sendQueue.dequeue()
+	if !ok {
+		return nil
+	}
+	src := p.src
+	if c.info.Version < protocolSrcAddrs {
+		src = key.Public{}
+	}
+	return c.sendPacket(src, p.bs)
+}
+
 // sendPacket writes contents to the client in a RecvPacket frame. If
 // srcKey.IsZero, uses the old DERPv1 framing format, otherwise uses
 // DERPv2. The bytes of contents are only valid until this function
@@ -1018,14 +1219,15 @@ func (c *sclient) sendPacket(srcKey key.Public, contents []byte) (err error) {
 	defer func() {
 		// Stats update.
 		if err != nil {
-			c.s.packetsDropped.Add(1)
-			c.s.packetsDroppedWrite.Add(1)
+			c.s.recordDrop(c, dropReasonWriteError)
 			if debug {
 				c.logf("dropping packet to %x: %v", c.key, err)
 			}
 		} else {
 			c.s.packetsSent.Add(1)
 			c.s.bytesSent.Add(int64(len(contents)))
+			c.packetsSent.Add(1)
+			c.bytesSent.Add(int64(len(contents)))
 		}
 	}()
 
@@ -1176,11 +1378,14 @@ func (s *Server) ExpVar() expvar.Var {
 	m.Set("gauge_clients_local", expvar.Func(func() interface{} { return len(s.clients) }))
 	m.Set("gauge_clients_remote", expvar.Func(func() interface{} { return len(s.clientsMesh) - len(s.clients) }))
 	m.Set("accepts", &s.accepts)
+	m.Set("clients_rejected", &s.clientsRejected)
+	m.Set("clients_banned", &s.clientsBanned)
 	m.Set("clients_replaced", &s.clientsReplaced)
 	m.Set("bytes_received", &s.bytesRecv)
 	m.Set("bytes_sent", &s.bytesSent)
 	m.Set("packets_dropped", &s.packetsDropped)
 	m.Set("counter_packets_dropped_reason", &s.packetsDroppedReason)
+	m.Set("counter_send_queue_depth", &s.sendQueueDepth)
 	m.Set("packets_sent", &s.packetsSent)
 	m.Set("packets_received", &s.packetsRecv)
 	m.Set("unknown_frames", &s.unknownFrames)
@@ -1192,6 +1397,8 @@ func (s *Server) ExpVar() expvar.Var {
 	m.Set("multiforwarder_created", &s.multiForwarderCreated)
 	m.Set("multiforwarder_deleted", &s.multiForwarderDeleted)
 	m.Set("packet_forwarder_delete_other_value", &s.removePktForwardOther)
+	m.Set("got_ping", &s.gotPing)
+	m.Set("sent_pong", &s.sentPong)
 	var expvarVersion expvar.String
 	expvarVersion.Set(version.LONG)
 	m.Set("version", &expvarVersion)
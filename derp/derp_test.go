@@ -6,6 +6,7 @@ package derp
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	crand "crypto/rand"
 	"errors"
@@ -434,11 +435,16 @@ func (ts *testServer) close(t *testing.T) error {
 	return nil
 }
 
-func newTestServer(t *testing.T) *testServer {
+// newTestServer returns a new testServer, after calling each of the
+// setup funcs on its Server before it starts serving.
+func newTestServer(t *testing.T, setup ...func(*Server)) *testServer {
 	t.Helper()
 	logf := logger.WithPrefix(t.Logf, "derp-server: ")
 	s := NewServer(newPrivateKey(t), logf)
 	s.SetMeshKey("mesh-key")
+	for _, f := range setup {
+		f(s)
+	}
 	ln, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		t.Fatal(err)
@@ -742,3 +748,319 @@ func TestForwarderRegistration(t *testing.T) {
 		u1: testFwd(3),
 	})
 }
+
+func TestVerifyClient(t *testing.T) {
+	allowed := newPrivateKey(t)
+	ts := newTestServer(t, func(s *Server) {
+		s.SetVerifyClient(Allowlist{allowed.Public(): true}.VerifyClient)
+	})
+	defer ts.close(t)
+
+	dial := func(priv key.Private, opts ...ClientOpt) error {
+		nc, err := net.Dial("tcp", ts.ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer nc.Close()
+		brw := bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))
+		_, err = NewClient(priv, nc, brw, t.Logf, opts...)
+		return err
+	}
+
+	if err := dial(allowed); err != nil {
+		t.Errorf("allowed client: %v", err)
+	}
+	if err := dial(newPrivateKey(t)); err == nil {
+		t.Errorf("unknown client was accepted")
+	}
+	if err := dial(newPrivateKey(t), MeshKey("mesh-key")); err != nil {
+		t.Errorf("mesh peer: %v", err)
+	}
+	if got := ts.s.clientsRejected.Value(); got != 1 {
+		t.Errorf("clientsRejected = %d; want 1", got)
+	}
+}
+
+func TestClientRateLimit(t *testing.T) {
+	ts := newTestServer(t, func(s *Server) {
+		s.SetClientRateLimit(0, 1)
+	})
+	defer ts.close(t)
+
+	c1 := newRegularClient(t, ts, "c1")
+	c2 := newRegularClient(t, ts, "c2")
+
+	// Only the first packet fits in c1's burst of one packet.
+	for i := 0; i < 5; i++ {
+		if err := c1.c.Send(c2.pub, []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, err := c2.c.recvTimeout(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := m.(ReceivedPacket); !ok || string(p.Data) != "\x00" {
+		t.Fatalf("got %#v; want first packet", m)
+	}
+
+	dropped := ts.s.packetsDroppedRateLimit
+	for deadline := time.Now().Add(5 * time.Second); dropped.Value() < 4 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := dropped.Value(); got != 4 {
+		t.Errorf("rate limited drops = %d; want 4", got)
+	}
+}
+
+func TestPing(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close(t)
+
+	c1 := newRegularClient(t, ts, "c1")
+	data := [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	if err := c1.c.SendPing(data); err != nil {
+		t.Fatal(err)
+	}
+	m, err := c1.c.recvTimeout(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pm, ok := m.(PongMessage); !ok || pm != PongMessage(data) {
+		t.Fatalf("got %#v; want pong of %v", m, data)
+	}
+	if got := ts.s.sentPong.Value(); got != 1 {
+		t.Errorf("sentPong = %d; want 1", got)
+	}
+
+	// Servers that predate ping don't get sent one.
+	c1.c.protoVersion = protocolPing - 1
+	if err := c1.c.SendPing(data); err != ErrPingUnsupported {
+		t.Errorf("SendPing to old server = %v; want ErrPingUnsupported", err)
+	}
+}
+
+func TestSendQueue(t *testing.T) {
+	a, b := pubAll(1), pubAll(2)
+	q := newSendQueue(4)
+	for i, src := range []key.Public{a, a, a, b} {
+		if depth, dropped := q.enqueue(pkt{src: src, bs: []byte{byte(i)}}); depth != i || dropped {
+			t.Fatalf("enqueue %d = %v, %v", i, depth, dropped)
+		}
+	}
+	// Full: b's packet pushes out a's oldest, as a has the most.
+	if depth, dropped := q.enqueue(pkt{src: b, bs: []byte{4}}); depth != 4 || !dropped {
+		t.Fatalf("enqueue to full queue = %v, %v", depth, dropped)
+	}
+	var got []byte
+	for {
+		p, ok := q.dequeue()
+		if !ok {
+			break
+		}
+		got = append(got, p.bs[0])
+	}
+	if want := []byte{1, 3, 2, 4}; !bytes.Equal(got, want) {
+		t.Errorf("dequeued %v; want round-robin %v", got, want)
+	}
+	if n := q.len(); n != 0 {
+		t.Errorf("len = %d after dequeuing all", n)
+	}
+}
+
+// TestSendQueueFairness checks that a client flooding another
+// doesn't crowd out a third client's packets to it.
+func TestSendQueueFairness(t *testing.T) {
+	s := NewServer(newPrivateKey(t), t.Logf)
+	defer s.Close()
+
+	newClient := func(name string, k key.Private) (*Client, nettest.Conn) {
+		t.Helper()
+		c1, c2 := nettest.NewConn(name, 1024)
+		go s.Accept(c1, bufio.NewReadWriter(bufio.NewReader(c1), bufio.NewWriter(c1)), name)
+
+		brw := bufio.NewReadWriter(bufio.NewReader(c2), bufio.NewWriter(c2))
+		c, err := NewClient(k, c2, brw, t.Logf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c, c2
+	}
+	busyKey, quietKey, dstKey := newPrivateKey(t), newPrivateKey(t), newPrivateKey(t)
+	busy, _ := newClient("busy", busyKey)
+	quiet, _ := newClient("quiet", quietKey)
+	dst, dstConn := newClient("dst", dstKey)
+
+	// Stop dst reading, so its queue on the server backs up. The
+	// server gives up on writes after writeTimeout, so the rest of
+	// the test must be quicker than that.
+	dstConn.SetReadBlock(true)
+
+	const numBusy, numQuiet = 300, 5
+	send := func(c *Client, n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			if err := c.Send(dstKey.Public(), []byte{byte(i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	send(busy, numBusy)
+	send(quiet, numQuiet)
+	send(busy, numBusy)
+
+	// Wait for the server to have queued or dropped them all.
+	for deadline := time.Now().Add(time.Second); ; {
+		recv := map[key.Public]int64{}
+		for _, cs := range s.Clients() {
+			recv[cs.Key] = cs.PacketsRecv
+		}
+		if recv[busyKey.Public()] == 2*numBusy && recv[quietKey.Public()] == numQuiet {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server received %v packets", recv)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	dstConn.SetReadBlock(false)
+	for gotQuiet := 0; gotQuiet < numQuiet; {
+		m, err := dst.recvTimeout(time.Second)
+		if err != nil {
+			t.Fatalf("got %d of %d packets from quiet client: %v", gotQuiet, numQuiet, err)
+		}
+		if p, ok := m.(ReceivedPacket); ok && p.Source == quietKey.Public() {
+			gotQuiet++
+		}
+	}
+
+	if got := s.packetsDroppedQueueHead.Value(); got == 0 {
+		t.Errorf("no queue_head drops")
+	}
+	for _, cs := range s.Clients() {
+		if cs.Key == dstKey.Public() && cs.PacketsDropped["queue_head"] == 0 {
+			t.Errorf("dst status = %+v; want queue_head drops", cs)
+		}
+	}
+	if got := s.sendQueueDepthBy[perClientSendQueueDepth].Value(); got == 0 {
+		t.Errorf("send queue depth histogram has no full queues")
+	}
+}
+
+// newPipeClient connects a client with key priv to s over an
+// in-memory net.Pipe.
+func newPipeClient(t *testing.T, s *Server, priv key.Private, remoteAddr string) (*Client, error) {
+	cc, sc := net.Pipe()
+	go s.Accept(sc, bufio.NewReadWriter(bufio.NewReader(sc), bufio.NewWriter(sc)), remoteAddr)
+	brw := bufio.NewReadWriter(bufio.NewReader(cc), bufio.NewWriter(cc))
+	c, err := NewClient(priv, cc, brw, t.Logf)
+	if err != nil {
+		cc.Close()
+	}
+	return c, err
+}
+
+func TestClientAdmin(t *testing.T) {
+	s := NewServer(newPrivateKey(t), t.Logf)
+	defer s.Close()
+
+	k1, k2 := newPrivateKey(t), newPrivateKey(t)
+	c1, err := newPipeClient(t, s, k1, "pipe-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := newPipeClient(t, s, k2, "pipe-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c1.NotePreferred(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := c1.Send(k2.Public(), []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := c2.recvTimeout(time.Second); err != nil {
+		t.Fatal(err)
+	} else if _, ok := m.(ReceivedPacket); !ok {
+		t.Fatalf("got %#v; want ReceivedPacket", m)
+	}
+
+	// The preferred frame is handled before the packet that
+	// followed it, which c2 has received.
+	byKey := map[key.Public]ClientStatus{}
+	for _, cs := range s.Clients() {
+		byKey[cs.Key] = cs
+	}
+	if len(byKey) != 2 {
+		t.Fatalf("Clients = %+v; want 2", byKey)
+	}
+	cs1, cs2 := byKey[k1.Public()], byKey[k2.Public()]
+	if cs1.RemoteAddr != "pipe-1" || !cs1.Preferred || cs1.PacketsRecv != 1 || cs1.BytesRecv != 5 {
+		t.Errorf("c1 status = %+v", cs1)
+	}
+	if cs2.Preferred || cs2.PacketsSent != 1 || cs2.BytesSent != 5 || len(cs2.PacketsDropped) != 0 {
+		t.Errorf("c2 status = %+v", cs2)
+	}
+
+	if s.CloseClient(newPrivateKey(t).Public()) {
+		t.Errorf("CloseClient of unknown key = true")
+	}
+	if !s.CloseClient(k2.Public()) {
+		t.Errorf("CloseClient(c2) = false")
+	}
+	if _, err := c2.recvTimeout(time.Second); err == nil {
+		t.Errorf("c2 still connected after CloseClient")
+	}
+
+	s.BanClient(k1.Public(), time.Hour)
+	if _, err := c1.recvTimeout(time.Second); err == nil {
+		t.Errorf("c1 still connected after BanClient")
+	}
+	if bans := s.Bans(); len(bans) != 1 || bans[0].Key != k1.Public() {
+		t.Errorf("Bans = %+v; want c1", bans)
+	}
+	if _, err := newPipeClient(t, s, k1, "pipe-3"); err == nil {
+		t.Errorf("banned client reconnected")
+	}
+	if got := s.clientsBanned.Value(); got != 1 {
+		t.Errorf("clientsBanned = %d; want 1", got)
+	}
+	if !s.UnbanClient(k1.Public()) {
+		t.Errorf("UnbanClient(c1) = false")
+	}
+	if _, err := newPipeClient(t, s, k1, "pipe-4"); err != nil {
+		t.Errorf("unbanned client: %v", err)
+	}
+
+	// Bans expire.
+	s.BanClient(k2.Public(), time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	if bans := s.Bans(); len(bans) != 0 {
+		t.Errorf("Bans = %+v; want none", bans)
+	}
+	if _, err := newPipeClient(t, s, k2, "pipe-5"); err != nil {
+		t.Errorf("client with expired ban: %v", err)
+	}
+}
+
+func TestParseAllowlist(t *testing.T) {
+	k1, k2 := pubAll(1), pubAll(2)
+	k2b64, _ := k2.MarshalText()
+	in := fmt.Sprintf("# comment\n%x\n\n  %s  \n", k1[:], k2b64)
+	a, err := parseAllowlist([]byte(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Allowlist{k1: true, k2: true}); !reflect.DeepEqual(a, want) {
+		t.Errorf("got %v; want %v", a, want)
+	}
+	if err := a.VerifyClient(pubAll(3)); err == nil {
+		t.Errorf("VerifyClient of unlisted key succeeded")
+	}
+
+	if _, err := parseAllowlist([]byte("not-a-key\n")); err == nil {
+		t.Errorf("invalid key parsed without error")
+	}
+}
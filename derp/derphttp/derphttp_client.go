@@ -13,7 +13,9 @@ package derphttp
 import (
 	"bufio"
 	"context"
+	crand "crypto/rand"
 	"crypto/tls"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
@@ -45,6 +47,23 @@ type Client struct {
 	DNSCache  *dnscache.Resolver // optional; nil means no caching
 	MeshKey   string             // optional; for trusted clients
 
+	// Proxy optionally returns the HTTP proxy to tunnel the
+	// connection through with CONNECT, given a request for the DERP
+	// server's URL. If nil, http.ProxyFromEnvironment is used.
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// WebSocket, if true, frames DERP in WebSocket binary messages,
+	// for networks that let WebSockets through but not other
+	// upgraded HTTP connections.
+	WebSocket bool
+
+	// ClientCertFile and ClientKeyFile optionally name the PEM
+	// files of a TLS client certificate and its key, presented to
+	// servers that ask for one. They're read at each handshake,
+	// so that renewed certificates are picked up.
+	ClientCertFile string
+	ClientKeyFile  string
+
 	privateKey key.Private
 	logf       logger.Logf
 
@@ -62,6 +81,10 @@ type Client struct {
 	client       *derp.Client
 	connGen      int // incremented once per new connection; valid values are >0
 	serverPubKey key.Public
+
+	// pingOut are the outstanding pings, keyed by the pong that
+	// answers each. Guarded by mu.
+	pingOut map[derp.PongMessage]chan struct{}
 }
 
 // NewRegionClient returns a new DERP-over-HTTP client. It connects lazily.
@@ -123,6 +146,15 @@ func (c *Client) ServerPublicKey() key.Public {
 	return c.serverPubKey
 }
 
+// String returns a description of c: the URL it connects to, or
+// that it connects to a region.
+func (c *Client) String() string {
+	if c.url != nil {
+		return "derphttp.Client(" + c.url.String() + ")"
+	}
+	return "derphttp.Client(region)"
+}
+
 func urlPort(u *url.URL) string {
 	if p := u.Port(); p != "" {
 		return p
@@ -265,7 +297,18 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 	if err != nil {
 		return nil, 0, err
 	}
-	req.Header.Set("Upgrade", "DERP")
+	var wsKey string
+	if c.WebSocket {
+		if wsKey, err = newWebSocketKey(); err != nil {
+			return nil, 0, err
+		}
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Sec-WebSocket-Key", wsKey)
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		req.Header.Set("Sec-WebSocket-Protocol", webSocketProtocol)
+	} else {
+		req.Header.Set("Upgrade", "DERP")
+	}
 	req.Header.Set("Connection", "Upgrade")
 
 	if err := req.Write(brw); err != nil {
@@ -284,6 +327,14 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 		resp.Body.Close()
 		return nil, 0, fmt.Errorf("GET failed: %v: %s", err, b)
 	}
+	if c.WebSocket {
+		if err := checkWebSocketResponse(resp, wsKey); err != nil {
+			return nil, 0, err
+		}
+		wc := newWSConn(httpConn, brw.Reader, true)
+		httpConn = wc
+		brw = bufio.NewReadWriter(bufio.NewReader(wc), bufio.NewWriter(wc))
+	}
 
 	derpClient, err := derp.NewClient(c.privateKey, httpConn, brw, c.logf, derp.MeshKey(c.MeshKey))
 	if err != nil {
@@ -307,6 +358,14 @@ func (c *Client) dialURL(ctx context.Context) (net.Conn, error) {
 	host := c.url.Hostname()
 	hostOrIP := host
 
+	proxyURL, err := c.proxyURL(host, urlPort(c.url))
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL != nil {
+		return c.dialViaProxy(ctx, proxyURL, net.JoinHostPort(host, urlPort(c.url)))
+	}
+
 	dialer := netns.NewDialer()
 
 	if c.DNSCache != nil {
@@ -360,10 +419,22 @@ func (c *Client) tlsClient(nc net.Conn, node *tailcfg.DERPNode) *tls.Conn {
 		if node.DERPTestPort != 0 {
 			tlsConf.InsecureSkipVerify = true
 		}
-		if node.CertName != "" {
+		if node.CertPubKeySHA256 != "" {
+			tlsdial.SetConfigExpectedCertPubKey(tlsConf, node.CertPubKeySHA256)
+		} else if node.CertName != "" {
 			tlsdial.SetConfigExpectedCert(tlsConf, node.CertName)
 		}
 	}
+	if c.ClientCertFile != "" {
+		certFile, keyFile := c.ClientCertFile, c.ClientKeyFile
+		tlsConf.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return nil, fmt.Errorf("derphttp: loading client certificate: %v", err)
+			}
+			return &cert, nil
+		}
+	}
 	return tls.Client(nc, tlsConf)
 }
 
@@ -399,6 +470,85 @@ func (c *Client) dialContext(ctx context.Context, proto, addr string) (net.Conn,
 	return netns.NewDialer().DialContext(ctx, proto, addr)
 }
 
+// proxyURL returns the HTTP proxy to use to reach the DERP server at
+// host and port, or nil to dial it directly.
+func (c *Client) proxyURL(host, port string) (*url.URL, error) {
+	proxy := c.Proxy
+	if proxy == nil {
+		proxy = http.ProxyFromEnvironment
+	}
+	scheme := "https"
+	if !c.useHTTPS() {
+		scheme = "http"
+	}
+	req, err := http.NewRequest("GET", scheme+"://"+net.JoinHostPort(host, port)+"/derp", nil)
+	if err != nil {
+		return nil, err
+	}
+	u, err := proxy(req)
+	if err != nil {
+		return nil, fmt.Errorf("finding proxy: %v", err)
+	}
+	return u, nil
+}
+
+// dialViaProxy returns a connection to target ("host:port") tunneled
+// through an HTTP CONNECT request to the proxy at proxyURL. Any
+// username and password in proxyURL are sent as basic auth.
+func (c *Client) dialViaProxy(ctx context.Context, proxyURL *url.URL, target string) (_ net.Conn, err error) {
+	port := urlPort(proxyURL)
+	if port == "" {
+		return nil, fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+	}
+	proxyAddr := net.JoinHostPort(proxyURL.Hostname(), port)
+	conn, err := c.dialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("dial of proxy %v: %v", proxyAddr, err)
+	}
+	defer func() {
+		if err != nil {
+			conn.Close()
+		}
+	}()
+	if proxyURL.Scheme == "https" {
+		conn = tls.Client(conn, tlsdial.Config(proxyURL.Hostname(), nil))
+	}
+	if d, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(d)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	if u := proxyURL.User; u != nil {
+		pass, _ := u.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("proxy %v: %v", proxyAddr, err)
+	}
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, fmt.Errorf("proxy %v: %v", proxyAddr, err)
+	}
+	if res.StatusCode != 200 {
+		res.Body.Close()
+		return nil, fmt.Errorf("proxy %v: CONNECT to %v: %v", proxyAddr, target, res.Status)
+	}
+	if br.Buffered() > 0 {
+		// The server speaks first neither in TLS nor in HTTP, so
+		// this is a confused proxy.
+		return nil, fmt.Errorf("proxy %v: unexpected data after CONNECT response", proxyAddr)
+	}
+	return conn, nil
+}
+
 // shouldDialProto reports whether an explicitly provided IPv4 or IPv6
 // address (given in s) is valid. An empty value means to dial, but to
 // use DNS. The predicate function reports whether the non-empty
@@ -420,6 +570,20 @@ const dialNodeTimeout = 1500 * time.Millisecond
 // TODO(bradfitz): longer if no options remain perhaps? ...  Or longer
 // overall but have dialRegion start overlapping races?
 func (c *Client) dialNode(ctx context.Context, n *tailcfg.DERPNode) (net.Conn, error) {
+	port := "443"
+	if n.DERPTestPort != 0 {
+		port = fmt.Sprint(n.DERPTestPort)
+	}
+	proxyURL, err := c.proxyURL(n.HostName, port)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL != nil {
+		// The proxy resolves the name and picks the address
+		// family, and it may well be slower than dialNodeTimeout.
+		return c.dialViaProxy(ctx, proxyURL, net.JoinHostPort(n.HostName, port))
+	}
+
 	type res struct {
 		c   net.Conn
 		err error
@@ -436,10 +600,6 @@ func (c *Client) dialNode(ctx context.Context, n *tailcfg.DERPNode) (net.Conn, e
 			if dst == "" {
 				dst = n.HostName
 			}
-			port := "443"
-			if n.DERPTestPort != 0 {
-				port = fmt.Sprint(n.DERPTestPort)
-			}
 			c, err := c.dialContext(ctx, proto, net.JoinHostPort(dst, port))
 			select {
 			case resc <- res{c, err}:
@@ -561,16 +721,91 @@ func (c *Client) Recv() (derp.ReceivedMessage, error) {
 
 // RecvDetail is like Recv, but additional returns the connection generation on each message.
 // The connGen value is incremented every time the derphttp.Client reconnects to the server.
+//
+// Pings from the server and pongs for Ping are handled internally and
+// not returned.
 func (c *Client) RecvDetail() (m derp.ReceivedMessage, connGen int, err error) {
-	client, connGen, err := c.connect(context.TODO(), "derphttp.Client.Recv")
-	if err != nil {
-		return nil, 0, err
+	for {
+		client, connGen, err := c.connect(context.TODO(), "derphttp.Client.Recv")
+		if err != nil {
+			return nil, 0, err
+		}
+		m, err = client.Recv()
+		if err != nil {
+			c.closeForReconnect(client)
+			return m, connGen, err
+		}
+		switch m := m.(type) {
+		case derp.PingMessage:
+			if err := client.SendPong(m); err != nil {
+				c.closeForReconnect(client)
+				return nil, connGen, err
+			}
+			continue
+		case derp.PongMessage:
+			c.notePong(m)
+			continue
+		}
+		return m, connGen, nil
 	}
-	m, err = client.Recv()
+}
+
+// Ping sends a ping to the server and waits for its pong, returning
+// the round-trip time. The pong is read by Recv, so a concurrent
+// Recv loop is required. If ctx is done before the pong arrives, the
+// connection is presumed dead and is closed, so the next use
+// reconnects.
+//
+// If the server is too old to answer pings, Ping returns
+// derp.ErrPingUnsupported.
+func (c *Client) Ping(ctx context.Context) (time.Duration, error) {
+	client, _, err := c.connect(ctx, "derphttp.Client.Ping")
 	if err != nil {
+		return 0, err
+	}
+	var data [8]byte
+	if _, err := crand.Read(data[:]); err != nil {
+		return 0, err
+	}
+	pong := make(chan struct{}) // closed by notePong
+	c.mu.Lock()
+	if c.pingOut == nil {
+		c.pingOut = make(map[derp.PongMessage]chan struct{})
+	}
+	c.pingOut[derp.PongMessage(data)] = pong
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pingOut, derp.PongMessage(data))
+		c.mu.Unlock()
+	}()
+
+	start := time.Now()
+	if err := client.SendPing(data); err != nil {
+		if err != derp.ErrPingUnsupported {
+			c.closeForReconnect(client)
+		}
+		return 0, err
+	}
+	select {
+	case <-pong:
+		return time.Since(start), nil
+	case <-c.ctx.Done():
+		return 0, ErrClientClosed
+	case <-ctx.Done():
 		c.closeForReconnect(client)
+		return 0, ctx.Err()
+	}
+}
+
+// notePong wakes up the Ping waiting for m, if any.
+func (c *Client) notePong(m derp.PongMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ch, ok := c.pingOut[m]; ok {
+		close(ch)
+		delete(c.pingOut, m)
 	}
-	return m, connGen, err
 }
 
 // Close closes the client. It will not automatically reconnect after
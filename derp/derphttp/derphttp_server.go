@@ -5,6 +5,7 @@
 package derphttp
 
 import (
+	"bufio"
 	"log"
 	"net/http"
 
@@ -13,6 +14,10 @@ import (
 
 func Handler(s *derp.Server) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isWebSocketUpgrade(r) {
+			serveWebSocket(s, w, r)
+			return
+		}
 		if p := r.Header.Get("Upgrade"); p != "WebSocket" && p != "DERP" {
 			http.Error(w, "DERP requires connection upgrade", http.StatusUpgradeRequired)
 			return
@@ -35,3 +40,28 @@ func Handler(s *derp.Server) http.Handler {
 		s.Accept(netConn, conn, netConn.RemoteAddr().String())
 	})
 }
+
+// serveWebSocket accepts a DERP connection whose bytes are framed in
+// WebSocket binary messages.
+func serveWebSocket(s *derp.Server, w http.ResponseWriter, r *http.Request) {
+	h, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "HTTP does not support general TCP support", 500)
+		return
+	}
+	w.Header().Set("Upgrade", "websocket")
+	w.Header().Set("Connection", "Upgrade")
+	w.Header().Set("Sec-WebSocket-Accept", webSocketAccept(r.Header.Get("Sec-WebSocket-Key")))
+	w.Header().Set("Sec-WebSocket-Protocol", webSocketProtocol)
+	w.WriteHeader(http.StatusSwitchingProtocols)
+
+	netConn, conn, err := h.Hijack()
+	if err != nil {
+		log.Printf("Hijack failed: %v", err)
+		http.Error(w, "HTTP does not support general TCP support", 500)
+		return
+	}
+	wc := newWSConn(netConn, conn.Reader, false)
+	brw := bufio.NewReadWriter(bufio.NewReader(wc), bufio.NewWriter(wc))
+	s.Accept(wc, brw, netConn.RemoteAddr().String())
+}
@@ -5,12 +5,27 @@
 package derphttp
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	crand "crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -148,3 +163,371 @@ func TestSendRecv(t *testing.T) {
 	recvNothing(1)
 
 }
+
+// newTestServer starts a DERP-over-HTTP server and returns its URL.
+func newTestServer(t *testing.T) (serverURL string, cleanup func()) {
+	t.Helper()
+	var serverPrivateKey key.Private
+	if _, err := crand.Read(serverPrivateKey[:]); err != nil {
+		t.Fatal(err)
+	}
+	s := derp.NewServer(serverPrivateKey, t.Logf)
+	httpsrv := httptest.NewServer(Handler(s))
+	return httpsrv.URL, func() {
+		s.Close()
+		httpsrv.Close()
+	}
+}
+
+// testSendOne connects two clients to serverURL, configured by
+// configure, and checks that a packet gets from one to the other.
+func testSendOne(t *testing.T, serverURL string, configure func(*Client)) {
+	t.Helper()
+	var keys [2]key.Private
+	var clients [2]*Client
+	for i := range clients {
+		if _, err := crand.Read(keys[i][:]); err != nil {
+			t.Fatal(err)
+		}
+		c, err := NewClient(keys[i], serverURL, t.Logf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		configure(c)
+		defer c.Close()
+		if err := c.Connect(context.Background()); err != nil {
+			t.Fatalf("client %d Connect: %v", i, err)
+		}
+		clients[i] = c
+	}
+
+	// Big enough to need a 16-bit WebSocket frame length.
+	msg := bytes.Repeat([]byte("hello 0->1\n"), 100)
+	if err := clients[0].Send(keys[1].Public(), msg); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		m, err := clients[1].Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p, ok := m.(derp.ReceivedPacket); ok {
+			if !bytes.Equal(p.Data, msg) {
+				t.Errorf("got %q, want %q", p.Data, msg)
+			}
+			if p.Source != keys[0].Public() {
+				t.Errorf("source = %v, want %v", p.Source, keys[0].Public())
+			}
+			return
+		}
+	}
+}
+
+func TestSendRecvWebSocket(t *testing.T) {
+	serverURL, cleanup := newTestServer(t)
+	defer cleanup()
+	testSendOne(t, serverURL, func(c *Client) { c.WebSocket = true })
+}
+
+func TestWebSocketUpgradeRejected(t *testing.T) {
+	// A server that speaks raw DERP even when asked for WebSockets
+	// must not be mistaken for a WebSocket server.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Upgrade", "DERP")
+		w.Header().Set("Connection", "Upgrade")
+		w.WriteHeader(http.StatusSwitchingProtocols)
+	}))
+	defer srv.Close()
+
+	var k key.Private
+	c, err := NewClient(k, srv.URL, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.WebSocket = true
+	if err := c.Connect(context.Background()); err == nil {
+		t.Fatal("Connect succeeded; want error")
+	}
+}
+
+// connectProxy is an HTTP CONNECT proxy that requires basic auth.
+type connectProxy struct {
+	user, pass string
+	conns      int32 // atomic; number of tunnels made
+}
+
+func (p *connectProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "CONNECT" {
+		http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Header.Set("Authorization", r.Header.Get("Proxy-Authorization"))
+	if user, pass, ok := r.BasicAuth(); !ok || user != p.user || pass != p.pass {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="test"`)
+		http.Error(w, "bad auth", http.StatusProxyAuthRequired)
+		return
+	}
+	dst, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	src, brw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		dst.Close()
+		return
+	}
+	atomic.AddInt32(&p.conns, 1)
+	io.WriteString(src, "HTTP/1.1 200 Connection established\r\n\r\n")
+	go func() {
+		io.Copy(dst, brw)
+		dst.Close()
+	}()
+	io.Copy(src, dst)
+	src.Close()
+}
+
+func TestSendRecvViaProxy(t *testing.T) {
+	serverURL, cleanup := newTestServer(t)
+	defer cleanup()
+
+	p := &connectProxy{user: "alice", pass: "s3cret"}
+	proxySrv := httptest.NewServer(p)
+	defer proxySrv.Close()
+	proxyURL, err := url.Parse(proxySrv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyURL.User = url.UserPassword(p.user, p.pass)
+
+	for _, ws := range []bool{false, true} {
+		testSendOne(t, serverURL, func(c *Client) {
+			c.Proxy = http.ProxyURL(proxyURL)
+			c.WebSocket = ws
+		})
+	}
+	if got, want := atomic.LoadInt32(&p.conns), int32(4); got != want {
+		t.Errorf("proxy made %d tunnels, want %d", got, want)
+	}
+}
+
+func TestProxyAuthFailure(t *testing.T) {
+	serverURL, cleanup := newTestServer(t)
+	defer cleanup()
+
+	proxySrv := httptest.NewServer(&connectProxy{user: "alice", pass: "s3cret"})
+	defer proxySrv.Close()
+	proxyURL, err := url.Parse(proxySrv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyURL.User = url.UserPassword("alice", "wrong")
+
+	var k key.Private
+	c, err := NewClient(k, serverURL, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Proxy = http.ProxyURL(proxyURL)
+	if err := c.Connect(context.Background()); err == nil {
+		t.Fatal("Connect succeeded; want error")
+	}
+}
+
+// writeClientCert writes a CA-signed TLS client certificate and its
+// key to dir, and returns the CA's pool and the files' paths.
+func writeClientCert(t *testing.T, dir string) (pool *x509.CertPool, certFile, keyFile string) {
+	t.Helper()
+	newCert := func(tmpl, parent *x509.Certificate, signer *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parent == nil {
+			parent, signer = tmpl, priv
+		}
+		der, err := x509.CreateCertificate(crand.Reader, tmpl, parent, &priv.PublicKey, signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert, priv
+	}
+	ca, caKey := newCert(&x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}, nil, nil)
+	cert, key := newCert(&x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "test client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(dir, "client.crt")
+	keyFile = filepath.Join(dir, "client.key")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	pool = x509.NewCertPool()
+	pool.AddCert(ca)
+	return pool, certFile, keyFile
+}
+
+func TestClientCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "derphttp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pool, certFile, keyFile := writeClientCert(t, dir)
+
+	var serverPrivateKey key.Private
+	if _, err := crand.Read(serverPrivateKey[:]); err != nil {
+		t.Fatal(err)
+	}
+	s := derp.NewServer(serverPrivateKey, t.Logf)
+	defer s.Close()
+	srv := httptest.NewUnstartedServer(Handler(s))
+	srv.Config.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	srv.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  pool,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	var k key.Private
+	c, err := NewClient(k, srv.URL, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	if err := c.Connect(context.Background()); err == nil {
+		t.Fatal("Connect without a client certificate succeeded; want error")
+	}
+
+	testSendOne(t, srv.URL, func(c *Client) {
+		c.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+		c.ClientCertFile = certFile
+		c.ClientKeyFile = keyFile
+	})
+}
+
+func TestWSConn(t *testing.T) {
+	cc, sc := net.Pipe()
+	client := newWSConn(cc, nil, true)
+	server := newWSConn(sc, nil, false)
+	defer client.Close()
+	defer server.Close()
+
+	big := make([]byte, 70000) // needs a 64-bit frame length
+	if _, err := crand.Read(big); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		client.Write([]byte("small"))
+		client.writeFrame(wsOpPing, []byte("ping"))
+		client.Write(big)
+		client.Write(nil)
+		client.Write(big[:300])
+	}()
+
+	// Server side: read everything back through a bufio.Reader, the
+	// way derp.Server does.
+	br := bufio.NewReader(server)
+	want := append(append([]byte("small"), big...), big[:300]...)
+	got := make([]byte, len(want))
+	errc := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(br, got)
+		errc <- err
+	}()
+
+	// The client must see the pong for its ping, and nothing else.
+	pongc := make(chan error, 1)
+	go func() {
+		var hdr [2]byte
+		_, err := io.ReadFull(client.br, hdr[:])
+		if err == nil && (hdr[0] != 0x80|wsOpPong || hdr[1] != 4) {
+			err = io.ErrUnexpectedEOF
+		}
+		pongc <- err
+	}()
+
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("payload mismatch")
+	}
+	if err := <-pongc; err != nil {
+		t.Fatalf("pong: %v", err)
+	}
+}
+
+func TestPing(t *testing.T) {
+	serverURL, cleanup := newTestServer(t)
+	defer cleanup()
+
+	var k key.Private
+	if _, err := crand.Read(k[:]); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewClient(k, serverURL, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Without anybody reading, the pong never arrives and the
+	// connection is dropped.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := c.Ping(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Ping without Recv = %v; want deadline exceeded", err)
+	}
+	_, gen1, _ := c.connect(context.Background(), "test")
+
+	go func() {
+		for {
+			if _, err := c.Recv(); err == ErrClientClosed {
+				return
+			}
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		rtt, err := c.Ping(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rtt <= 0 {
+			t.Errorf("rtt = %v; want positive", rtt)
+		}
+	}
+	if _, gen2, _ := c.connect(context.Background(), "test"); gen2 != gen1 {
+		t.Errorf("reconnected during successful pings")
+	}
+}
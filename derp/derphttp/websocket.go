@@ -0,0 +1,283 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package derphttp
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// This file implements just enough of WebSockets (RFC 6455) to carry
+// the DERP byte stream in binary messages, for networks whose
+// middleboxes pass WebSockets but nothing else.
+
+// webSocketProtocol is the WebSocket subprotocol name used for DERP.
+const webSocketProtocol = "derp"
+
+// webSocketGUID is the magic value from RFC 6455 section 1.3.
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes.
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+)
+
+// wsMaxControlPayload is the largest payload a control frame may have.
+const wsMaxControlPayload = 125
+
+var errWebSocketProtocol = errors.New("websocket: protocol error")
+
+// webSocketAccept returns the Sec-WebSocket-Accept value for the
+// Sec-WebSocket-Key value key.
+func webSocketAccept(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+webSocketGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// newWebSocketKey returns a new random Sec-WebSocket-Key value.
+func newWebSocketKey() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b[:]), nil
+}
+
+// headerHasToken reports whether the comma-separated header values
+// of h[key] contain token, ignoring case.
+func headerHasToken(h http.Header, key, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(key)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isWebSocketUpgrade reports whether r asks for DERP framed in
+// WebSocket messages, rather than the raw DERP stream that some
+// clients request with "Upgrade: WebSocket" to look like one.
+func isWebSocketUpgrade(r *http.Request) bool {
+	return headerHasToken(r.Header, "Upgrade", "websocket") &&
+		r.Header.Get("Sec-WebSocket-Key") != "" &&
+		headerHasToken(r.Header, "Sec-WebSocket-Protocol", webSocketProtocol)
+}
+
+// wsConn is a net.Conn that carries a byte stream in binary WebSocket
+// messages.
+//
+// Close closes the underlying connection without sending a close
+// frame first, as that write could block behind a stuck Write.
+type wsConn struct {
+	net.Conn
+	br       *bufio.Reader // reads from Conn
+	isClient bool          // whether to mask outgoing frames
+
+	writeMu sync.Mutex // serializes frame writes
+
+	// Read state; only accessed from Read.
+	remain  int64   // unread payload bytes of the current data frame
+	mask    [4]byte // mask of the current data frame
+	masked  bool
+	maskPos int
+	readErr error
+}
+
+// newWSConn returns a WebSocket connection over c. br, if non-nil,
+// is a reader of c that may have buffered data already.
+func newWSConn(c net.Conn, br *bufio.Reader, isClient bool) *wsConn {
+	if br == nil {
+		br = bufio.NewReader(c)
+	}
+	return &wsConn{Conn: c, br: br, isClient: isClient}
+}
+
+// Read reads payload bytes of binary messages, answering pings and
+// skipping pongs along the way. A close frame reads as io.EOF.
+func (c *wsConn) Read(p []byte) (n int, err error) {
+	if c.readErr != nil {
+		return 0, c.readErr
+	}
+	for c.remain == 0 {
+		if err := c.readFrameHeader(); err != nil {
+			c.readErr = err
+			return 0, err
+		}
+	}
+	if int64(len(p)) > c.remain {
+		p = p[:c.remain]
+	}
+	n, err = c.br.Read(p)
+	if c.masked {
+		for i := range p[:n] {
+			p[i] ^= c.mask[c.maskPos&3]
+			c.maskPos++
+		}
+	}
+	c.remain -= int64(n)
+	if err != nil {
+		c.readErr = err
+	}
+	return n, err
+}
+
+// readFrameHeader reads frames until it finds the header of a data
+// frame with a non-empty payload, whose state it stores in c.
+func (c *wsConn) readFrameHeader() error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+		return err
+	}
+	fin := hdr[0]&0x80 != 0
+	op := hdr[0] & 0x0f
+	masked := hdr[1]&0x80 != 0
+	length := int64(hdr[1] & 0x7f)
+	if hdr[0]&0x70 != 0 {
+		return errWebSocketProtocol // reserved bits; no extensions negotiated
+	}
+	if masked == c.isClient {
+		// Clients must mask; servers must not.
+		return errWebSocketProtocol
+	}
+	switch length {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(c.br, b[:]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(c.br, b[:]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint64(b[:]))
+		if length < 0 {
+			return errWebSocketProtocol
+		}
+	}
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+			return err
+		}
+	}
+
+	switch op {
+	case wsOpBinary, wsOpContinuation:
+		c.remain, c.mask, c.masked, c.maskPos = length, mask, masked, 0
+		return nil
+	case wsOpText:
+		return errWebSocketProtocol
+	}
+
+	// Control frame.
+	if !fin || length > wsMaxControlPayload {
+		return errWebSocketProtocol
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i&3]
+		}
+	}
+	switch op {
+	case wsOpPing:
+		if err := c.writeFrame(wsOpPong, payload); err != nil {
+			return err
+		}
+	case wsOpPong:
+	case wsOpClose:
+		c.writeFrame(wsOpClose, nil)
+		return io.EOF
+	default:
+		return errWebSocketProtocol
+	}
+	return nil
+}
+
+// Write writes p as one binary message.
+func (c *wsConn) Write(p []byte) (n int, err error) {
+	if err := c.writeFrame(wsOpBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	buf := make([]byte, 0, 14+len(payload))
+	buf = append(buf, 0x80|op) // FIN
+	var maskBit byte
+	if c.isClient {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n <= 125:
+		buf = append(buf, maskBit|byte(n))
+	case n <= 0xffff:
+		buf = append(buf, maskBit|126, byte(n>>8), byte(n))
+	default:
+		buf = append(buf, maskBit|127)
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], uint64(n))
+		buf = append(buf, b[:]...)
+	}
+	if c.isClient {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		buf = append(buf, mask[:]...)
+		for i, b := range payload {
+			buf = append(buf, b^mask[i&3])
+		}
+	} else {
+		buf = append(buf, payload...)
+	}
+	_, err := c.Conn.Write(buf)
+	return err
+}
+
+// checkWebSocketResponse checks that res accepts the WebSocket
+// upgrade request sent with Sec-WebSocket-Key key.
+func checkWebSocketResponse(res *http.Response, key string) error {
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		return fmt.Errorf("websocket upgrade failed: %v", res.Status)
+	}
+	if !headerHasToken(res.Header, "Upgrade", "websocket") {
+		return fmt.Errorf("websocket upgrade failed: Upgrade %q", res.Header.Get("Upgrade"))
+	}
+	if got, want := res.Header.Get("Sec-WebSocket-Accept"), webSocketAccept(key); got != want {
+		return fmt.Errorf("websocket upgrade failed: Sec-WebSocket-Accept %q, want %q", got, want)
+	}
+	if !headerHasToken(res.Header, "Sec-WebSocket-Protocol", webSocketProtocol) {
+		return errors.New("websocket upgrade failed: server didn't select the derp subprotocol")
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package derp
+
+import (
+	"sync"
+
+	"tailscale.com/types/key"
+)
+
+// sendQueue is the queue of packets waiting to be written to one
+// client. It's fair among the sources of the packets: they're
+// dequeued round-robin by source, and when the queue is full, the
+// source with the most packets queued loses its oldest one. That
+// way one busy sender can't starve the others sending to the same
+// client.
+type sendQueue struct {
+	max int
+
+	// ready has a value when the queue may be non-empty. It's
+	// buffered, so it can be in a select alongside the client's
+	// other work.
+	ready chan struct{}
+
+	mu    sync.Mutex
+	bySrc map[key.Public][]pkt
+	order []key.Public // sources with packets queued, in dequeue order
+	n     int          // total packets queued
+}
+
+func newSendQueue(max int) *sendQueue {
+	return &sendQueue{
+		max:   max,
+		ready: make(chan struct{}, 1),
+		bySrc: map[key.Public][]pkt{},
+	}
+}
+
+// enqueue adds p to the queue of its source, p.src. It returns the
+// number of packets that were queued ahead of p, and whether another
+// packet was dropped to make room for it.
+func (q *sendQueue) enqueue(p pkt) (depth int, dropped bool) {
+	q.mu.Lock()
+	depth = q.n
+	if q.n >= q.max {
+		q.dropFromLongestLocked()
+		dropped = true
+	}
+	if len(q.bySrc[p.src]) == 0 {
+		q.order = append(q.order, p.src)
+	}
+	q.bySrc[p.src] = append(q.bySrc[p.src], p)
+	q.n++
+	q.mu.Unlock()
+
+	q.signal()
+	return depth, dropped
+}
+
+// dropFromLongestLocked drops the oldest packet of the source with
+// the most packets queued.
+//
+// q.mu must be held and the queue must be non-empty.
+func (q *sendQueue) dropFromLongestLocked() {
+	var longest key.Public
+	max := 0
+	for _, src := range q.order {
+		if n := len(q.bySrc[src]); n > max {
+			longest, max = src, n
+		}
+	}
+	q.popLocked(longest)
+}
+
+// dequeue removes and returns the next packet, from the source after
+// the one that last had a packet dequeued. It reports false if the
+// queue is empty.
+func (q *sendQueue) dequeue() (p pkt, ok bool) {
+	q.mu.Lock()
+	if q.n == 0 {
+		q.mu.Unlock()
+		return pkt{}, false
+	}
+	src := q.order[0]
+	p = q.popLocked(src)
+	if len(q.bySrc[src]) > 0 {
+		// src had its turn; back of the line.
+		q.order = append(q.order[1:], src)
+	}
+	more := q.n > 0
+	q.mu.Unlock()
+
+	if more {
+		q.signal()
+	}
+	return p, true
+}
+
+// popLocked removes and returns the oldest packet from src, which
+// must have one. If that was src's last packet, src is removed from
+// q.order.
+//
+// q.mu must be held.
+func (q *sendQueue) popLocked(src key.Public) pkt {
+	pkts := q.bySrc[src]
+	p := pkts[0]
+	pkts[0] = pkt{} // for GC
+	q.n--
+	if len(pkts) > 1 {
+		q.bySrc[src] = pkts[1:]
+		return p
+	}
+	delete(q.bySrc, src)
+	for i, k := range q.order {
+		if k == src {
+			q.order = append(q.order[:i], q.order[i+1:]...)
+			break
+		}
+	}
+	return p
+}
+
+// drain removes all queued packets and returns how many there were.
+func (q *sendQueue) drain() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := q.n
+	q.bySrc = map[key.Public][]pkt{}
+	q.order = nil
+	q.n = 0
+	return n
+}
+
+// len returns the number of packets queued.
+func (q *sendQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.n
+}
+
+func (q *sendQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
@@ -62,6 +62,7 @@ type Notify struct {
 	Status        *ipnstate.Status          // full status
 	BrowseToURL   *string                   // UI should open a browser right now
 	BackendLogID  *string                   // public logtail id used by backend
+	Forwards      []Forward                 // if non-nil, the TCP forwards now running
 
 	// LocalTCPPort, if non-nil, informs the UI frontend which
 	// (non-zero) localhost TCP port it's listening on.
@@ -156,4 +157,14 @@ type Backend interface {
 	// make sure they react properly with keys that are going to
 	// expire.
 	FakeExpireAfter(x time.Duration)
+	// AddForward starts forwarding TCP connections as f says,
+	// until RemoveForward is called with the same Forward. The
+	// new list of forwards is sent as a Forwards notification,
+	// or the error as an ErrMessage. In tailscaled, a forward
+	// also stops when the frontend connection that added it
+	// closes.
+	AddForward(f Forward)
+	// RemoveForward stops the forward f and closes its
+	// connections.
+	RemoveForward(f Forward)
 }
@@ -90,3 +90,11 @@ func (b *FakeBackend) RequestStatus() {
 func (b *FakeBackend) FakeExpireAfter(x time.Duration) {
 	b.notify(Notify{NetMap: &controlclient.NetworkMap{}})
 }
+
+func (b *FakeBackend) AddForward(f Forward) {
+	b.notify(Notify{Forwards: []Forward{f}})
+}
+
+func (b *FakeBackend) RemoveForward(f Forward) {
+	b.notify(Notify{Forwards: []Forward{}})
+}
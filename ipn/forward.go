@@ -0,0 +1,207 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/types/logger"
+	"tailscale.com/wgengine"
+)
+
+// A Forward is a TCP port forward between this machine and a peer,
+// run by the backend in the engine's own network stack, so that it
+// works without a TUN device. Forwarded connections are subject to
+// the packet filter like any other traffic.
+type Forward struct {
+	// Listen is where connections are accepted: a local
+	// host:port, or if Reverse, a port on this node's Tailscale
+	// IPs.
+	Listen string
+	// Target is where connections are forwarded to: a peer's
+	// Tailscale ip:port, or if Reverse, a host:port on this
+	// machine's loopback interface. Reverse forwards can't reach
+	// other hosts, so that the peers allowed to connect don't get
+	// to use this machine as a proxy into its LAN.
+	Target string
+	// Reverse is whether connections come from the Tailscale
+	// network, rather than go to it.
+	Reverse bool
+}
+
+func (f Forward) String() string {
+	if f.Reverse {
+		return fmt.Sprintf("tailscale port %s to %s", f.Listen, f.Target)
+	}
+	return fmt.Sprintf("%s to %s", f.Listen, f.Target)
+}
+
+// forwardDialTimeout is how long to wait to connect to the target of
+// a forwarded connection.
+const forwardDialTimeout = 10 * time.Second
+
+// A forwarder runs a Forward.
+type forwarder struct {
+	f    Forward
+	logf logger.Logf
+	ln   net.Listener
+	dial func(context.Context) (net.Conn, error)
+
+	mu     sync.Mutex
+	conns  map[net.Conn]bool // both ends of the forwarded connections
+	closed bool
+}
+
+// newForwarder starts running f with e.
+func newForwarder(logf logger.Logf, e wgengine.Engine, f Forward) (*forwarder, error) {
+	fw := &forwarder{
+		f:     f,
+		logf:  logger.WithPrefix(logf, "forward: "),
+		conns: make(map[net.Conn]bool),
+	}
+	if f.Reverse {
+		port, err := strconv.ParseUint(strings.TrimPrefix(f.Listen, ":"), 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("forward: bad port %q", f.Listen)
+		}
+		host, _, err := net.SplitHostPort(f.Target)
+		if err != nil {
+			return nil, fmt.Errorf("forward: bad target %q: %v", f.Target, err)
+		}
+		if !isLoopbackHost(host) {
+			return nil, fmt.Errorf("forward: target %q is not a loopback address", f.Target)
+		}
+		fw.ln, err = e.ListenTCP(uint16(port))
+		if err != nil {
+			return nil, fmt.Errorf("forward: %v", err)
+		}
+		fw.dial = func(ctx context.Context) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", f.Target)
+		}
+	} else {
+		dst, err := netaddr.ParseIPPort(f.Target)
+		if err != nil {
+			return nil, fmt.Errorf("forward: bad target %q: %v", f.Target, err)
+		}
+		if !tsaddr.IsTailscaleIP(dst.IP) {
+			return nil, fmt.Errorf("forward: %v is not a Tailscale IP", dst.IP)
+		}
+		fw.ln, err = net.Listen("tcp", f.Listen)
+		if err != nil {
+			return nil, fmt.Errorf("forward: %v", err)
+		}
+		fw.dial = func(ctx context.Context) (net.Conn, error) {
+			return e.DialTCP(ctx, dst)
+		}
+	}
+	fw.logf("forwarding %v", f)
+	go fw.serve()
+	return fw, nil
+}
+
+// isLoopbackHost reports whether host is a loopback IP or localhost.
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (fw *forwarder) serve() {
+	for {
+		c, err := fw.ln.Accept()
+		if err != nil {
+			fw.mu.Lock()
+			closed := fw.closed
+			fw.mu.Unlock()
+			if !closed {
+				fw.logf("%v: %v", fw.f, err)
+			}
+			return
+		}
+		go fw.forwardConn(c)
+	}
+}
+
+// track adds c to the connections closed by Close, and reports
+// whether it did. If fw is closed already, it closes c instead.
+func (fw *forwarder) track(c net.Conn) bool {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if fw.closed {
+		c.Close()
+		return false
+	}
+	fw.conns[c] = true
+	return true
+}
+
+func (fw *forwarder) untrack(c net.Conn) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	delete(fw.conns, c)
+	c.Close()
+}
+
+// forwardConn copies c to and from a new connection to the target,
+// until both directions are done.
+func (fw *forwarder) forwardConn(c net.Conn) {
+	if !fw.track(c) {
+		return
+	}
+	defer fw.untrack(c)
+
+	ctx, cancel := context.WithTimeout(context.Background(), forwardDialTimeout)
+	tc, err := fw.dial(ctx)
+	cancel()
+	if err != nil {
+		fw.logf("%v: from %v: %v", fw.f, c.RemoteAddr(), err)
+		return
+	}
+	if !fw.track(tc) {
+		return
+	}
+	defer fw.untrack(tc)
+
+	errc := make(chan error, 2)
+	copyHalf := func(dst, src net.Conn) {
+		_, err := io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+		errc <- err
+	}
+	go copyHalf(tc, c)
+	go copyHalf(c, tc)
+	<-errc
+	<-errc
+}
+
+// Close stops accepting connections and closes the forwarded ones.
+func (fw *forwarder) Close() error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if fw.closed {
+		return nil
+	}
+	fw.closed = true
+	for c := range fw.conns {
+		c.Close()
+	}
+	return fw.ln.Close()
+}
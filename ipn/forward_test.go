@@ -0,0 +1,260 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	crand "crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"tailscale.com/control/controlclient"
+	"tailscale.com/derp"
+	"tailscale.com/derp/derphttp"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstest/testcontrol"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+	"tailscale.com/wgengine"
+)
+
+// runDERP runs a DERP server for the duration of the test, and
+// returns a DERP map of it.
+func runDERP(t *testing.T) (*tailcfg.DERPMap, func()) {
+	var priv key.Private
+	if _, err := crand.Read(priv[:]); err != nil {
+		t.Fatal(err)
+	}
+	d := derp.NewServer(priv, t.Logf)
+	srv := httptest.NewUnstartedServer(derphttp.Handler(d))
+	srv.Config.ErrorLog = logger.StdLogger(t.Logf)
+	srv.Config.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	srv.StartTLS()
+	dm := &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			1: {
+				RegionID:   1,
+				RegionCode: "test",
+				Nodes: []*tailcfg.DERPNode{{
+					Name:         "t1",
+					RegionID:     1,
+					HostName:     "test-node.unused",
+					IPv4:         "127.0.0.1",
+					IPv6:         "none",
+					STUNPort:     -1,
+					DERPTestPort: srv.Listener.Addr().(*net.TCPAddr).Port,
+				}},
+			},
+		},
+	}
+	return dm, func() {
+		srv.CloseClientConnections()
+		srv.Close()
+		d.Close()
+	}
+}
+
+// upperServer runs a TCP server on localhost that replies to each
+// connection with what it read, upper-cased.
+func upperServer(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				b, _ := ioutil.ReadAll(c)
+				for i, ch := range b {
+					if 'a' <= ch && ch <= 'z' {
+						b[i] = ch - 'a' + 'A'
+					}
+				}
+				c.Write(b)
+			}()
+		}
+	}()
+	return ln
+}
+
+// roundTrip sends msg over a new connection to addr and returns the
+// reply, which is empty if the forwarded connection failed.
+func roundTrip(t *testing.T, addr, msg string) string {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(time.Minute))
+	io.WriteString(c, msg)
+	c.(*net.TCPConn).CloseWrite()
+	b, _ := ioutil.ReadAll(c)
+	return string(b)
+}
+
+func TestReverseForwardTarget(t *testing.T) {
+	// The targets are checked before the engine is used.
+	for _, target := range []string{"192.168.1.1:22", "example.com:80", "[fd7a:115c:a1e0::1]:80"} {
+		f := Forward{Listen: "80", Target: target, Reverse: true}
+		if _, err := newForwarder(t.Logf, nil, f); err == nil {
+			t.Errorf("reverse forward to %s was allowed", target)
+		}
+	}
+	for _, host := range []string{"localhost", "127.0.0.1", "127.1.2.3", "::1"} {
+		if !isLoopbackHost(host) {
+			t.Errorf("isLoopbackHost(%q) = false; want true", host)
+		}
+	}
+}
+
+func TestForwardWithFakeEngines(t *testing.T) {
+	derpMap, cleanup := runDERP(t)
+	defer cleanup()
+	control := testcontrol.New(t.Logf)
+	defer control.Close()
+	control.SetDERPMap(derpMap)
+
+	// Node 0 forwards a local port to node 1, which forwards it
+	// back to a server on this machine.
+	var backends [2]*LocalBackend
+	type nodeNetMap struct {
+		node int
+		nm   *controlclient.NetworkMap
+	}
+	netMaps := make(chan nodeNetMap, 100)
+	forwards := make(chan []Forward, 100)
+	errs := make(chan string, 100)
+	for i := range backends {
+		i := i
+		logf := logger.WithPrefix(t.Logf, fmt.Sprintf("node%d: ", i))
+		e, err := wgengine.NewFakeUserspaceEngine(logf, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := NewLocalBackend(logf, fmt.Sprintf("logid%d", i), &MemoryStore{}, e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Shutdown()
+		backends[i] = b
+
+		prefs := NewPrefs()
+		prefs.ControlURL = control.URL
+		prefs.WantRunning = true
+		err = b.Start(Options{
+			Prefs: prefs,
+			Notify: func(n Notify) {
+				// Don't block the backend once the test stops
+				// reading.
+				if n.NetMap != nil {
+					select {
+					case netMaps <- nodeNetMap{i, n.NetMap}:
+					default:
+					}
+				}
+				if n.Forwards != nil {
+					select {
+					case forwards <- n.Forwards:
+					default:
+					}
+				}
+				if n.ErrMessage != nil {
+					select {
+					case errs <- *n.ErrMessage:
+					default:
+					}
+				}
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Wait for both nodes to see each other, and learn node 1's IP.
+	var node1IP string
+	seen := map[int]bool{}
+	timeout := time.After(30 * time.Second)
+	for len(seen) < len(backends) {
+		select {
+		case m := <-netMaps:
+			if len(m.nm.Peers) == len(backends)-1 {
+				seen[m.node] = true
+			}
+			if m.node == 1 && len(m.nm.Addresses) > 0 {
+				node1IP = m.nm.Addresses[0].IP.String()
+			}
+		case <-timeout:
+			t.Fatalf("timeout; %d of %d nodes saw all their peers", len(seen), len(backends))
+		}
+	}
+
+	upper := upperServer(t)
+	defer upper.Close()
+	reverse := Forward{Listen: "80", Target: upper.Addr().String(), Reverse: true}
+	forward := Forward{Listen: "127.0.0.1:0", Target: node1IP + ":80"}
+	backends[1].AddForward(reverse)
+	backends[0].AddForward(forward)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-forwards:
+		case msg := <-errs:
+			t.Fatalf("AddForward: %s", msg)
+		case <-time.After(10 * time.Second):
+			t.Fatal("timeout waiting for the forwards to start")
+		}
+	}
+	backends[1].AddForward(reverse)
+	select {
+	case <-errs:
+	case <-time.After(10 * time.Second):
+		t.Error("adding a forward twice didn't fail")
+	}
+	backends[0].mu.Lock()
+	addr := backends[0].forwards[forward].ln.Addr().String()
+	backends[0].mu.Unlock()
+
+	// The first connections may fail while WireGuard connects.
+	deadline := time.Now().Add(time.Minute)
+	for {
+		got := roundTrip(t, addr, "hello")
+		if got == "HELLO" {
+			break
+		}
+		if got != "" || time.Now().After(deadline) {
+			t.Fatalf("got %q; want HELLO", got)
+		}
+	}
+
+	// Once the packet filter doesn't allow the port any more, the
+	// connections fail.
+	control.SetPacketFilter([]tailcfg.FilterRule{{
+		SrcIPs:   []string{"*"},
+		DstPorts: []tailcfg.NetPortRange{{IP: "*", Ports: tailcfg.PortRange{First: 22, Last: 22}}},
+	}})
+	deadline = time.Now().Add(time.Minute)
+	for roundTrip(t, addr, "hello") != "" {
+		if time.Now().After(deadline) {
+			t.Fatal("forwarded connections still allowed by the packet filter")
+		}
+	}
+
+	backends[0].RemoveForward(forward)
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Error("forward still listening after RemoveForward")
+	}
+}
@@ -174,3 +174,11 @@ func (h *Handle) RequestStatus() {
 func (h *Handle) FakeExpireAfter(x time.Duration) {
 	h.b.FakeExpireAfter(x)
 }
+
+func (h *Handle) AddForward(f Forward) {
+	h.b.AddForward(f)
+}
+
+func (h *Handle) RemoveForward(f Forward) {
+	h.b.RemoveForward(f)
+}
@@ -0,0 +1,320 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"tailscale.com/control/controlclient"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/logger"
+	"tailscale.com/version"
+)
+
+// localAPIPrefix is the path prefix of the HTTP API that the server
+// serves on its socket, alongside the IPN message bus. The endpoints
+// are:
+//
+//	GET   status   the ipnstate.Status
+//	GET   prefs    the current ipn.Prefs
+//	PATCH prefs    sets the prefs fields in the JSON body; returns the new prefs
+//	GET   netmap   the current network map
+//	POST  login    starts an interactive login; the URL comes as a Notify
+//	POST  logout   logs out
+//	GET   watch    streams Notify messages, one JSON object per line
+const localAPIPrefix = "/localapi/v0/"
+
+// watchQueueLen is how many Notify messages may be waiting for a
+// local API watcher before it's cut off for falling behind.
+const watchQueueLen = 64
+
+// localBackend is the part of *ipn.LocalBackend that the local API
+// and the IPN bus connections use.
+type localBackend interface {
+	Status() *ipnstate.Status
+	State() ipn.State
+	Prefs() *ipn.Prefs
+	SetPrefs(*ipn.Prefs)
+	NetMap() *controlclient.NetworkMap
+	StartLoginInteractive()
+	Logout()
+	HasForward(ipn.Forward) bool
+	StopForward(ipn.Forward) bool
+}
+
+// httpMethodPrefixes are the first bytes of the HTTP requests the
+// local API accepts. A message on the IPN bus starts with its
+// little-endian length, whose high byte is always zero since
+// ipn.MaxMessageSize is under 16MB, so these can't be mistaken for
+// one.
+var httpMethodPrefixes = []string{"GET ", "POST", "PATC", "PUT ", "HEAD", "DELE", "OPTI"}
+
+// isHTTPRequest reports whether start, the first bytes read from a
+// connection, begins an HTTP request.
+func isHTTPRequest(start []byte) bool {
+	for _, m := range httpMethodPrefixes {
+		if string(start) == m {
+			return true
+		}
+	}
+	return false
+}
+
+// bufferedConn is a net.Conn whose reads come through a
+// bufio.Reader, which may have already read the start of the
+// stream.
+type bufferedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (c bufferedConn) Read(p []byte) (int, error) { return c.br.Read(p) }
+
+// oneConnListener is a net.Listener that returns a single connection
+// and then blocks until closed.
+type oneConnListener struct {
+	mu     sync.Mutex
+	conn   net.Conn // nil once accepted
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newOneConnListener(c net.Conn) *oneConnListener {
+	return &oneConnListener{conn: c, closed: make(chan struct{})}
+}
+
+func (ln *oneConnListener) Accept() (net.Conn, error) {
+	ln.mu.Lock()
+	c := ln.conn
+	ln.conn = nil
+	ln.mu.Unlock()
+	if c != nil {
+		return c, nil
+	}
+	<-ln.closed
+	return nil, errors.New("listener closed")
+}
+
+func (ln *oneConnListener) Close() error {
+	ln.once.Do(func() { close(ln.closed) })
+	return nil
+}
+
+func (ln *oneConnListener) Addr() net.Addr { return dummyAddr("localapi") }
+
+type dummyAddr string
+
+func (a dummyAddr) Network() string { return string(a) }
+func (a dummyAddr) String() string  { return string(a) }
+
+// serveHTTPConn serves the local API on c until the client closes
+// it or ctx is done.
+func (s *server) serveHTTPConn(ctx context.Context, c net.Conn, logf logger.Logf) {
+	done := make(chan struct{})
+	var doneOnce sync.Once
+	hs := &http.Server{
+		Handler:  http.HandlerFunc(s.serveLocalAPI),
+		ErrorLog: logger.StdLogger(logf),
+		ConnState: func(_ net.Conn, st http.ConnState) {
+			if st == http.StateClosed {
+				doneOnce.Do(func() { close(done) })
+			}
+		},
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		hs.Close()
+	}()
+	hs.Serve(newOneConnListener(c))
+}
+
+// serveLocalAPI handles the requests under localAPIPrefix.
+func (s *server) serveLocalAPI(w http.ResponseWriter, r *http.Request) {
+	// On Windows the socket is a localhost TCP port, which web
+	// pages can send requests to. Browsers set Origin on those;
+	// the CLI and other local clients don't.
+	if r.Header.Get("Origin") != "" {
+		http.Error(w, "cross-origin request", http.StatusForbidden)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, localAPIPrefix) {
+		http.NotFound(w, r)
+		return
+	}
+	b := s.lb
+	if b == nil {
+		http.Error(w, "backend not running", http.StatusServiceUnavailable)
+		return
+	}
+	switch strings.TrimPrefix(r.URL.Path, localAPIPrefix) {
+	case "status":
+		if !requireMethod(w, r, "GET") {
+			return
+		}
+		writeJSON(w, b.Status())
+	case "prefs":
+		switch r.Method {
+		case "GET":
+		case "PATCH":
+			p := b.Prefs()
+			if p == nil {
+				http.Error(w, "backend not started", http.StatusConflict)
+				return
+			}
+			// Decoding into the current prefs leaves the fields
+			// the body doesn't mention alone.
+			dec := json.NewDecoder(r.Body)
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(p); err != nil {
+				http.Error(w, "bad prefs: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			b.SetPrefs(p)
+		default:
+			http.Error(w, "GET or PATCH required", http.StatusMethodNotAllowed)
+			return
+		}
+		p := b.Prefs()
+		if p == nil {
+			http.Error(w, "backend not started", http.StatusConflict)
+			return
+		}
+		writeJSON(w, p)
+	case "netmap":
+		if !requireMethod(w, r, "GET") {
+			return
+		}
+		nm := b.NetMap()
+		if nm == nil {
+			http.Error(w, "no network map yet", http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, nm)
+	case "login", "logout":
+		if !requireMethod(w, r, "POST") {
+			return
+		}
+		// The backend only has a control client to log in or
+		// out with once it's been started.
+		if b.State() == ipn.NoState {
+			http.Error(w, "backend not started", http.StatusConflict)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/login") {
+			b.StartLoginInteractive()
+		} else {
+			b.Logout()
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "watch":
+		if !requireMethod(w, r, "GET") {
+			return
+		}
+		s.serveWatch(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveWatch streams the Notify messages sent to the IPN bus clients
+// to w, starting with one holding the current state and prefs, until
+// the client goes away or falls too far behind.
+func (s *server) serveWatch(w http.ResponseWriter, r *http.Request) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	ch := s.addWatcher()
+	defer s.removeWatcher(ch)
+
+	w.Header().Set("Content-Type", "application/json")
+	st := s.lb.State()
+	json.NewEncoder(w).Encode(ipn.Notify{
+		Version: version.LONG,
+		State:   &st,
+		Prefs:   s.lb.Prefs(),
+	})
+	f.Flush()
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				// Fell behind; the client can reconnect.
+				return
+			}
+			// msg is shared with the other watchers, so don't
+			// append to it.
+			w.Write(msg)
+			if _, err := w.Write([]byte("\n")); err != nil {
+				return
+			}
+			f.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (s *server) addWatcher() chan []byte {
+	ch := make(chan []byte, watchQueueLen)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.watchers == nil {
+		s.watchers = map[chan []byte]bool{}
+	}
+	s.watchers[ch] = true
+	return ch
+}
+
+func (s *server) removeWatcher(ch chan []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.watchers, ch)
+}
+
+// writeToWatchersLocked sends the Notify message b to the local API
+// watchers. Watchers whose queue is full are dropped, and their
+// channel closed.
+//
+// s.mu must be held.
+func (s *server) writeToWatchersLocked(b []byte) {
+	for ch := range s.watchers {
+		select {
+		case ch <- b:
+		default:
+			delete(s.watchers, ch)
+			close(ch)
+		}
+	}
+}
+
+// requireMethod reports whether r uses method, replying with an
+// error if not.
+func requireMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		http.Error(w, method+" required", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(v)
+}
@@ -0,0 +1,324 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+	"tailscale.com/control/controlclient"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+)
+
+type fakeLocalBackend struct {
+	mu       sync.Mutex
+	state    ipn.State
+	prefs    *ipn.Prefs
+	logins   int
+	logouts  int
+	forwards map[ipn.Forward]bool
+}
+
+func (b *fakeLocalBackend) Status() *ipnstate.Status {
+	return &ipnstate.Status{BackendState: b.State().String()}
+}
+
+func (b *fakeLocalBackend) State() ipn.State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *fakeLocalBackend) Prefs() *ipn.Prefs {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.prefs == nil {
+		return nil
+	}
+	return b.prefs.Clone()
+}
+
+func (b *fakeLocalBackend) SetPrefs(p *ipn.Prefs) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.prefs = p
+}
+
+func (b *fakeLocalBackend) NetMap() *controlclient.NetworkMap { return nil }
+
+func (b *fakeLocalBackend) StartLoginInteractive() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.logins++
+}
+
+func (b *fakeLocalBackend) Logout() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.logouts++
+}
+
+// The rest of ipn.Backend, for the IPN bus.
+func (b *fakeLocalBackend) Start(ipn.Options) error         { return nil }
+func (b *fakeLocalBackend) Login(*oauth2.Token)             {}
+func (b *fakeLocalBackend) RequestEngineStatus()            {}
+func (b *fakeLocalBackend) RequestStatus()                  {}
+func (b *fakeLocalBackend) FakeExpireAfter(x time.Duration) {}
+
+func (b *fakeLocalBackend) AddForward(f ipn.Forward) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.forwards == nil {
+		b.forwards = make(map[ipn.Forward]bool)
+	}
+	b.forwards[f] = true
+}
+
+func (b *fakeLocalBackend) RemoveForward(f ipn.Forward) { b.StopForward(f) }
+
+func (b *fakeLocalBackend) HasForward(f ipn.Forward) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.forwards[f]
+}
+
+func (b *fakeLocalBackend) StopForward(f ipn.Forward) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	was := b.forwards[f]
+	delete(b.forwards, f)
+	return was
+}
+
+func TestLocalAPI(t *testing.T) {
+	b := &fakeLocalBackend{}
+	s := &server{lb: b}
+	ts := httptest.NewServer(http.HandlerFunc(s.serveLocalAPI))
+	defer ts.Close()
+
+	do := func(method, path, body string, hdr ...string) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, ts.URL+localAPIPrefix+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i+1 < len(hdr); i += 2 {
+			req.Header.Set(hdr[i], hdr[i+1])
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		all, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(all)
+	}
+
+	if code, _ := do("GET", "prefs", ""); code != http.StatusConflict {
+		t.Errorf("prefs before start: %v; want 409", code)
+	}
+	if code, _ := do("POST", "login", ""); code != http.StatusConflict {
+		t.Errorf("login before start: %v; want 409", code)
+	}
+
+	p := ipn.NewPrefs()
+	p.Hostname = "foo"
+	b.mu.Lock()
+	b.state = ipn.Running
+	b.prefs = p
+	b.mu.Unlock()
+
+	code, body := do("GET", "status", "")
+	var st ipnstate.Status
+	if err := json.Unmarshal([]byte(body), &st); code != 200 || err != nil {
+		t.Fatalf("status: %v, %q", code, body)
+	}
+	if st.BackendState != "Running" {
+		t.Errorf("BackendState = %q", st.BackendState)
+	}
+	if code, _ := do("POST", "status", ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("POST of status: %v; want 405", code)
+	}
+	if code, _ := do("GET", "status", "", "Origin", "http://evil.example"); code != http.StatusForbidden {
+		t.Errorf("cross-origin status: %v; want 403", code)
+	}
+
+	code, body = do("PATCH", "prefs", `{"WantRunning": false}`)
+	var got ipn.Prefs
+	if err := json.Unmarshal([]byte(body), &got); code != 200 || err != nil {
+		t.Fatalf("prefs patch: %v, %q", code, body)
+	}
+	if got.WantRunning || got.Hostname != "foo" {
+		t.Errorf("patched prefs: WantRunning=%v Hostname=%q; want false, foo", got.WantRunning, got.Hostname)
+	}
+	if code, _ := do("PATCH", "prefs", `{"NoSuchPref": 1}`); code != http.StatusBadRequest {
+		t.Errorf("patch of unknown pref: %v; want 400", code)
+	}
+
+	if code, _ := do("GET", "netmap", ""); code != http.StatusServiceUnavailable {
+		t.Errorf("netmap before one arrived: %v; want 503", code)
+	}
+	if code, _ := do("POST", "login", ""); code != http.StatusNoContent {
+		t.Errorf("login: %v; want 204", code)
+	}
+	if code, _ := do("POST", "logout", ""); code != http.StatusNoContent {
+		t.Errorf("logout: %v; want 204", code)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.logins != 1 || b.logouts != 1 {
+		t.Errorf("logins, logouts = %v, %v; want 1, 1", b.logins, b.logouts)
+	}
+}
+
+func TestLocalAPIWatch(t *testing.T) {
+	b := &fakeLocalBackend{state: ipn.Starting}
+	s := &server{lb: b}
+	ts := httptest.NewServer(http.HandlerFunc(s.serveLocalAPI))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + localAPIPrefix + "watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	br := bufio.NewReader(res.Body)
+
+	line, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n ipn.Notify
+	if err := json.Unmarshal([]byte(line), &n); err != nil {
+		t.Fatalf("first line %q: %v", line, err)
+	}
+	if n.State == nil || *n.State != ipn.Starting {
+		t.Errorf("first Notify state = %v; want Starting", n.State)
+	}
+
+	// The watcher was added before the first line was written.
+	msg := `{"Version":"test"}`
+	s.writeToClients([]byte(msg))
+	line, err = br.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(line) != msg {
+		t.Errorf("second line = %q; want %q", line, msg)
+	}
+}
+
+func TestServeConnSniffsHTTP(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := &server{lb: &fakeLocalBackend{}}
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go s.serveConn(ctx, c2, t.Logf)
+
+	go io.WriteString(c1, "GET "+localAPIPrefix+"status HTTP/1.1\r\nHost: local-tailscaled.sock\r\nConnection: close\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(c1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("status code = %v; want 200", res.StatusCode)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.clients) != 0 {
+		t.Errorf("HTTP conn was added as an IPN bus client")
+	}
+}
+
+func TestServeConnListenOnly(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := &server{lb: &fakeLocalBackend{}}
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go s.serveConn(ctx, c2, t.Logf)
+
+	// A bus client that sends nothing still becomes one, once
+	// serveConn gives up waiting for an HTTP request.
+	deadline := time.Now().Add(10 * sniffTimeout)
+	for {
+		s.mu.Lock()
+		n := len(s.clients)
+		s.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("quiet conn was not added as an IPN bus client")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	const msg = "notify"
+	go s.writeToClients([]byte(msg))
+	got, err := ipn.ReadMsg(c1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != msg {
+		t.Errorf("got %q; want %q", got, msg)
+	}
+}
+
+func TestForwardsStopWithConn(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := &fakeLocalBackend{}
+	s := &server{lb: b}
+	s.bs = ipn.NewBackendServer(t.Logf, b, s.writeToClients)
+
+	f := ipn.Forward{Listen: "127.0.0.1:8080", Target: "100.64.0.2:80"}
+	connect := func() (net.Conn, <-chan struct{}) {
+		c1, c2 := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			s.serveConn(ctx, c2, t.Logf)
+		}()
+		bc := ipn.NewBackendClient(t.Logf, func(msg []byte) { ipn.WriteMsg(c1, msg) })
+		bc.AddForward(f)
+		return c1, done
+	}
+
+	// The second connection's AddForward fails, as f is already
+	// running, so f isn't its to stop.
+	c1, done1 := connect()
+	for !b.HasForward(f) {
+		time.Sleep(time.Millisecond)
+	}
+	c2, done2 := connect()
+	c2.Close()
+	<-done2
+	if !b.HasForward(f) {
+		t.Fatal("forward stopped by a connection that didn't start it")
+	}
+	c1.Close()
+	<-done1
+	if b.HasForward(f) {
+		t.Error("forward still running after its connection closed")
+	}
+}
@@ -7,6 +7,7 @@ package ipnserver
 import (
 	"bufio"
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net"
@@ -38,7 +39,8 @@ type Options struct {
 	// frontend connections.
 	Port int
 
-	// StatePath is the path to the stored agent state.
+	// StatePath is the path to the stored agent state, or another
+	// state store spec accepted by ipn.NewStateStore.
 	StatePath string
 
 	// AutostartStateKey, if non-empty, immediately starts the agent
@@ -69,6 +71,11 @@ type Options struct {
 	// DebugMux, if non-nil, specifies an HTTP ServeMux in which
 	// to register a debug handler.
 	DebugMux *http.ServeMux
+
+	// StaticEndpoints are ip:port or host:port endpoints to
+	// advertise for this node, in addition to those discovered
+	// automatically and those in the prefs.
+	StaticEndpoints []string
 }
 
 // server is an IPN backend and its set of 0 or more active connections
@@ -79,26 +86,72 @@ type server struct {
 	bsMu sync.Mutex // lock order: bsMu, then mu
 	bs   *ipn.BackendServer
 
-	mu      sync.Mutex
-	clients map[net.Conn]bool
+	lb localBackend // for the local API; nil until the backend is created
+
+	mu       sync.Mutex
+	clients  map[net.Conn]bool
+	watchers map[chan []byte]bool // local API watch streams
 }
 
+// sniffTimeout is how long serveConn waits for the first bytes of a
+// connection to tell a local API request from an IPN bus client. A
+// bus client may only listen for Notify messages without sending
+// anything, so a connection that stays quiet is a bus client.
+const sniffTimeout = 500 * time.Millisecond
+
+// serveConn serves a frontend connection, which is either a client
+// of the IPN message bus or, if it starts with an HTTP request, of
+// the local API.
 func (s *server) serveConn(ctx context.Context, c net.Conn, logf logger.Logf) {
+	br := bufio.NewReader(c)
+	c.SetReadDeadline(time.Now().Add(sniffTimeout))
+	start, err := br.Peek(4)
+	c.SetReadDeadline(time.Time{})
+	if ne, ok := err.(net.Error); err != nil && !(ok && ne.Timeout()) {
+		c.Close()
+		return
+	}
+	if isHTTPRequest(start) {
+		s.serveHTTPConn(ctx, bufferedConn{c, br}, logf)
+		return
+	}
+
+	// The forwards started through c, which stop once it's closed.
+	forwards := map[ipn.Forward]bool{}
+	defer func() {
+		s.bsMu.Lock()
+		defer s.bsMu.Unlock()
+		for f := range forwards {
+			s.lb.StopForward(f)
+		}
+	}()
+
 	s.addConn(c)
 	logf("incoming control connection")
 	defer s.removeAndCloseConn(c)
 	for ctx.Err() == nil {
-		msg, err := ipn.ReadMsg(c)
+		msg, err := ipn.ReadMsg(br)
 		if err != nil {
 			if ctx.Err() == nil {
 				logf("ReadMsg: %v", err)
 			}
 			return
 		}
+		// Errors are reported by GotCommandMsg.
+		var fc forwardCommand
+		json.Unmarshal(msg, &fc)
+
 		s.bsMu.Lock()
+		wasRunning := fc.AddForward != nil && s.lb.HasForward(fc.AddForward.Forward)
 		if err := s.bs.GotCommandMsg(msg); err != nil {
 			logf("GotCommandMsg: %v", err)
 		}
+		if fc.AddForward != nil && !wasRunning && s.lb.HasForward(fc.AddForward.Forward) {
+			forwards[fc.AddForward.Forward] = true
+		}
+		if fc.RemoveForward != nil {
+			delete(forwards, fc.RemoveForward.Forward)
+		}
 		gotQuit := s.bs.GotQuit
 		s.bsMu.Unlock()
 		if gotQuit {
@@ -107,6 +160,13 @@ func (s *server) serveConn(ctx context.Context, c net.Conn, logf logger.Logf) {
 	}
 }
 
+// forwardCommand is the part of an ipn.Command that serveConn looks
+// at to track the forwards a connection starts.
+type forwardCommand struct {
+	AddForward    *ipn.ForwardArgs
+	RemoveForward *ipn.ForwardArgs
+}
+
 func (s *server) addConn(c net.Conn) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -146,6 +206,7 @@ func (s *server) writeToClients(b []byte) {
 	for c := range s.clients {
 		ipn.WriteMsg(c, b)
 	}
+	s.writeToWatchersLocked(b)
 }
 
 // Run runs a Tailscale backend service.
@@ -213,9 +274,9 @@ func Run(ctx context.Context, logf logger.Logf, logid string, getEngine func() (
 
 	var store ipn.StateStore
 	if opts.StatePath != "" {
-		store, err = ipn.NewFileStore(opts.StatePath)
+		store, err = ipn.NewStateStore(opts.StatePath)
 		if err != nil {
-			return fmt.Errorf("ipn.NewFileStore(%q): %v", opts.StatePath, err)
+			return fmt.Errorf("ipn.NewStateStore(%q): %v", opts.StatePath, err)
 		}
 	} else {
 		store = &ipn.MemoryStore{}
@@ -229,6 +290,9 @@ func Run(ctx context.Context, logf logger.Logf, logid string, getEngine func() (
 	b.SetDecompressor(func() (controlclient.Decompressor, error) {
 		return smallzstd.NewDecoder(nil)
 	})
+	if len(opts.StaticEndpoints) > 0 {
+		b.SetStaticEndpoints(opts.StaticEndpoints)
+	}
 
 	if opts.DebugMux != nil {
 		opts.DebugMux.HandleFunc("/debug/ipn", func(w http.ResponseWriter, r *http.Request) {
@@ -240,6 +304,7 @@ func Run(ctx context.Context, logf logger.Logf, logid string, getEngine func() (
 	}
 
 	server.bs = ipn.NewBackendServer(logf, b, server.writeToClients)
+	server.lb = b
 
 	if opts.AutostartStateKey != "" {
 		server.bs.GotCommand(&ipn.Command{
@@ -29,6 +29,7 @@ type Status struct {
 	TailscaleIPs []netaddr.IP // Tailscale IP(s) assigned to this node
 	Peer         map[key.Public]*PeerStatus
 	User         map[tailcfg.UserID]tailcfg.UserProfile
+	DERP         []*DERPStatus // active DERP connections, by region ID
 }
 
 func (s *Status) Peers() []key.Public {
@@ -74,6 +75,29 @@ type PeerStatus struct {
 	InEngine bool
 }
 
+// DERPStatus is the status of a connection to a DERP region.
+type DERPStatus struct {
+	RegionID   int
+	RegionCode string
+	Home       bool      // whether this is the node's home region
+	Created    time.Time // when the connection was set up
+	LastWrite  time.Time // time last packet sent
+
+	// LastPong is when a ping to the region was last answered, or
+	// zero if never. Latency is that ping's round-trip time.
+	LastPong time.Time
+	Latency  time.Duration
+
+	// PingError is the error from the latest ping, if it failed.
+	PingError string `json:",omitempty"`
+}
+
+// Healthy reports whether the latest ping to the region was
+// answered.
+func (ds *DERPStatus) Healthy() bool {
+	return !ds.LastPong.IsZero() && ds.PingError == ""
+}
+
 // SimpleHostName returns a potentially simplified version of ps.HostName for display purposes.
 func (ps *PeerStatus) SimpleHostName() string {
 	n := ps.HostName
@@ -201,6 +225,21 @@ func (sb *StatusBuilder) AddPeer(peer key.Public, st *PeerStatus) {
 	}
 }
 
+// AddDERP adds the status of a DERP region connection.
+func (sb *StatusBuilder) AddDERP(ds *DERPStatus) {
+	if ds == nil {
+		panic("nil DERPStatus")
+	}
+
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if sb.locked {
+		log.Printf("[unexpected] ipnstate: AddDERP after Locked")
+		return
+	}
+	sb.st.DERP = append(sb.st.DERP, ds)
+}
+
 type StatusUpdater interface {
 	UpdateStatus(*StatusBuilder)
 }
@@ -238,6 +277,28 @@ table tbody tr:nth-child(even) td { background-color: #f5f5f5; }
 	}
 	f("<p>Tailscale IP: %s", strings.Join(ips, ", "))
 
+	if len(st.DERP) > 0 {
+		f("<p>DERP: ")
+		for i, ds := range st.DERP {
+			if i > 0 {
+				f(", ")
+			}
+			name := html.EscapeString(fmt.Sprintf("derp-%v", ds.RegionCode))
+			if ds.Home {
+				name = "<b>" + name + "</b>"
+			}
+			switch {
+			case ds.Healthy():
+				f("%s (%v)", name, ds.Latency.Round(time.Millisecond))
+			case ds.PingError != "":
+				f("%s (%s)", name, html.EscapeString(ds.PingError))
+			default:
+				f("%s", name)
+			}
+		}
+		f("</p>\n")
+	}
+
 	f("<table>\n<thead>\n")
 	f("<tr><th>Peer</th><th>Node</th><th>Owner</th><th>Rx</th><th>Tx</th><th>Activity</th><th>Endpoints</th></tr>\n")
 	f("</thead>\n<tbody>\n")
@@ -8,6 +8,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -76,6 +77,12 @@ type LocalBackend struct {
 	authURL      string
 	interact     int
 
+	// staticEndpoints are advertised in addition to
+	// prefs.StaticEndpoints; see SetStaticEndpoints.
+	staticEndpoints []string
+
+	forwards map[Forward]*forwarder // see AddForward
+
 	// statusLock must be held before calling statusChanged.Wait() or
 	// statusChanged.Broadcast().
 	statusLock    sync.Mutex
@@ -119,8 +126,13 @@ func NewLocalBackend(logf logger.Logf, logid string, store StateStore, e wgengin
 func (b *LocalBackend) Shutdown() {
 	b.mu.Lock()
 	cli := b.c
+	forwards := b.forwards
+	b.forwards = nil
 	b.mu.Unlock()
 
+	for _, fw := range forwards {
+		fw.Close()
+	}
 	if cli != nil {
 		cli.Shutdown()
 	}
@@ -184,6 +196,39 @@ func (b *LocalBackend) SetDecompressor(fn func() (controlclient.Decompressor, er
 	b.newDecompressor = fn
 }
 
+// SetStaticEndpoints sets ip:port or host:port endpoints to advertise
+// for this node in addition to those in Prefs.StaticEndpoints, such as
+// ones given on the tailscaled command line.
+func (b *LocalBackend) SetStaticEndpoints(eps []string) {
+	b.mu.Lock()
+	b.staticEndpoints = append([]string(nil), eps...)
+	b.mu.Unlock()
+	b.updateStaticEndpoints()
+}
+
+// updateStaticEndpoints tells the engine the union of b.staticEndpoints
+// and the prefs' StaticEndpoints.
+func (b *LocalBackend) updateStaticEndpoints() {
+	b.mu.Lock()
+	var eps []string
+	seen := map[string]bool{}
+	add := func(list []string) {
+		for _, ep := range list {
+			if !seen[ep] {
+				seen[ep] = true
+				eps = append(eps, ep)
+			}
+		}
+	}
+	add(b.staticEndpoints)
+	if b.prefs != nil {
+		add(b.prefs.StaticEndpoints)
+	}
+	b.mu.Unlock()
+
+	b.e.SetStaticEndpoints(eps)
+}
+
 // setClientStatus is the callback invoked by the control client whenever it posts a new status.
 // Among other things, this is where we update the netmap, packet filters, DNS and DERP maps.
 func (b *LocalBackend) setClientStatus(st controlclient.Status) {
@@ -375,6 +420,7 @@ func (b *LocalBackend) Start(opts Options) error {
 	b.mu.Unlock()
 
 	b.updateFilter(nil, nil)
+	b.updateStaticEndpoints()
 
 	var discoPublic tailcfg.DiscoKey
 	if controlclient.Debug.Disco {
@@ -483,15 +529,32 @@ func (b *LocalBackend) updateFilter(netMap *controlclient.NetworkMap, prefs *Pre
 }
 
 // dnsCIDRsEqual determines whether two CIDR lists are equal
-// for DNS map construction purposes (that is, only the first entry counts).
+// for DNS map construction purposes.
 func dnsCIDRsEqual(newAddr, oldAddr []wgcfg.CIDR) bool {
 	if len(newAddr) != len(oldAddr) {
 		return false
 	}
-	if len(newAddr) == 0 || newAddr[0] == oldAddr[0] {
-		return true
+	for i := range newAddr {
+		if newAddr[i].IP != oldAddr[i].IP {
+			return false
+		}
+	}
+	return true
+}
+
+// dnsServicesEqual determines whether two service lists are equal
+// for DNS map construction purposes.
+func dnsServicesEqual(newServices, oldServices []tailcfg.Service) bool {
+	if len(newServices) != len(oldServices) {
+		return false
 	}
-	return false
+	for i := range newServices {
+		n, o := &newServices[i], &oldServices[i]
+		if n.Proto != o.Proto || n.Port != o.Port || n.Description != o.Description {
+			return false
+		}
+	}
+	return true
 }
 
 // dnsMapsEqual determines whether the new and the old network map
@@ -515,6 +578,18 @@ func dnsMapsEqual(new, old *controlclient.NetworkMap) bool {
 	if !dnsCIDRsEqual(new.Addresses, old.Addresses) {
 		return false
 	}
+	if !dnsServicesEqual(new.Hostinfo.Services, old.Hostinfo.Services) {
+		return false
+	}
+
+	if len(new.DNS.Aliases) != len(old.DNS.Aliases) {
+		return false
+	}
+	for alias, target := range new.DNS.Aliases {
+		if old.DNS.Aliases[alias] != target {
+			return false
+		}
+	}
 
 	for i, newPeer := range new.Peers {
 		oldPeer := old.Peers[i]
@@ -524,6 +599,9 @@ func dnsMapsEqual(new, old *controlclient.NetworkMap) bool {
 		if !dnsCIDRsEqual(newPeer.Addresses, oldPeer.Addresses) {
 			return false
 		}
+		if !dnsServicesEqual(newPeer.Hostinfo.Services, oldPeer.Hostinfo.Services) {
+			return false
+		}
 	}
 
 	return true
@@ -537,24 +615,74 @@ func (b *LocalBackend) updateDNSMap(netMap *controlclient.NetworkMap) {
 		return
 	}
 
-	nameToIP := make(map[string]netaddr.IP)
-	set := func(name string, addrs []wgcfg.CIDR) {
-		if len(addrs) == 0 {
+	records := make(map[string]tsdns.Record)
+	set := func(name string, addrs []wgcfg.CIDR, services []tailcfg.Service) {
+		if name == "" || len(addrs) == 0 {
 			return
 		}
-		nameToIP[name] = netaddr.IPFrom16(addrs[0].IP.Addr)
+		var rec tsdns.Record
+		for _, addr := range addrs {
+			rec.IPs = append(rec.IPs, netaddr.IPFrom16(addr.IP.Addr))
+		}
+		records[name] = rec
+
+		// Services get SRV records, with their description as TXT.
+		for _, svc := range services {
+			label := dnsServiceLabel(svc.Description)
+			if label == "" || (svc.Proto != tailcfg.TCP && svc.Proto != tailcfg.UDP) {
+				continue
+			}
+			srvName := "_" + label + "._" + string(svc.Proto) + "." + name
+			srv := records[srvName]
+			srv.SRV = append(srv.SRV, tsdns.SRV{Port: svc.Port, Target: name})
+			if len(srv.TXT) == 0 || srv.TXT[len(srv.TXT)-1] != svc.Description {
+				srv.TXT = append(srv.TXT, svc.Description)
+			}
+			records[srvName] = srv
+		}
 	}
 
 	for _, peer := range netMap.Peers {
-		set(peer.Name, peer.Addresses)
+		set(peer.Name, peer.Addresses, peer.Hostinfo.Services)
+	}
+	set(netMap.Name, netMap.Addresses, netMap.Hostinfo.Services)
+	for alias, target := range netMap.DNS.Aliases {
+		if _, ok := records[alias]; ok {
+			// Node names take precedence.
+			continue
+		}
+		records[alias] = tsdns.Record{CNAME: target}
 	}
-	set(netMap.Name, netMap.Addresses)
 
-	dnsMap := tsdns.NewMap(nameToIP)
+	dnsMap := tsdns.NewRecordMap(records)
 	// map diff will be logged in tsdns.Resolver.SetMap.
 	b.e.SetDNSMap(dnsMap)
 }
 
+// dnsServiceLabel returns the service name (RFC 6335, section 5.1)
+// used in the SRV records of a service with the given description,
+// or the empty string if there is none.
+func dnsServiceLabel(description string) string {
+	var b strings.Builder
+	for _, c := range strings.ToLower(description) {
+		switch {
+		case 'a' <= c && c <= 'z', '0' <= c && c <= '9':
+			b.WriteRune(c)
+		case b.Len() > 0 && !strings.HasSuffix(b.String(), "-"):
+			b.WriteByte('-')
+		}
+		if b.Len() == 15 {
+			break
+		}
+	}
+	label := strings.TrimSuffix(b.String(), "-")
+	if strings.IndexFunc(label, func(c rune) bool { return 'a' <= c && c <= 'z' }) < 0 {
+		// A service name needs a letter.
+		return ""
+	}
+	return label
+}
+
 // readPoller is a goroutine that receives service lists from
 // b.portpoll and propagates them into the controlclient's HostInfo.
 func (b *LocalBackend) readPoller() {
@@ -683,6 +811,18 @@ func (b *LocalBackend) State() State {
 	return b.state
 }
 
+// Prefs returns a copy of the current prefs, or nil if the backend
+// hasn't been started yet.
+func (b *LocalBackend) Prefs() *Prefs {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.prefs == nil {
+		return nil
+	}
+	return b.prefs.Clone()
+}
+
 // getEngineStatus returns a copy of b.engineStatus.
 //
 // TODO(bradfitz): remove this and use Status() throughout.
@@ -745,6 +885,79 @@ func (b *LocalBackend) FakeExpireAfter(x time.Duration) {
 	b.send(Notify{NetMap: b.netMap})
 }
 
+// AddForward implements Backend.
+func (b *LocalBackend) AddForward(f Forward) {
+	b.mu.Lock()
+	var err error
+	if b.forwards[f] != nil {
+		err = fmt.Errorf("already forwarding %v", f)
+	} else {
+		var fw *forwarder
+		fw, err = newForwarder(b.logf, b.e, f)
+		if err == nil {
+			if b.forwards == nil {
+				b.forwards = make(map[Forward]*forwarder)
+			}
+			b.forwards[f] = fw
+		}
+	}
+	forwards := b.forwardListLocked()
+	b.mu.Unlock()
+
+	if err != nil {
+		msg := err.Error()
+		b.send(Notify{ErrMessage: &msg})
+		return
+	}
+	b.send(Notify{Forwards: forwards})
+}
+
+// RemoveForward implements Backend.
+func (b *LocalBackend) RemoveForward(f Forward) {
+	if !b.StopForward(f) {
+		msg := fmt.Sprintf("not forwarding %v", f)
+		b.send(Notify{ErrMessage: &msg})
+	}
+}
+
+// HasForward reports whether the forward f is running.
+func (b *LocalBackend) HasForward(f Forward) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.forwards[f] != nil
+}
+
+// StopForward stops the forward f and closes its connections, and
+// reports whether it was running. Unlike RemoveForward, it sends no
+// error if it wasn't.
+func (b *LocalBackend) StopForward(f Forward) bool {
+	b.mu.Lock()
+	fw := b.forwards[f]
+	delete(b.forwards, f)
+	forwards := b.forwardListLocked()
+	b.mu.Unlock()
+
+	if fw == nil {
+		return false
+	}
+	fw.Close()
+	b.logf("stopped forwarding %v", f)
+	b.send(Notify{Forwards: forwards})
+	return true
+}
+
+// forwardListLocked returns the running forwards, sorted, and never nil.
+//
+// b.mu must be held.
+func (b *LocalBackend) forwardListLocked() []Forward {
+	ret := make([]Forward, 0, len(b.forwards))
+	for f := range b.forwards {
+		ret = append(ret, f)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].String() < ret[j].String() })
+	return ret
+}
+
 func (b *LocalBackend) parseWgStatus(s *wgengine.Status) (ret EngineStatus) {
 	var (
 		peerStats []string
@@ -823,6 +1036,9 @@ func (b *LocalBackend) SetPrefs(new *Prefs) {
 	}
 
 	b.updateFilter(netMap, new)
+	if !compareStrings(old.StaticEndpoints, new.StaticEndpoints) {
+		b.updateStaticEndpoints()
+	}
 
 	turnDERPOff := new.DisableDERP && !old.DisableDERP
 	turnDERPOn := !new.DisableDERP && old.DisableDERP
@@ -935,7 +1151,7 @@ func (b *LocalBackend) authReconfig() {
 		domains := nm.DNS.Domains
 		proxied := nm.DNS.Proxied
 		if proxied {
-			if len(nm.DNS.Nameservers) == 0 {
+			if len(nm.DNS.Nameservers) == 0 && len(nm.DNS.Resolvers) == 0 {
 				b.logf("[unexpected] dns proxied but no nameservers")
 				proxied = false
 			} else {
@@ -945,6 +1161,7 @@ func (b *LocalBackend) authReconfig() {
 		}
 		rcfg.DNS = dns.Config{
 			Nameservers: nm.DNS.Nameservers,
+			Resolvers:   nm.DNS.Resolvers,
 			Domains:     domains,
 			PerDomain:   nm.DNS.PerDomain,
 			Proxied:     proxied,
@@ -1021,6 +1238,11 @@ func wgCIDRsToFilter(cidrLists ...[]wgcfg.CIDR) (ret []filter.Net) {
 	for _, cidrs := range cidrLists {
 		for _, cidr := range cidrs {
 			if !cidr.IP.Is4() {
+				ret = append(ret, filter.Net{
+					IsIP6: true,
+					IP6:   filter.NewIP6(cidr.IP.IP()),
+					Mask6: filter.Netmask6(int(cidr.Mask)),
+				})
 				continue
 			}
 			ret = append(ret, filter.Net{
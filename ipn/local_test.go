@@ -0,0 +1,90 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"tailscale.com/control/controlclient"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstest/testcontrol"
+	"tailscale.com/types/logger"
+	"tailscale.com/wgengine"
+)
+
+func TestLocalBackendsWithTestControl(t *testing.T) {
+	control := testcontrol.New(t.Logf)
+	defer control.Close()
+
+	const numNodes = 2
+	netMaps := make(chan *controlclient.NetworkMap, 100)
+	for i := 0; i < numNodes; i++ {
+		logf := logger.WithPrefix(t.Logf, fmt.Sprintf("node%d: ", i))
+		e, err := wgengine.NewFakeUserspaceEngine(logf, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := NewLocalBackend(logf, fmt.Sprintf("logid%d", i), &MemoryStore{}, e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Shutdown()
+
+		prefs := NewPrefs()
+		prefs.ControlURL = control.URL
+		prefs.WantRunning = true
+		err = b.Start(Options{
+			Prefs: prefs,
+			Notify: func(n Notify) {
+				if n.NetMap != nil {
+					select {
+					case netMaps <- n.NetMap:
+					default:
+					}
+				}
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Wait for every node to see all the others.
+	seen := map[tailcfg.NodeKey]bool{}
+	timeout := time.After(30 * time.Second)
+	for len(seen) < numNodes {
+		select {
+		case nm := <-netMaps:
+			if len(nm.Peers) == numNodes-1 {
+				seen[nm.NodeKey] = true
+			}
+		case <-timeout:
+			t.Fatalf("timeout; %d of %d nodes saw all their peers", len(seen), numNodes)
+		}
+	}
+	if got := len(control.Nodes()); got != numNodes {
+		t.Errorf("control has %d nodes; want %d", got, numNodes)
+	}
+}
+
+func TestDNSServiceLabel(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"sshd", "sshd"},
+		{"Python3.8", "python3-8"},
+		{"nginx: master process", "nginx-master-pr"},
+		{"  --weird--  ", "weird"},
+		{"1234", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := dnsServiceLabel(tt.in); got != tt.want {
+			t.Errorf("dnsServiceLabel(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -33,6 +33,10 @@ type FakeExpireAfterArgs struct {
 	Duration time.Duration
 }
 
+type ForwardArgs struct {
+	Forward Forward
+}
+
 // Command is a command message that is JSON encoded and sent by a
 // frontend to a backend.
 type Command struct {
@@ -56,6 +60,8 @@ type Command struct {
 	RequestEngineStatus   *NoArgs
 	RequestStatus         *NoArgs
 	FakeExpireAfter       *FakeExpireAfterArgs
+	AddForward            *ForwardArgs
+	RemoveForward         *ForwardArgs
 }
 
 type BackendServer struct {
@@ -148,6 +154,12 @@ func (bs *BackendServer) GotCommand(cmd *Command) error {
 	} else if c := cmd.FakeExpireAfter; c != nil {
 		bs.b.FakeExpireAfter(c.Duration)
 		return nil
+	} else if c := cmd.AddForward; c != nil {
+		bs.b.AddForward(c.Forward)
+		return nil
+	} else if c := cmd.RemoveForward; c != nil {
+		bs.b.RemoveForward(c.Forward)
+		return nil
 	} else {
 		return fmt.Errorf("BackendServer.Do: no command specified")
 	}
@@ -254,6 +266,14 @@ func (bc *BackendClient) FakeExpireAfter(x time.Duration) {
 	bc.send(Command{FakeExpireAfter: &FakeExpireAfterArgs{Duration: x}})
 }
 
+func (bc *BackendClient) AddForward(f Forward) {
+	bc.send(Command{AddForward: &ForwardArgs{Forward: f}})
+}
+
+func (bc *BackendClient) RemoveForward(f Forward) {
+	bc.send(Command{RemoveForward: &ForwardArgs{Forward: f}})
+}
+
 // MaxMessageSize is the maximum message size, in bytes.
 const MaxMessageSize = 10 << 20
 
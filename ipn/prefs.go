@@ -6,11 +6,14 @@ package ipn
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 
 	"github.com/tailscale/wireguard-go/wgcfg"
 	"tailscale.com/atomicfile"
@@ -70,6 +73,13 @@ type Prefs struct {
 	// DisableDERP prevents DERP from being used.
 	DisableDERP bool
 
+	// StaticEndpoints are extra endpoints, in ip:port or host:port
+	// form, to advertise to peers in addition to the ones
+	// discovered automatically. They're for machines behind 1:1
+	// NAT or load balancers, whose public addresses STUN can't
+	// discover.
+	StaticEndpoints []string
+
 	// The following block of options only have an effect on Linux.
 
 	// AdvertiseRoutes specifies CIDR prefixes to advertise into the
@@ -146,6 +156,7 @@ func (p *Prefs) Equals(p2 *Prefs) bool {
 		p.DeviceModel == p2.DeviceModel &&
 		compareIPNets(p.AdvertiseRoutes, p2.AdvertiseRoutes) &&
 		compareStrings(p.AdvertiseTags, p2.AdvertiseTags) &&
+		compareStrings(p.StaticEndpoints, p2.StaticEndpoints) &&
 		p.Persist.Equals(p2.Persist)
 }
 
@@ -173,6 +184,22 @@ func compareStrings(a, b []string) bool {
 	return true
 }
 
+// CheckStaticEndpoint validates ep as a Prefs.StaticEndpoints entry:
+// an ip:port or host:port with a non-zero port number.
+func CheckStaticEndpoint(ep string) error {
+	host, port, err := net.SplitHostPort(ep)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return errors.New("missing host")
+	}
+	if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
 func NewPrefs() *Prefs {
 	return &Prefs{
 		// Provide default values for options which might be missing
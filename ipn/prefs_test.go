@@ -24,7 +24,7 @@ func fieldsOf(t reflect.Type) (fields []string) {
 func TestPrefsEqual(t *testing.T) {
 	tstest.PanicOnLog()
 
-	prefsHandles := []string{"ControlURL", "RouteAll", "AllowSingleHosts", "CorpDNS", "WantRunning", "ShieldsUp", "AdvertiseTags", "Hostname", "OSVersion", "DeviceModel", "NotepadURLs", "DisableDERP", "AdvertiseRoutes", "NoSNAT", "NetfilterMode", "Persist"}
+	prefsHandles := []string{"ControlURL", "RouteAll", "AllowSingleHosts", "CorpDNS", "WantRunning", "ShieldsUp", "AdvertiseTags", "Hostname", "OSVersion", "DeviceModel", "NotepadURLs", "DisableDERP", "StaticEndpoints", "AdvertiseRoutes", "NoSNAT", "NetfilterMode", "Persist"}
 	if have := fieldsOf(reflect.TypeOf(Prefs{})); !reflect.DeepEqual(have, prefsHandles) {
 		t.Errorf("Prefs.Equal check might be out of sync\nfields: %q\nhandled: %q\n",
 			have, prefsHandles)
@@ -185,6 +185,17 @@ func TestPrefsEqual(t *testing.T) {
 			true,
 		},
 
+		{
+			&Prefs{StaticEndpoints: []string{"1.2.3.4:41641"}},
+			&Prefs{StaticEndpoints: []string{"1.2.3.4:41642"}},
+			false,
+		},
+		{
+			&Prefs{StaticEndpoints: []string{"1.2.3.4:41641", "example.com:41641"}},
+			&Prefs{StaticEndpoints: []string{"1.2.3.4:41641", "example.com:41641"}},
+			true,
+		},
+
 		{
 			&Prefs{NetfilterMode: router.NetfilterOff},
 			&Prefs{NetfilterMode: router.NetfilterOn},
@@ -278,3 +289,25 @@ func TestPrefsPersist(t *testing.T) {
 	}
 	checkPrefs(t, p)
 }
+
+func TestCheckStaticEndpoint(t *testing.T) {
+	tests := []struct {
+		ep   string
+		good bool
+	}{
+		{"1.2.3.4:41641", true},
+		{"[2001:db8::1]:41641", true},
+		{"example.com:41641", true},
+		{"example.com", false},
+		{":41641", false},
+		{"1.2.3.4:0", false},
+		{"1.2.3.4:65536", false},
+		{"1.2.3.4:http", false},
+	}
+	for _, tt := range tests {
+		err := CheckStaticEndpoint(tt.ep)
+		if (err == nil) != tt.good {
+			t.Errorf("CheckStaticEndpoint(%q) = %v; want good=%v", tt.ep, err, tt.good)
+		}
+	}
+}
@@ -5,13 +5,20 @@
 package ipn
 
 import (
+	"bytes"
+	crand "crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 
+	"golang.org/x/crypto/nacl/secretbox"
 	"tailscale.com/atomicfile"
 )
 
@@ -62,41 +69,84 @@ func (s *MemoryStore) WriteState(id StateKey, bs []byte) error {
 // FileStore is a StateStore that uses a JSON file for persistence.
 type FileStore struct {
 	path string
+	key  *[32]byte // if non-nil, the file is encrypted with it
 
 	mu    sync.RWMutex
 	cache map[StateKey][]byte
 }
 
+// encryptedFileMagic starts the files of encrypted FileStores,
+// followed by the secretbox nonce and sealed JSON.
+const encryptedFileMagic = "tailscale-state-secretbox-v1\n"
+
 // NewFileStore returns a new file store that persists to path.
 func NewFileStore(path string) (*FileStore, error) {
+	return newFileStore(path, nil)
+}
+
+// NewEncryptedFileStore returns a new file store that persists to
+// path, encrypted with key using nacl/secretbox. If path has the
+// unencrypted state of a NewFileStore, it's encrypted in place.
+func NewEncryptedFileStore(path string, key [32]byte) (*FileStore, error) {
+	return newFileStore(path, &key)
+}
+
+func newFileStore(path string, key *[32]byte) (*FileStore, error) {
+	ret := &FileStore{
+		path:  path,
+		key:   key,
+		cache: map[StateKey][]byte{},
+	}
 	bs, err := ioutil.ReadFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			// Write out an initial file, to verify that we can write
 			// to the path.
 			os.MkdirAll(filepath.Dir(path), 0755) // best effort
-			if err = atomicfile.WriteFile(path, []byte("{}"), 0600); err != nil {
+			if err = ret.writeLocked(); err != nil {
 				return nil, err
 			}
-			return &FileStore{
-				path:  path,
-				cache: map[StateKey][]byte{},
-			}, nil
+			return ret, nil
 		}
 		return nil, err
 	}
 
-	ret := &FileStore{
-		path:  path,
-		cache: map[StateKey][]byte{},
+	encrypted := bytes.HasPrefix(bs, []byte(encryptedFileMagic))
+	if encrypted {
+		if key == nil {
+			return nil, fmt.Errorf("%s is encrypted; no key given", path)
+		}
+		if bs, err = ret.open(bs); err != nil {
+			return nil, err
+		}
 	}
 	if err := json.Unmarshal(bs, &ret.cache); err != nil {
 		return nil, err
 	}
-
+	if key != nil && !encrypted {
+		// Migrate from an unencrypted FileStore.
+		if err := ret.writeLocked(); err != nil {
+			return nil, fmt.Errorf("encrypting %s: %v", path, err)
+		}
+	}
 	return ret, nil
 }
 
+// open decrypts the contents of an encrypted file.
+func (s *FileStore) open(bs []byte) ([]byte, error) {
+	bs = bs[len(encryptedFileMagic):]
+	var nonce [24]byte
+	if len(bs) < len(nonce) {
+		return nil, fmt.Errorf("%s: short encrypted file", s.path)
+	}
+	copy(nonce[:], bs)
+	out, ok := secretbox.Open(nil, bs[len(nonce):], &nonce, s.key)
+	if !ok {
+		return nil, fmt.Errorf("%s: can't decrypt; wrong key?", s.path)
+	}
+	return out, nil
+}
+
 // ReadState implements the StateStore interface.
 func (s *FileStore) ReadState(id StateKey) ([]byte, error) {
 	s.mu.RLock()
@@ -113,9 +163,75 @@ func (s *FileStore) WriteState(id StateKey, bs []byte) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.cache[id] = append([]byte(nil), bs...)
+	return s.writeLocked()
+}
+
+// writeLocked writes s.cache to s.path, encrypting it if s.key is
+// set.
+//
+// s.mu must be held.
+func (s *FileStore) writeLocked() error {
 	bs, err := json.MarshalIndent(s.cache, "", "  ")
 	if err != nil {
 		return err
 	}
+	if s.key != nil {
+		var nonce [24]byte
+		if _, err := io.ReadFull(crand.Reader, nonce[:]); err != nil {
+			return err
+		}
+		out := append([]byte(encryptedFileMagic), nonce[:]...)
+		bs = secretbox.Seal(out, bs, &nonce, s.key)
+	}
 	return atomicfile.WriteFile(s.path, bs, 0600)
 }
+
+// NewStateStore returns the StateStore described by spec, which is
+// the value of tailscaled's --state flag.
+//
+// A spec of "kube:<name>" keeps state in the Kubernetes Secret
+// <name>, in the namespace of the pod that tailscaled runs in. See
+// NewKubeStore.
+//
+// A spec of "encfile:<path>" is an encrypted FileStore at path; see
+// NewEncryptedFileStore. Its key is 64 hex digits, from the
+// TS_STATE_KEY environment variable or else the file named by
+// TS_STATE_KEY_FILE.
+//
+// Any other spec is the path of an unencrypted FileStore.
+func NewStateStore(spec string) (StateStore, error) {
+	switch {
+	case strings.HasPrefix(spec, "kube:"):
+		return NewKubeStore(strings.TrimPrefix(spec, "kube:"))
+	case strings.HasPrefix(spec, "encfile:"):
+		key, err := stateKeyFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		return NewEncryptedFileStore(strings.TrimPrefix(spec, "encfile:"), key)
+	}
+	return NewFileStore(spec)
+}
+
+// stateKeyFromEnv returns the key for an encrypted FileStore, from
+// TS_STATE_KEY or the file named by TS_STATE_KEY_FILE.
+func stateKeyFromEnv() (key [32]byte, err error) {
+	v := os.Getenv("TS_STATE_KEY")
+	if v == "" {
+		path := os.Getenv("TS_STATE_KEY_FILE")
+		if path == "" {
+			return key, errors.New("encrypted state needs TS_STATE_KEY or TS_STATE_KEY_FILE set")
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return key, err
+		}
+		v = string(bytes.TrimSpace(b))
+	}
+	b, err := hex.DecodeString(v)
+	if err != nil || len(b) != len(key) {
+		return key, errors.New("state key must be 64 hex digits")
+	}
+	copy(key[:], b)
+	return key, nil
+}
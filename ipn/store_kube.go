@@ -0,0 +1,231 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// kubeServiceAccountDir is where Kubernetes mounts a pod's service
+// account credentials.
+const kubeServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// KubeStore is a StateStore that keeps state in a Kubernetes Secret,
+// one Secret data key per StateKey, so that pods keep their node
+// identity across restarts.
+//
+// The pod's service account needs permission to get, create and
+// patch the Secret.
+type KubeStore struct {
+	client     *kubeClient
+	secretName string
+}
+
+// NewKubeStore returns a KubeStore using the Secret secretName in
+// the pod's namespace, talking to the API server of the cluster the
+// process runs in. The Secret is created on first write if needed.
+func NewKubeStore(secretName string) (*KubeStore, error) {
+	if secretName == "" {
+		return nil, errors.New("missing Kubernetes Secret name")
+	}
+	c, err := newInClusterKubeClient()
+	if err != nil {
+		return nil, err
+	}
+	return &KubeStore{client: c, secretName: secretName}, nil
+}
+
+// kubeSecret is the subset of a Kubernetes Secret that KubeStore
+// uses.
+type kubeSecret struct {
+	APIVersion string            `json:"apiVersion,omitempty"`
+	Kind       string            `json:"kind,omitempty"`
+	Metadata   kubeObjectMeta    `json:"metadata"`
+	Data       map[string][]byte `json:"data,omitempty"`
+}
+
+type kubeObjectMeta struct {
+	Name string `json:"name,omitempty"`
+}
+
+// kubeSecretKey returns the Secret data key for id. Secret keys may
+// only contain alphanumerics, '-', '_' and '.', so anything else is
+// replaced with '_'.
+func kubeSecretKey(id StateKey) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		}
+		return '_'
+	}, string(id))
+}
+
+// ReadState implements the StateStore interface.
+func (s *KubeStore) ReadState(id StateKey) ([]byte, error) {
+	var secret kubeSecret
+	err := s.client.do("GET", "secrets/"+s.secretName, "", nil, &secret)
+	if isKubeNotFound(err) {
+		return nil, ErrStateNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	bs, ok := secret.Data[kubeSecretKey(id)]
+	if !ok {
+		return nil, ErrStateNotExist
+	}
+	return bs, nil
+}
+
+// WriteState implements the StateStore interface.
+func (s *KubeStore) WriteState(id StateKey, bs []byte) error {
+	data := map[string][]byte{kubeSecretKey(id): bs}
+	patch := map[string]interface{}{"data": data}
+	err := s.client.do("PATCH", "secrets/"+s.secretName, "application/merge-patch+json", patch, nil)
+	if !isKubeNotFound(err) {
+		return err
+	}
+	secret := kubeSecret{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Metadata:   kubeObjectMeta{Name: s.secretName},
+		Data:       data,
+	}
+	err = s.client.do("POST", "secrets", "application/json", secret, nil)
+	if isKubeConflict(err) {
+		// Someone else created it since our PATCH; try that again.
+		err = s.client.do("PATCH", "secrets/"+s.secretName, "application/merge-patch+json", patch, nil)
+	}
+	return err
+}
+
+// kubeClient is a minimal client of the Kubernetes API, for the
+// resources of one namespace.
+type kubeClient struct {
+	url       string // API server base URL, like "https://10.0.0.1:443"
+	namespace string
+	tokenFile string // file with the bearer token; re-read as it rotates
+	http      *http.Client
+}
+
+// newInClusterKubeClient returns a kubeClient configured from the
+// environment and service account of the pod it runs in.
+func newInClusterKubeClient() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in Kubernetes: KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT not set")
+	}
+	ns, err := ioutil.ReadFile(kubeServiceAccountDir + "/namespace")
+	if err != nil {
+		return nil, err
+	}
+	caPEM, err := ioutil.ReadFile(kubeServiceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New("no certificates in Kubernetes service account ca.crt")
+	}
+	return &kubeClient{
+		url:       "https://" + net.JoinHostPort(host, port),
+		namespace: strings.TrimSpace(string(ns)),
+		tokenFile: kubeServiceAccountDir + "/token",
+		http: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: roots},
+			},
+			Timeout: 10 * time.Second,
+		},
+	}, nil
+}
+
+// kubeStatusError is an error response from the API server.
+type kubeStatusError struct {
+	Code    int    `json:"code"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+func (e *kubeStatusError) Error() string {
+	return fmt.Sprintf("kubernetes: %d %s: %s", e.Code, e.Reason, e.Message)
+}
+
+func isKubeNotFound(err error) bool {
+	var se *kubeStatusError
+	return errors.As(err, &se) && se.Code == http.StatusNotFound
+}
+
+func isKubeConflict(err error) bool {
+	var se *kubeStatusError
+	return errors.As(err, &se) && se.Code == http.StatusConflict
+}
+
+// do sends a request with method to the namespaced resource path,
+// with in, if non-nil, as its JSON body of type contentType. If out
+// is non-nil, the JSON response is decoded into it.
+func (c *kubeClient) do(method, path, contentType string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	url := fmt.Sprintf("%s/api/v1/namespaces/%s/%s", c.url, c.namespace, path)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.tokenFile != "" {
+		token, err := ioutil.ReadFile(c.tokenFile)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		se := &kubeStatusError{Code: res.StatusCode}
+		b, _ := ioutil.ReadAll(io.LimitReader(res.Body, 64<<10))
+		if json.Unmarshal(b, se) != nil || se.Message == "" {
+			se.Message = strings.TrimSpace(string(b))
+		}
+		se.Code = res.StatusCode
+		if se.Reason == "" {
+			se.Reason = http.StatusText(res.StatusCode)
+		}
+		return fmt.Errorf("%s %s: %w", method, path, se)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
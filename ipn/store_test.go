@@ -5,8 +5,16 @@
 package ipn
 
 import (
+	"bytes"
+	"encoding/json"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 
 	"tailscale.com/tstest"
@@ -125,3 +133,186 @@ func TestFileStore(t *testing.T) {
 		}
 	}
 }
+
+func TestEncryptedFileStore(t *testing.T) {
+	tstest.PanicOnLog()
+
+	dir, err := ioutil.TempDir("", "test_ipn_store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state")
+	key := [32]byte{1, 2, 3}
+
+	// Start with an unencrypted store, to check migration.
+	plain, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plain.WriteState("old", []byte("secret-old")); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewEncryptedFileStore(path, key)
+	if err != nil {
+		t.Fatalf("creating encrypted file store failed: %v", err)
+	}
+	testStoreSemantics(t, store)
+
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(bs, []byte(encryptedFileMagic)) || bytes.Contains(bs, []byte("secret-old")) {
+		t.Errorf("state file isn't encrypted: %q", bs)
+	}
+
+	store, err = NewEncryptedFileStore(path, key)
+	if err != nil {
+		t.Fatalf("creating second encrypted file store failed: %v", err)
+	}
+	expected := map[StateKey]string{
+		"old": "secret-old",
+		"foo": "bar",
+		"baz": "quux",
+	}
+	for id, want := range expected {
+		bs, err := store.ReadState(id)
+		if err != nil {
+			t.Errorf("reading %q (2nd store): %v", id, err)
+		}
+		if string(bs) != want {
+			t.Errorf("reading %q (2nd store): got %q, want %q", id, string(bs), want)
+		}
+	}
+
+	if _, err := NewEncryptedFileStore(path, [32]byte{4}); err == nil {
+		t.Errorf("opened encrypted store with wrong key")
+	}
+	if _, err := NewFileStore(path); err == nil {
+		t.Errorf("opened encrypted store without key")
+	}
+}
+
+// fakeKubeAPI is a stand-in for the parts of the Kubernetes API
+// server that KubeStore uses.
+type fakeKubeAPI struct {
+	t       *testing.T
+	mu      sync.Mutex
+	secrets map[string]map[string][]byte
+	creates int
+}
+
+func (f *fakeKubeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if got := r.Header.Get("Authorization"); got != "Bearer test-token" {
+		http.Error(w, `{"code":401,"reason":"Unauthorized","message":"bad token"}`, 401)
+		return
+	}
+	const prefix = "/api/v1/namespaces/test-ns/secrets"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		http.NotFound(w, r)
+		return
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	notFound := func() {
+		w.WriteHeader(404)
+		io.WriteString(w, `{"code":404,"reason":"NotFound","message":"secret not found"}`)
+	}
+	var secret kubeSecret
+	switch r.Method {
+	case "GET":
+		data, ok := f.secrets[name]
+		if !ok {
+			notFound()
+			return
+		}
+		json.NewEncoder(w).Encode(kubeSecret{Metadata: kubeObjectMeta{Name: name}, Data: data})
+	case "PATCH":
+		if ct := r.Header.Get("Content-Type"); ct != "application/merge-patch+json" {
+			f.t.Errorf("PATCH Content-Type = %q", ct)
+		}
+		data, ok := f.secrets[name]
+		if !ok {
+			notFound()
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&secret); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		for k, v := range secret.Data {
+			data[k] = v
+		}
+		json.NewEncoder(w).Encode(kubeSecret{Metadata: kubeObjectMeta{Name: name}, Data: data})
+	case "POST":
+		if err := json.NewDecoder(r.Body).Decode(&secret); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if _, ok := f.secrets[secret.Metadata.Name]; ok {
+			w.WriteHeader(409)
+			io.WriteString(w, `{"code":409,"reason":"AlreadyExists","message":"exists"}`)
+			return
+		}
+		if secret.Data == nil {
+			secret.Data = map[string][]byte{}
+		}
+		f.secrets[secret.Metadata.Name] = secret.Data
+		f.creates++
+		w.WriteHeader(201)
+		json.NewEncoder(w).Encode(secret)
+	default:
+		http.Error(w, "bad method", 405)
+	}
+}
+
+func TestKubeStore(t *testing.T) {
+	tstest.PanicOnLog()
+
+	dir, err := ioutil.TempDir("", "test_ipn_store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("test-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	api := &fakeKubeAPI{t: t, secrets: map[string]map[string][]byte{}}
+	ts := httptest.NewServer(api)
+	defer ts.Close()
+	client := &kubeClient{
+		url:       ts.URL,
+		namespace: "test-ns",
+		tokenFile: tokenFile,
+		http:      ts.Client(),
+	}
+
+	store := &KubeStore{client: client, secretName: "tailscale"}
+	testStoreSemantics(t, store)
+	if api.creates != 1 {
+		t.Errorf("secret created %d times; want 1", api.creates)
+	}
+	if got := string(api.secrets["tailscale"]["foo"]); got != "bar" {
+		t.Errorf("secret foo = %q; want bar", got)
+	}
+
+	// State keys that aren't valid secret keys are mapped to ones
+	// that are.
+	if err := store.WriteState("user/S-1:2", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := api.secrets["tailscale"]["user_S-1_2"]; !ok {
+		t.Errorf("secret keys = %v; want user_S-1_2", api.secrets["tailscale"])
+	}
+
+	// API errors other than not found are returned.
+	ioutil.WriteFile(tokenFile, []byte("wrong"), 0600)
+	if _, err := store.ReadState("foo"); err == nil || err == ErrStateNotExist {
+		t.Errorf("ReadState with bad token = %v; want error", err)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logpolicy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+)
+
+// journalSocket is where systemd-journald receives native protocol
+// messages.
+const journalSocket = "/run/systemd/journal/socket"
+
+// journalWriter is an io.Writer that sends each write to journald as
+// a log message.
+type journalWriter struct {
+	ident string
+
+	mu sync.Mutex
+	c  net.Conn
+}
+
+func newJournalWriter(ident string) (*journalWriter, error) {
+	c, err := net.Dial("unixgram", journalSocket)
+	if err != nil {
+		return nil, err
+	}
+	return &journalWriter{ident: ident, c: c}, nil
+}
+
+func (w *journalWriter) Write(buf []byte) (int, error) {
+	msg := journalMessage(w.ident, buf)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err := w.c.Write(msg)
+	if err != nil {
+		// journald may have been restarted; reconnect and try once more.
+		c, derr := net.Dial("unixgram", journalSocket)
+		if derr != nil {
+			return 0, err
+		}
+		w.c.Close()
+		w.c = c
+		if _, err := w.c.Write(msg); err != nil {
+			return 0, err
+		}
+	}
+	return len(buf), nil
+}
+
+// journalMessage returns the journald native protocol datagram
+// logging buf, without its trailing newline, at info priority.
+func journalMessage(ident string, buf []byte) []byte {
+	buf = bytes.TrimSuffix(buf, []byte("\n"))
+	var msg bytes.Buffer
+	if bytes.IndexByte(buf, '\n') >= 0 {
+		// Values with newlines are length-prefixed instead.
+		msg.WriteString("MESSAGE\n")
+		var n [8]byte
+		binary.LittleEndian.PutUint64(n[:], uint64(len(buf)))
+		msg.Write(n[:])
+	} else {
+		msg.WriteString("MESSAGE=")
+	}
+	msg.Write(buf)
+	msg.WriteString("\nPRIORITY=6\nSYSLOG_IDENTIFIER=")
+	msg.WriteString(ident)
+	msg.WriteByte('\n')
+	return msg.Bytes()
+}
@@ -0,0 +1,24 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logpolicy
+
+import "testing"
+
+func TestJournalMessage(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"hello\n", "MESSAGE=hello\nPRIORITY=6\nSYSLOG_IDENTIFIER=tailscaled\n"},
+		{"hello", "MESSAGE=hello\nPRIORITY=6\nSYSLOG_IDENTIFIER=tailscaled\n"},
+		{"a\nb\n", "MESSAGE\n\x03\x00\x00\x00\x00\x00\x00\x00a\nb\nPRIORITY=6\nSYSLOG_IDENTIFIER=tailscaled\n"},
+	}
+	for _, tt := range tests {
+		got := string(journalMessage("tailscaled", []byte(tt.in)))
+		if got != tt.want {
+			t.Errorf("journalMessage(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
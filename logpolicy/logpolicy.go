@@ -12,11 +12,14 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -29,6 +32,7 @@ import (
 	"tailscale.com/atomicfile"
 	"tailscale.com/logtail"
 	"tailscale.com/logtail/filch"
+	"tailscale.com/logtail/logfile"
 	"tailscale.com/net/netns"
 	"tailscale.com/net/tlsdial"
 	"tailscale.com/smallzstd"
@@ -51,6 +55,48 @@ type Policy struct {
 	PublicID logtail.PublicID
 }
 
+// Options are the optional settings of a log policy.
+// The zero value uploads logs to logtail.DefaultHost and
+// also writes them to stderr.
+type Options struct {
+	// CollectorURL, if non-empty, is the base URL of the log server
+	// to upload logs to, as in "https://logs.example.com".
+	CollectorURL string
+	// LocalOnly, if true, keeps logs on this machine instead of
+	// uploading them. They're written to a file in the logs
+	// directory, rotated as it grows, as a series of zstd frames
+	// that each hold a JSON array of log entries.
+	LocalOnly bool
+	// Output is where logs are also written as text:
+	// "stderr" (the default), "syslog" or "journald".
+	Output string
+}
+
+// Check reports whether o is valid.
+func (o Options) Check() error {
+	if o.CollectorURL != "" {
+		if o.LocalOnly {
+			return errors.New("a collector URL can't be used with local-only logs")
+		}
+		u, err := url.Parse(o.CollectorURL)
+		if err != nil {
+			return fmt.Errorf("invalid collector URL: %v", err)
+		}
+		if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("invalid collector URL %q: want http or https URL with host", o.CollectorURL)
+		}
+		if u.RawQuery != "" || u.Fragment != "" {
+			return fmt.Errorf("invalid collector URL %q: query or fragment not allowed", o.CollectorURL)
+		}
+	}
+	switch o.Output {
+	case "", "stderr", "syslog", "journald":
+	default:
+		return fmt.Errorf("unknown log output %q; want stderr, syslog or journald", o.Output)
+	}
+	return nil
+}
+
 // ToBytes returns the JSON representation of c.
 func (c *Config) ToBytes() []byte {
 	data, err := json.MarshalIndent(c, "", "\t")
@@ -296,6 +342,16 @@ func tryFixLogStateLocation(dir, cmdname string) {
 // New returns a new log policy (a logger and its instance ID) for a
 // given collection name.
 func New(collection string) *Policy {
+	return NewWithOptions(collection, Options{})
+}
+
+// NewWithOptions is like New, but with the settings in opts,
+// which must be valid according to Options.Check.
+func NewWithOptions(collection string, opts Options) *Policy {
+	if err := opts.Check(); err != nil {
+		log.Fatalf("logpolicy: %v", err)
+	}
+
 	var lflags int
 	if terminal.IsTerminal(2) || runtime.GOOS == "windows" {
 		lflags = 0
@@ -307,7 +363,6 @@ func New(collection string) *Policy {
 		// anyway, no need to add one.
 		lflags = 0
 	}
-	console := log.New(stderrWriter{}, "", lflags)
 
 	var earlyErrBuf bytes.Buffer
 	earlyLogf := func(format string, a ...interface{}) {
@@ -315,9 +370,29 @@ func New(collection string) *Policy {
 		earlyErrBuf.WriteByte('\n')
 	}
 
+	cmdName := version.CmdName()
+
+	var out io.Writer = stderrWriter{}
+	switch opts.Output {
+	case "syslog", "journald":
+		var w io.Writer
+		var err error
+		if opts.Output == "syslog" {
+			w, err = newSyslogWriter(cmdName)
+		} else {
+			w, err = newJournalWriter(cmdName)
+		}
+		if err != nil {
+			earlyLogf("logpolicy: %s output failed, using stderr: %v", opts.Output, err)
+		} else {
+			// Both add their own timestamps.
+			out, lflags = w, 0
+		}
+	}
+	console := log.New(out, "", lflags)
+
 	dir := logsDir(earlyLogf)
 
-	cmdName := version.CmdName()
 	tryFixLogStateLocation(dir, cmdName)
 
 	cfgPath := filepath.Join(dir, fmt.Sprintf("%s.log.conf", cmdName))
@@ -367,7 +442,28 @@ func New(collection string) *Policy {
 			}
 			return w
 		},
-		HTTPC: &http.Client{Transport: newLogtailTransport(logtail.DefaultHost)},
+	}
+	var logfileErr error
+	switch {
+	case opts.LocalOnly:
+		path := filepath.Join(dir, cmdName+".log.json.zst")
+		lf, err := logfile.Open(path, logfile.Options{})
+		if err != nil {
+			// Never upload in local-only mode, even if the
+			// logs can't be kept.
+			logfileErr = err
+			c.Sink = ioutil.Discard
+		} else {
+			c.Sink = lf
+		}
+		earlyLogf("logpolicy: writing logs locally to %q", path)
+	case opts.CollectorURL != "":
+		c.BaseURL = strings.TrimSuffix(opts.CollectorURL, "/")
+		u, _ := url.Parse(c.BaseURL) // checked above
+		c.HTTPC = &http.Client{Transport: newLogtailTransport(u.Hostname())}
+		earlyLogf("logpolicy: uploading logs to %q", c.BaseURL)
+	default:
+		c.HTTPC = &http.Client{Transport: newLogtailTransport(logtail.DefaultHost)}
 	}
 
 	filchBuf, filchErr := filch.New(filepath.Join(dir, cmdName), filch.Options{})
@@ -386,6 +482,9 @@ func New(collection string) *Policy {
 	if filchErr != nil {
 		log.Printf("filch failed: %v", filchErr)
 	}
+	if logfileErr != nil {
+		log.Printf("logfile failed: %v", logfileErr)
+	}
 	if earlyErrBuf.Len() != 0 {
 		log.Printf("%s", earlyErrBuf.Bytes())
 	}
@@ -0,0 +1,31 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logpolicy
+
+import "testing"
+
+func TestOptionsCheck(t *testing.T) {
+	tests := []struct {
+		opts    Options
+		wantErr bool
+	}{
+		{Options{}, false},
+		{Options{CollectorURL: "https://logs.example.com"}, false},
+		{Options{CollectorURL: "http://10.0.0.1:8080/"}, false},
+		{Options{LocalOnly: true, Output: "journald"}, false},
+		{Options{Output: "syslog"}, false},
+		{Options{CollectorURL: "logs.example.com"}, true},
+		{Options{CollectorURL: "ftp://logs.example.com"}, true},
+		{Options{CollectorURL: "https://logs.example.com/?x=1"}, true},
+		{Options{CollectorURL: "https://logs.example.com", LocalOnly: true}, true},
+		{Options{Output: "file"}, true},
+	}
+	for _, tt := range tests {
+		err := tt.opts.Check()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%+v.Check() = %v; want error: %v", tt.opts, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package logfile writes logs to a file, rotating it as it grows.
+package logfile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultMaxSize  = 10 << 20
+	defaultMaxFiles = 4
+)
+
+// Options configures the rotation of a File.
+type Options struct {
+	MaxSize  int64 // size past which the file is rotated; if zero, 10 MiB
+	MaxFiles int   // rotated files kept besides the current one; if zero, 4
+}
+
+// A File is a log file that is rotated when it grows past a maximum
+// size. The current file is at its path, and the rotated ones next to
+// it, numbered from the most recent: logs.json.zst is rotated to
+// logs.json.1.zst, which is rotated to logs.json.2.zst, and so on.
+//
+// Each Write ends up whole in one file, so that a file holds complete
+// records if each Write is one.
+type File struct {
+	path string
+	opts Options
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// Open opens the log file at path, appending to it if it exists.
+func Open(path string, opts Options) (*File, error) {
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = defaultMaxSize
+	}
+	if opts.MaxFiles <= 0 {
+		opts.MaxFiles = defaultMaxFiles
+	}
+	lf := &File{path: path, opts: opts}
+	if err := lf.openLocked(); err != nil {
+		return nil, err
+	}
+	return lf, nil
+}
+
+func (lf *File) openLocked() error {
+	f, err := os.OpenFile(lf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("logfile: %v", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("logfile: %v", err)
+	}
+	lf.f, lf.size = f, fi.Size()
+	return nil
+}
+
+// rotatedPath returns the path of the nth most recently rotated file.
+func (lf *File) rotatedPath(n int) string {
+	ext := filepath.Ext(lf.path)
+	return fmt.Sprintf("%s.%d%s", strings.TrimSuffix(lf.path, ext), n, ext)
+}
+
+func (lf *File) rotateLocked() error {
+	if err := lf.f.Close(); err != nil {
+		return err
+	}
+	lf.f = nil
+	for n := lf.opts.MaxFiles - 1; n >= 1; n-- {
+		err := os.Rename(lf.rotatedPath(n), lf.rotatedPath(n+1))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("logfile: %v", err)
+		}
+	}
+	if err := os.Rename(lf.path, lf.rotatedPath(1)); err != nil {
+		return fmt.Errorf("logfile: %v", err)
+	}
+	return lf.openLocked()
+}
+
+// Write writes b to the file, rotating the file first if b would
+// take it past the maximum size.
+func (lf *File) Write(b []byte) (int, error) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+
+	if lf.f == nil {
+		// A previous rotation failed; try again.
+		if err := lf.openLocked(); err != nil {
+			return 0, err
+		}
+	}
+	if lf.size > 0 && lf.size+int64(len(b)) > lf.opts.MaxSize {
+		if err := lf.rotateLocked(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := lf.f.Write(b)
+	lf.size += int64(n)
+	return n, err
+}
+
+// Close closes the file.
+func (lf *File) Close() error {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+
+	if lf.f == nil {
+		return nil
+	}
+	err := lf.f.Close()
+	lf.f = nil
+	return err
+}
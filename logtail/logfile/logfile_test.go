@@ -0,0 +1,73 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logfile-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "logs.json.zst")
+
+	lf, err := Open(path, Options{MaxSize: 10, MaxFiles: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"aaaa", "bbbb", "cccc", "dddd", "eeeeeeeeeeeeeeee", "ffff"} {
+		if _, err := lf.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"logs.json.zst":   "ffff",
+		"logs.json.1.zst": "eeeeeeeeeeeeeeee",
+		"logs.json.2.zst": "ccccdddd",
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != len(want) {
+		var names []string
+		for _, fi := range fis {
+			names = append(names, fi.Name())
+		}
+		t.Errorf("files = %s; want %d", strings.Join(names, ", "), len(want))
+	}
+	for name, content := range want {
+		got, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if string(got) != content {
+			t.Errorf("%s = %q; want %q", name, got, content)
+		}
+	}
+
+	// Reopening appends to the current file.
+	lf, err = Open(path, Options{MaxSize: 10, MaxFiles: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lf.Write([]byte("gg"))
+	lf.Close()
+	if got, _ := ioutil.ReadFile(path); string(got) != "ffffgg" {
+		t.Errorf("after reopening: %q; want %q", got, "ffffgg")
+	}
+}
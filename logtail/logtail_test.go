@@ -5,7 +5,10 @@
 package logtail
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"sync"
 	"testing"
 	"time"
 )
@@ -47,3 +50,45 @@ func TestLoggerWriteLength(t *testing.T) {
 		t.Errorf("logger.Write wrote %d bytes, expected %d", n, len(inBuf))
 	}
 }
+
+// batchSink is a Config.Sink that keeps the batches written to it.
+type batchSink struct {
+	mu      sync.Mutex
+	batches [][]byte
+}
+
+func (s *batchSink) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches = append(s.batches, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func TestSink(t *testing.T) {
+	sink := new(batchSink)
+	l := Log(Config{
+		BaseURL: "http://localhost:1234",
+		Sink:    sink,
+	}, t.Logf)
+	l.Write([]byte("hello, sink"))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := l.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	var found bool
+	for _, b := range sink.batches {
+		if !json.Valid(b) {
+			t.Errorf("batch is not JSON: %q", b)
+		}
+		if bytes.Contains(b, []byte(`"text": "hello, sink"`)) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("log line not in batches %q", sink.batches)
+	}
+}
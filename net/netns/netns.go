@@ -17,8 +17,23 @@ package netns
 import (
 	"context"
 	"net"
+	"sync/atomic"
 )
 
+// bypassMark is the packet mark set on sockets on Linux, or zero for
+// the default. It's accessed atomically.
+var bypassMark uint32
+
+// SetBypassMark sets the packet mark (fwmark) that marks sockets
+// created by this package on Linux as bypassing Tailscale routes. It
+// must match the bypass mark of the router. Zero means the default,
+// 0x80000.
+//
+// It's ignored on other platforms.
+func SetBypassMark(mark uint32) {
+	atomic.StoreUint32(&bypassMark, mark)
+}
+
 // Listener returns a new net.Listener with its Control hook func
 // initialized as necessary to run in logical network namespace that
 // doesn't route back into Tailscale.
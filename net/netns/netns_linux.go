@@ -15,14 +15,15 @@ import (
 	"os/exec"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 
 	"golang.org/x/sys/unix"
 )
 
-// tailscaleBypassMark is the mark indicating that packets originating
-// from a socket should bypass Tailscale-managed routes during routing
-// table lookups.
+// tailscaleBypassMark is the default mark indicating that packets
+// originating from a socket should bypass Tailscale-managed routes
+// during routing table lookups. See SetBypassMark.
 //
 // Keep this in sync with tailscaleBypassMark in
 // wgengine/router/router_linux.go.
@@ -126,7 +127,11 @@ func control(network, address string, c syscall.RawConn) error {
 }
 
 func setBypassMark(fd uintptr) error {
-	if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, tailscaleBypassMark); err != nil {
+	mark := atomic.LoadUint32(&bypassMark)
+	if mark == 0 {
+		mark = tailscaleBypassMark
+	}
+	if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, int(mark)); err != nil {
 		return fmt.Errorf("setting SO_MARK bypass: %w", err)
 	}
 	return nil
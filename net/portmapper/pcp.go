@@ -0,0 +1,149 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package portmapper
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// PCP constants, from RFC 6887.
+const (
+	pcpVersion     = 2
+	pcpOpMap       = 1
+	pcpOpReply     = 0x80 // OR'd into the opcode of responses
+	pcpMapLen      = 60   // 24 byte header + 36 byte MAP payload
+	pcpCodeOK      = 0
+	pcpCodeUnsupp  = 1 // UNSUPP_VERSION
+	pcpCodeNotAuth = 2 // NOT_AUTHORIZED
+
+	udpProtoNumber = 17
+)
+
+var v4unspec = netaddr.IPv4(0, 0, 0, 0)
+
+// pcpMapRequest returns a PCP MAP request asking for a UDP mapping to
+// localPort on myIP for lifetime seconds. A lifetime of zero deletes
+// the mapping. suggested, if non-zero, is the external address we'd
+// like.
+func pcpMapRequest(myIP netaddr.IP, nonce [12]byte, localPort uint16, suggested netaddr.IPPort, lifetime uint32) []byte {
+	pkt := make([]byte, pcpMapLen)
+	pkt[0] = pcpVersion
+	pkt[1] = pcpOpMap
+	binary.BigEndian.PutUint32(pkt[4:8], lifetime)
+	myIP16 := myIP.As16()
+	copy(pkt[8:24], myIP16[:])
+	copy(pkt[24:36], nonce[:])
+	pkt[36] = udpProtoNumber
+	binary.BigEndian.PutUint16(pkt[40:42], localPort)
+	binary.BigEndian.PutUint16(pkt[42:44], suggested.Port)
+	extIP := suggested.IP
+	if extIP.IsZero() {
+		extIP = v4unspec
+	}
+	ext16 := extIP.As16()
+	copy(pkt[44:60], ext16[:])
+	return pkt
+}
+
+// pcpMapResponse is a parsed PCP MAP response.
+type pcpMapResponse struct {
+	code         uint8
+	lifetime     uint32
+	nonce        [12]byte
+	internalPort uint16
+	external     netaddr.IPPort
+}
+
+// parsePCPMapResponse parses a PCP MAP response. It reports false if
+// b isn't one.
+func parsePCPMapResponse(b []byte) (res pcpMapResponse, ok bool) {
+	if len(b) < 24 || b[0] != pcpVersion || b[1] != pcpOpMap|pcpOpReply {
+		return res, false
+	}
+	res.code = b[3]
+	res.lifetime = binary.BigEndian.Uint32(b[4:8])
+	if len(b) < pcpMapLen {
+		// Error responses may omit the opcode payload.
+		return res, res.code != pcpCodeOK
+	}
+	copy(res.nonce[:], b[24:36])
+	res.internalPort = binary.BigEndian.Uint16(b[40:42])
+	res.external.Port = binary.BigEndian.Uint16(b[42:44])
+	res.external.IP, _ = netaddr.FromStdIP(net.IP(b[44:60]))
+	return res, true
+}
+
+func (c *Client) createPCPMapping(ctx context.Context, gw, myIP netaddr.IP, port uint16, prev *mapping) (*mapping, error) {
+	m := &mapping{
+		proto:    "pcp",
+		gw:       gw,
+		myIP:     myIP,
+		internal: port,
+	}
+	var suggested netaddr.IPPort
+	if prev != nil {
+		// Renewals must reuse the nonce of the original request.
+		m.pcpNonce = prev.pcpNonce
+		suggested = prev.external
+	} else if _, err := rand.Read(m.pcpNonce[:]); err != nil {
+		return nil, err
+	}
+
+	lifetime := uint32(mappingLifetime / time.Second)
+	req := pcpMapRequest(myIP, m.pcpNonce, m.internal, suggested, lifetime)
+	var res pcpMapResponse
+	var pmpOnly, gotRes bool
+	err := exchange(ctx, c.pxpAddr(gw), pxpTimeout, [][]byte{req}, func(b []byte) bool {
+		if len(b) >= 2 && b[0] == pmpVersion {
+			// A NAT-PMP server telling us it doesn't speak PCP.
+			pmpOnly = true
+			return true
+		}
+		r, ok := parsePCPMapResponse(b)
+		if !ok || (r.code == pcpCodeOK && (r.nonce != m.pcpNonce || r.internalPort != m.internal)) {
+			return false
+		}
+		res, gotRes = r, true
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if pmpOnly || !gotRes {
+		return nil, errNotSupported
+	}
+	switch res.code {
+	case pcpCodeOK:
+	case pcpCodeUnsupp:
+		return nil, errNotSupported
+	case pcpCodeNotAuth:
+		return nil, errors.New("PCP: mapping not authorized by gateway")
+	default:
+		return nil, fmt.Errorf("PCP: gateway returned result code %d", res.code)
+	}
+	if res.external.IP.IsZero() || res.external.Port == 0 {
+		return nil, fmt.Errorf("PCP: gateway returned invalid external address %v", res.external)
+	}
+
+	now := time.Now()
+	d := time.Duration(res.lifetime) * time.Second
+	m.external = res.external
+	m.goodUntil = now.Add(d)
+	m.renewAfter = now.Add(d / 2)
+	return m, nil
+}
+
+func (c *Client) releasePCPMapping(ctx context.Context, m *mapping) error {
+	req := pcpMapRequest(m.myIP, m.pcpNonce, m.internal, m.external, 0)
+	return send(ctx, c.pxpAddr(m.gw), req)
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package portmapper
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// NAT-PMP constants, from RFC 6886.
+const (
+	pmpVersion      = 0
+	pmpOpPublicAddr = 0
+	pmpOpMapUDP     = 1
+	pmpOpReply      = 0x80 // OR'd into the opcode of responses
+	pmpCodeOK       = 0
+	pmpCodeUnsupp   = 1 // Unsupported Version
+)
+
+// pmpPublicAddrRequest is a NAT-PMP request for the gateway's
+// external address.
+var pmpPublicAddrRequest = []byte{pmpVersion, pmpOpPublicAddr}
+
+// pmpMapRequest returns a NAT-PMP request asking for a UDP mapping to
+// localPort for lifetime seconds. A lifetime of zero deletes the
+// mapping.
+func pmpMapRequest(localPort, suggestedPort uint16, lifetime uint32) []byte {
+	pkt := make([]byte, 12)
+	pkt[0] = pmpVersion
+	pkt[1] = pmpOpMapUDP
+	binary.BigEndian.PutUint16(pkt[4:6], localPort)
+	binary.BigEndian.PutUint16(pkt[6:8], suggestedPort)
+	binary.BigEndian.PutUint32(pkt[8:12], lifetime)
+	return pkt
+}
+
+// pmpResponse is a parsed NAT-PMP response.
+type pmpResponse struct {
+	op   uint8 // without pmpOpReply
+	code uint16
+
+	// For pmpOpPublicAddr:
+	publicAddr netaddr.IP
+
+	// For pmpOpMapUDP:
+	internalPort uint16
+	externalPort uint16
+	lifetime     uint32
+}
+
+// parsePMPResponse parses a NAT-PMP response. It reports false if b
+// isn't one.
+func parsePMPResponse(b []byte) (res pmpResponse, ok bool) {
+	if len(b) < 4 || b[0] != pmpVersion || b[1]&pmpOpReply == 0 {
+		return res, false
+	}
+	res.op = b[1] &^ pmpOpReply
+	res.code = binary.BigEndian.Uint16(b[2:4])
+	if res.code != pmpCodeOK {
+		return res, true
+	}
+	switch res.op {
+	case pmpOpPublicAddr:
+		if len(b) < 12 {
+			return res, false
+		}
+		res.publicAddr = netaddr.IPv4(b[8], b[9], b[10], b[11])
+	case pmpOpMapUDP:
+		if len(b) < 16 {
+			return res, false
+		}
+		res.internalPort = binary.BigEndian.Uint16(b[8:10])
+		res.externalPort = binary.BigEndian.Uint16(b[10:12])
+		res.lifetime = binary.BigEndian.Uint32(b[12:16])
+	default:
+		return res, false
+	}
+	return res, true
+}
+
+func (c *Client) createPMPMapping(ctx context.Context, gw, myIP netaddr.IP, port uint16, prev *mapping) (*mapping, error) {
+	m := &mapping{
+		proto:    "pmp",
+		gw:       gw,
+		myIP:     myIP,
+		internal: port,
+	}
+	var suggested uint16
+	if prev != nil {
+		suggested = prev.external.Port
+	}
+
+	lifetime := uint32(mappingLifetime / time.Second)
+	reqs := [][]byte{
+		pmpPublicAddrRequest,
+		pmpMapRequest(m.internal, suggested, lifetime),
+	}
+	var addrRes, mapRes pmpResponse
+	var gotAddr, gotMap bool
+	var resErr error
+	err := exchange(ctx, c.pxpAddr(gw), pxpTimeout, reqs, func(b []byte) bool {
+		r, ok := parsePMPResponse(b)
+		if !ok {
+			return false
+		}
+		switch {
+		case r.code == pmpCodeUnsupp:
+			resErr = errNotSupported
+			return true
+		case r.code != pmpCodeOK:
+			resErr = fmt.Errorf("NAT-PMP: gateway returned result code %d for opcode %d", r.code, r.op)
+			return true
+		case r.op == pmpOpPublicAddr:
+			addrRes, gotAddr = r, true
+		case r.op == pmpOpMapUDP && r.internalPort == m.internal:
+			mapRes, gotMap = r, true
+		}
+		return gotAddr && gotMap
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resErr != nil {
+		return nil, resErr
+	}
+	if !gotAddr || !gotMap {
+		return nil, errNotSupported
+	}
+	if addrRes.publicAddr == v4unspec || mapRes.externalPort == 0 {
+		return nil, fmt.Errorf("NAT-PMP: gateway returned invalid external address %v:%d", addrRes.publicAddr, mapRes.externalPort)
+	}
+
+	now := time.Now()
+	d := time.Duration(mapRes.lifetime) * time.Second
+	m.external = netaddr.IPPort{IP: addrRes.publicAddr, Port: mapRes.externalPort}
+	m.goodUntil = now.Add(d)
+	m.renewAfter = now.Add(d / 2)
+	return m, nil
+}
+
+func (c *Client) releasePMPMapping(ctx context.Context, m *mapping) error {
+	return send(ctx, c.pxpAddr(m.gw), pmpMapRequest(m.internal, 0, 0))
+}
@@ -0,0 +1,398 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package portmapper is a UDP port mapping client. It asks the LAN's
+// gateway to forward an external port to a local UDP port using
+// whichever of PCP (RFC 6887), NAT-PMP (RFC 6886) or UPnP IGD the
+// gateway speaks, and keeps that mapping alive.
+package portmapper
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/interfaces"
+	"tailscale.com/net/netns"
+	"tailscale.com/types/logger"
+)
+
+var (
+	// ErrNoPortMappingServices is returned by CreateOrGetMapping when
+	// the gateway doesn't answer any of the supported protocols.
+	ErrNoPortMappingServices = errors.New("no port mapping services were found")
+
+	// ErrGatewayNotFound is returned by CreateOrGetMapping when the
+	// LAN's gateway can't be determined.
+	ErrGatewayNotFound = errors.New("failed to look up gateway address")
+
+	errClosed           = errors.New("portmapper: client closed")
+	errNoLocalPort      = errors.New("portmapper: local port not set")
+	errLocalPortChanged = errors.New("portmapper: local port changed")
+)
+
+const (
+	// defaultPxPPort is the port on which gateways listen for PCP
+	// and NAT-PMP requests.
+	defaultPxPPort = 5351
+
+	// defaultSSDPPort is the port on which gateways listen for UPnP
+	// discovery requests.
+	defaultSSDPPort = 1900
+
+	// mappingLifetime is the lifetime we ask for new mappings to
+	// have. Mappings are renewed once half of it has passed.
+	mappingLifetime = 2 * time.Hour
+
+	// pxpTimeout is how long we wait for the gateway to answer a
+	// single PCP or NAT-PMP request.
+	pxpTimeout = 250 * time.Millisecond
+
+	// upnpTimeout bounds the whole UPnP exchange: discovery,
+	// fetching the device description and the SOAP requests.
+	upnpTimeout = 2 * time.Second
+
+	// releaseTimeout bounds releasing a mapping on Close.
+	releaseTimeout = time.Second
+
+	// retryAfterFailure is how long CreateOrGetMapping waits after
+	// failing to create a mapping before asking the gateway again.
+	retryAfterFailure = 5 * time.Minute
+)
+
+// Client is a port mapping client. Its zero value is not valid; use
+// NewClient.
+type Client struct {
+	logf logger.Logf
+
+	// Test hooks; zero values mean the defaults.
+	ipAndGateway func() (gw, myIP netaddr.IP, ok bool)
+	pxpPort      uint16
+	ssdpPort     uint16
+
+	mu          sync.Mutex // guards following; not held during network I/O
+	closed      bool
+	localPort   uint16
+	mapping     *mapping // or nil
+	lastFailure time.Time
+	lastErr     error
+}
+
+// mapping is a port mapping obtained from the gateway.
+type mapping struct {
+	proto      string // "pcp", "pmp" or "upnp"
+	gw         netaddr.IP
+	myIP       netaddr.IP
+	internal   uint16
+	external   netaddr.IPPort
+	renewAfter time.Time
+	goodUntil  time.Time
+
+	pcpNonce       [12]byte // for "pcp"
+	upnpService    string   // for "upnp"; the WAN connection service type
+	upnpControlURL string   // for "upnp"
+}
+
+// NewClient returns a new port mapping client that logs to logf.
+func NewClient(logf logger.Logf) *Client {
+	return &Client{logf: logf}
+}
+
+// SetLocalPort sets the local UDP port to map. If it differs from
+// the port of the current mapping, that mapping is released.
+func (c *Client) SetLocalPort(port uint16) {
+	c.mu.Lock()
+	if c.localPort == port {
+		c.mu.Unlock()
+		return
+	}
+	c.localPort = port
+	c.lastFailure = time.Time{}
+	m := c.mapping
+	c.mapping = nil
+	c.mu.Unlock()
+	c.release(m)
+}
+
+// CreateOrGetMapping returns the external address of a mapping to
+// the local port, creating or renewing the mapping as needed.
+//
+// It returns ErrNoPortMappingServices if the gateway doesn't support
+// any of the port mapping protocols. After a failure, it returns the
+// same error without contacting the gateway for a few minutes, unless
+// the gateway or the local port changes.
+func (c *Client) CreateOrGetMapping(ctx context.Context) (external netaddr.IPPort, err error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return netaddr.IPPort{}, errClosed
+	}
+	port := c.localPort
+	if port == 0 {
+		c.mu.Unlock()
+		return netaddr.IPPort{}, errNoLocalPort
+	}
+	gw, myIP, ok := c.gatewayAndSelfIP()
+	if !ok {
+		c.mu.Unlock()
+		return netaddr.IPPort{}, ErrGatewayNotFound
+	}
+
+	now := time.Now()
+	prev := c.mapping
+	if prev != nil && (prev.gw != gw || prev.myIP != myIP) {
+		// We moved networks. The old gateway is unreachable, so
+		// there's nothing to release; just forget the mapping.
+		c.mapping, prev = nil, nil
+		c.lastFailure = time.Time{}
+	}
+	if prev != nil && now.Before(prev.renewAfter) {
+		c.mu.Unlock()
+		return prev.external, nil
+	}
+	if prev == nil && !c.lastFailure.IsZero() && now.Sub(c.lastFailure) < retryAfterFailure {
+		err := c.lastErr
+		c.mu.Unlock()
+		return netaddr.IPPort{}, err
+	}
+	c.mu.Unlock()
+
+	// Talk to the gateway without holding c.mu, so that Close
+	// and SetLocalPort don't wait for it.
+	m, err := c.createMapping(ctx, gw, myIP, port, prev)
+
+	c.mu.Lock()
+	if c.closed || c.localPort != port {
+		// The mapping is no longer wanted.
+		closed := c.closed
+		c.mu.Unlock()
+		c.release(m)
+		if closed {
+			return netaddr.IPPort{}, errClosed
+		}
+		return netaddr.IPPort{}, errLocalPortChanged
+	}
+	if cur := c.mapping; cur != nil && cur != prev {
+		// A concurrent call got a mapping while we were talking to
+		// the gateway. Keep that one.
+		c.mu.Unlock()
+		if err == nil && !sameGatewayMapping(m, cur) {
+			c.release(m)
+		}
+		return cur.external, nil
+	}
+	defer c.mu.Unlock()
+	if err != nil {
+		if prev != nil && now.Before(prev.goodUntil) {
+			c.logf("failed to renew %s mapping %v, keeping it: %v", prev.proto, prev.external, err)
+			return prev.external, nil
+		}
+		if c.mapping == prev {
+			c.mapping = nil
+		}
+		if ctx.Err() == nil {
+			c.logf("failed to create mapping for local port %d: %v", port, err)
+			c.lastFailure, c.lastErr = now, err
+		}
+		return netaddr.IPPort{}, err
+	}
+	if prev == nil || prev.external != m.external {
+		c.logf("mapped %v -> local port %d using %s", m.external, m.internal, m.proto)
+	}
+	c.mapping = m
+	c.lastFailure = time.Time{}
+	return m.external, nil
+}
+
+// Close releases the current mapping, if any. After Close,
+// CreateOrGetMapping always fails.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	m := c.mapping
+	c.mapping = nil
+	c.mu.Unlock()
+	c.release(m)
+	return nil
+}
+
+// release asks the gateway to delete the mapping m, which may be nil.
+// Failures are logged but otherwise ignored; the mapping will expire
+// on its own.
+//
+// c.mu must not be held.
+func (c *Client) release(m *mapping) {
+	if m == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+	defer cancel()
+	var err error
+	switch m.proto {
+	case "pcp":
+		err = c.releasePCPMapping(ctx, m)
+	case "pmp":
+		err = c.releasePMPMapping(ctx, m)
+	case "upnp":
+		err = c.releaseUPnPMapping(ctx, m)
+	}
+	if err != nil {
+		c.logf("releasing %s mapping %v: %v", m.proto, m.external, err)
+	}
+}
+
+// sameGatewayMapping reports whether m, a mapping that lost a race
+// with cur, may be cur itself on the gateway, so that releasing m
+// would delete cur. PCP and NAT-PMP gateways keep one mapping per
+// internal port and release by internal port, which on gateways that
+// also speak UPnP can hit a UPnP mapping too. UPnP mappings are
+// released by external port.
+func sameGatewayMapping(m, cur *mapping) bool {
+	if m.proto != "upnp" {
+		return true
+	}
+	return m.external.Port == cur.external.Port
+}
+
+// createMapping asks the gateway gw for a mapping to port,
+// trying each protocol in turn. If prev is non-nil, its protocol is
+// tried first so the gateway renews the existing mapping.
+func (c *Client) createMapping(ctx context.Context, gw, myIP netaddr.IP, port uint16, prev *mapping) (*mapping, error) {
+	type creator struct {
+		proto string
+		fn    func(context.Context, netaddr.IP, netaddr.IP, uint16, *mapping) (*mapping, error)
+	}
+	creators := []creator{
+		{"pcp", c.createPCPMapping},
+		{"pmp", c.createPMPMapping},
+		{"upnp", c.createUPnPMapping},
+	}
+	if prev != nil {
+		for i, cr := range creators {
+			if cr.proto == prev.proto {
+				creators[0], creators[i] = creators[i], creators[0]
+				break
+			}
+		}
+	}
+	var firstErr error
+	for _, cr := range creators {
+		var p *mapping
+		if prev != nil && prev.proto == cr.proto {
+			p = prev
+		}
+		m, err := cr.fn(ctx, gw, myIP, port, p)
+		if err == nil {
+			return m, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != errNoResponse && err != errNotSupported && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return nil, ErrNoPortMappingServices
+}
+
+func (c *Client) gatewayAndSelfIP() (gw, myIP netaddr.IP, ok bool) {
+	if c.ipAndGateway != nil {
+		return c.ipAndGateway()
+	}
+	return interfaces.LikelyHomeRouterIP()
+}
+
+func (c *Client) pxpAddr(gw netaddr.IP) *net.UDPAddr {
+	port := c.pxpPort
+	if port == 0 {
+		port = defaultPxPPort
+	}
+	return netaddr.IPPort{IP: gw, Port: port}.UDPAddr()
+}
+
+func (c *Client) ssdpAddr(gw netaddr.IP) *net.UDPAddr {
+	port := c.ssdpPort
+	if port == 0 {
+		port = defaultSSDPPort
+	}
+	return netaddr.IPPort{IP: gw, Port: port}.UDPAddr()
+}
+
+var (
+	// errNoResponse is returned when the gateway doesn't answer a
+	// request, meaning it probably doesn't speak the protocol.
+	errNoResponse = errors.New("portmapper: no response from gateway")
+
+	// errNotSupported is returned when the gateway answers that it
+	// doesn't support the protocol version or operation.
+	errNotSupported = errors.New("portmapper: not supported by gateway")
+)
+
+// exchange sends each of pkts to addr from a new UDP socket, then
+// passes each packet received from addr to handle until handle
+// returns true or timeout passes. It returns errNoResponse if nothing
+// was received at all.
+func exchange(ctx context.Context, addr *net.UDPAddr, timeout time.Duration, pkts [][]byte, handle func([]byte) (done bool)) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	uc, err := netns.Listener().ListenPacket(ctx, "udp4", ":0")
+	if err != nil {
+		return err
+	}
+	defer uc.Close()
+	go func() {
+		<-ctx.Done()
+		uc.SetReadDeadline(time.Now())
+	}()
+	for _, pkt := range pkts {
+		if _, err := uc.WriteTo(pkt, addr); err != nil {
+			return err
+		}
+	}
+
+	gotAny := false
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := uc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() == context.Canceled {
+				return ctx.Err()
+			}
+			if !gotAny {
+				return errNoResponse
+			}
+			return nil
+		}
+		if ua, ok := from.(*net.UDPAddr); !ok || !ua.IP.Equal(addr.IP) || ua.Port != addr.Port {
+			continue
+		}
+		gotAny = true
+		if handle(buf[:n]) {
+			return nil
+		}
+	}
+}
+
+// send sends pkt to addr from a new UDP socket without waiting for a
+// reply.
+func send(ctx context.Context, addr *net.UDPAddr, pkt []byte) error {
+	uc, err := netns.Listener().ListenPacket(ctx, "udp4", ":0")
+	if err != nil {
+		return err
+	}
+	defer uc.Close()
+	_, err = uc.WriteTo(pkt, addr)
+	return err
+}
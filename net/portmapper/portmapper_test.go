@@ -0,0 +1,510 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package portmapper
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+var (
+	loopback = netaddr.IPv4(127, 0, 0, 1)
+	fakeWAN  = netaddr.IPv4(203, 0, 113, 7)
+)
+
+// fakeGateway is a gateway on loopback that speaks some subset of
+// PCP, NAT-PMP and UPnP IGD.
+type fakeGateway struct {
+	t    *testing.T
+	pcp  bool
+	pmp  bool
+	upnp bool
+
+	// upnpPermanentOnly makes the UPnP service refuse mappings with
+	// a lease duration.
+	upnpPermanentOnly bool
+
+	pxp  net.PacketConn
+	ssdp net.PacketConn
+	http *httptest.Server
+
+	mu       sync.Mutex
+	mappings map[uint16]uint16 // internal port -> external port
+	packets  int               // PCP, NAT-PMP and SSDP packets received
+	requests int               // mapping creations and renewals
+}
+
+func newFakeGateway(t *testing.T, pcp, pmp, upnp bool) *fakeGateway {
+	g := &fakeGateway{
+		t:        t,
+		pcp:      pcp,
+		pmp:      pmp,
+		upnp:     upnp,
+		mappings: map[uint16]uint16{},
+	}
+	var err error
+	if g.pxp, err = net.ListenPacket("udp4", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	if g.ssdp, err = net.ListenPacket("udp4", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	g.http = httptest.NewServer(http.HandlerFunc(g.serveHTTP))
+	go g.servePxP()
+	go g.serveSSDP()
+	return g
+}
+
+func (g *fakeGateway) Close() {
+	g.pxp.Close()
+	g.ssdp.Close()
+	g.http.Close()
+}
+
+// newClient returns a Client that talks to g.
+func (g *fakeGateway) newClient(localPort uint16) *Client {
+	c := NewClient(g.t.Logf)
+	c.ipAndGateway = func() (gw, myIP netaddr.IP, ok bool) {
+		return loopback, loopback, true
+	}
+	c.pxpPort = uint16(g.pxp.LocalAddr().(*net.UDPAddr).Port)
+	c.ssdpPort = uint16(g.ssdp.LocalAddr().(*net.UDPAddr).Port)
+	c.SetLocalPort(localPort)
+	return c
+}
+
+func (g *fakeGateway) mapping(internal uint16) (external uint16, ok bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	external, ok = g.mappings[internal]
+	return
+}
+
+func (g *fakeGateway) numRequests() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.requests
+}
+
+func (g *fakeGateway) numPackets() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.packets
+}
+
+func (g *fakeGateway) countPacket() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.packets++
+}
+
+// setMapping records a mapping, or deletes it if lifetime is zero,
+// and returns the external port.
+func (g *fakeGateway) setMapping(internal uint16, lifetime uint32) uint16 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if lifetime == 0 {
+		delete(g.mappings, internal)
+		return 0
+	}
+	g.requests++
+	ext, ok := g.mappings[internal]
+	if !ok {
+		ext = internal + 10000
+		g.mappings[internal] = ext
+	}
+	return ext
+}
+
+func (g *fakeGateway) servePxP() {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := g.pxp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		g.countPacket()
+		b := buf[:n]
+		var res []byte
+		switch {
+		case n >= pcpMapLen && b[0] == pcpVersion && b[1] == pcpOpMap:
+			if !g.pcp {
+				if g.pmp {
+					res = []byte{pmpVersion, pmpOpReply | b[1], 0, pmpCodeUnsupp}
+				}
+				break
+			}
+			lifetime := binary.BigEndian.Uint32(b[4:8])
+			internal := binary.BigEndian.Uint16(b[40:42])
+			ext := g.setMapping(internal, lifetime)
+			res = make([]byte, pcpMapLen)
+			copy(res, b)
+			res[1] = pcpOpMap | pcpOpReply
+			res[3] = pcpCodeOK
+			binary.BigEndian.PutUint32(res[8:12], 1) // epoch
+			for i := 12; i < 24; i++ {
+				res[i] = 0
+			}
+			binary.BigEndian.PutUint16(res[42:44], ext)
+			ext16 := fakeWAN.As16()
+			copy(res[44:60], ext16[:])
+		case n >= 2 && b[0] == pmpVersion && g.pmp:
+			switch b[1] {
+			case pmpOpPublicAddr:
+				res = make([]byte, 12)
+				res[1] = pmpOpReply | pmpOpPublicAddr
+				ip4 := fakeWAN.As4()
+				copy(res[8:12], ip4[:])
+			case pmpOpMapUDP:
+				if n < 12 {
+					break
+				}
+				internal := binary.BigEndian.Uint16(b[4:6])
+				lifetime := binary.BigEndian.Uint32(b[8:12])
+				ext := g.setMapping(internal, lifetime)
+				res = make([]byte, 16)
+				res[1] = pmpOpReply | pmpOpMapUDP
+				binary.BigEndian.PutUint16(res[8:10], internal)
+				binary.BigEndian.PutUint16(res[10:12], ext)
+				binary.BigEndian.PutUint32(res[12:16], lifetime)
+			}
+		}
+		if res != nil {
+			g.pxp.WriteTo(res, addr)
+		}
+	}
+}
+
+func (g *fakeGateway) serveSSDP() {
+	buf := make([]byte, 1500)
+	for {
+		_, addr, err := g.ssdp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		g.countPacket()
+		if !g.upnp {
+			continue
+		}
+		res := "HTTP/1.1 200 OK\r\n" +
+			"CACHE-CONTROL: max-age=120\r\n" +
+			"ST: " + upnpSearchTarget + "\r\n" +
+			"LOCATION: " + g.http.URL + "/rootDesc.xml\r\n" +
+			"\r\n"
+		g.ssdp.WriteTo([]byte(res), addr)
+	}
+}
+
+const fakeRootDesc = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<device>
+  <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+  <serviceList>
+    <service>
+      <serviceType>urn:schemas-upnp-org:service:Layer3Forwarding:1</serviceType>
+      <controlURL>/ctl/L3F</controlURL>
+    </service>
+  </serviceList>
+  <deviceList>
+    <device>
+      <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+      <deviceList>
+        <device>
+          <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+          <serviceList>
+            <service>
+              <serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+              <controlURL>/ctl/IPConn</controlURL>
+            </service>
+          </serviceList>
+        </device>
+      </deviceList>
+    </device>
+  </deviceList>
+</device>
+</root>`
+
+func (g *fakeGateway) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/rootDesc.xml":
+		w.Header().Set("Content-Type", "text/xml")
+		fmt.Fprint(w, fakeRootDesc)
+		return
+	case "/ctl/IPConn":
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	arg := func(name string) string {
+		s, _ := xmlElementText(body, name)
+		return s
+	}
+	const svc = "urn:schemas-upnp-org:service:WANIPConnection:1"
+	var resp string
+	switch r.Header.Get("SOAPAction") {
+	case `"` + svc + `#AddPortMapping"`:
+		if g.upnpPermanentOnly && arg("NewLeaseDuration") != "0" {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, `<s:Envelope><s:Body><s:Fault><detail><UPnPError><errorCode>%d</errorCode><errorDescription>OnlyPermanentLeasesSupported</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`, upnpErrOnlyPermanentLease)
+			return
+		}
+		internal, _ := strconv.Atoi(arg("NewInternalPort"))
+		ext, _ := strconv.Atoi(arg("NewExternalPort"))
+		g.mu.Lock()
+		g.requests++
+		g.mappings[uint16(internal)] = uint16(ext)
+		g.mu.Unlock()
+		resp = `<u:AddPortMappingResponse xmlns:u="` + svc + `"/>`
+	case `"` + svc + `#GetExternalIPAddress"`:
+		resp = `<u:GetExternalIPAddressResponse xmlns:u="` + svc + `"><NewExternalIPAddress>` + fakeWAN.String() + `</NewExternalIPAddress></u:GetExternalIPAddressResponse>`
+	case `"` + svc + `#DeletePortMapping"`:
+		ext, _ := strconv.Atoi(arg("NewExternalPort"))
+		g.mu.Lock()
+		for in, ex := range g.mappings {
+			if ex == uint16(ext) {
+				delete(g.mappings, in)
+			}
+		}
+		g.mu.Unlock()
+		resp = `<u:DeletePortMappingResponse xmlns:u="` + svc + `"/>`
+	default:
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>%s</s:Body></s:Envelope>`, resp)
+}
+
+// waitUnmapped waits for g to no longer have a mapping for internal.
+func waitUnmapped(t *testing.T, g *fakeGateway, internal uint16) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, ok := g.mapping(internal); !ok {
+			return
+		}
+	}
+	t.Errorf("mapping for port %d was not released", internal)
+}
+
+func TestCreateMapping(t *testing.T) {
+	tests := []struct {
+		name           string
+		pcp, pmp, upnp bool
+		wantProto      string
+		wantExtPort    uint16
+	}{
+		{name: "pcp", pcp: true, wantProto: "pcp", wantExtPort: 51641},
+		{name: "pmp", pmp: true, wantProto: "pmp", wantExtPort: 51641},
+		{name: "upnp", upnp: true, wantProto: "upnp", wantExtPort: 41641},
+		{name: "pcp_and_pmp", pcp: true, pmp: true, wantProto: "pcp", wantExtPort: 51641},
+		{name: "pmp_and_upnp", pmp: true, upnp: true, wantProto: "pmp", wantExtPort: 51641},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newFakeGateway(t, tt.pcp, tt.pmp, tt.upnp)
+			defer g.Close()
+			c := g.newClient(41641)
+
+			ext, err := c.CreateOrGetMapping(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := netaddr.IPPort{IP: fakeWAN, Port: tt.wantExtPort}
+			if ext != want {
+				t.Errorf("external = %v; want %v", ext, want)
+			}
+			if c.mapping.proto != tt.wantProto {
+				t.Errorf("proto = %q; want %q", c.mapping.proto, tt.wantProto)
+			}
+			if got, ok := g.mapping(41641); !ok || got != tt.wantExtPort {
+				t.Errorf("gateway mapping = %v, %v; want %v", got, ok, tt.wantExtPort)
+			}
+
+			// A second call uses the existing mapping.
+			if ext2, err := c.CreateOrGetMapping(context.Background()); err != nil || ext2 != ext {
+				t.Errorf("second CreateOrGetMapping = %v, %v; want %v", ext2, err, ext)
+			}
+			if n := g.numRequests(); n != 1 {
+				t.Errorf("gateway got %d requests; want 1", n)
+			}
+
+			// Once due, the mapping is renewed with the same protocol.
+			c.mapping.renewAfter = time.Now().Add(-time.Second)
+			if ext2, err := c.CreateOrGetMapping(context.Background()); err != nil || ext2 != ext {
+				t.Errorf("renewal = %v, %v; want %v", ext2, err, ext)
+			}
+			if n := g.numRequests(); n != 2 {
+				t.Errorf("gateway got %d requests; want 2", n)
+			}
+			if c.mapping.proto != tt.wantProto {
+				t.Errorf("renewed proto = %q; want %q", c.mapping.proto, tt.wantProto)
+			}
+
+			c.Close()
+			waitUnmapped(t, g, 41641)
+			if _, err := c.CreateOrGetMapping(context.Background()); err == nil {
+				t.Error("CreateOrGetMapping succeeded after Close")
+			}
+		})
+	}
+}
+
+func TestNoServices(t *testing.T) {
+	g := newFakeGateway(t, false, false, false)
+	defer g.Close()
+	c := g.newClient(41641)
+	defer c.Close()
+
+	if _, err := c.CreateOrGetMapping(context.Background()); err != ErrNoPortMappingServices {
+		t.Fatalf("err = %v; want ErrNoPortMappingServices", err)
+	}
+
+	// The failure is remembered for a while.
+	n := g.numPackets()
+	if _, err := c.CreateOrGetMapping(context.Background()); err != ErrNoPortMappingServices {
+		t.Fatalf("second err = %v; want ErrNoPortMappingServices", err)
+	}
+	if got := g.numPackets(); got != n {
+		t.Errorf("gateway got %d more packets; want 0", got-n)
+	}
+}
+
+func TestSetLocalPortReleases(t *testing.T) {
+	g := newFakeGateway(t, false, true, false)
+	defer g.Close()
+	c := g.newClient(41641)
+	defer c.Close()
+
+	if _, err := c.CreateOrGetMapping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	c.SetLocalPort(41642)
+	waitUnmapped(t, g, 41641)
+
+	ext, err := c.CreateOrGetMapping(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (netaddr.IPPort{IP: fakeWAN, Port: 51642}); ext != want {
+		t.Errorf("external = %v; want %v", ext, want)
+	}
+}
+
+func TestCloseDuringCreate(t *testing.T) {
+	// A gateway that answers nothing keeps CreateOrGetMapping
+	// waiting on the network for a while.
+	g := newFakeGateway(t, false, false, false)
+	defer g.Close()
+	c := g.newClient(41641)
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.CreateOrGetMapping(context.Background())
+		errc <- err
+	}()
+	for g.numPackets() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	start := time.Now()
+	c.Close()
+	if d := time.Since(start); d > pxpTimeout/2 {
+		t.Errorf("Close took %v; want it not to wait for the gateway", d)
+	}
+	if err := <-errc; err != errClosed {
+		t.Errorf("CreateOrGetMapping = %v; want %v", err, errClosed)
+	}
+}
+
+func TestConcurrentCreate(t *testing.T) {
+	for _, proto := range []string{"pcp", "pmp", "upnp"} {
+		t.Run(proto, func(t *testing.T) {
+			g := newFakeGateway(t, proto == "pcp", proto == "pmp", proto == "upnp")
+			defer g.Close()
+			c := g.newClient(41641)
+			defer c.Close()
+
+			const n = 4
+			var wg sync.WaitGroup
+			exts := make([]netaddr.IPPort, n)
+			for i := range exts {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					ext, err := c.CreateOrGetMapping(context.Background())
+					if err != nil {
+						t.Error(err)
+					}
+					exts[i] = ext
+				}(i)
+			}
+			wg.Wait()
+			for _, ext := range exts[1:] {
+				if ext != exts[0] {
+					t.Errorf("CreateOrGetMapping returned %v and %v", exts[0], ext)
+				}
+			}
+			// The calls that lost the race didn't release the
+			// mapping that won.
+			time.Sleep(50 * time.Millisecond)
+			if _, ok := g.mapping(41641); !ok {
+				t.Error("gateway has no mapping")
+			}
+			if c.mapping == nil || c.mapping.external != exts[0] {
+				t.Errorf("client mapping = %+v; want %v", c.mapping, exts[0])
+			}
+		})
+	}
+}
+
+func TestUPnPPermanentLease(t *testing.T) {
+	g := newFakeGateway(t, false, false, true)
+	g.upnpPermanentOnly = true
+	defer g.Close()
+	c := g.newClient(41641)
+
+	ext, err := c.CreateOrGetMapping(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (netaddr.IPPort{IP: fakeWAN, Port: 41641}); ext != want {
+		t.Errorf("external = %v; want %v", ext, want)
+	}
+	c.Close()
+	waitUnmapped(t, g, 41641)
+}
+
+func TestPCPPacket(t *testing.T) {
+	var nonce [12]byte
+	copy(nonce[:], "abcdefghijkl")
+	myIP := netaddr.IPv4(192, 168, 1, 2)
+	pkt := pcpMapRequest(myIP, nonce, 41641, netaddr.IPPort{}, 7200)
+	if len(pkt) != pcpMapLen {
+		t.Fatalf("len = %d; want %d", len(pkt), pcpMapLen)
+	}
+	if got := binary.BigEndian.Uint16(pkt[40:42]); got != 41641 {
+		t.Errorf("internal port = %d; want 41641", got)
+	}
+	if got, _ := netaddr.FromStdIP(net.IP(pkt[8:24])); got != myIP {
+		t.Errorf("client IP = %v; want %v", got, myIP)
+	}
+	if got, _ := netaddr.FromStdIP(net.IP(pkt[44:60])); got != v4unspec {
+		t.Errorf("suggested IP = %v; want %v", got, v4unspec)
+	}
+	if string(pkt[24:36]) != "abcdefghijkl" {
+		t.Errorf("nonce = %q", pkt[24:36])
+	}
+}
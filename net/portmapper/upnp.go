@@ -0,0 +1,321 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package portmapper
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/netns"
+)
+
+// upnpSearchTarget is the SSDP search target for Internet gateway
+// devices.
+const upnpSearchTarget = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+
+// upnpWANServices are the UPnP service types that can map ports, in
+// order of preference.
+var upnpWANServices = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+// UPnP error codes returned by AddPortMapping.
+const (
+	upnpErrConflict           = 718 // ConflictInMappingEntry
+	upnpErrOnlyPermanentLease = 725 // OnlyPermanentLeasesSupported
+)
+
+// upnpSearchPacket is an SSDP M-SEARCH request for gateway devices.
+// We send it directly to the gateway rather than to the multicast
+// group, but gateways expect the usual HOST header regardless.
+var upnpSearchPacket = []byte("M-SEARCH * HTTP/1.1\r\n" +
+	"HOST: 239.255.255.250:1900\r\n" +
+	"ST: " + upnpSearchTarget + "\r\n" +
+	"MAN: \"ssdp:discover\"\r\n" +
+	"MX: 2\r\n\r\n")
+
+// upnpDescription is the subset of a UPnP device description that we
+// care about.
+type upnpDescription struct {
+	URLBase string     `xml:"URLBase"`
+	Device  upnpDevice `xml:"device"`
+}
+
+type upnpDevice struct {
+	DeviceType string        `xml:"deviceType"`
+	Services   []upnpService `xml:"serviceList>service"`
+	Devices    []upnpDevice  `xml:"deviceList>device"`
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+// findService returns the first service of type typ in d or its
+// embedded devices.
+func (d *upnpDevice) findService(typ string) (upnpService, bool) {
+	for _, s := range d.Services {
+		if s.ServiceType == typ {
+			return s, true
+		}
+	}
+	for i := range d.Devices {
+		if s, ok := d.Devices[i].findService(typ); ok {
+			return s, true
+		}
+	}
+	return upnpService{}, false
+}
+
+// upnpArg is an argument to a UPnP SOAP action. Arguments are
+// positional, so they're kept in a slice rather than a map.
+type upnpArg struct {
+	name, value string
+}
+
+// upnpError is an error returned by a UPnP SOAP action.
+type upnpError struct {
+	action string
+	code   int
+	desc   string
+}
+
+func (e *upnpError) Error() string {
+	return fmt.Sprintf("UPnP: %s: error %d (%s)", e.action, e.code, e.desc)
+}
+
+func (c *Client) upnpHTTPClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:       netns.NewDialer().DialContext,
+			DisableKeepAlives: true,
+		},
+	}
+}
+
+// discoverUPnP finds the WAN connection service of the gateway gw,
+// returning its type and control URL.
+func (c *Client) discoverUPnP(ctx context.Context, gw netaddr.IP) (serviceType, controlURL string, err error) {
+	var location string
+	err = exchange(ctx, c.ssdpAddr(gw), pxpTimeout, [][]byte{upnpSearchPacket}, func(b []byte) bool {
+		res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(b)), nil)
+		if err != nil {
+			return false
+		}
+		res.Body.Close()
+		if res.StatusCode != 200 || !strings.Contains(res.Header.Get("St"), ":InternetGatewayDevice:") {
+			return false
+		}
+		location = res.Header.Get("Location")
+		return location != ""
+	})
+	if err != nil {
+		return "", "", err
+	}
+	if location == "" {
+		return "", "", errNotSupported
+	}
+
+	// Only talk HTTP to the gateway itself, no matter where the
+	// SSDP response tells us to go.
+	locURL, err := url.Parse(location)
+	if err != nil || locURL.Scheme != "http" {
+		return "", "", fmt.Errorf("UPnP: bad device location %q", location)
+	}
+	if ip, err := netaddr.ParseIP(locURL.Hostname()); err != nil || ip != gw {
+		return "", "", fmt.Errorf("UPnP: device location %q isn't on gateway %v", location, gw)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", location, nil)
+	if err != nil {
+		return "", "", err
+	}
+	res, err := c.upnpHTTPClient().Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return "", "", fmt.Errorf("UPnP: fetching device description: %v", res.Status)
+	}
+	var desc upnpDescription
+	if err := xml.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&desc); err != nil {
+		return "", "", fmt.Errorf("UPnP: parsing device description: %v", err)
+	}
+	for _, typ := range upnpWANServices {
+		s, ok := desc.Device.findService(typ)
+		if !ok {
+			continue
+		}
+		base := locURL
+		if desc.URLBase != "" {
+			if u, err := url.Parse(desc.URLBase); err == nil {
+				base = u
+			}
+		}
+		ctl, err := base.Parse(s.ControlURL)
+		if err != nil || ctl.Host != locURL.Host {
+			return "", "", fmt.Errorf("UPnP: bad control URL %q", s.ControlURL)
+		}
+		return typ, ctl.String(), nil
+	}
+	return "", "", errNotSupported
+}
+
+// upnpCall performs a UPnP SOAP action and returns the response body.
+func (c *Client) upnpCall(ctx context.Context, controlURL, serviceType, action string, args []upnpArg) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body>`)
+	fmt.Fprintf(&buf, `<u:%s xmlns:u="%s">`, action, serviceType)
+	for _, a := range args {
+		fmt.Fprintf(&buf, "<%s>", a.name)
+		xml.EscapeText(&buf, []byte(a.value))
+		fmt.Fprintf(&buf, "</%s>", a.name)
+	}
+	fmt.Fprintf(&buf, `</u:%s></s:Body></s:Envelope>`, action)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", controlURL, &buf)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, serviceType, action))
+	res, err := c.upnpHTTPClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		if s, ok := xmlElementText(body, "errorCode"); ok {
+			code, _ := strconv.Atoi(s)
+			desc, _ := xmlElementText(body, "errorDescription")
+			return nil, &upnpError{action: action, code: code, desc: desc}
+		}
+		return nil, fmt.Errorf("UPnP: %s: %v", action, res.Status)
+	}
+	return body, nil
+}
+
+// xmlElementText returns the text of the first element in doc with
+// the local name name.
+func xmlElementText(doc []byte, name string) (string, bool) {
+	d := xml.NewDecoder(bytes.NewReader(doc))
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return "", false
+		}
+		if se, ok := tok.(xml.StartElement); ok && se.Name.Local == name {
+			var s string
+			if err := d.DecodeElement(&s, &se); err != nil {
+				return "", false
+			}
+			return strings.TrimSpace(s), true
+		}
+	}
+}
+
+func (c *Client) createUPnPMapping(ctx context.Context, gw, myIP netaddr.IP, port uint16, prev *mapping) (*mapping, error) {
+	ctx, cancel := context.WithTimeout(ctx, upnpTimeout)
+	defer cancel()
+
+	m := &mapping{
+		proto:    "upnp",
+		gw:       gw,
+		myIP:     myIP,
+		internal: port,
+	}
+	if prev != nil {
+		m.upnpService, m.upnpControlURL = prev.upnpService, prev.upnpControlURL
+		m.external.Port = prev.external.Port
+	} else {
+		var err error
+		m.upnpService, m.upnpControlURL, err = c.discoverUPnP(ctx, gw)
+		if err != nil {
+			return nil, err
+		}
+		m.external.Port = m.internal
+	}
+
+	lease := mappingLifetime
+	for tries := 0; ; tries++ {
+		_, err := c.upnpCall(ctx, m.upnpControlURL, m.upnpService, "AddPortMapping", []upnpArg{
+			{"NewRemoteHost", ""},
+			{"NewExternalPort", strconv.Itoa(int(m.external.Port))},
+			{"NewProtocol", "UDP"},
+			{"NewInternalPort", strconv.Itoa(int(m.internal))},
+			{"NewInternalClient", myIP.String()},
+			{"NewEnabled", "1"},
+			{"NewPortMappingDescription", "tailscale"},
+			{"NewLeaseDuration", strconv.Itoa(int(lease / time.Second))},
+		})
+		if err == nil {
+			break
+		}
+		var ue *upnpError
+		if tries >= 2 || !errors.As(err, &ue) {
+			return nil, err
+		}
+		switch ue.code {
+		case upnpErrConflict:
+			// Someone else on the LAN has this port; pick another.
+			m.external.Port = uint16(1024 + rand.Intn(65535-1024))
+		case upnpErrOnlyPermanentLease:
+			// Ask for a permanent mapping instead. We still
+			// renew it, which also recreates it if the gateway
+			// restarts.
+			lease = 0
+		default:
+			return nil, err
+		}
+	}
+
+	body, err := c.upnpCall(ctx, m.upnpControlURL, m.upnpService, "GetExternalIPAddress", nil)
+	if err != nil {
+		return nil, err
+	}
+	s, _ := xmlElementText(body, "NewExternalIPAddress")
+	extIP, err := netaddr.ParseIP(s)
+	if err != nil || !extIP.Is4() || extIP == v4unspec {
+		return nil, fmt.Errorf("UPnP: gateway returned invalid external address %q", s)
+	}
+	m.external.IP = extIP
+
+	now := time.Now()
+	m.goodUntil = now.Add(mappingLifetime)
+	m.renewAfter = now.Add(mappingLifetime / 2)
+	return m, nil
+}
+
+func (c *Client) releaseUPnPMapping(ctx context.Context, m *mapping) error {
+	_, err := c.upnpCall(ctx, m.upnpControlURL, m.upnpService, "DeletePortMapping", []upnpArg{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(int(m.external.Port))},
+		{"NewProtocol", "UDP"},
+	})
+	return err
+}
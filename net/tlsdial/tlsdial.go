@@ -12,9 +12,13 @@
 package tlsdial
 
 import (
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 )
 
@@ -74,3 +78,36 @@ func SetConfigExpectedCert(c *tls.Config, certDNSName string) {
 		return err
 	}
 }
+
+// CertPubKeySHA256 returns the hex SHA-256 hash of cert's DER
+// SubjectPublicKeyInfo, the form used to pin a certificate with
+// SetConfigExpectedCertPubKey.
+func CertPubKeySHA256(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+// SetConfigExpectedCertPubKey modifies c to accept only a server
+// certificate whose public key hashes to pubKeySHA256, as returned by
+// CertPubKeySHA256. The certificate's issuer, names and validity
+// period aren't checked, so it may be self-signed.
+func SetConfigExpectedCertPubKey(c *tls.Config, pubKeySHA256 string) {
+	if c.VerifyPeerCertificate != nil {
+		panic("refusing to override tls.Config.VerifyPeerCertificate")
+	}
+	want := strings.ToLower(pubKeySHA256)
+	c.InsecureSkipVerify = true
+	c.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("no certs presented")
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		if got := CertPubKeySHA256(cert); got != want {
+			return fmt.Errorf("certificate public key SHA-256 %s doesn't match pinned %s", got, want)
+		}
+		return nil
+	}
+}
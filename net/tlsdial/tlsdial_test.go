@@ -0,0 +1,38 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tlsdial
+
+import (
+	"crypto/tls"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSetConfigExpectedCertPubKey(t *testing.T) {
+	srv := httptest.NewTLSServer(nil)
+	defer srv.Close()
+	pin := CertPubKeySHA256(srv.Certificate())
+	addr := srv.Listener.Addr().String()
+
+	dial := func(pin string) error {
+		conf := Config("derp.example.com", nil) // name isn't on the cert
+		SetConfigExpectedCertPubKey(conf, pin)
+		c, err := tls.Dial("tcp", addr, conf)
+		if err != nil {
+			return err
+		}
+		return c.Close()
+	}
+	if err := dial(pin); err != nil {
+		t.Errorf("with correct pin: %v", err)
+	}
+	if err := dial(strings.ToUpper(pin)); err != nil {
+		t.Errorf("with upper case pin: %v", err)
+	}
+	if err := dial(strings.Repeat("0", 64)); err == nil {
+		t.Error("with wrong pin: succeeded")
+	}
+}
@@ -90,6 +90,14 @@ type DERPNode struct {
 	// not present) + TLS ClientHello.
 	CertName string `json:",omitempty"`
 
+	// CertPubKeySHA256 optionally pins the public key of the DERP
+	// node's TLS certificate, as the hex SHA-256 hash of its DER
+	// SubjectPublicKeyInfo. If non-empty, the certificate is
+	// trusted if and only if its public key matches, regardless
+	// of who signed it or CertName; this allows self-signed
+	// certificates.
+	CertPubKeySHA256 string `json:",omitempty"`
+
 	// IPv4 optionally forces an IPv4 address to use, instead of using DNS.
 	// If empty, A record(s) from DNS lookups of HostName are used.
 	// If the string is not an IPv4 address, IPv4 is not used; the
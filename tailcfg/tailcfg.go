@@ -497,9 +497,18 @@ var FilterAllowAll = []FilterRule{
 // DNSConfig is the DNS configuration.
 type DNSConfig struct {
 	Nameservers []netaddr.IP `json:",omitempty"`
-	Domains     []string     `json:",omitempty"`
-	PerDomain   bool
-	Proxied     bool
+	// Resolvers are encrypted upstream nameservers, given as
+	// https://host/path URLs for DNS over HTTPS or tls://host[:port]
+	// URLs for DNS over TLS. If Proxied, they are used instead of
+	// Nameservers, which older clients still use.
+	Resolvers []string `json:",omitempty"`
+	Domains   []string `json:",omitempty"`
+	PerDomain bool
+	Proxied   bool
+	// Aliases maps extra names in the tailnet's domain to the names
+	// they are aliases of, usually those of nodes. MagicDNS answers
+	// for them with CNAME records.
+	Aliases map[string]string `json:",omitempty"`
 }
 
 type MapResponse struct {
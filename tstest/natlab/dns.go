@@ -0,0 +1,138 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package natlab
+
+import (
+	"errors"
+	"net"
+	"strings"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"inet.af/netaddr"
+)
+
+var errNotQuery = errors.New("not a DNS query")
+
+// DNSServer is a minimal DNS server for virtual networks. It answers
+// A and AAAA queries from a static table of records.
+type DNSServer struct {
+	// Records maps domain names, like "derp.example.com", to their
+	// addresses. Names are matched case-insensitively, with or
+	// without a trailing dot.
+	Records map[string][]netaddr.IP
+	// DNS64, if true, makes the server synthesize AAAA records for
+	// names that have IPv4 addresses but no IPv6 ones (RFC 6147), to
+	// steer IPv6-only clients to a NAT64.
+	DNS64 bool
+	// DNS64Prefix is the /96 prefix of synthesized AAAA records. If
+	// zero, DefaultNAT64Prefix is used.
+	DNS64Prefix netaddr.IPPrefix
+}
+
+// Serve answers DNS queries arriving on pc until reading from pc
+// fails, typically because pc was closed.
+func (s *DNSServer) Serve(pc net.PacketConn) error {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		resp, err := s.respond(buf[:n])
+		if err != nil {
+			// Not a valid query, no answer.
+			continue
+		}
+		pc.WriteTo(resp, addr)
+	}
+}
+
+// lookup returns the addresses of name for a query of type typ, and
+// whether name exists.
+func (s *DNSServer) lookup(name string, typ dns.Type) (ips []netaddr.IP, ok bool) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	var all []netaddr.IP
+	for k, v := range s.Records {
+		if strings.TrimSuffix(strings.ToLower(k), ".") == name {
+			all, ok = v, true
+			break
+		}
+	}
+	var v4s, v6s []netaddr.IP
+	for _, ip := range all {
+		if ip.Is4() {
+			v4s = append(v4s, ip)
+		} else {
+			v6s = append(v6s, ip)
+		}
+	}
+	switch typ {
+	case dns.TypeA:
+		return v4s, ok
+	case dns.TypeAAAA:
+		if len(v6s) == 0 && s.DNS64 {
+			pfx := s.DNS64Prefix
+			if pfx.IsZero() {
+				pfx = DefaultNAT64Prefix
+			}
+			for _, ip := range v4s {
+				v6s = append(v6s, embedIPv4(pfx, ip))
+			}
+		}
+		return v6s, ok
+	}
+	return nil, ok
+}
+
+// respond returns the response to the DNS query in query.
+func (s *DNSServer) respond(query []byte) ([]byte, error) {
+	var parser dns.Parser
+	h, err := parser.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	if h.Response {
+		return nil, errNotQuery
+	}
+	q, err := parser.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	ips, ok := s.lookup(q.Name.String(), q.Type)
+	h.Response = true
+	h.Authoritative = true
+	if !ok {
+		h.RCode = dns.RCodeNameError
+	}
+
+	builder := dns.NewBuilder(nil, h)
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := builder.Question(q); err != nil {
+		return nil, err
+	}
+	if err := builder.StartAnswers(); err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		rh := dns.ResourceHeader{
+			Name:  q.Name,
+			Type:  q.Type,
+			Class: dns.ClassINET,
+			TTL:   60,
+		}
+		if ip.Is4() {
+			err = builder.AResource(rh, dns.AResource{A: ip.As4()})
+		} else {
+			err = builder.AAAAResource(rh, dns.AAAAResource{AAAA: ip.As16()})
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return builder.Finish()
+}
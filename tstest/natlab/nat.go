@@ -16,6 +16,7 @@ import (
 
 // mapping is the state of an allocated NAT session.
 type mapping struct {
+	proto    Protocol
 	lanSrc   netaddr.IPPort
 	lanDst   netaddr.IPPort
 	wanSrc   netaddr.IPPort
@@ -53,12 +54,14 @@ const (
 // 4-tuple ({src,dst} {ip,port}), some NATTypes will zero out some
 // fields, so in practice the key is either a 2-tuple (src only),
 // 3-tuple (src ip+port and dst ip) or 4-tuple (src+dst ip+port).
+// Sessions of different protocols never share a key.
 type natKey struct {
+	proto    Protocol
 	src, dst netaddr.IPPort
 }
 
-func (t NATType) key(src, dst netaddr.IPPort) natKey {
-	k := natKey{src: src}
+func (t NATType) key(proto Protocol, src, dst netaddr.IPPort) natKey {
+	k := natKey{proto: proto, src: src}
 	switch t {
 	case EndpointIndependentNAT:
 	case AddressDependentNAT:
@@ -74,8 +77,90 @@ func (t NATType) key(src, dst netaddr.IPPort) natKey {
 // DefaultMappingTimeout is the default timeout for a NAT mapping.
 const DefaultMappingTimeout = 30 * time.Second
 
+// wanKey is the lookup key for a NAT session from the WAN side.
+type wanKey struct {
+	proto Protocol
+	ipp   netaddr.IPPort
+}
+
+// natTable is the session table of a NAT.
+type natTable struct {
+	mu    sync.Mutex
+	byLAN map[natKey]*mapping // lookup by outbound packet tuple
+	byWAN map[wanKey]*mapping // lookup by protocol and wan ip:port only
+}
+
+// lookupWAN returns the unexpired session for packets of proto
+// arriving at the WAN address dst, or nil if there's none.
+func (t *natTable) lookupWAN(proto Protocol, dst netaddr.IPPort, now time.Time) *mapping {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m := t.byWAN[wanKey{proto, dst}]
+	if m == nil || now.After(m.deadline) {
+		return nil
+	}
+	return m
+}
+
+// mapOutbound returns the WAN address that a packet of proto from
+// src to dst gets translated to, allocating a port on wanIP of
+// machine for a new session if there's no unexpired one.
+func (t *natTable) mapOutbound(typ NATType, machine *Machine, wanIP netaddr.IP, proto Protocol, src, dst netaddr.IPPort, now time.Time, timeout time.Duration) netaddr.IPPort {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.byLAN == nil {
+		t.byLAN = map[natKey]*mapping{}
+		t.byWAN = map[wanKey]*mapping{}
+	}
+
+	k := typ.key(proto, src, dst)
+	m := t.byLAN[k]
+	if m == nil || now.After(m.deadline) {
+		// Clean up old entries before trying to allocate, to free
+		// up any expired ports.
+		t.gcLocked(typ, now)
+
+		pc, wanAddr := allocateMappedPort(machine, wanIP)
+		m = &mapping{
+			proto:  proto,
+			lanSrc: src,
+			lanDst: dst,
+			wanSrc: wanAddr,
+			pc:     pc,
+		}
+		t.byLAN[k] = m
+		t.byWAN[wanKey{proto, wanAddr}] = m
+	}
+	m.deadline = now.Add(timeout)
+	return m.wanSrc
+}
+
+func (t *natTable) gcLocked(typ NATType, now time.Time) {
+	for _, m := range t.byLAN {
+		if !now.After(m.deadline) {
+			continue
+		}
+		m.pc.Close()
+		delete(t.byLAN, typ.key(m.proto, m.lanSrc, m.lanDst))
+		delete(t.byWAN, wanKey{m.proto, m.wanSrc})
+	}
+}
+
+func allocateMappedPort(machine *Machine, ip netaddr.IP) (net.PacketConn, netaddr.IPPort) {
+	pc, err := machine.ListenPacket(context.Background(), "udp", net.JoinHostPort(ip.String(), "0"))
+	if err != nil {
+		panic(fmt.Sprintf("ran out of NAT ports: %v", err))
+	}
+	addr := netaddr.IPPort{
+		IP:   ip,
+		Port: uint16(pc.LocalAddr().(*net.UDPAddr).Port),
+	}
+	return pc, addr
+}
+
 // SNAT44 implements an IPv4-to-IPv4 source NAT (SNAT) translator, with
-// optional builtin firewall.
+// optional builtin firewall. Packets of other address families are
+// routed untranslated, subject to the firewall.
 type SNAT44 struct {
 	// Machine is the machine to which this NAT is attached. Altered
 	// packets are injected back into this Machine for processing.
@@ -99,11 +184,15 @@ type SNAT44 struct {
 	// nil, time.Now is used.
 	TimeNow func() time.Time
 
-	mu    sync.Mutex
-	byLAN map[natKey]*mapping         // lookup by outbound packet tuple
-	byWAN map[netaddr.IPPort]*mapping // lookup by wan ip:port only
+	sessions natTable
 }
 
+// SNAT66 is like SNAT44, but translates IPv6 source addresses to
+// ExternalInterface's IPv6 address, as some home routers do. Packets
+// of other address families are routed untranslated, subject to the
+// firewall.
+type SNAT66 SNAT44
+
 func (n *SNAT44) timeNow() time.Time {
 	if n.TimeNow != nil {
 		return n.TimeNow()
@@ -118,11 +207,7 @@ func (n *SNAT44) mappingTimeout() time.Duration {
 	return n.MappingTimeout
 }
 
-func (n *SNAT44) initLocked() {
-	if n.byLAN == nil {
-		n.byLAN = map[natKey]*mapping{}
-		n.byWAN = map[netaddr.IPPort]*mapping{}
-	}
+func (n *SNAT44) checkMachine() {
 	if n.ExternalInterface.Machine() != n.Machine {
 		panic(fmt.Sprintf("NAT given interface %s that is not part of given machine %s", n.ExternalInterface, n.Machine.Name))
 	}
@@ -137,7 +222,29 @@ func (n *SNAT44) HandleOut(p *Packet, oif *Interface) *Packet {
 }
 
 func (n *SNAT44) HandleIn(p *Packet, iif *Interface) *Packet {
-	if iif != n.ExternalInterface {
+	return n.handleIn(p, iif, 4)
+}
+
+func (n *SNAT44) HandleForward(p *Packet, iif, oif *Interface) *Packet {
+	return n.handleForward(p, iif, oif, 4)
+}
+
+func (n *SNAT66) HandleOut(p *Packet, oif *Interface) *Packet {
+	return (*SNAT44)(n).HandleOut(p, oif)
+}
+
+func (n *SNAT66) HandleIn(p *Packet, iif *Interface) *Packet {
+	return (*SNAT44)(n).handleIn(p, iif, 6)
+}
+
+func (n *SNAT66) HandleForward(p *Packet, iif, oif *Interface) *Packet {
+	return (*SNAT44)(n).handleForward(p, iif, oif, 6)
+}
+
+// handleIn implements HandleIn for a NAT of address family fam (4
+// or 6).
+func (n *SNAT44) handleIn(p *Packet, iif *Interface, fam uint8) *Packet {
+	if iif != n.ExternalInterface || !familyOK(fam, p.Dst.IP) {
 		// NAT can't apply, defer to firewall.
 		if n.Firewall != nil {
 			return n.Firewall.HandleIn(p, iif)
@@ -145,13 +252,9 @@ func (n *SNAT44) HandleIn(p *Packet, iif *Interface) *Packet {
 		return p
 	}
 
-	n.mu.Lock()
-	defer n.mu.Unlock()
-	n.initLocked()
-
-	now := n.timeNow()
-	mapping := n.byWAN[p.Dst]
-	if mapping == nil || now.After(mapping.deadline) {
+	n.checkMachine()
+	mapping := n.sessions.lookupWAN(p.Proto, p.Dst, n.timeNow())
+	if mapping == nil {
 		// NAT didn't hit, defer to firewall or allow in for local
 		// socket handling.
 		if n.Firewall != nil {
@@ -168,14 +271,24 @@ func (n *SNAT44) HandleIn(p *Packet, iif *Interface) *Packet {
 	return p
 }
 
-func (n *SNAT44) HandleForward(p *Packet, iif, oif *Interface) *Packet {
+// handleForward implements HandleForward for a NAT of address
+// family fam (4 or 6).
+func (n *SNAT44) handleForward(p *Packet, iif, oif *Interface, fam uint8) *Packet {
 	switch {
-	case oif == n.ExternalInterface:
-		if p.Src.IP == oif.V4() {
+	case oif == n.ExternalInterface && familyOK(fam, p.Src.IP):
+		wanIP := oif.V4()
+		if fam == 6 {
+			wanIP = oif.V6()
+		}
+		if p.Src.IP == wanIP {
 			// Packet already NATed and is just retraversing Forward,
 			// don't touch it again.
 			return p
 		}
+		if wanIP.IsZero() {
+			p.Trace("drop, no IPv%d address on %v", fam, oif)
+			return nil
+		}
 
 		if n.Firewall != nil {
 			p2 := n.Firewall.HandleForward(p, iif, oif)
@@ -189,31 +302,14 @@ func (n *SNAT44) HandleForward(p *Packet, iif, oif *Interface) *Packet {
 			}
 		}
 
-		n.mu.Lock()
-		defer n.mu.Unlock()
-		n.initLocked()
-
-		k := n.Type.key(p.Src, p.Dst)
-		now := n.timeNow()
-		m := n.byLAN[k]
-		if m == nil || now.After(m.deadline) {
-			pc, wanAddr := n.allocateMappedPort()
-			m = &mapping{
-				lanSrc: p.Src,
-				lanDst: p.Dst,
-				wanSrc: wanAddr,
-				pc:     pc,
-			}
-			n.byLAN[k] = m
-			n.byWAN[wanAddr] = m
-		}
-		m.deadline = now.Add(n.mappingTimeout())
-		p.Src = m.wanSrc
+		n.checkMachine()
+		p.Src = n.sessions.mapOutbound(n.Type, n.Machine, wanIP, p.Proto, p.Src, p.Dst, n.timeNow(), n.mappingTimeout())
 		p.Trace("snat from %v", p.Src)
 		return p
-	case iif == n.ExternalInterface:
-		// Packet was already un-NAT-ed, we just need to either
-		// firewall it or let it through.
+	case iif == n.ExternalInterface || oif == n.ExternalInterface:
+		// Packet was already un-NAT-ed, or is of an address family
+		// we don't translate. We just need to either firewall it or
+		// let it through.
 		if n.Firewall != nil {
 			return n.Firewall.HandleForward(p, iif, oif)
 		}
@@ -227,31 +323,143 @@ func (n *SNAT44) HandleForward(p *Packet, iif, oif *Interface) *Packet {
 	}
 }
 
-func (n *SNAT44) allocateMappedPort() (net.PacketConn, netaddr.IPPort) {
-	// Clean up old entries before trying to allocate, to free up any
-	// expired ports.
-	n.gc()
+// DefaultNAT64Prefix is the well-known NAT64 prefix from RFC 6052.
+var DefaultNAT64Prefix = mustPrefix("64:ff9b::/96")
 
-	ip := n.ExternalInterface.V4()
-	pc, err := n.Machine.ListenPacket(context.Background(), "udp", net.JoinHostPort(ip.String(), "0"))
-	if err != nil {
-		panic(fmt.Sprintf("ran out of NAT ports: %v", err))
+// NAT64 implements a stateful NAT64 translator (RFC 6146). IPv6
+// packets to an address in Prefix are translated into IPv4 packets
+// to the IPv4 address in the low 32 bits, sent from a mapped port on
+// ExternalInterface's IPv4 address.
+//
+// Packets that NAT64 doesn't translate are passed to Firewall, which
+// may itself be a NAT, such as an SNAT44 for a dual-stack LAN.
+type NAT64 struct {
+	// Machine is the machine to which this NAT is attached. Altered
+	// packets are injected back into this Machine for processing.
+	Machine *Machine
+	// ExternalInterface is the "WAN" interface of Machine, which
+	// must have an IPv4 address.
+	ExternalInterface *Interface
+	// Prefix is the /96 prefix in which IPv4 addresses are
+	// embedded. If zero, DefaultNAT64Prefix is used.
+	Prefix netaddr.IPPrefix
+	// Type specifies the mapping allocation behavior for this NAT.
+	Type NATType
+	// MappingTimeout is the lifetime of individual NAT sessions. If
+	// MappingTimeout is 0, DefaultMappingTimeout is used.
+	MappingTimeout time.Duration
+	// Firewall is an optional packet handler that will be invoked as
+	// a firewall during NAT translation, seeing packets in their
+	// "LAN form" like SNAT44's Firewall.
+	Firewall PacketHandler
+	// TimeNow is a function that returns the current time. If
+	// nil, time.Now is used.
+	TimeNow func() time.Time
+
+	sessions natTable
+}
+
+func (n *NAT64) timeNow() time.Time {
+	if n.TimeNow != nil {
+		return n.TimeNow()
 	}
-	addr := netaddr.IPPort{
-		IP:   ip,
-		Port: uint16(pc.LocalAddr().(*net.UDPAddr).Port),
+	return time.Now()
+}
+
+func (n *NAT64) mappingTimeout() time.Duration {
+	if n.MappingTimeout == 0 {
+		return DefaultMappingTimeout
 	}
-	return pc, addr
+	return n.MappingTimeout
 }
 
-func (n *SNAT44) gc() {
-	now := n.timeNow()
-	for _, m := range n.byLAN {
-		if !now.After(m.deadline) {
-			continue
+func (n *NAT64) prefix() netaddr.IPPrefix {
+	if n.Prefix.IsZero() {
+		return DefaultNAT64Prefix
+	}
+	if n.Prefix.Bits != 96 || !n.Prefix.IP.Is6() {
+		panic(fmt.Sprintf("NAT64 prefix %v is not an IPv6 /96", n.Prefix))
+	}
+	return n.Prefix
+}
+
+func (n *NAT64) HandleOut(p *Packet, oif *Interface) *Packet {
+	// NATs don't affect locally originated packets.
+	if n.Firewall != nil {
+		return n.Firewall.HandleOut(p, oif)
+	}
+	return p
+}
+
+func (n *NAT64) HandleIn(p *Packet, iif *Interface) *Packet {
+	if iif == n.ExternalInterface && p.Dst.IP.Is4() {
+		if mapping := n.sessions.lookupWAN(p.Proto, p.Dst, n.timeNow()); mapping != nil {
+			p.Src.IP = embedIPv4(n.prefix(), p.Src.IP)
+			p.Dst = mapping.lanSrc
+			p.Trace("nat64 to %v", p.Dst)
+			// As in SNAT44, the firewall sees this packet in
+			// HandleForward.
+			return p
 		}
-		m.pc.Close()
-		delete(n.byLAN, n.Type.key(m.lanSrc, m.lanDst))
-		delete(n.byWAN, m.wanSrc)
 	}
+	if n.Firewall != nil {
+		return n.Firewall.HandleIn(p, iif)
+	}
+	return p
+}
+
+func (n *NAT64) HandleForward(p *Packet, iif, oif *Interface) *Packet {
+	ext := n.ExternalInterface
+	switch {
+	case oif == ext && p.Src.IP == ext.V4():
+		// Packet already NATed and is just retraversing Forward,
+		// don't touch it again.
+		return p
+	case oif == ext && n.prefix().Contains(p.Dst.IP):
+		wanIP := ext.V4()
+		if wanIP.IsZero() {
+			p.Trace("drop, no IPv4 address on %v", oif)
+			return nil
+		}
+		if n.Firewall != nil {
+			p2 := n.Firewall.HandleForward(p, iif, oif)
+			if p2 == nil {
+				return nil
+			}
+			if !p.Equivalent(p2) {
+				return p2
+			}
+		}
+		if ext.Machine() != n.Machine {
+			panic(fmt.Sprintf("NAT given interface %s that is not part of given machine %s", ext, n.Machine.Name))
+		}
+		p.Src = n.sessions.mapOutbound(n.Type, n.Machine, wanIP, p.Proto, p.Src, p.Dst, n.timeNow(), n.mappingTimeout())
+		p.Dst.IP = extractIPv4(p.Dst.IP)
+		p.Trace("nat64 from %v", p.Src)
+		return p
+	case n.Firewall != nil:
+		return n.Firewall.HandleForward(p, iif, oif)
+	case iif == ext || oif == ext:
+		// Already translated back by HandleIn, or not ours to
+		// translate; route it as-is.
+		return p
+	default:
+		return nil
+	}
+}
+
+// embedIPv4 returns the address in the /96 prefix pfx that embeds
+// the IPv4 address ip4, per RFC 6052.
+func embedIPv4(pfx netaddr.IPPrefix, ip4 netaddr.IP) netaddr.IP {
+	a := pfx.IP.As16()
+	b := ip4.As16()
+	copy(a[12:], b[12:])
+	return netaddr.IPFrom16(a)
+}
+
+// extractIPv4 returns the IPv4 address embedded in the low 32 bits
+// of ip6.
+func extractIPv4(ip6 netaddr.IP) netaddr.IP {
+	a := ip6.As16()
+	return netaddr.IPv4(a[12], a[13], a[14], a[15])
 }
@@ -31,28 +31,54 @@ import (
 
 var traceOn, _ = strconv.ParseBool(os.Getenv("NATLAB_TRACE"))
 
-// Packet represents a UDP packet flowing through the virtual network.
+// Protocol is the transport protocol of a Packet.
+type Protocol uint8
+
+const (
+	UDP Protocol = iota
+	TCP
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case UDP:
+		return "udp"
+	case TCP:
+		return "tcp"
+	default:
+		return fmt.Sprintf("<unknown protocol %d>", uint8(p))
+	}
+}
+
+// Packet represents a UDP packet or TCP segment flowing through the
+// virtual network.
 type Packet struct {
+	Proto    Protocol
 	Src, Dst netaddr.IPPort
 	Payload  []byte
 
+	// tcp is the TCP header of the packet, if Proto is TCP.
+	tcp tcpHeader
+
 	// Prefix set by various internal methods of natlab, to locate
 	// where in the network a trace occured.
 	locator string
 }
 
-// Equivalent returns true if Src, Dst and Payload are the same in p
-// and p2.
+// Equivalent returns true if Proto, Src, Dst and Payload (and the
+// TCP header, for TCP) are the same in p and p2.
 func (p *Packet) Equivalent(p2 *Packet) bool {
-	return p.Src == p2.Src && p.Dst == p2.Dst && bytes.Equal(p.Payload, p2.Payload)
+	return p.Proto == p2.Proto && p.tcp == p2.tcp && p.Src == p2.Src && p.Dst == p2.Dst && bytes.Equal(p.Payload, p2.Payload)
 }
 
 // Clone returns a copy of p that shares nothing with p.
 func (p *Packet) Clone() *Packet {
 	return &Packet{
+		Proto:   p.Proto,
 		Src:     p.Src,
 		Dst:     p.Dst,
 		Payload: append([]byte(nil), p.Payload...),
+		tcp:     p.tcp,
 		locator: p.locator,
 	}
 }
@@ -73,9 +99,9 @@ func (p *Packet) Trace(msg string, args ...interface{}) {
 	if !traceOn {
 		return
 	}
-	allArgs := []interface{}{p.short(), p.locator, p.Src, p.Dst}
+	allArgs := []interface{}{p.short(), p.locator, p.Proto, p.Src, p.Dst}
 	allArgs = append(allArgs, args...)
-	fmt.Fprintf(os.Stderr, "[%s]%s src=%s dst=%s "+msg+"\n", allArgs...)
+	fmt.Fprintf(os.Stderr, "[%s]%s %s src=%s dst=%s "+msg+"\n", allArgs...)
 }
 
 func (p *Packet) setLocator(msg string, args ...interface{}) {
@@ -345,6 +371,9 @@ type Machine struct {
 
 	conns4 map[netaddr.IPPort]*conn // conns that want IPv4 packets
 	conns6 map[netaddr.IPPort]*conn // conns that want IPv6 packets
+
+	tcpListeners map[netaddr.IPPort]*tcpListener // by listening ip:port, possibly unspecified
+	tcpConns     map[tcpConnKey]*tcpConn
 }
 
 func (m *Machine) isLocalIP(ip netaddr.IP) bool {
@@ -387,6 +416,11 @@ func (m *Machine) deliverLocalPacket(p *Packet, iface *Interface) {
 		}
 	}
 
+	if p.Proto == TCP {
+		m.deliverTCPSegment(p)
+		return
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -611,6 +645,16 @@ func (m *Machine) portInUseLocked(port uint16) bool {
 			return true
 		}
 	}
+	for ipp := range m.tcpListeners {
+		if ipp.Port == port {
+			return true
+		}
+	}
+	for k := range m.tcpConns {
+		if k.local.Port == port {
+			return true
+		}
+	}
 	return false
 }
 
@@ -704,7 +748,7 @@ func (m *Machine) ListenPacket(ctx context.Context, network, address string) (ne
 	if port == 0 {
 		port, err = m.pickEphemPort()
 		if err != nil {
-			return nil, nil
+			return nil, err
 		}
 	}
 	ipp := netaddr.IPPort{IP: ip, Port: port}
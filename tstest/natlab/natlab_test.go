@@ -6,10 +6,16 @@ package natlab
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
 	"testing"
 	"time"
 
+	dns "golang.org/x/net/dns/dnsmessage"
 	"inet.af/netaddr"
 	"tailscale.com/tstest"
 )
@@ -507,3 +513,296 @@ func testNAT(t *testing.T, n *SNAT44, lanIf, wanIf *Interface, tests []natTest)
 		}
 	}
 }
+
+// udpRoundTrip sends msg from pc to dst and returns what dst's
+// PacketConn received and the source address it saw.
+func udpRoundTrip(t *testing.T, pc, dstPC net.PacketConn, dst netaddr.IPPort, msg string) (got, from string) {
+	t.Helper()
+	if _, err := pc.WriteTo([]byte(msg), dst.UDPAddr()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	n, addr, err := dstPC.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n]), addr.String()
+}
+
+func TestIPv6NAT(t *testing.T) {
+	internet := NewInternet()
+	lan := &Network{
+		Name:    "lan",
+		Prefix4: mustPrefix("192.168.0.0/24"),
+		Prefix6: mustPrefix("fd00:916::/64"),
+	}
+
+	client := &Machine{Name: "client"}
+	nat := &Machine{Name: "nat"}
+	server := &Machine{Name: "server"}
+
+	ifClient := client.Attach("eth0", lan)
+	ifNATWAN := nat.Attach("wan", internet)
+	ifNATLAN := nat.Attach("lan", lan)
+	ifServer := server.Attach("eth0", internet)
+	lan.SetDefaultGateway(ifNATLAN)
+
+	ctx := context.Background()
+	clientPC, err := client.ListenPacket(ctx, "udp", ":123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverPC, err := server.ListenPacket(ctx, "udp", ":456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server4 := netaddr.IPPort{IP: ifServer.V4(), Port: 456}
+	server6 := netaddr.IPPort{IP: ifServer.V6(), Port: 456}
+
+	// A dual-stack router with SNAT44 routes IPv6 untranslated.
+	nat.PacketHandler = &SNAT44{
+		Machine:           nat,
+		ExternalInterface: ifNATWAN,
+		Firewall:          &Firewall{TrustedInterface: ifNATLAN},
+	}
+	if _, from := udpRoundTrip(t, clientPC, serverPC, server4, "v4"); !strings.HasPrefix(from, ifNATWAN.V4().String()+":") {
+		t.Errorf("IPv4 packet from %v; want NATed to %v", from, ifNATWAN.V4())
+	}
+	if _, from := udpRoundTrip(t, clientPC, serverPC, server6, "v6"); from != (netaddr.IPPort{IP: ifClient.V6(), Port: 123}).String() {
+		t.Errorf("IPv6 packet from %v; want untranslated %v", from, ifClient.V6())
+	}
+
+	// With SNAT66, it's the other way around.
+	nat.PacketHandler = &SNAT66{
+		Machine:           nat,
+		ExternalInterface: ifNATWAN,
+		Firewall:          &Firewall{TrustedInterface: ifNATLAN},
+	}
+	if _, from := udpRoundTrip(t, clientPC, serverPC, server6, "v6"); !strings.HasPrefix(from, "["+ifNATWAN.V6().String()+"]:") {
+		t.Errorf("IPv6 packet from %v; want NATed to %v", from, ifNATWAN.V6())
+	}
+	if _, from := udpRoundTrip(t, clientPC, serverPC, server4, "v4"); from != (netaddr.IPPort{IP: ifClient.V4(), Port: 123}).String() {
+		t.Errorf("IPv4 packet from %v; want untranslated %v", from, ifClient.V4())
+	}
+
+	// And the reply makes it back through the NAT.
+	_, from := udpRoundTrip(t, clientPC, serverPC, server6, "ping")
+	reply, replyFrom := udpRoundTrip(t, serverPC, clientPC, ipp(from), "pong")
+	if reply != "pong" || replyFrom != server6.String() {
+		t.Errorf("reply %q from %v; want %q from %v", reply, replyFrom, "pong", server6)
+	}
+}
+
+// echo accepts connections on ln and echoes back what it reads.
+func echo(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			io.Copy(c, c)
+		}()
+	}
+}
+
+// testEcho dials addr from m and checks that a message round trips.
+func testEcho(t *testing.T, m *Machine, network, addr string) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := m.DialContext(ctx, network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	msg := strings.Repeat("hello ", 1000) // more than one segment
+	if _, err := io.WriteString(c, msg); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(msg))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != msg {
+		t.Errorf("echo mismatch")
+	}
+}
+
+func TestTCP(t *testing.T) {
+	internet := NewInternet()
+	lan := &Network{
+		Name:    "lan",
+		Prefix4: mustPrefix("192.168.0.0/24"),
+	}
+
+	client := &Machine{Name: "client"}
+	nat := &Machine{Name: "nat"}
+	server := &Machine{Name: "server"}
+
+	client.Attach("eth0", lan)
+	ifNATWAN := nat.Attach("wan", internet)
+	ifNATLAN := nat.Attach("lan", lan)
+	ifServer := server.Attach("eth0", internet)
+	lan.SetDefaultGateway(ifNATLAN)
+	nat.PacketHandler = &SNAT44{
+		Machine:           nat,
+		ExternalInterface: ifNATWAN,
+		Firewall:          &Firewall{TrustedInterface: ifNATLAN},
+	}
+
+	ln, err := server.Listen("tcp", ":80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go echo(ln)
+
+	t.Run("through_nat", func(t *testing.T) {
+		testEcho(t, client, "tcp", netaddr.IPPort{IP: ifServer.V4(), Port: 80}.String())
+	})
+	t.Run("v6", func(t *testing.T) {
+		testEcho(t, nat, "tcp6", netaddr.IPPort{IP: ifServer.V6(), Port: 80}.String())
+	})
+	t.Run("refused", func(t *testing.T) {
+		_, err := client.DialContext(context.Background(), "tcp", netaddr.IPPort{IP: ifServer.V4(), Port: 81}.String())
+		if !errors.Is(err, errConnRefused) {
+			t.Errorf("got %v; want connection refused", err)
+		}
+	})
+	t.Run("firewalled", func(t *testing.T) {
+		// The NAT's firewall silently drops unsolicited SYNs.
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		_, err = server.DialContext(ctx, "tcp", netaddr.IPPort{IP: ifNATWAN.V4(), Port: 22}.String())
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("got %v; want timeout", err)
+		}
+	})
+	t.Run("eof", func(t *testing.T) {
+		sln, err := server.Listen("tcp4", ":0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sln.Close()
+		go func() {
+			c, err := sln.Accept()
+			if err != nil {
+				return
+			}
+			io.WriteString(c, "bye")
+			c.Close()
+		}()
+		port := sln.Addr().(*net.TCPAddr).Port
+		c, err := client.DialContext(context.Background(), "tcp", fmt.Sprintf("%v:%d", ifServer.V4(), port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		got, err := ioutil.ReadAll(c)
+		if err != nil || string(got) != "bye" {
+			t.Errorf("ReadAll = %q, %v; want %q, nil", got, err, "bye")
+		}
+	})
+}
+
+func TestNAT64(t *testing.T) {
+	internet := &Network{
+		Name:    "internet4",
+		Prefix4: mustPrefix("1.0.0.0/24"),
+	}
+	lan := &Network{
+		Name:    "lan6",
+		Prefix6: mustPrefix("fd00:64::/64"),
+	}
+
+	client := &Machine{Name: "client"}
+	nat := &Machine{Name: "nat64"}
+	server := &Machine{Name: "server"}
+
+	ifClient := client.Attach("eth0", lan)
+	ifNATWAN := nat.Attach("wan", internet)
+	ifNATLAN := nat.Attach("lan", lan)
+	ifServer := server.Attach("eth0", internet)
+	lan.SetDefaultGateway(ifNATLAN)
+	nat.PacketHandler = &NAT64{
+		Machine:           nat,
+		ExternalInterface: ifNATWAN,
+		Firewall:          &Firewall{TrustedInterface: ifNATLAN},
+	}
+	if !ifClient.V4().IsZero() {
+		t.Fatalf("client has IPv4 address %v", ifClient.V4())
+	}
+
+	// DNS64 on the LAN tells the client where the server is.
+	dnsServer := &Machine{Name: "dns64"}
+	ifDNS := dnsServer.Attach("eth0", lan)
+	ctx := context.Background()
+	dnsPC, err := dnsServer.ListenPacket(ctx, "udp", ":53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dnsPC.Close()
+	go (&DNSServer{
+		Records: map[string][]netaddr.IP{"server.test": {ifServer.V4()}},
+		DNS64:   true,
+	}).Serve(dnsPC)
+
+	clientPC, err := client.ListenPacket(ctx, "udp", ":123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, err := (&dns.Message{
+		Header:    dns.Header{ID: 1},
+		Questions: []dns.Question{{Name: dns.MustNewName("server.test."), Type: dns.TypeAAAA, Class: dns.ClassINET}},
+	}).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clientPC.WriteTo(query, (netaddr.IPPort{IP: ifDNS.V6(), Port: 53}).UDPAddr()); err != nil {
+		t.Fatal(err)
+	}
+	var msg dns.Message
+	buf := make([]byte, 1500)
+	n, _, err := clientPC.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := msg.Unpack(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Answers) != 1 {
+		t.Fatalf("got %d answers; want 1", len(msg.Answers))
+	}
+	server6 := netaddr.IPFrom16(msg.Answers[0].Body.(*dns.AAAAResource).AAAA)
+	if want := embedIPv4(DefaultNAT64Prefix, ifServer.V4()); server6 != want {
+		t.Fatalf("DNS64 answer %v; want %v", server6, want)
+	}
+
+	// UDP to the synthesized address reaches the IPv4 server, and
+	// the reply comes back from the synthesized address.
+	serverPC, err := server.ListenPacket(ctx, "udp4", ":456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, from := udpRoundTrip(t, clientPC, serverPC, netaddr.IPPort{IP: server6, Port: 456}, "ping")
+	if !strings.HasPrefix(from, ifNATWAN.V4().String()+":") {
+		t.Errorf("packet from %v; want NATed to %v", from, ifNATWAN.V4())
+	}
+	reply, replyFrom := udpRoundTrip(t, serverPC, clientPC, ipp(from), "pong")
+	if want := (netaddr.IPPort{IP: server6, Port: 456}).String(); reply != "pong" || replyFrom != want {
+		t.Errorf("reply %q from %v; want %q from %v", reply, replyFrom, "pong", want)
+	}
+
+	// And so does TCP.
+	ln, err := server.Listen("tcp4", ":80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go echo(ln)
+	testEcho(t, client, "tcp", netaddr.IPPort{IP: server6, Port: 80}.String())
+}
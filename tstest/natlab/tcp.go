@@ -0,0 +1,516 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package natlab
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// natlab's TCP is just enough TCP to carry streams through NATs and
+// firewalls: a SYN, SYN-ACK handshake, FIN and RST. The virtual
+// network never loses packets on its own, so there are no
+// retransmissions, windows or congestion control. Sequence numbers
+// only exist to undo the reordering caused by delivering each packet
+// on its own goroutine. Writes never block, and the reader buffers
+// without limit.
+
+// tcpFlags are the control bits of a TCP segment.
+type tcpFlags uint8
+
+const (
+	tcpSYN tcpFlags = 1 << iota
+	tcpACK
+	tcpFIN
+	tcpRST
+)
+
+// tcpHeader is the part of a TCP header natlab needs.
+type tcpHeader struct {
+	flags tcpFlags
+	seq   uint64 // stream offset of the first payload byte, or of the FIN
+}
+
+// maxSegmentSize is the largest payload of a natlab TCP segment.
+const maxSegmentSize = 1400
+
+// tcpConnKey identifies a TCP connection on a Machine.
+type tcpConnKey struct {
+	local, remote netaddr.IPPort
+}
+
+var (
+	errConnRefused = errors.New("connection refused")
+	errConnReset   = errors.New("connection reset by peer")
+	errClosed      = errors.New("use of closed network connection")
+)
+
+// timeoutError is the net.Error returned when a deadline passes.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// tcpFamily parses a TCP network name into an address family (0
+// for either, 4 or 6) and the matching unspecified IP.
+func tcpFamily(network string) (fam uint8, unspec netaddr.IP, err error) {
+	switch network {
+	case "tcp":
+		return 0, v6unspec, nil
+	case "tcp4":
+		return 4, v4unspec, nil
+	case "tcp6":
+		return 6, v6unspec, nil
+	}
+	return 0, netaddr.IP{}, fmt.Errorf("unsupported network type %q", network)
+}
+
+func familyOK(fam uint8, ip netaddr.IP) bool {
+	switch fam {
+	case 4:
+		return ip.Is4()
+	case 6:
+		return ip.Is6()
+	}
+	return true
+}
+
+func tcpAddr(ipp netaddr.IPPort) *net.TCPAddr {
+	ua := ipp.UDPAddr()
+	return &net.TCPAddr{IP: ua.IP, Port: ua.Port}
+}
+
+// Listen announces on the local network address, like net.Listen.
+// Only the "tcp", "tcp4" and "tcp6" networks are supported.
+func (m *Machine) Listen(network, address string) (net.Listener, error) {
+	fam, ip, err := tcpFamily(network)
+	if err != nil {
+		return nil, err
+	}
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if host != "" {
+		ip, err = netaddr.ParseIP(host)
+		if err != nil {
+			return nil, err
+		}
+		if !familyOK(fam, ip) {
+			return nil, fmt.Errorf("address %s is not %s", host, network)
+		}
+	}
+	porti, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	port := uint16(porti)
+	if port == 0 {
+		port, err = m.pickEphemPort()
+		if err != nil {
+			return nil, err
+		}
+	}
+	ln := &tcpListener{
+		m:      m,
+		fam:    fam,
+		ipp:    netaddr.IPPort{IP: ip, Port: port},
+		accept: make(chan *tcpConn, 100), // arbitrary
+		closed: make(chan struct{}),
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.tcpListeners[ln.ipp]; ok {
+		return nil, fmt.Errorf("duplicate listener on %v", ln.ipp)
+	}
+	if m.tcpListeners == nil {
+		m.tcpListeners = map[netaddr.IPPort]*tcpListener{}
+	}
+	m.tcpListeners[ln.ipp] = ln
+	return ln, nil
+}
+
+// DialContext connects to the address on the named network, like
+// net.Dialer.DialContext. Only the "tcp", "tcp4" and "tcp6" networks
+// are supported.
+//
+// If the connection attempt is silently dropped along the way (by a
+// firewall, say), DialContext blocks until ctx is done.
+func (m *Machine) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	fam, _, err := tcpFamily(network)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := netaddr.ParseIPPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if !familyOK(fam, remote.IP) {
+		return nil, fmt.Errorf("address %s is not %s", address, network)
+	}
+	iface, err := m.interfaceForIP(remote.IP)
+	if err != nil {
+		return nil, err
+	}
+	local := netaddr.IPPort{IP: iface.V4()}
+	if remote.IP.Is6() {
+		local.IP = iface.V6()
+	}
+	if local.IP.IsZero() {
+		return nil, fmt.Errorf("no source address on %v to dial %v", iface, remote)
+	}
+	local.Port, err = m.pickEphemPort()
+	if err != nil {
+		return nil, err
+	}
+
+	c := newTCPConn(m, local, remote)
+	if err := m.registerTCPConn(c); err != nil {
+		return nil, err
+	}
+	c.send(tcpSYN, 0, nil)
+
+	select {
+	case err := <-c.handshake:
+		if err != nil {
+			m.unregisterTCPConn(c)
+			return nil, fmt.Errorf("dial %s %s: %w", network, address, err)
+		}
+		return c, nil
+	case <-ctx.Done():
+		m.unregisterTCPConn(c)
+		return nil, fmt.Errorf("dial %s %s: %w", network, address, ctx.Err())
+	}
+}
+
+func (m *Machine) registerTCPConn(c *tcpConn) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := tcpConnKey{c.local, c.remote}
+	if _, ok := m.tcpConns[k]; ok {
+		return fmt.Errorf("duplicate conn %v -> %v", c.local, c.remote)
+	}
+	if m.tcpConns == nil {
+		m.tcpConns = map[tcpConnKey]*tcpConn{}
+	}
+	m.tcpConns[k] = c
+	return nil
+}
+
+func (m *Machine) unregisterTCPConn(c *tcpConn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := tcpConnKey{c.local, c.remote}
+	if m.tcpConns[k] == c {
+		delete(m.tcpConns, k)
+	}
+}
+
+// tcpListenerForLocked returns the listener that should accept a
+// connection to dst, or nil.
+//
+// m.mu must be held.
+func (m *Machine) tcpListenerForLocked(dst netaddr.IPPort) *tcpListener {
+	for _, ip := range []netaddr.IP{dst.IP, v6unspec, v4unspec} {
+		ln, ok := m.tcpListeners[netaddr.IPPort{IP: ip, Port: dst.Port}]
+		if ok && familyOK(ln.fam, dst.IP) {
+			return ln
+		}
+	}
+	return nil
+}
+
+// deliverTCPSegment delivers a TCP segment addressed to m to its
+// connection or listener, answering with an RST if there's neither.
+func (m *Machine) deliverTCPSegment(p *Packet) {
+	m.mu.Lock()
+	c := m.tcpConns[tcpConnKey{p.Dst, p.Src}]
+	var ln *tcpListener
+	if c == nil && p.tcp.flags == tcpSYN {
+		ln = m.tcpListenerForLocked(p.Dst)
+	}
+	m.mu.Unlock()
+
+	switch {
+	case c != nil:
+		c.handleSegment(p)
+	case ln != nil:
+		ln.handleSYN(p)
+	case p.tcp.flags&tcpRST != 0:
+		p.Trace("dropped RST for unknown conn")
+	default:
+		p.Trace("no conn, sending RST")
+		m.writePacket(&Packet{
+			Proto: TCP,
+			Src:   p.Dst,
+			Dst:   p.Src,
+			tcp:   tcpHeader{flags: tcpRST},
+		})
+	}
+}
+
+// tcpListener is our net.Listener implementation.
+type tcpListener struct {
+	m      *Machine
+	fam    uint8 // 0, 4, or 6
+	ipp    netaddr.IPPort
+	accept chan *tcpConn
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (ln *tcpListener) handleSYN(p *Packet) {
+	c := newTCPConn(ln.m, p.Dst, p.Src)
+	if err := ln.m.registerTCPConn(c); err != nil {
+		// A concurrently delivered duplicate SYN got here first.
+		return
+	}
+	select {
+	case ln.accept <- c:
+		c.send(tcpSYN|tcpACK, 0, nil)
+	default:
+		p.Trace("dropped, accept queue overflow")
+		ln.m.unregisterTCPConn(c)
+		c.send(tcpRST, 0, nil)
+	}
+}
+
+func (ln *tcpListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-ln.accept:
+		return c, nil
+	case <-ln.closed:
+		return nil, errClosed
+	}
+}
+
+func (ln *tcpListener) Close() error {
+	ln.closeOnce.Do(func() {
+		close(ln.closed)
+		ln.m.mu.Lock()
+		delete(ln.m.tcpListeners, ln.ipp)
+		ln.m.mu.Unlock()
+	})
+	return nil
+}
+
+func (ln *tcpListener) Addr() net.Addr { return tcpAddr(ln.ipp) }
+
+// tcpConn is our net.Conn implementation for TCP.
+type tcpConn struct {
+	m             *Machine
+	local, remote netaddr.IPPort
+	handshake     chan error    // for dialers, receives the result of the SYN
+	wake          chan struct{} // signaled when a blocked Read may proceed
+
+	mu            sync.Mutex
+	sendSeq       uint64             // stream offset of next byte to send
+	recvSeq       uint64             // stream offset of next byte to read
+	pending       map[uint64]*Packet // received segments past recvSeq
+	buf           []byte             // received data not yet Read
+	readErr       error              // io.EOF after FIN, or errConnReset
+	reset         bool
+	closed        bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newTCPConn(m *Machine, local, remote netaddr.IPPort) *tcpConn {
+	return &tcpConn{
+		m:         m,
+		local:     local,
+		remote:    remote,
+		handshake: make(chan error, 1),
+		wake:      make(chan struct{}, 1),
+		pending:   map[uint64]*Packet{},
+	}
+}
+
+// send sends a segment with the given flags, seq and payload.
+func (c *tcpConn) send(flags tcpFlags, seq uint64, payload []byte) error {
+	p := &Packet{
+		Proto:   TCP,
+		Src:     c.local,
+		Dst:     c.remote,
+		Payload: payload,
+		tcp:     tcpHeader{flags: flags, seq: seq},
+	}
+	p.setLocator("mach=%s", c.m.Name)
+	_, err := c.m.writePacket(p)
+	return err
+}
+
+func (c *tcpConn) wakeReader() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (c *tcpConn) handleSegment(p *Packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.wakeReader()
+
+	switch {
+	case p.tcp.flags&tcpRST != 0:
+		p.Trace("conn reset")
+		c.reset = true
+		if c.readErr == nil {
+			c.readErr = errConnReset
+		}
+		select {
+		case c.handshake <- errConnRefused:
+		default:
+		}
+		return
+	case p.tcp.flags == tcpSYN|tcpACK:
+		select {
+		case c.handshake <- nil:
+		default:
+		}
+		return
+	case p.tcp.flags&tcpSYN != 0:
+		return // duplicate SYN
+	}
+
+	if p.tcp.seq < c.recvSeq {
+		return // duplicate
+	}
+	c.pending[p.tcp.seq] = p
+	for {
+		next, ok := c.pending[c.recvSeq]
+		if !ok {
+			break
+		}
+		delete(c.pending, c.recvSeq)
+		if next.tcp.flags&tcpFIN != 0 {
+			if c.readErr == nil {
+				c.readErr = io.EOF
+			}
+			break
+		}
+		c.buf = append(c.buf, next.Payload...)
+		c.recvSeq += uint64(len(next.Payload))
+	}
+}
+
+func (c *tcpConn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		switch {
+		case c.closed:
+			c.mu.Unlock()
+			return 0, errClosed
+		case len(c.buf) > 0:
+			n := copy(b, c.buf)
+			c.buf = c.buf[n:]
+			c.mu.Unlock()
+			return n, nil
+		case c.readErr != nil:
+			err := c.readErr
+			c.mu.Unlock()
+			return 0, err
+		}
+		deadline := c.readDeadline
+		c.mu.Unlock()
+
+		if deadline.IsZero() {
+			<-c.wake
+			continue
+		}
+		d := time.Until(deadline)
+		if d <= 0 {
+			return 0, timeoutError{}
+		}
+		t := time.NewTimer(d)
+		select {
+		case <-c.wake:
+		case <-t.C:
+		}
+		t.Stop()
+	}
+}
+
+func (c *tcpConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case c.closed:
+		return 0, errClosed
+	case c.reset:
+		return 0, errConnReset
+	case !c.writeDeadline.IsZero() && !time.Now().Before(c.writeDeadline):
+		return 0, timeoutError{}
+	}
+	n := 0
+	for n < len(b) {
+		chunk := b[n:]
+		if len(chunk) > maxSegmentSize {
+			chunk = chunk[:maxSegmentSize]
+		}
+		if err := c.send(tcpACK, c.sendSeq, append([]byte(nil), chunk...)); err != nil {
+			return n, err
+		}
+		c.sendSeq += uint64(len(chunk))
+		n += len(chunk)
+	}
+	return n, nil
+}
+
+// Close sends a FIN to the peer and forgets the connection. Any
+// further segments from the peer are answered with an RST.
+func (c *tcpConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	reset := c.reset
+	seq := c.sendSeq
+	c.mu.Unlock()
+
+	c.wakeReader()
+	c.m.unregisterTCPConn(c)
+	if !reset {
+		c.send(tcpACK|tcpFIN, seq, nil)
+	}
+	return nil
+}
+
+func (c *tcpConn) LocalAddr() net.Addr  { return tcpAddr(c.local) }
+func (c *tcpConn) RemoteAddr() net.Addr { return tcpAddr(c.remote) }
+
+func (c *tcpConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *tcpConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	c.wakeReader()
+	return nil
+}
+
+func (c *tcpConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	return nil
+}
@@ -0,0 +1,520 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package testcontrol contains a minimal, in-process control server
+// for tests.
+//
+// It speaks the real encrypted register and map protocol, so it can
+// be used with an unmodified controlclient or ipn.LocalBackend, and
+// lets tests manipulate the network map (peers, packet filter, DNS
+// and DERP configuration, key expiry) and inspect what clients sent.
+package testcontrol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/control/controlserver"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+)
+
+// keepAliveInterval is how often streaming map responses send
+// keep-alives to clients that asked for them.
+const keepAliveInterval = 60 * time.Second
+
+// Server is a control server for tests.
+type Server struct {
+	// URL is the base URL of the server, such as
+	// "http://127.0.0.1:1234". It's the value to use as a client's
+	// ServerURL.
+	URL string
+
+	logf    logger.Logf
+	ts      *httptest.Server
+	privKey wgcfg.PrivateKey
+	pubKey  wgcfg.Key
+	codec   *controlserver.Codec
+
+	mu           sync.Mutex
+	nodes        map[tailcfg.NodeKey]*tailcfg.Node
+	lastNodeID   tailcfg.NodeID
+	authKey      string // if non-empty, required for new registrations
+	derpMap      *tailcfg.DERPMap
+	packetFilter []tailcfg.FilterRule
+	dnsConfig    tailcfg.DNSConfig
+	mapRequests  map[tailcfg.NodeKey][]*tailcfg.MapRequest
+	updates      map[chan struct{}]bool // active map streams
+	reqCh        chan struct{}          // closed and replaced on each MapRequest
+}
+
+// user is the user that all nodes belong to.
+var user = tailcfg.User{
+	ID:          1,
+	LoginName:   "testuser@example.com",
+	DisplayName: "Test User",
+	Logins:      []tailcfg.LoginID{1},
+}
+
+// New returns a new Server, serving on a local httptest server.
+// Close must be called when the test is done with it.
+//
+// If logf is nil, log.Printf is used.
+func New(logf logger.Logf) *Server {
+	if logf == nil {
+		logf = log.Printf
+	}
+	priv, err := wgcfg.NewPrivateKey()
+	if err != nil {
+		panic(err)
+	}
+	s := &Server{
+		logf:         logger.WithPrefix(logf, "testcontrol: "),
+		privKey:      priv,
+		pubKey:       priv.Public(),
+		codec:        controlserver.NewCodec(priv),
+		nodes:        make(map[tailcfg.NodeKey]*tailcfg.Node),
+		packetFilter: tailcfg.FilterAllowAll,
+		mapRequests:  make(map[tailcfg.NodeKey][]*tailcfg.MapRequest),
+		updates:      make(map[chan struct{}]bool),
+		reqCh:        make(chan struct{}),
+	}
+	s.ts = httptest.NewServer(s)
+	s.URL = s.ts.URL
+	return s
+}
+
+// Close shuts down the server and waits for outstanding requests
+// to finish.
+func (s *Server) Close() {
+	s.ts.CloseClientConnections()
+	s.ts.Close()
+	s.codec.Close()
+}
+
+// RequireAuthKey makes registration of new node keys require the
+// given auth key. An empty key lets any node register.
+func (s *Server) RequireAuthKey(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.authKey = key
+}
+
+// SetDERPMap sets the DERP map sent to nodes and pushes it to all
+// connected nodes.
+func (s *Server) SetDERPMap(dm *tailcfg.DERPMap) {
+	s.mu.Lock()
+	s.derpMap = dm
+	s.mu.Unlock()
+	s.notifyAll()
+}
+
+// SetPacketFilter sets the packet filter sent to nodes and pushes it
+// to all connected nodes. The default filter allows all traffic.
+func (s *Server) SetPacketFilter(rules []tailcfg.FilterRule) {
+	s.mu.Lock()
+	s.packetFilter = rules
+	s.mu.Unlock()
+	s.notifyAll()
+}
+
+// SetDNSConfig sets the DNS configuration sent to nodes and pushes
+// it to all connected nodes.
+func (s *Server) SetDNSConfig(dns tailcfg.DNSConfig) {
+	s.mu.Lock()
+	s.dnsConfig = dns
+	s.mu.Unlock()
+	s.notifyAll()
+}
+
+// AddNode adds a node that isn't backed by a real client to the
+// network, or replaces the node with the same Key. If n.ID or
+// n.Addresses are zero, they're assigned. It returns a copy of the
+// added node.
+func (s *Server) AddNode(n *tailcfg.Node) *tailcfg.Node {
+	s.mu.Lock()
+	n = n.Clone()
+	if n.Key.IsZero() {
+		s.mu.Unlock()
+		panic("testcontrol: AddNode with zero node key")
+	}
+	if old, ok := s.nodes[n.Key]; ok && n.ID == 0 {
+		n.ID = old.ID
+	}
+	s.initNodeLocked(n)
+	s.nodes[n.Key] = n
+	ret := n.Clone()
+	s.mu.Unlock()
+	s.notifyAll()
+	return ret
+}
+
+// AddFakeNode adds a peer with a random node key and the given
+// hostname and returns a copy of it.
+func (s *Server) AddFakeNode(hostname string) *tailcfg.Node {
+	k, err := wgcfg.NewPrivateKey()
+	if err != nil {
+		panic(err)
+	}
+	return s.AddNode(&tailcfg.Node{
+		Key:               tailcfg.NodeKey(k.Public()),
+		Hostinfo:          tailcfg.Hostinfo{Hostname: hostname},
+		MachineAuthorized: true,
+	})
+}
+
+// RemoveNode removes the node with node key nk from the network.
+// Its client, if any, will fail to fetch new network maps.
+func (s *Server) RemoveNode(nk tailcfg.NodeKey) {
+	s.mu.Lock()
+	delete(s.nodes, nk)
+	s.mu.Unlock()
+	s.notifyAll()
+}
+
+// ExpireNodeKey marks the node key nk as expired. The node is sent
+// the new expiry, and its next registration with the same key is
+// answered with NodeKeyExpired.
+func (s *Server) ExpireNodeKey(nk tailcfg.NodeKey) error {
+	s.mu.Lock()
+	n, ok := s.nodes[nk]
+	if ok {
+		n.KeyExpiry = time.Now().Add(-time.Minute)
+	}
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("testcontrol: unknown node key %v", nk.ShortString())
+	}
+	s.notifyAll()
+	return nil
+}
+
+// Node returns a copy of the node with node key nk, or nil if there's
+// no such node.
+func (s *Server) Node(nk tailcfg.NodeKey) *tailcfg.Node {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n, ok := s.nodes[nk]; ok {
+		return n.Clone()
+	}
+	return nil
+}
+
+// Nodes returns copies of all nodes, sorted by ID.
+func (s *Server) Nodes() []*tailcfg.Node {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nodesLocked()
+}
+
+func (s *Server) nodesLocked() []*tailcfg.Node {
+	ret := make([]*tailcfg.Node, 0, len(s.nodes))
+	for _, n := range s.nodes {
+		ret = append(ret, n.Clone())
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+	return ret
+}
+
+// MapRequests returns the MapRequests received so far from the node
+// with node key nk, oldest first.
+func (s *Server) MapRequests(nk tailcfg.NodeKey) []*tailcfg.MapRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*tailcfg.MapRequest(nil), s.mapRequests[nk]...)
+}
+
+// AwaitMapRequests waits until at least n MapRequests have been
+// received from the node with node key nk, and returns them all.
+func (s *Server) AwaitMapRequests(ctx context.Context, nk tailcfg.NodeKey, n int) ([]*tailcfg.MapRequest, error) {
+	for {
+		s.mu.Lock()
+		reqs := s.mapRequests[nk]
+		ch := s.reqCh
+		s.mu.Unlock()
+		if len(reqs) >= n {
+			return append([]*tailcfg.MapRequest(nil), reqs...), nil
+		}
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("testcontrol: got %d MapRequests from %v, want %d: %v", len(reqs), nk.ShortString(), n, ctx.Err())
+		}
+	}
+}
+
+// AwaitNode waits for a node with node key nk to register, and
+// returns a copy of it.
+func (s *Server) AwaitNode(ctx context.Context, nk tailcfg.NodeKey) (*tailcfg.Node, error) {
+	for {
+		s.mu.Lock()
+		n := s.nodes[nk]
+		ch := s.reqCh
+		s.mu.Unlock()
+		if n != nil {
+			return n.Clone(), nil
+		}
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// initNodeLocked fills in the ID, addresses and name of n, if they're
+// not set.
+func (s *Server) initNodeLocked(n *tailcfg.Node) {
+	if n.ID == 0 {
+		s.lastNodeID++
+		n.ID = s.lastNodeID
+	} else if n.ID > s.lastNodeID {
+		s.lastNodeID = n.ID
+	}
+	if n.User == 0 {
+		n.User = user.ID
+	}
+	if len(n.Addresses) == 0 {
+		addr := wgcfg.CIDR{IP: wgcfg.IPv4(100, 64, byte(n.ID>>8), byte(n.ID)), Mask: 32}
+		n.Addresses = []wgcfg.CIDR{addr}
+		n.AllowedIPs = []wgcfg.CIDR{addr}
+	}
+	if n.Name == "" {
+		n.Name = n.Hostinfo.Hostname + ".tailnet"
+	}
+	if n.Created.IsZero() {
+		n.Created = time.Now()
+	}
+}
+
+// bumpLocked wakes up AwaitMapRequests and AwaitNode waiters.
+func (s *Server) bumpLocked() {
+	close(s.reqCh)
+	s.reqCh = make(chan struct{})
+}
+
+func (s *Server) notifyAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.updates {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/key" {
+		io.WriteString(w, s.pubKey.HexString())
+		return
+	}
+	mkey, isMap, ok := controlserver.ParseMachinePath(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if isMap {
+		s.serveMap(w, r, mkey)
+	} else {
+		s.serveRegister(w, r, mkey)
+	}
+}
+
+func (s *Server) serveRegister(w http.ResponseWriter, r *http.Request, mkey wgcfg.Key) {
+	var req tailcfg.RegisterRequest
+	if err := s.codec.Decode(r, mkey, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res, err := s.register(tailcfg.MachineKey(mkey), &req)
+	if err != nil {
+		s.logf("register: %v", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	b, err := s.codec.Encode(mkey, false, res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
+func (s *Server) register(mkey tailcfg.MachineKey, req *tailcfg.RegisterRequest) (*tailcfg.RegisterResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := s.nodes[req.NodeKey]
+	if n == nil && !req.OldNodeKey.IsZero() {
+		n = s.nodes[req.OldNodeKey]
+	}
+	if n != nil && n.Machine != mkey {
+		return nil, errors.New("node key belongs to another machine")
+	}
+	if n != nil && !n.KeyExpiry.IsZero() && n.KeyExpiry.Before(time.Now()) {
+		if n.Key == req.NodeKey {
+			return &tailcfg.RegisterResponse{NodeKeyExpired: true}, nil
+		}
+		n = nil // rotating away from an expired key needs re-auth
+	}
+	if n == nil && s.authKey != "" && req.Auth.AuthKey != s.authKey {
+		return nil, errors.New("invalid auth key")
+	}
+	if n == nil {
+		n = &tailcfg.Node{
+			Machine:           mkey,
+			MachineAuthorized: true,
+		}
+		if req.Hostinfo != nil {
+			n.Hostinfo = *req.Hostinfo.Clone()
+		}
+		s.initNodeLocked(n)
+	}
+	delete(s.nodes, n.Key)
+	delete(s.nodes, req.OldNodeKey)
+	n.Key = req.NodeKey
+	n.KeyExpiry = time.Time{}
+	s.nodes[n.Key] = n
+	s.bumpLocked()
+	go s.notifyAll()
+
+	login := tailcfg.Login{
+		ID:          1,
+		Provider:    "testcontrol",
+		LoginName:   user.LoginName,
+		DisplayName: user.DisplayName,
+	}
+	return &tailcfg.RegisterResponse{
+		User:              user,
+		Login:             login,
+		MachineAuthorized: n.MachineAuthorized,
+	}, nil
+}
+
+func (s *Server) serveMap(w http.ResponseWriter, r *http.Request, mkey wgcfg.Key) {
+	ctx := r.Context()
+	var req tailcfg.MapRequest
+	if err := s.codec.Decode(r, mkey, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	updates := make(chan struct{}, 1)
+	s.mu.Lock()
+	s.mapRequests[req.NodeKey] = append(s.mapRequests[req.NodeKey], &req)
+	s.bumpLocked()
+	n := s.nodes[req.NodeKey]
+	if n == nil || n.Machine != tailcfg.MachineKey(mkey) {
+		s.mu.Unlock()
+		http.Error(w, "unknown node key", http.StatusUnauthorized)
+		return
+	}
+	n.DiscoKey = req.DiscoKey
+	n.Endpoints = append([]string(nil), req.Endpoints...)
+	if req.Hostinfo != nil {
+		n.Hostinfo = *req.Hostinfo.Clone()
+		if ni := n.Hostinfo.NetInfo; ni != nil && ni.PreferredDERP != 0 {
+			n.DERP = fmt.Sprintf("127.3.3.40:%d", ni.PreferredDERP)
+		}
+	}
+	if req.Stream {
+		s.updates[updates] = true
+		defer func() {
+			s.mu.Lock()
+			delete(s.updates, updates)
+			s.mu.Unlock()
+		}()
+	}
+	s.mu.Unlock()
+	s.notifyAll()
+
+	var keepAlive <-chan time.Time
+	if req.KeepAlive {
+		t := time.NewTicker(keepAliveInterval)
+		defer t.Stop()
+		keepAlive = t.C
+	}
+
+	compress := req.Compress == "zstd"
+	var lastDERPMap *tailcfg.DERPMap
+	var prevPeers []*tailcfg.Node
+	for first := true; ; first = false {
+		res, err := s.mapResponse(req.NodeKey)
+		if err != nil {
+			if first {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+			}
+			return
+		}
+		if res.DERPMap == lastDERPMap {
+			res.DERPMap = nil
+		} else {
+			lastDERPMap = res.DERPMap
+		}
+		peers := res.Peers
+		if !first && req.DeltaPeers {
+			res.Peers = nil
+			res.PeersChanged, res.PeersRemoved = controlserver.DiffPeers(prevPeers, peers)
+		}
+		prevPeers = peers
+		if err := s.codec.SendMapResponse(w, mkey, compress, res); err != nil {
+			return
+		}
+		if !req.Stream {
+			return
+		}
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-keepAlive:
+				if err := s.codec.SendMapResponse(w, mkey, compress, &tailcfg.MapResponse{KeepAlive: true}); err != nil {
+					return
+				}
+			case <-updates:
+				break wait
+			}
+		}
+	}
+}
+
+// mapResponse returns a full MapResponse for the node with node key nk.
+func (s *Server) mapResponse(nk tailcfg.NodeKey) (*tailcfg.MapResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, ok := s.nodes[nk]
+	if !ok {
+		return nil, errors.New("node removed")
+	}
+	res := &tailcfg.MapResponse{
+		Node:         n.Clone(),
+		DERPMap:      s.derpMap,
+		Domain:       "tailnet",
+		PacketFilter: s.packetFilter,
+		DNSConfig:    s.dnsConfig,
+		UserProfiles: []tailcfg.UserProfile{{
+			ID:          user.ID,
+			LoginName:   user.LoginName,
+			DisplayName: user.DisplayName,
+		}},
+	}
+	for _, p := range s.nodesLocked() {
+		if p.Key != nk {
+			res.Peers = append(res.Peers, p)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package testcontrol
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/control/controlclient"
+	"tailscale.com/smallzstd"
+	"tailscale.com/tailcfg"
+)
+
+func newClient(t *testing.T, s *Server, hostname, authKey string) *controlclient.Direct {
+	t.Helper()
+	c, err := controlclient.NewDirect(controlclient.Options{
+		ServerURL: s.URL,
+		AuthKey:   authKey,
+		Hostinfo: &tailcfg.Hostinfo{
+			Hostname:     hostname,
+			BackendLogID: "log-" + hostname,
+		},
+		NewDecompressor: func() (controlclient.Decompressor, error) {
+			return smallzstd.NewDecoder(nil)
+		},
+		KeepAlive: true,
+		Logf:      t.Logf,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func nodeKey(c *controlclient.Direct) tailcfg.NodeKey {
+	p := c.GetPersist()
+	return tailcfg.NodeKey(p.PrivateNodeKey.Public())
+}
+
+// netMapWatcher streams network maps from a client.
+type netMapWatcher struct {
+	t   *testing.T
+	ctx context.Context
+	c   chan *controlclient.NetworkMap
+	err chan error
+}
+
+func watchNetMaps(ctx context.Context, t *testing.T, c *controlclient.Direct) *netMapWatcher {
+	w := &netMapWatcher{
+		t:   t,
+		ctx: ctx,
+		c:   make(chan *controlclient.NetworkMap, 100),
+		err: make(chan error, 1),
+	}
+	go func() {
+		w.err <- c.PollNetMap(ctx, -1, func(nm *controlclient.NetworkMap) { w.c <- nm })
+	}()
+	return w
+}
+
+// await returns the first network map for which cond returns true.
+func (w *netMapWatcher) await(what string, cond func(*controlclient.NetworkMap) bool) *controlclient.NetworkMap {
+	w.t.Helper()
+	for {
+		select {
+		case nm := <-w.c:
+			if cond(nm) {
+				return nm
+			}
+		case err := <-w.err:
+			w.t.Fatalf("waiting for %s: PollNetMap: %v", what, err)
+		case <-w.ctx.Done():
+			w.t.Fatalf("timeout waiting for %s", what)
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	s := New(t.Logf)
+	defer s.Close()
+	s.RequireAuthKey("secret")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	bad := newClient(t, s, "bad", "wrong")
+	if _, err := bad.TryLogin(ctx, nil, controlclient.LoginDefault); err == nil || !strings.Contains(err.Error(), "invalid auth key") {
+		t.Fatalf("login with wrong auth key: err = %v", err)
+	}
+
+	c := newClient(t, s, "client", "secret")
+	if _, err := c.TryLogin(ctx, nil, controlclient.LoginDefault); err != nil {
+		t.Fatal(err)
+	}
+	nk := nodeKey(c)
+	if _, err := s.AwaitNode(ctx, nk); err != nil {
+		t.Fatal(err)
+	}
+
+	c.SetEndpoints(1234, []string{"192.0.2.1:1234"})
+	w := watchNetMaps(ctx, t, c)
+	nm := w.await("first netmap", func(nm *controlclient.NetworkMap) bool { return true })
+	if nm.Name != "client.tailnet" {
+		t.Errorf("Name = %q; want client.tailnet", nm.Name)
+	}
+
+	reqs, err := s.AwaitMapRequests(ctx, nk, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := reqs[0]
+	if !req.Stream || req.Compress != "zstd" || !req.KeepAlive || !req.DeltaPeers {
+		t.Errorf("MapRequest = %+v; want stream, zstd, keep-alives and delta peers", req)
+	}
+	if len(req.Endpoints) != 1 || req.Endpoints[0] != "192.0.2.1:1234" {
+		t.Errorf("MapRequest.Endpoints = %q", req.Endpoints)
+	}
+
+	peer := s.AddFakeNode("peer")
+	w.await("peer added", func(nm *controlclient.NetworkMap) bool {
+		return len(nm.Peers) == 1 && nm.Peers[0].Key == peer.Key && nm.Peers[0].Name == "peer.tailnet"
+	})
+
+	s.SetPacketFilter([]tailcfg.FilterRule{{
+		SrcIPs:   []string{"100.64.0.2"},
+		DstPorts: []tailcfg.NetPortRange{{IP: "*", Ports: tailcfg.PortRange{First: 22, Last: 22}}},
+	}})
+	w.await("packet filter", func(nm *controlclient.NetworkMap) bool {
+		return len(nm.PacketFilter) == 1 && len(nm.PacketFilter[0].Dsts) == 1 && nm.PacketFilter[0].Dsts[0].Ports.First == 22
+	})
+
+	dnsIP := netaddr.IPv4(100, 100, 100, 100)
+	s.SetDNSConfig(tailcfg.DNSConfig{Nameservers: []netaddr.IP{dnsIP}, Domains: []string{"tailnet"}})
+	w.await("DNS config", func(nm *controlclient.NetworkMap) bool {
+		return len(nm.DNS.Nameservers) == 1 && nm.DNS.Nameservers[0] == dnsIP
+	})
+
+	s.SetDERPMap(&tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{
+		900: {RegionID: 900, RegionCode: "test"},
+	}})
+	w.await("DERP map", func(nm *controlclient.NetworkMap) bool {
+		return nm.DERPMap != nil && nm.DERPMap.Regions[900] != nil
+	})
+
+	s.RemoveNode(peer.Key)
+	w.await("peer removed", func(nm *controlclient.NetworkMap) bool {
+		return len(nm.Peers) == 0 && nm.DERPMap != nil
+	})
+
+	if err := s.ExpireNodeKey(nk); err != nil {
+		t.Fatal(err)
+	}
+	w.await("key expiry", func(nm *controlclient.NetworkMap) bool {
+		return !nm.Expiry.IsZero() && nm.Expiry.Before(time.Now())
+	})
+	// The expired client must rotate to a new node key, which
+	// needs the auth key again.
+	if _, err := c.TryLogin(ctx, nil, controlclient.LoginDefault); err != nil {
+		t.Fatal(err)
+	}
+	if nk2 := nodeKey(c); nk2 == nk {
+		t.Error("node key not rotated after expiry")
+	} else if n := s.Node(nk2); n == nil || !n.KeyExpiry.IsZero() {
+		t.Errorf("rotated node = %+v; want registered and unexpired", n)
+	}
+}
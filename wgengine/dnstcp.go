@@ -0,0 +1,198 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/packet"
+	"tailscale.com/wgengine/tsdns"
+	"tailscale.com/wgengine/usertcp"
+)
+
+const (
+	// dnsTCPIdleTimeout is how long a DNS TCP connection may go
+	// without a query from the client before it's closed.
+	dnsTCPIdleTimeout = 30 * time.Second
+	// dnsTCPWriteTimeout is how long writing a response may block
+	// on a client that doesn't read.
+	dnsTCPWriteTimeout = 5 * time.Second
+	// maxDNSTCPConns is the maximum number of open DNS TCP
+	// connections. Further ones are closed right away.
+	maxDNSTCPConns = 64
+)
+
+// dnsTCPConn is the state of a DNS TCP connection.
+type dnsTCPConn struct {
+	c       net.Conn
+	pending int  // queries given to the resolver but not answered
+	eof     bool // the client has closed its side
+}
+
+// dnsTCPResponder serves DNS over TCP to the MagicDNS IP. It runs a
+// userspace TCP stack of its own, which exchanges packets with the
+// local network stack through the TUN device, splits what it reads
+// into queries for the resolver and writes the responses back.
+type dnsTCPResponder struct {
+	logf        logger.Logf
+	enqueue     func(tsdns.Packet) error // passes a query to the resolver
+	stack       *usertcp.Stack
+	ln          net.Listener
+	idleTimeout time.Duration
+
+	mu    sync.Mutex
+	conns map[netaddr.IPPort]*dnsTCPConn
+}
+
+// newDNSTCPResponder returns a responder that passes queries to
+// enqueue and injects its packets inbound into the TUN device with
+// inject.
+func newDNSTCPResponder(logf logger.Logf, enqueue func(tsdns.Packet) error, inject func([]byte)) (*dnsTCPResponder, error) {
+	stack := usertcp.NewStack(logf, inject)
+	ln, err := stack.Listen(magicDNSPort)
+	if err != nil {
+		stack.Close()
+		return nil, err
+	}
+	d := &dnsTCPResponder{
+		logf:        logf,
+		enqueue:     enqueue,
+		stack:       stack,
+		ln:          ln,
+		idleTimeout: dnsTCPIdleTimeout,
+		conns:       make(map[netaddr.IPPort]*dnsTCPConn),
+	}
+	go d.serve()
+	return d, nil
+}
+
+// handle processes p, a TCP packet to the MagicDNS IP and port.
+func (d *dnsTCPResponder) handle(p *packet.ParsedPacket) {
+	d.stack.Handle(p)
+}
+
+// serve accepts connections until the responder is closed.
+func (d *dnsTCPResponder) serve() {
+	for {
+		c, err := d.ln.Accept()
+		if err != nil {
+			return
+		}
+		ta := c.RemoteAddr().(*net.TCPAddr)
+		ip, _ := netaddr.FromStdIP(ta.IP)
+		addr := netaddr.IPPort{IP: ip, Port: uint16(ta.Port)}
+
+		d.mu.Lock()
+		if len(d.conns) >= maxDNSTCPConns {
+			d.mu.Unlock()
+			d.logf("tsdns: too many TCP connections; closing %v", addr)
+			c.Close()
+			continue
+		}
+		dc := &dnsTCPConn{c: c}
+		d.conns[addr] = dc
+		d.mu.Unlock()
+
+		go d.serveConn(addr, dc)
+	}
+}
+
+// serveConn passes the queries read from dc, each preceded by its
+// 16-bit length, to the resolver.
+func (d *dnsTCPResponder) serveConn(addr netaddr.IPPort, dc *dnsTCPConn) {
+	br := bufio.NewReader(dc.c)
+	var err error
+	for {
+		dc.c.SetReadDeadline(time.Now().Add(d.idleTimeout))
+		var n [2]byte
+		if _, err = io.ReadFull(br, n[:]); err != nil {
+			break
+		}
+		query := make([]byte, binary.BigEndian.Uint16(n[:]))
+		if _, err = io.ReadFull(br, query); err != nil {
+			break
+		}
+
+		d.mu.Lock()
+		dc.pending++
+		d.mu.Unlock()
+		req := tsdns.Packet{
+			Payload: query,
+			Addr:    addr,
+			TCP:     true,
+		}
+		if err := d.enqueue(req); err != nil {
+			d.logf("tsdns: enqueue: %v", err)
+			d.mu.Lock()
+			dc.pending--
+			d.mu.Unlock()
+		}
+	}
+
+	d.mu.Lock()
+	dc.eof = true
+	// After a clean close by the client, the pending queries are
+	// still answered; on errors and timeouts they are not.
+	done := err != io.EOF || dc.pending == 0
+	d.mu.Unlock()
+	if done {
+		d.closeConn(addr, dc)
+	}
+}
+
+// respond sends resp, a response to a query over TCP, to its client.
+// A nil payload means the query failed without a response to send.
+func (d *dnsTCPResponder) respond(resp tsdns.Packet) {
+	d.mu.Lock()
+	dc := d.conns[resp.Addr]
+	if dc == nil {
+		// The client went away.
+		d.mu.Unlock()
+		return
+	}
+	dc.pending--
+	done := dc.eof && dc.pending == 0
+	d.mu.Unlock()
+
+	if resp.Payload != nil {
+		msg := make([]byte, 2+len(resp.Payload))
+		binary.BigEndian.PutUint16(msg, uint16(len(resp.Payload)))
+		copy(msg[2:], resp.Payload)
+		dc.c.SetWriteDeadline(time.Now().Add(dnsTCPWriteTimeout))
+		if _, err := dc.c.Write(msg); err != nil {
+			d.logf("tsdns: TCP response to %v: %v", resp.Addr, err)
+			done = true
+		}
+	}
+	if done {
+		d.closeConn(resp.Addr, dc)
+	}
+}
+
+// closeConn closes dc and forgets it.
+func (d *dnsTCPResponder) closeConn(addr netaddr.IPPort, dc *dnsTCPConn) {
+	d.mu.Lock()
+	if d.conns[addr] == dc {
+		delete(d.conns, addr)
+	}
+	d.mu.Unlock()
+	dc.c.Close()
+}
+
+// close closes all connections and stops accepting new ones.
+func (d *dnsTCPResponder) close() {
+	d.ln.Close()
+	d.stack.Close()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.conns = make(map[netaddr.IPPort]*dnsTCPConn)
+}
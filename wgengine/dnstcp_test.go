@@ -0,0 +1,199 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/wgengine/packet"
+	"tailscale.com/wgengine/tsdns"
+	"tailscale.com/wgengine/usertcp"
+)
+
+const dnsTCPClientIP = packet.IP(0x64400001) // 100.64.0.1
+
+// dnsTCPTest connects a dnsTCPResponder to a client TCP stack, as
+// the local network stack would be through the TUN device.
+type dnsTCPTest struct {
+	t       *testing.T
+	d       *dnsTCPResponder
+	client  *usertcp.Stack
+	queries chan tsdns.Packet
+}
+
+func newDNSTCPTest(t *testing.T) *dnsTCPTest {
+	tt := &dnsTCPTest{t: t, queries: make(chan tsdns.Packet, 16)}
+	deliver := func(handle func(*packet.ParsedPacket)) func([]byte) {
+		return func(b []byte) {
+			var p packet.ParsedPacket
+			p.Decode(b)
+			handle(&p)
+		}
+	}
+	d, err := newDNSTCPResponder(t.Logf, func(p tsdns.Packet) error {
+		tt.queries <- p
+		return nil
+	}, deliver(func(p *packet.ParsedPacket) { tt.client.Handle(p) }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tt.d = d
+	tt.client = usertcp.NewStack(t.Logf, deliver(d.handle))
+	return tt
+}
+
+func (tt *dnsTCPTest) Close() {
+	tt.client.Close()
+	tt.d.close()
+}
+
+func (tt *dnsTCPTest) dial() *usertcp.Conn {
+	tt.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := tt.client.Dial(ctx, dnsTCPClientIP, packet.IP(magicDNSIP), magicDNSPort)
+	if err != nil {
+		tt.t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	return c
+}
+
+func (tt *dnsTCPTest) nextQuery() tsdns.Packet {
+	tt.t.Helper()
+	select {
+	case q := <-tt.queries:
+		return q
+	case <-time.After(10 * time.Second):
+		tt.t.Fatal("timeout waiting for a query")
+		return tsdns.Packet{}
+	}
+}
+
+func lengthPrefixed(msgs ...[]byte) []byte {
+	var b []byte
+	for _, m := range msgs {
+		var n [2]byte
+		binary.BigEndian.PutUint16(n[:], uint16(len(m)))
+		b = append(append(b, n[:]...), m...)
+	}
+	return b
+}
+
+func TestDNSTCPResponder(t *testing.T) {
+	tt := newDNSTCPTest(t)
+	defer tt.Close()
+	c := tt.dial()
+	defer c.Close()
+
+	// Two queries, the second split across writes.
+	q1, q2 := []byte("first query"), []byte("second query")
+	stream := lengthPrefixed(q1, q2)
+	if _, err := c.Write(stream[:20]); err != nil {
+		t.Fatal(err)
+	}
+	got1 := tt.nextQuery()
+	if _, err := c.Write(stream[20:]); err != nil {
+		t.Fatal(err)
+	}
+	got2 := tt.nextQuery()
+	for i, q := range []tsdns.Packet{got1, got2} {
+		want := [][]byte{q1, q2}[i]
+		if !bytes.Equal(q.Payload, want) || !q.TCP || q.Addr.IP != dnsTCPClientIP.Netaddr() {
+			t.Errorf("query %d = %+v; want %q over TCP from %v", i, q, want, dnsTCPClientIP)
+		}
+	}
+
+	// A response larger than a segment.
+	resp := bytes.Repeat([]byte("x"), 2*usertcp.MSS)
+	tt.d.respond(tsdns.Packet{Payload: resp, Addr: got1.Addr, TCP: true})
+	received := make([]byte, 2+len(resp))
+	if _, err := io.ReadFull(c, received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, lengthPrefixed(resp)) {
+		t.Errorf("received %d bytes; want the length-prefixed response", len(received))
+	}
+
+	// The client closes its side with a query outstanding, so the
+	// responder closes its own only after answering it.
+	c.CloseWrite()
+	time.Sleep(50 * time.Millisecond)
+	tt.d.respond(tsdns.Packet{Payload: []byte("second response"), Addr: got2.Addr, TCP: true})
+	rest, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := lengthPrefixed([]byte("second response")); !bytes.Equal(rest, want) {
+		t.Errorf("received %q before EOF; want %q", rest, want)
+	}
+	tt.d.mu.Lock()
+	n := len(tt.d.conns)
+	tt.d.mu.Unlock()
+	if n != 0 {
+		t.Errorf("%d connections left; want 0", n)
+	}
+}
+
+func TestDNSTCPResponderConnLimit(t *testing.T) {
+	tt := newDNSTCPTest(t)
+	defer tt.Close()
+	tt.d.mu.Lock()
+	for i := 0; i < maxDNSTCPConns; i++ {
+		addr := netaddr.IPPort{IP: netaddr.IPv4(100, 64, 0, 2), Port: uint16(i)}
+		tt.d.conns[addr] = &dnsTCPConn{}
+	}
+	tt.d.mu.Unlock()
+
+	c := tt.dial()
+	defer c.Close()
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Error("connection over the limit is still open")
+	}
+}
+
+func TestDNSTCPResponderFailedQuery(t *testing.T) {
+	tt := newDNSTCPTest(t)
+	defer tt.Close()
+	c := tt.dial()
+	defer c.Close()
+	if _, err := c.Write(lengthPrefixed([]byte("query"))); err != nil {
+		t.Fatal(err)
+	}
+	q := tt.nextQuery()
+	c.CloseWrite()
+	time.Sleep(50 * time.Millisecond)
+
+	// A query the resolver failed to answer no longer holds up
+	// closing the connection.
+	tt.d.respond(tsdns.Packet{Addr: q.Addr, TCP: true})
+	rest, err := ioutil.ReadAll(c)
+	if err != nil || len(rest) != 0 {
+		t.Errorf("ReadAll = %q, %v; want EOF without data", rest, err)
+	}
+}
+
+func TestDNSTCPResponderIdle(t *testing.T) {
+	tt := newDNSTCPTest(t)
+	defer tt.Close()
+	tt.d.idleTimeout = 50 * time.Millisecond
+	c := tt.dial()
+	defer c.Close()
+
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			t.Fatal("idle connection not closed")
+		}
+		t.Errorf("Read of idle connection = %v; want EOF", err)
+	}
+}
@@ -0,0 +1,333 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"time"
+
+	"tailscale.com/wgengine/packet"
+)
+
+// ConntrackConfig configures the connection tracking tables of a
+// Filter. Zero values mean to use the defaults.
+type ConntrackConfig struct {
+	// MaxTCPFlows, MaxUDPFlows and MaxICMPFlows are the maximum
+	// numbers of tracked flows of each protocol. Each protocol has
+	// its own table, so that a flood of one can't evict the flows
+	// of the others. When a table is full, its least recently
+	// active flow is forgotten.
+	MaxTCPFlows  int
+	MaxUDPFlows  int
+	MaxICMPFlows int
+	// TCPSynTimeout is how long a TCP connection that hasn't
+	// completed its handshake is remembered.
+	TCPSynTimeout time.Duration
+	// TCPEstablishedTimeout is how long an idle, established TCP
+	// connection is remembered.
+	TCPEstablishedTimeout time.Duration
+	// TCPClosingTimeout is how long a TCP connection is remembered
+	// after either side sent a FIN.
+	TCPClosingTimeout time.Duration
+	// UDPTimeout is how long an idle UDP flow is remembered.
+	UDPTimeout time.Duration
+	// ICMPTimeout is how long an ICMP echo is remembered.
+	ICMPTimeout time.Duration
+}
+
+const (
+	DefaultMaxTCPFlows           = 4096
+	DefaultMaxUDPFlows           = 1024
+	DefaultMaxICMPFlows          = 256
+	DefaultTCPSynTimeout         = 2 * time.Minute
+	DefaultTCPEstablishedTimeout = 5 * 24 * time.Hour
+	DefaultTCPClosingTimeout     = 2 * time.Minute
+	DefaultUDPTimeout            = 2 * time.Minute
+	DefaultICMPTimeout           = 30 * time.Second
+)
+
+// withDefaults returns c with its zero fields set to the defaults.
+func (c ConntrackConfig) withDefaults() ConntrackConfig {
+	if c.MaxTCPFlows <= 0 {
+		c.MaxTCPFlows = DefaultMaxTCPFlows
+	}
+	if c.MaxUDPFlows <= 0 {
+		c.MaxUDPFlows = DefaultMaxUDPFlows
+	}
+	if c.MaxICMPFlows <= 0 {
+		c.MaxICMPFlows = DefaultMaxICMPFlows
+	}
+	if c.TCPSynTimeout <= 0 {
+		c.TCPSynTimeout = DefaultTCPSynTimeout
+	}
+	if c.TCPEstablishedTimeout <= 0 {
+		c.TCPEstablishedTimeout = DefaultTCPEstablishedTimeout
+	}
+	if c.TCPClosingTimeout <= 0 {
+		c.TCPClosingTimeout = DefaultTCPClosingTimeout
+	}
+	if c.UDPTimeout <= 0 {
+		c.UDPTimeout = DefaultUDPTimeout
+	}
+	if c.ICMPTimeout <= 0 {
+		c.ICMPTimeout = DefaultICMPTimeout
+	}
+	return c
+}
+
+// flowKey identifies a flow, in the direction of the packet that
+// started it. For ICMP echoes, the echo ID is the source port of a
+// request and the destination port of a reply, so that a reply's
+// reversed key is its request's key.
+type flowKey struct {
+	proto   packet.IPProto
+	srcIP   packet.IP
+	dstIP   packet.IP
+	srcIP6  packet.IP6
+	dstIP6  packet.IP6
+	srcPort uint16
+	dstPort uint16
+}
+
+func newFlowKey(q *packet.ParsedPacket, srcPort, dstPort uint16) flowKey {
+	return flowKey{
+		proto:   q.IPProto,
+		srcIP:   q.SrcIP,
+		dstIP:   q.DstIP,
+		srcIP6:  q.SrcIP6,
+		dstIP6:  q.DstIP6,
+		srcPort: srcPort,
+		dstPort: dstPort,
+	}
+}
+
+// reverse returns the key of packets flowing the opposite way.
+func (k flowKey) reverse() flowKey {
+	return flowKey{
+		proto:   k.proto,
+		srcIP:   k.dstIP,
+		dstIP:   k.srcIP,
+		srcIP6:  k.dstIP6,
+		dstIP6:  k.srcIP6,
+		srcPort: k.dstPort,
+		dstPort: k.srcPort,
+	}
+}
+
+// tcpState is the state of a tracked TCP connection.
+type tcpState uint8
+
+const (
+	tcpSynSent     tcpState = iota // initiator sent SYN
+	tcpSynReceived                 // responder sent SYN-ACK
+	tcpEstablished                 // initiator acked the SYN-ACK
+	tcpFinWait                     // one side sent FIN
+	tcpTimeWait                    // both sides sent FIN
+	tcpClosed                      // either side sent RST
+)
+
+func (s tcpState) String() string {
+	switch s {
+	case tcpSynSent:
+		return "syn-sent"
+	case tcpSynReceived:
+		return "syn-received"
+	case tcpEstablished:
+		return "established"
+	case tcpFinWait:
+		return "fin-wait"
+	case tcpTimeWait:
+		return "time-wait"
+	case tcpClosed:
+		return "closed"
+	default:
+		return "???"
+	}
+}
+
+// flow is a tracked flow.
+type flow struct {
+	key flowKey // in the direction of the initiator
+
+	tcp      tcpState
+	finOrig  bool // initiator sent FIN
+	finReply bool // responder sent FIN
+
+	expires time.Time
+
+	// prev and next link the flows of a conntrack from most to
+	// least recently active.
+	prev, next *flow
+}
+
+// updateTCP advances f's TCP state machine for a packet with the given
+// TCP flags, sent by the initiator if orig is true and by the
+// responder otherwise. It reports whether the packet is valid in f's
+// current state.
+func (f *flow) updateTCP(flags uint8, orig bool) bool {
+	switch {
+	case flags&packet.TCPRst != 0:
+		f.tcp = tcpClosed
+		return true
+	case flags&packet.TCPSynAck == packet.TCPSyn:
+		// Only the initiator sends SYNs, and only to retransmit
+		// them before the handshake completes. Simultaneous open
+		// is not supported.
+		return orig && f.tcp == tcpSynSent
+	case flags&packet.TCPSynAck == packet.TCPSynAck:
+		if orig {
+			return false
+		}
+		switch f.tcp {
+		case tcpSynSent, tcpSynReceived:
+			f.tcp = tcpSynReceived
+			return true
+		case tcpEstablished:
+			// Retransmitted because our ACK was lost.
+			return true
+		}
+		return false
+	}
+
+	switch f.tcp {
+	case tcpSynSent:
+		// Nothing but SYN-ACK or RST can follow a SYN.
+		return false
+	case tcpSynReceived:
+		if orig && flags&packet.TCPAck != 0 {
+			f.tcp = tcpEstablished
+		}
+	}
+	if flags&packet.TCPFin != 0 {
+		if orig {
+			f.finOrig = true
+		} else {
+			f.finReply = true
+		}
+		if f.finOrig && f.finReply {
+			f.tcp = tcpTimeWait
+		} else {
+			f.tcp = tcpFinWait
+		}
+	}
+	return true
+}
+
+// conntrack is a connection tracking table, of the flows of one
+// protocol. It is not safe for concurrent use; callers serialize
+// access with filterState.mu.
+type conntrack struct {
+	cfg      ConntrackConfig // with defaults
+	maxFlows int
+	flows    map[flowKey]*flow
+	// head and tail are the most and least recently active flows.
+	head, tail *flow
+}
+
+// newConntrack returns a table of at most maxFlows flows, whose
+// timeouts are those of cfg. Its config must have its defaults set.
+func newConntrack(cfg ConntrackConfig, maxFlows int) *conntrack {
+	return &conntrack{
+		cfg:      cfg,
+		maxFlows: maxFlows,
+		flows:    make(map[flowKey]*flow),
+	}
+}
+
+// setConfig replaces ct's configuration, evicting flows if the
+// table is now too big. The config must have its defaults set.
+func (ct *conntrack) setConfig(cfg ConntrackConfig, maxFlows int) {
+	ct.cfg = cfg
+	ct.maxFlows = maxFlows
+	for len(ct.flows) > ct.maxFlows {
+		ct.remove(ct.tail)
+	}
+}
+
+// lookup returns the flow that packets with key k belong to, and
+// whether k is in the flow's original direction. Expired flows are
+// removed and not returned.
+func (ct *conntrack) lookup(k flowKey, now time.Time) (f *flow, orig bool) {
+	if f = ct.flows[k]; f != nil {
+		orig = true
+	} else if f = ct.flows[k.reverse()]; f == nil {
+		return nil, false
+	}
+	if now.After(f.expires) {
+		ct.remove(f)
+		return nil, false
+	}
+	return f, orig
+}
+
+// insert starts tracking a new flow with key k. If the table is
+// full, it forgets the least recently active flow.
+func (ct *conntrack) insert(k flowKey, now time.Time) *flow {
+	for len(ct.flows) >= ct.maxFlows {
+		ct.remove(ct.tail)
+	}
+	f := &flow{key: k}
+	ct.flows[k] = f
+	ct.pushFront(f)
+	ct.refresh(f, now)
+	return f
+}
+
+// refresh records activity on f at time now, extending its
+// lifetime according to its protocol and state.
+func (ct *conntrack) refresh(f *flow, now time.Time) {
+	var timeout time.Duration
+	switch f.key.proto {
+	case packet.TCP:
+		switch f.tcp {
+		case tcpSynSent, tcpSynReceived:
+			timeout = ct.cfg.TCPSynTimeout
+		case tcpEstablished:
+			timeout = ct.cfg.TCPEstablishedTimeout
+		default:
+			timeout = ct.cfg.TCPClosingTimeout
+		}
+	case packet.UDP:
+		timeout = ct.cfg.UDPTimeout
+	default:
+		timeout = ct.cfg.ICMPTimeout
+	}
+	f.expires = now.Add(timeout)
+	if ct.head != f {
+		ct.unlink(f)
+		ct.pushFront(f)
+	}
+}
+
+// remove stops tracking f.
+func (ct *conntrack) remove(f *flow) {
+	delete(ct.flows, f.key)
+	ct.unlink(f)
+}
+
+func (ct *conntrack) pushFront(f *flow) {
+	f.prev = nil
+	f.next = ct.head
+	if ct.head != nil {
+		ct.head.prev = f
+	}
+	ct.head = f
+	if ct.tail == nil {
+		ct.tail = f
+	}
+}
+
+func (ct *conntrack) unlink(f *flow) {
+	if f.prev != nil {
+		f.prev.next = f.next
+	} else if ct.head == f {
+		ct.head = f.next
+	}
+	if f.next != nil {
+		f.next.prev = f.prev
+	} else if ct.tail == f {
+		ct.tail = f.prev
+	}
+	f.prev, f.next = nil, nil
+}
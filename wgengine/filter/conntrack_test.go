@@ -0,0 +1,237 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"testing"
+	"time"
+
+	"tailscale.com/wgengine/packet"
+)
+
+const (
+	localIP  = IP(0x01020304) // 1.2.3.4, in newFilter's localNets
+	remoteIP = IP(0x08080808) // 8.8.8.8
+	peerIP   = IP(0x08010101) // 8.1.1.1, allowed to 1.2.3.4:22
+)
+
+func tcpPacket(src, dst IP, sport, dport uint16, flags uint8) *ParsedPacket {
+	p := parsed(TCP, src, dst, sport, dport)
+	p.TCPFlags = flags
+	return &p
+}
+
+func udpPacket(src, dst IP, sport, dport uint16) *ParsedPacket {
+	p := parsed(UDP, src, dst, sport, dport)
+	return &p
+}
+
+func icmpEcho(src, dst IP, typ packet.ICMPType, id uint16) *ParsedPacket {
+	h := &packet.ICMPHeader{
+		IPHeader: packet.IPHeader{SrcIP: src, DstIP: dst},
+		Type:     typ,
+	}
+	p := new(ParsedPacket)
+	p.Decode(packet.Generate(h, []byte{byte(id >> 8), byte(id), 0, 1}))
+	return p
+}
+
+// testStep is a packet run through a filter, and the expected verdict.
+type testStep struct {
+	in   bool // RunIn if true, RunOut otherwise
+	p    *ParsedPacket
+	want Response
+}
+
+func runSteps(t *testing.T, f *Filter, steps []testStep) {
+	t.Helper()
+	for i, s := range steps {
+		var got Response
+		var why string
+		if s.in {
+			got, why = f.runIn(s.p)
+		} else {
+			got, why = f.runOut(s.p)
+		}
+		if got != s.want {
+			t.Errorf("step %d: %v got=%v (%s) want=%v", i, s.p, got, why, s.want)
+		}
+	}
+}
+
+func TestConntrackTCPOutbound(t *testing.T) {
+	const (
+		syn    = packet.TCPSyn
+		synAck = packet.TCPSynAck
+		ack    = packet.TCPAck
+		fin    = packet.TCPFin | packet.TCPAck
+		rst    = packet.TCPRst
+	)
+	f := newFilter(t.Logf)
+	runSteps(t, f, []testStep{
+		// Stray segments and unsolicited SYN-ACKs are dropped.
+		{true, tcpPacket(remoteIP, localIP, 80, 5000, ack), Drop},
+		{true, tcpPacket(remoteIP, localIP, 80, 5000, synAck), Drop},
+		// A connection to 8.8.8.8:80.
+		{false, tcpPacket(localIP, remoteIP, 5000, 80, syn), Accept},
+		// Data can't arrive before the SYN-ACK.
+		{true, tcpPacket(remoteIP, localIP, 80, 5000, ack), Drop},
+		{true, tcpPacket(remoteIP, localIP, 80, 5000, synAck), Accept},
+		{false, tcpPacket(localIP, remoteIP, 5000, 80, ack), Accept},
+		{true, tcpPacket(remoteIP, localIP, 80, 5000, ack), Accept},
+		// Another port is not part of the connection.
+		{true, tcpPacket(remoteIP, localIP, 80, 5001, ack), Drop},
+		// The responder can't restart the handshake.
+		{true, tcpPacket(remoteIP, localIP, 80, 5000, packet.TCPSyn), Drop},
+		// Half close, then full close.
+		{true, tcpPacket(remoteIP, localIP, 80, 5000, fin), Accept},
+		{true, tcpPacket(remoteIP, localIP, 80, 5000, ack), Accept},
+		{false, tcpPacket(localIP, remoteIP, 5000, 80, fin), Accept},
+		{true, tcpPacket(remoteIP, localIP, 80, 5000, ack), Accept},
+		// The ports can be reused by a new connection.
+		{false, tcpPacket(localIP, remoteIP, 5000, 80, syn), Accept},
+		{true, tcpPacket(remoteIP, localIP, 80, 5000, synAck), Accept},
+		// RST forgets the connection.
+		{true, tcpPacket(remoteIP, localIP, 80, 5000, rst), Accept},
+		{true, tcpPacket(remoteIP, localIP, 80, 5000, ack), Drop},
+	})
+	if n := len(f.state.tcp.flows); n != 0 {
+		t.Errorf("%d flows left; want 0", n)
+	}
+}
+
+func TestConntrackTCPInbound(t *testing.T) {
+	const (
+		syn    = packet.TCPSyn
+		synAck = packet.TCPSynAck
+		ack    = packet.TCPAck
+	)
+	f := newFilter(t.Logf)
+	runSteps(t, f, []testStep{
+		// Not allowed by the matches.
+		{true, tcpPacket(peerIP, localIP, 6000, 23, syn), Drop},
+		{true, tcpPacket(peerIP, localIP, 6000, 23, ack), Drop},
+		// Allowed.
+		{true, tcpPacket(peerIP, localIP, 6000, 22, syn), Accept},
+		{true, tcpPacket(peerIP, localIP, 6000, 22, ack), Drop},
+		{false, tcpPacket(localIP, peerIP, 22, 6000, synAck), Accept},
+		{true, tcpPacket(peerIP, localIP, 6000, 22, ack), Accept},
+		{true, tcpPacket(peerIP, localIP, 6000, 22, ack), Accept},
+		// A peer can't pretend to be the responder.
+		{true, tcpPacket(peerIP, localIP, 6000, 22, synAck), Drop},
+	})
+	if got := f.state.tcp.flows[flowKey{proto: TCP, srcIP: peerIP, dstIP: localIP, srcPort: 6000, dstPort: 22}]; got == nil || got.tcp != tcpEstablished {
+		t.Errorf("flow = %+v; want established", got)
+	}
+}
+
+func TestConntrackUDPTimeout(t *testing.T) {
+	f := newFilter(t.Logf)
+	now := time.Unix(1600000000, 0)
+	f.state.timeNow = func() time.Time { return now }
+	f.SetConntrackConfig(ConntrackConfig{UDPTimeout: time.Minute})
+
+	runSteps(t, f, []testStep{
+		{true, udpPacket(remoteIP, localIP, 53, 7000), Drop},
+		{false, udpPacket(localIP, remoteIP, 7000, 53), Accept},
+		{true, udpPacket(remoteIP, localIP, 53, 7000), Accept},
+	})
+	now = now.Add(50 * time.Second)
+	runSteps(t, f, []testStep{
+		{true, udpPacket(remoteIP, localIP, 53, 7000), Accept},
+	})
+	now = now.Add(61 * time.Second)
+	runSteps(t, f, []testStep{
+		{true, udpPacket(remoteIP, localIP, 53, 7000), Drop},
+	})
+	if n := len(f.state.udp.flows); n != 0 {
+		t.Errorf("%d flows left; want 0", n)
+	}
+}
+
+func TestConntrackICMPEcho(t *testing.T) {
+	f := newFilter(t.Logf)
+	runSteps(t, f, []testStep{
+		{true, icmpEcho(remoteIP, localIP, packet.ICMPEchoReply, 7), Drop},
+		{false, icmpEcho(localIP, remoteIP, packet.ICMPEchoRequest, 7), Accept},
+		{true, icmpEcho(remoteIP, localIP, packet.ICMPEchoReply, 7), Accept},
+		{true, icmpEcho(remoteIP, localIP, packet.ICMPEchoReply, 8), Drop},
+		// The reply must come from the host that was pinged.
+		{true, icmpEcho(peerIP, localIP, packet.ICMPEchoReply, 7), Drop},
+	})
+}
+
+func TestConntrackMaxFlows(t *testing.T) {
+	f := newFilter(t.Logf)
+	f.SetConntrackConfig(ConntrackConfig{MaxUDPFlows: 2})
+	runSteps(t, f, []testStep{
+		{false, udpPacket(localIP, remoteIP, 7000, 53), Accept},
+		{false, udpPacket(localIP, remoteIP, 7001, 53), Accept},
+		// Activity on the first flow makes the second one the
+		// least recently active.
+		{true, udpPacket(remoteIP, localIP, 53, 7000), Accept},
+		{false, udpPacket(localIP, remoteIP, 7002, 53), Accept},
+		{true, udpPacket(remoteIP, localIP, 53, 7000), Accept},
+		{true, udpPacket(remoteIP, localIP, 53, 7001), Drop},
+		{true, udpPacket(remoteIP, localIP, 53, 7002), Accept},
+	})
+	if n := len(f.state.udp.flows); n != 2 {
+		t.Errorf("%d flows; want 2", n)
+	}
+
+	f.SetConntrackConfig(ConntrackConfig{MaxUDPFlows: 1})
+	runSteps(t, f, []testStep{
+		{true, udpPacket(remoteIP, localIP, 53, 7000), Drop},
+		{true, udpPacket(remoteIP, localIP, 53, 7002), Accept},
+	})
+}
+
+func TestConntrackPerProtocolTables(t *testing.T) {
+	f := newFilter(t.Logf)
+	f.SetConntrackConfig(ConntrackConfig{MaxUDPFlows: 10})
+	runSteps(t, f, []testStep{
+		{false, icmpEcho(localIP, remoteIP, packet.ICMPEchoRequest, 7), Accept},
+		{false, tcpPacket(localIP, remoteIP, 5000, 80, packet.TCPSyn), Accept},
+	})
+	// A flood of UDP flows fills only the UDP table.
+	for port := uint16(10000); port < 10100; port++ {
+		f.runOut(udpPacket(localIP, remoteIP, port, 53))
+	}
+	runSteps(t, f, []testStep{
+		{true, icmpEcho(remoteIP, localIP, packet.ICMPEchoReply, 7), Accept},
+		{true, tcpPacket(remoteIP, localIP, 80, 5000, packet.TCPSynAck), Accept},
+		{true, udpPacket(remoteIP, localIP, 53, 10000), Drop},
+		{true, udpPacket(remoteIP, localIP, 53, 10099), Accept},
+	})
+	if n := len(f.state.udp.flows); n != 10 {
+		t.Errorf("%d UDP flows; want 10", n)
+	}
+	if n := len(f.state.tcp.flows); n != 1 {
+		t.Errorf("%d TCP flows; want 1", n)
+	}
+}
+
+func TestConntrackSharedState(t *testing.T) {
+	f1 := newFilter(t.Logf)
+	runSteps(t, f1, []testStep{
+		{false, tcpPacket(localIP, remoteIP, 5000, 80, packet.TCPSyn), Accept},
+		{false, udpPacket(localIP, remoteIP, 7000, 53), Accept},
+	})
+
+	// A new filter with no rules at all still knows the flows.
+	f2 := New(nil, f1.localNets, f1, t.Logf)
+	runSteps(t, f2, []testStep{
+		{true, tcpPacket(remoteIP, localIP, 80, 5000, packet.TCPSynAck), Accept},
+		{false, tcpPacket(localIP, remoteIP, 5000, 80, packet.TCPAck), Accept},
+		{true, tcpPacket(remoteIP, localIP, 80, 5000, packet.TCPAck), Accept},
+		{true, udpPacket(remoteIP, localIP, 53, 7000), Accept},
+	})
+
+	// But a fresh one doesn't.
+	f3 := New(nil, f1.localNets, nil, t.Logf)
+	runSteps(t, f3, []testStep{
+		{true, udpPacket(remoteIP, localIP, 53, 7000), Drop},
+	})
+}
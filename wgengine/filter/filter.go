@@ -6,19 +6,45 @@
 package filter
 
 import (
+	"encoding/binary"
 	"fmt"
 	"sync"
 	"time"
 
-	"github.com/golang/groupcache/lru"
 	"golang.org/x/time/rate"
 	"tailscale.com/types/logger"
 	"tailscale.com/wgengine/packet"
 )
 
 type filterState struct {
-	mu  sync.Mutex
-	lru *lru.Cache // of tuple
+	mu   sync.Mutex
+	tcp  *conntrack
+	udp  *conntrack
+	icmp *conntrack // ICMP and ICMPv6 echoes
+
+	timeNow func() time.Time // for tests; time.Now otherwise
+}
+
+func newFilterState() *filterState {
+	cfg := ConntrackConfig{}.withDefaults()
+	return &filterState{
+		tcp:     newConntrack(cfg, cfg.MaxTCPFlows),
+		udp:     newConntrack(cfg, cfg.MaxUDPFlows),
+		icmp:    newConntrack(cfg, cfg.MaxICMPFlows),
+		timeNow: time.Now,
+	}
+}
+
+// conntrack returns the table of the flows of protocol proto.
+func (s *filterState) conntrack(proto packet.IPProto) *conntrack {
+	switch proto {
+	case packet.TCP:
+		return s.tcp
+	case packet.UDP:
+		return s.udp
+	default:
+		return s.icmp
+	}
 }
 
 // Filter is a stateful packet filter.
@@ -37,7 +63,9 @@ type Filter struct {
 	// state is the connection tracking state attached to this
 	// filter. It is used to allow incoming traffic that is a response
 	// to an outbound connection that this node made, even if those
-	// incoming packets don't get accepted by matches above.
+	// incoming packets don't get accepted by matches above, to drop
+	// incoming ICMP echo replies to no request, and to drop TCP
+	// segments that are invalid in the state of their connection.
 	state *filterState
 }
 
@@ -74,18 +102,9 @@ const (
 	HexdumpAccepts
 )
 
-type tuple struct {
-	SrcIP   packet.IP
-	DstIP   packet.IP
-	SrcPort uint16
-	DstPort uint16
-}
-
-const lruMax = 512 // max entries in UDP LRU cache
-
 // MatchAllowAll matches all packets.
 var MatchAllowAll = Matches{
-	Match{[]NetPortRange{NetPortRangeAny}, []Net{NetAny}},
+	Match{[]NetPortRange{NetPortRangeAny, NetPortRangeAny6}, []Net{NetAny, NetAny6}},
 }
 
 // NewAllowAll returns a packet filter that accepts everything to and
@@ -109,9 +128,7 @@ func New(matches Matches, localNets []Net, shareStateWith *Filter, logf logger.L
 	if shareStateWith != nil {
 		state = shareStateWith.state
 	} else {
-		state = &filterState{
-			lru: lru.New(lruMax),
-		}
+		state = newFilterState()
 	}
 	f := &Filter{
 		logf:      logf,
@@ -122,6 +139,20 @@ func New(matches Matches, localNets []Net, shareStateWith *Filter, logf logger.L
 	return f
 }
 
+// SetConntrackConfig sets the configuration of f's connection
+// tracking tables. The tables are shared with the filters created
+// from f by New, so the configuration applies to them as well. If a
+// table holds more flows than its new maximum, the least recently
+// active ones are forgotten.
+func (f *Filter) SetConntrackConfig(cfg ConntrackConfig) {
+	cfg = cfg.withDefaults()
+	f.state.mu.Lock()
+	defer f.state.mu.Unlock()
+	f.state.tcp.setConfig(cfg, cfg.MaxTCPFlows)
+	f.state.udp.setConfig(cfg, cfg.MaxUDPFlows)
+	f.state.icmp.setConfig(cfg, cfg.MaxICMPFlows)
+}
+
 func maybeHexdump(flag RunFlags, b []byte) string {
 	if flag == 0 {
 		return ""
@@ -191,54 +222,40 @@ func (f *Filter) runIn(q *packet.ParsedPacket) (r Response, why string) {
 	// A compromised peer could try to send us packets for
 	// destinations we didn't explicitly advertise. This check is to
 	// prevent that.
-	if !ipInList(q.DstIP, f.localNets) {
+	if !dstInList(q, f.localNets) {
 		return Drop, "destination not allowed"
 	}
 
-	if q.IPVersion == 6 {
-		// TODO: support IPv6.
-		return Drop, "no rules matched"
-	}
-
 	switch q.IPProto {
-	case packet.ICMP:
-		if q.IsEchoResponse() || q.IsError() {
-			// ICMP responses are allowed.
-			// TODO(apenwarr): consider using conntrack state.
-			//  We could choose to reject all packets that aren't
-			//  related to an existing ICMP-Echo, TCP, or UDP
-			//  session.
-			return Accept, "icmp response ok"
+	case packet.ICMP, packet.ICMPv6:
+		if q.IsEchoResponse() {
+			if f.trackEchoReply(q) {
+				return Accept, "icmp echo reply ok"
+			}
+			return Drop, "icmp echo reply without request"
+		} else if q.IsError() {
+			// ICMP errors are allowed.
+			// TODO: only accept errors about tracked flows,
+			//  which requires decoding the quoted packet.
+			return Accept, "icmp error ok"
 		} else if matchIPWithoutPorts(f.matches, q) {
 			// If any port is open to an IP, allow ICMP to it.
 			return Accept, "icmp ok"
 		}
 	case packet.TCP:
-		// For TCP, we want to allow *outgoing* connections,
-		// which means we want to allow return packets on those
-		// connections. To make this restriction work, we need to
-		// allow non-SYN packets (continuation of an existing session)
-		// to arrive. This should be okay since a new incoming session
-		// can't be initiated without first sending a SYN.
-		// It happens to also be much faster.
-		// TODO(apenwarr): Skip the rest of decoding in this path?
-		if q.IPProto == packet.TCP && !q.IsTCPSyn() {
-			return Accept, "tcp non-syn"
-		}
-		if matchIPPorts(f.matches, q) {
-			return Accept, "tcp ok"
-		}
+		return f.runInTCP(q)
 	case packet.UDP:
-		t := tuple{q.SrcIP, q.DstIP, q.SrcPort, q.DstPort}
+		k := newFlowKey(q, q.SrcPort, q.DstPort)
+		now := f.state.timeNow()
 
 		f.state.mu.Lock()
-		_, ok := f.state.lru.Get(t)
-		f.state.mu.Unlock()
-
-		if ok {
+		defer f.state.mu.Unlock()
+		if fl, _ := f.state.udp.lookup(k, now); fl != nil {
+			f.state.udp.refresh(fl, now)
 			return Accept, "udp cached"
 		}
 		if matchIPPorts(f.matches, q) {
+			f.state.udp.insert(k, now)
 			return Accept, "udp ok"
 		}
 	default:
@@ -247,14 +264,108 @@ func (f *Filter) runIn(q *packet.ParsedPacket) (r Response, why string) {
 	return Drop, "no rules matched"
 }
 
+// runInTCP is runIn for TCP packets.
+//
+// A new incoming connection must start with a SYN allowed by the
+// matches. Every other segment must belong to a connection that is
+// already tracked, no matter which side opened it, and be valid in
+// that connection's state.
+func (f *Filter) runInTCP(q *packet.ParsedPacket) (r Response, why string) {
+	k := newFlowKey(q, q.SrcPort, q.DstPort)
+	now := f.state.timeNow()
+
+	f.state.mu.Lock()
+	defer f.state.mu.Unlock()
+	ct := f.state.tcp
+	fl, orig := ct.lookup(k, now)
+	if fl != nil && q.IsTCPSyn() && fl.tcp >= tcpTimeWait {
+		// A new connection reusing the ports of a finished one.
+		ct.remove(fl)
+		fl = nil
+	}
+	if fl == nil {
+		if !q.IsTCPSyn() {
+			return Drop, "tcp non-syn without connection"
+		}
+		if !matchIPPorts(f.matches, q) {
+			return Drop, "no rules matched"
+		}
+		ct.insert(k, now)
+		return Accept, "tcp ok"
+	}
+	if !fl.updateTCP(q.TCPFlags, orig) {
+		return Drop, "tcp invalid for connection state"
+	}
+	if fl.tcp == tcpClosed {
+		ct.remove(fl)
+	} else {
+		ct.refresh(fl, now)
+	}
+	return Accept, "tcp connection ok"
+}
+
+// trackEchoReply reports whether the ICMP echo reply q answers an
+// echo request that this node sent.
+func (f *Filter) trackEchoReply(q *packet.ParsedPacket) bool {
+	k := newFlowKey(q, 0, echoID(q))
+	now := f.state.timeNow()
+
+	f.state.mu.Lock()
+	defer f.state.mu.Unlock()
+	fl, orig := f.state.icmp.lookup(k, now)
+	return fl != nil && !orig
+}
+
+// echoID returns the identifier of ICMP echo request or reply q.
+func echoID(q *packet.ParsedPacket) uint16 {
+	return binary.BigEndian.Uint16(q.Sub(4, 2))
+}
+
 func (f *Filter) runOut(q *packet.ParsedPacket) (r Response, why string) {
-	if q.IPProto == packet.UDP {
-		t := tuple{q.DstIP, q.SrcIP, q.DstPort, q.SrcPort}
-		var ti interface{} = t // allocate once, rather than twice inside mutex
+	var k flowKey
+	switch q.IPProto {
+	case packet.TCP, packet.UDP:
+		k = newFlowKey(q, q.SrcPort, q.DstPort)
+	case packet.ICMP, packet.ICMPv6:
+		if !q.IsEchoRequest() {
+			return Accept, "ok out"
+		}
+		k = newFlowKey(q, echoID(q), 0)
+	default:
+		return Accept, "ok out"
+	}
+	now := f.state.timeNow()
+
+	f.state.mu.Lock()
+	defer f.state.mu.Unlock()
+	ct := f.state.conntrack(q.IPProto)
+	fl, orig := ct.lookup(k, now)
+	if q.IPProto != packet.TCP {
+		if fl == nil {
+			fl = ct.insert(k, now)
+		}
+		ct.refresh(fl, now)
+		return Accept, "ok out"
+	}
 
-		f.state.mu.Lock()
-		f.state.lru.Add(ti, ti)
-		f.state.mu.Unlock()
+	// Outgoing TCP segments are never dropped, but they still
+	// drive the state of the connection they belong to.
+	if fl != nil && q.IsTCPSyn() && fl.tcp >= tcpTimeWait {
+		ct.remove(fl)
+		fl = nil
+	}
+	if fl == nil {
+		if q.IsTCPSyn() {
+			ct.insert(k, now)
+		}
+		return Accept, "ok out"
+	}
+	if fl.updateTCP(q.TCPFlags, orig) {
+		if fl.tcp == tcpClosed {
+			ct.remove(fl)
+		} else {
+			ct.refresh(fl, now)
+		}
 	}
 	return Accept, "ok out"
 }
@@ -288,10 +399,6 @@ func (f *Filter) pre(q *packet.ParsedPacket, rf RunFlags, dir direction) Respons
 		return Drop
 	}
 
-	if q.IPVersion == 6 {
-		f.logRateLimit(rf, q, dir, Drop, "ipv6")
-		return Drop
-	}
 	switch q.IPProto {
 	case packet.Unknown:
 		// Unknown packets are dangerous; always drop them.
@@ -8,6 +8,7 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"net"
 	"strings"
 	"testing"
 
@@ -21,6 +22,7 @@ type IP = packet.IP
 
 var Unknown = packet.Unknown
 var ICMP = packet.ICMP
+var ICMPv6 = packet.ICMPv6
 var TCP = packet.TCP
 var UDP = packet.UDP
 var Fragment = packet.Fragment
@@ -28,27 +30,27 @@ var Fragment = packet.Fragment
 func nets(ips []IP) []Net {
 	out := make([]Net, 0, len(ips))
 	for _, ip := range ips {
-		out = append(out, Net{ip, Netmask(32)})
+		out = append(out, Net{IP: ip, Mask: Netmask(32)})
 	}
 	return out
 }
 
 func ippr(ip IP, start, end uint16) []NetPortRange {
 	return []NetPortRange{
-		NetPortRange{Net{ip, Netmask(32)}, PortRange{start, end}},
+		NetPortRange{Net{IP: ip, Mask: Netmask(32)}, PortRange{start, end}},
 	}
 }
 
 func netpr(ip IP, bits int, start, end uint16) []NetPortRange {
 	return []NetPortRange{
-		NetPortRange{Net{ip, Netmask(bits)}, PortRange{start, end}},
+		NetPortRange{Net{IP: ip, Mask: Netmask(bits)}, PortRange{start, end}},
 	}
 }
 
 var matches = Matches{
 	{Srcs: nets([]IP{0x08010101, 0x08020202}), Dsts: []NetPortRange{
-		NetPortRange{Net{0x01020304, Netmask(32)}, PortRange{22, 22}},
-		NetPortRange{Net{0x05060708, Netmask(32)}, PortRange{23, 24}},
+		NetPortRange{Net{IP: 0x01020304, Mask: Netmask(32)}, PortRange{22, 22}},
+		NetPortRange{Net{IP: 0x05060708, Mask: Netmask(32)}, PortRange{23, 24}},
 	}},
 	{Srcs: nets([]IP{0x08010101, 0x08020202}), Dsts: ippr(0x05060708, 27, 28)},
 	{Srcs: nets([]IP{0x02020202}), Dsts: ippr(0x08010101, 22, 22)},
@@ -57,13 +59,37 @@ var matches = Matches{
 	{Srcs: nets([]IP{0x99010101, 0x99010102, 0x99030303}), Dsts: ippr(0x01020304, 999, 999)},
 }
 
+// ip6 parses s as an IPv6 address.
+func ip6(s string) packet.IP6 {
+	return packet.NewIP6(net.ParseIP(s))
+}
+
+func net6(s string, bits int) Net {
+	return Net{IsIP6: true, IP6: ip6(s), Mask6: Netmask6(bits)}
+}
+
+var matches6 = Matches{
+	{Srcs: []Net{net6("fd7a::1", 128)}, Dsts: []NetPortRange{
+		{net6("fd7a::2", 128), PortRange{22, 22}},
+	}},
+	{Srcs: []Net{NetAny6}, Dsts: []NetPortRange{
+		{net6("fd7a::2", 128), PortRange{80, 80}},
+	}},
+	// An IPv4 source with an IPv6 destination never matches.
+	{Srcs: []Net{NetAny}, Dsts: []NetPortRange{
+		{net6("fd7a::2", 128), PortRange{8080, 8080}},
+	}},
+}
+
 func newFilter(logf logger.Logf) *Filter {
 	// Expects traffic to 100.122.98.50, 1.2.3.4, 5.6.7.8,
 	// 102.102.102.102, 119.119.119.119, 8.1.0.0/16
 	localNets := nets([]IP{0x647a6232, 0x01020304, 0x05060708, 0x66666666, 0x77777777})
-	localNets = append(localNets, Net{IP(0x08010000), Netmask(16)})
+	localNets = append(localNets, Net{IP: IP(0x08010000), Mask: Netmask(16)})
+	// and to fd7a::/64.
+	localNets = append(localNets, net6("fd7a::", 64))
 
-	return New(matches, localNets, nil, logf)
+	return New(append(matches.Clone(), matches6...), localNets, nil, logf)
 }
 
 func TestMarshal(t *testing.T) {
@@ -114,6 +140,21 @@ func TestFilter(t *testing.T) {
 		{Accept, parsed(UDP, 0x66666666, 0x77777777, 4343, 4242)},
 		// Because of the return above, initial attempt is allowed now
 		{Accept, parsed(UDP, 0x77777777, 0x66666666, 4242, 4343)},
+
+		// IPv6
+		{Accept, parsed6(TCP, "fd7a::1", "fd7a::2", 999, 22)},
+		{Drop, parsed6(TCP, "fd7a::3", "fd7a::2", 999, 22)},
+		{Accept, parsed6(TCP, "fd7a::3", "fd7a::2", 999, 80)},
+		{Drop, parsed6(TCP, "fd7a::3", "fd7a::2", 999, 8080)},
+		{Accept, parsed6(ICMPv6, "fd7a::3", "fd7a::2", 0, 0)},
+		// Not a local address.
+		{Drop, parsed6(TCP, "fd7a::1", "fd7b::2", 999, 80)},
+		// The IPv4 wildcard rules don't apply to IPv6.
+		{Drop, parsed6(TCP, "fd7a::3", "fd7a::2", 999, 443)},
+		// Stateful UDP, as above.
+		{Drop, parsed6(UDP, "fd7a::3", "fd7a::2", 4242, 4343)},
+		{Accept, parsed6(UDP, "fd7a::2", "fd7a::3", 4343, 4242)},
+		{Accept, parsed6(UDP, "fd7a::3", "fd7a::2", 4242, 4343)},
 	}
 	for i, test := range tests {
 		if got, _ := acl.runIn(&test.p); test.want != got {
@@ -139,8 +180,9 @@ func TestNoAllocs(t *testing.T) {
 		{"tcp_in", true, 0, tcpPacket},
 		{"tcp_out", false, 0, tcpPacket},
 		{"udp_in", true, 0, udpPacket},
-		// One alloc is inevitable (an lru cache update)
-		{"udp_out", false, 1, udpPacket},
+		// New flows allocate, but the warm-up run creates this
+		// one, so later runs only refresh it.
+		{"udp_out", false, 0, udpPacket},
 	}
 
 	for _, test := range tests {
@@ -170,7 +212,7 @@ func BenchmarkFilter(b *testing.B) {
 	icmpPacket := rawpacket(ICMP, 0x08010101, 0x01020304, 0, 0, 0)
 
 	tcpSynPacket := rawpacket(TCP, 0x08010101, 0x01020304, 999, 22, 0)
-	// TCP filtering is trivial (Accept) for non-SYN packets.
+	// Non-SYN TCP packets are dropped without a tracked connection.
 	tcpSynPacket[33] = packet.TCPSyn
 
 	benches := []struct {
@@ -178,7 +220,7 @@ func BenchmarkFilter(b *testing.B) {
 		in     bool
 		packet []byte
 	}{
-		// Non-SYN TCP and ICMP have similar code paths in and out.
+		// Non-SYN TCP and ICMP are not tracked outbound.
 		{"icmp", true, icmpPacket},
 		{"tcp", true, tcpPacket},
 		{"tcp_syn_in", true, tcpSynPacket},
@@ -239,6 +281,18 @@ func parsed(proto packet.IPProto, src, dst packet.IP, sport, dport uint16) Parse
 	}
 }
 
+func parsed6(proto packet.IPProto, src, dst string, sport, dport uint16) ParsedPacket {
+	return ParsedPacket{
+		IPVersion: 6,
+		IPProto:   proto,
+		SrcIP6:    ip6(src),
+		DstIP6:    ip6(dst),
+		SrcPort:   sport,
+		DstPort:   dport,
+		TCPFlags:  packet.TCPSyn,
+	}
+}
+
 // rawpacket generates a packet with given source and destination ports and IPs
 // and resizes the header to trimLength if it is nonzero.
 func rawpacket(proto packet.IPProto, src, dst packet.IP, sport, dport uint16, trimLength int) []byte {
@@ -360,3 +414,23 @@ func TestOmitDropLogging(t *testing.T) {
 		})
 	}
 }
+
+func TestNetString(t *testing.T) {
+	tests := []struct {
+		n    Net
+		want string
+	}{
+		{NetAny, "*"},
+		{Net{IP: 0x01020304, Mask: Netmask(32)}, "1.2.3.4"},
+		{Net{IP: 0x08010000, Mask: Netmask(16)}, "8.1.0.0/16"},
+		{NetAny6, "::/0"},
+		{net6("fd7a::1", 128), "fd7a::1"},
+		{net6("fd7a:115c:a1e0::", 48), "fd7a:115c:a1e0::/48"},
+		{net6("fd7a:115c:a1e0::", 96), "fd7a:115c:a1e0::/96"},
+	}
+	for _, tt := range tests {
+		if got := tt.n.String(); got != tt.want {
+			t.Errorf("String = %q; want %q", got, tt.want)
+		}
+	}
+}
@@ -17,21 +17,52 @@ func NewIP(ip net.IP) packet.IP {
 	return packet.NewIP(ip)
 }
 
+func NewIP6(ip net.IP) packet.IP6 {
+	return packet.NewIP6(ip)
+}
+
+// Net is an IPv4 or IPv6 network.
+//
+// IPv4 networks use IP and Mask. IPv6 networks set IsIP6 and use
+// IP6 and Mask6 instead. A Net only ever includes addresses of its
+// own family.
 type Net struct {
 	IP   packet.IP
 	Mask packet.IP
+
+	IsIP6 bool
+	IP6   packet.IP6
+	Mask6 packet.IP6
 }
 
+// Includes reports whether n includes the IPv4 address ip.
 func (n Net) Includes(ip packet.IP) bool {
-	return (n.IP & n.Mask) == (ip & n.Mask)
+	return !n.IsIP6 && (n.IP&n.Mask) == (ip&n.Mask)
+}
+
+// Includes6 reports whether n includes the IPv6 address ip.
+func (n Net) Includes6(ip packet.IP6) bool {
+	return n.IsIP6 && n.IP6.And(n.Mask6) == ip.And(n.Mask6)
 }
 
 func (n Net) Bits() int {
+	if n.IsIP6 {
+		if n.Mask6.Lo != 0 {
+			return 128 - bits.TrailingZeros64(n.Mask6.Lo)
+		}
+		return 64 - bits.TrailingZeros64(n.Mask6.Hi)
+	}
 	return 32 - bits.TrailingZeros32(uint32(n.Mask))
 }
 
 func (n Net) String() string {
 	b := n.Bits()
+	if n.IsIP6 {
+		if b == 128 {
+			return n.IP6.String()
+		}
+		return fmt.Sprintf("%s/%d", n.IP6, b)
+	}
 	if b == 32 {
 		return n.IP.String()
 	} else if b == 0 {
@@ -41,14 +72,32 @@ func (n Net) String() string {
 	}
 }
 
-var NetAny = Net{0, 0}
-var NetNone = Net{^packet.IP(0), ^packet.IP(0)}
+var NetAny = Net{IP: 0, Mask: 0}
+var NetNone = Net{IP: ^packet.IP(0), Mask: ^packet.IP(0)}
+
+var NetAny6 = Net{IsIP6: true}
+var NetNone6 = Net{IsIP6: true, IP6: allOnes6, Mask6: allOnes6}
+
+var allOnes6 = packet.IP6{Hi: ^uint64(0), Lo: ^uint64(0)}
 
 func Netmask(bits int) packet.IP {
 	b := ^uint32((1 << (32 - bits)) - 1)
 	return packet.IP(b)
 }
 
+func Netmask6(bits int) packet.IP6 {
+	switch {
+	case bits <= 0:
+		return packet.IP6{}
+	case bits <= 64:
+		return packet.IP6{Hi: ^uint64(0) << (64 - bits)}
+	case bits < 128:
+		return packet.IP6{Hi: ^uint64(0), Lo: ^uint64(0) << (128 - bits)}
+	default:
+		return allOnes6
+	}
+}
+
 type PortRange struct {
 	First, Last uint16
 }
@@ -71,6 +120,7 @@ type NetPortRange struct {
 }
 
 var NetPortRangeAny = NetPortRange{NetAny, PortRangeAny}
+var NetPortRangeAny6 = NetPortRange{NetAny6, PortRangeAny}
 
 func (ipr NetPortRange) String() string {
 	return fmt.Sprintf("%v:%v", ipr.Net, ipr.Ports)
@@ -133,16 +183,49 @@ func ipInList(ip packet.IP, netlist []Net) bool {
 	return false
 }
 
+func ip6InList(ip packet.IP6, netlist []Net) bool {
+	for _, net := range netlist {
+		if net.Includes6(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// srcInList reports whether q's source address is in netlist.
+func srcInList(q *packet.ParsedPacket, netlist []Net) bool {
+	if q.IPVersion == 6 {
+		return ip6InList(q.SrcIP6, netlist)
+	}
+	return ipInList(q.SrcIP, netlist)
+}
+
+// dstInList reports whether q's destination address is in netlist.
+func dstInList(q *packet.ParsedPacket, netlist []Net) bool {
+	if q.IPVersion == 6 {
+		return ip6InList(q.DstIP6, netlist)
+	}
+	return ipInList(q.DstIP, netlist)
+}
+
+// includesDst reports whether n includes q's destination address.
+func includesDst(n Net, q *packet.ParsedPacket) bool {
+	if q.IPVersion == 6 {
+		return n.Includes6(q.DstIP6)
+	}
+	return n.Includes(q.DstIP)
+}
+
 func matchIPPorts(mm Matches, q *packet.ParsedPacket) bool {
 	for _, acl := range mm {
 		for _, dst := range acl.Dsts {
-			if !dst.Net.Includes(q.DstIP) {
+			if !includesDst(dst.Net, q) {
 				continue
 			}
 			if q.DstPort < dst.Ports.First || q.DstPort > dst.Ports.Last {
 				continue
 			}
-			if !ipInList(q.SrcIP, acl.Srcs) {
+			if !srcInList(q, acl.Srcs) {
 				// Skip other dests in this acl, since
 				// the src will never match.
 				break
@@ -156,10 +239,10 @@ func matchIPPorts(mm Matches, q *packet.ParsedPacket) bool {
 func matchIPWithoutPorts(mm Matches, q *packet.ParsedPacket) bool {
 	for _, acl := range mm {
 		for _, dst := range acl.Dsts {
-			if !dst.Net.Includes(q.DstIP) {
+			if !includesDst(dst.Net, q) {
 				continue
 			}
-			if !ipInList(q.SrcIP, acl.Srcs) {
+			if !srcInList(q, acl.Srcs) {
 				// Skip other dests in this acl, since
 				// the src will never match.
 				break
@@ -44,6 +44,7 @@ import (
 	"tailscale.com/net/interfaces"
 	"tailscale.com/net/netcheck"
 	"tailscale.com/net/netns"
+	"tailscale.com/net/portmapper"
 	"tailscale.com/net/stun"
 	"tailscale.com/syncs"
 	"tailscale.com/tailcfg"
@@ -79,6 +80,13 @@ var (
 	// on mobile devices, lowers the shutdown interval, and logs more
 	// verbosely about idle measurements.
 	debugReSTUNStopOnIdle, _ = strconv.ParseBool(os.Getenv("TS_DEBUG_RESTUN_STOP_ON_IDLE"))
+	// derpWebSocket frames DERP connections in WebSocket messages,
+	// for networks whose middleboxes only pass WebSockets.
+	derpWebSocket, _ = strconv.ParseBool(os.Getenv("TS_DERP_WEBSOCKET"))
+	// derpClientCert and derpClientKey name the PEM files of a TLS
+	// client certificate for DERP servers that require one.
+	derpClientCert = os.Getenv("TS_DERP_CLIENT_CERT")
+	derpClientKey  = os.Getenv("TS_DERP_CLIENT_KEY")
 )
 
 // inTest reports whether the running program is a test that set the
@@ -102,6 +110,7 @@ type Conn struct {
 	logf             logger.Logf
 	sendLogLimit     *rate.Limiter
 	netChecker       *netcheck.Client
+	portMapper       *portmapper.Client     // NAT-PMP/PCP/UPnP
 	idleFunc         func() time.Duration   // nil means unknown
 	noteRecvActivity func(tailcfg.DiscoKey) // or nil, see Options.NoteRecvActivity
 
@@ -135,6 +144,7 @@ type Conn struct {
 	wantEndpointsUpdate   string // true if non-empty; string is reason
 	lastEndpoints         []string
 	peerSet               map[key.Public]struct{}
+	staticEndpoints       []string // ip:port or host:port; see SetStaticEndpoints
 
 	discoPrivate    key.Private
 	discoPublic     tailcfg.DiscoKey // public of discoPrivate
@@ -247,8 +257,34 @@ type activeDerp struct {
 	// It is always non-nil and initialized to a non-zero Time[
 	lastWrite  *time.Time
 	createTime time.Time
+
+	// health is the result of the latest pings of the region.
+	// It is always non-nil. Guarded by Conn.mu.
+	health *derpHealth
+}
+
+// derpHealth is the result of the latest pings of a DERP region.
+type derpHealth struct {
+	lastPong time.Time     // when a ping was last answered
+	latency  time.Duration // round-trip time of that ping
+	err      error         // error from the latest ping, or nil
 }
 
+const (
+	// derpPingInterval is how often the home DERP connection, and
+	// the others in use to reach peers, are pinged to check their
+	// health and measure their latency.
+	derpPingInterval = 30 * time.Second
+
+	// derpPingMaxIdle is how long magicsock may go without traffic
+	// before DERP pings stop until there's traffic again.
+	derpPingMaxIdle = 5 * time.Minute
+
+	// derpPingTimeout is how long to wait for a pong before
+	// declaring the DERP connection dead and reconnecting.
+	derpPingTimeout = 5 * time.Second
+)
+
 // DefaultPort is the default port to listen on.
 // The current default (zero) means to auto-select a random free port.
 const DefaultPort = 0
@@ -348,6 +384,7 @@ func NewConn(opts Options) (*Conn, error) {
 	if c.pconn6 != nil {
 		c.netChecker.GetSTUNConn6 = func() netcheck.STUNConn { return c.pconn6 }
 	}
+	c.portMapper = portmapper.NewClient(logger.WithPrefix(c.logf, "portmapper: "))
 
 	c.ignoreSTUNPackets()
 
@@ -673,9 +710,15 @@ func (c *Conn) determineEndpoints(ctx context.Context) (ipPorts []string, reason
 			}
 		}
 	}
+	if ext, ok := c.maybePortMap(ctx, nr); ok {
+		addAddr(ext.String(), "portmap")
+	}
 	if nr.GlobalV6 != "" {
 		addAddr(nr.GlobalV6, "stun")
 	}
+	for _, ep := range c.resolveStaticEndpoints(ctx) {
+		addAddr(ep, "static")
+	}
 
 	c.ignoreSTUNPackets()
 
@@ -716,6 +759,85 @@ func (c *Conn) determineEndpoints(ctx context.Context) (ipPorts []string, reason
 	return eps, already, nil
 }
 
+// maybePortMap returns the external address of a port mapping to our
+// UDP port, if netcheck found that the gateway speaks one of the port
+// mapping protocols and it granted us a mapping.
+//
+// c.mu must NOT be held.
+func (c *Conn) maybePortMap(ctx context.Context, nr *netcheck.Report) (ext netaddr.IPPort, ok bool) {
+	if !nr.UPnP.EqualBool(true) && !nr.PMP.EqualBool(true) && !nr.PCP.EqualBool(true) {
+		return netaddr.IPPort{}, false
+	}
+	c.portMapper.SetLocalPort(c.LocalPort())
+	ext, err := c.portMapper.CreateOrGetMapping(ctx)
+	if err != nil {
+		// Already logged by the portmapper.
+		return netaddr.IPPort{}, false
+	}
+	return ext, true
+}
+
+// staticEndpointLookupTimeout bounds the DNS lookup of each static
+// endpoint's hostname.
+const staticEndpointLookupTimeout = 5 * time.Second
+
+// SetStaticEndpoints sets extra endpoints to advertise in addition to
+// those found via STUN and the local interfaces, such as the public
+// address of a 1:1 NAT or load balancer in front of this machine.
+//
+// Each endpoint is in ip:port or host:port form. Hostnames are looked
+// up again on every endpoint update, so changes to their addresses
+// are picked up periodically.
+func (c *Conn) SetStaticEndpoints(eps []string) {
+	c.mu.Lock()
+	if stringsEqual(c.staticEndpoints, eps) {
+		c.mu.Unlock()
+		return
+	}
+	c.staticEndpoints = append([]string(nil), eps...)
+	started := c.started
+	c.mu.Unlock()
+
+	if started {
+		c.ReSTUN("static-endpoints")
+	}
+}
+
+// resolveStaticEndpoints returns the static endpoints in ip:port
+// form, looking up any hostnames. Endpoints that fail to resolve are
+// logged and skipped.
+//
+// c.mu must NOT be held.
+func (c *Conn) resolveStaticEndpoints(ctx context.Context) []string {
+	c.mu.Lock()
+	eps := c.staticEndpoints
+	c.mu.Unlock()
+
+	var ret []string
+	for _, ep := range eps {
+		host, port, err := net.SplitHostPort(ep)
+		if err != nil {
+			c.logf("magicsock: invalid static endpoint %q: %v", ep, err)
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			ret = append(ret, net.JoinHostPort(ip.String(), port))
+			continue
+		}
+		lookupCtx, cancel := context.WithTimeout(ctx, staticEndpointLookupTimeout)
+		ips, err := net.DefaultResolver.LookupIPAddr(lookupCtx, host)
+		cancel()
+		if err != nil {
+			c.logf("magicsock: resolving static endpoint %q: %v", ep, err)
+			continue
+		}
+		for _, ip := range ips {
+			ret = append(ret, net.JoinHostPort(ip.IP.String(), port))
+		}
+	}
+	return ret
+}
+
 func stringsEqual(x, y []string) bool {
 	if len(x) != len(y) {
 		return false
@@ -1054,6 +1176,9 @@ func (c *Conn) derpWriteChanOfAddr(addr netaddr.IPPort, peer key.Public) chan<-
 
 	dc.NotePreferred(c.myDerp == regionID)
 	dc.DNSCache = dnscache.Get()
+	dc.WebSocket = derpWebSocket
+	dc.ClientCertFile = derpClientCert
+	dc.ClientKeyFile = derpClientKey
 
 	ctx, cancel := context.WithCancel(c.connCtx)
 	ch := make(chan derpWriteRequest, bufferedDerpWritesBeforeDrop)
@@ -1064,6 +1189,7 @@ func (c *Conn) derpWriteChanOfAddr(addr netaddr.IPPort, peer key.Public) chan<-
 	ad.lastWrite = new(time.Time)
 	*ad.lastWrite = time.Now()
 	ad.createTime = time.Now()
+	ad.health = new(derpHealth)
 	c.activeDerp[regionID] = ad
 	c.logActiveDerpLocked()
 	c.setPeerLastDerpLocked(peer, regionID, regionID)
@@ -1077,7 +1203,7 @@ func (c *Conn) derpWriteChanOfAddr(addr netaddr.IPPort, peer key.Public) chan<-
 	}
 	// And register a WaitGroup(Chan) for this generation.
 	wg := syncs.NewWaitGroupChan()
-	wg.Add(2)
+	wg.Add(3)
 	c.prevDerp[regionID] = wg
 
 	if firstDerp {
@@ -1091,6 +1217,7 @@ func (c *Conn) derpWriteChanOfAddr(addr netaddr.IPPort, peer key.Public) chan<-
 
 	go c.runDerpReader(ctx, addr, dc, wg, startGate)
 	go c.runDerpWriter(ctx, dc, ch, wg, startGate)
+	go c.runDerpPinger(ctx, regionID, dc, ad.health, wg, startGate)
 
 	return ad.writeCh
 }
@@ -1264,6 +1391,72 @@ func (c *Conn) runDerpWriter(ctx context.Context, dc *derphttp.Client, ch <-chan
 	}
 }
 
+// runDerpPinger periodically pings the DERP server of regionID via
+// dc, as long as shouldPingDerp says it's worth it, recording the
+// results in health. A ping that times out makes dc reconnect.
+func (c *Conn) runDerpPinger(ctx context.Context, regionID int, dc *derphttp.Client, health *derpHealth, wg *syncs.WaitGroupChan, startGate <-chan struct{}) {
+	defer wg.Decr()
+	select {
+	case <-startGate:
+	case <-ctx.Done():
+		return
+	}
+
+	t := time.NewTicker(derpPingInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if !c.shouldPingDerp(regionID, dc) {
+			continue
+		}
+		pingCtx, cancel := context.WithTimeout(ctx, derpPingTimeout)
+		latency, err := dc.Ping(pingCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if err == derp.ErrPingUnsupported {
+			// Old server; health unknown.
+			return
+		}
+
+		c.mu.Lock()
+		wasOK := health.err == nil
+		if err == nil {
+			health.lastPong = time.Now()
+			health.latency = latency
+		}
+		health.err = err
+		c.mu.Unlock()
+
+		if err != nil && wasOK {
+			c.logf("magicsock: derp-%d ping failed: %v", regionID, err)
+		} else if err == nil && !wasOK {
+			c.logf("magicsock: derp-%d ping ok again, latency %v", regionID, latency.Round(time.Millisecond))
+		}
+	}
+}
+
+// shouldPingDerp reports whether the DERP connection dc to regionID
+// is worth pinging: it's the home region's, or it was used to reach
+// peers since the last ping, and magicsock isn't idle.
+func (c *Conn) shouldPingDerp(regionID int, dc *derphttp.Client) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ad, ok := c.activeDerp[regionID]
+	if !ok || ad.c != dc {
+		return false
+	}
+	if f := c.idleFunc; f != nil && f() > derpPingMaxIdle {
+		return false
+	}
+	return regionID == c.myDerp || time.Since(*ad.lastWrite) < derpPingInterval
+}
+
 // findEndpoint maps from a UDP address to a WireGuard endpoint, for
 // ReceiveIPv4/ReceiveIPv6.
 // The provided addr and ipp must match.
@@ -2103,7 +2296,6 @@ func (c *Conn) Close() error {
 		c.mu.Unlock()
 		return nil
 	}
-	defer c.mu.Unlock()
 
 	for _, ep := range c.endpointOfDisco {
 		ep.stopAndReset()
@@ -2112,6 +2304,9 @@ func (c *Conn) Close() error {
 	c.closed = true
 	c.connCtxCancel()
 	c.closeAllDerpLocked("conn-close")
+	// Releasing the port mapping talks to the gateway, so it's
+	// done once mu is released.
+	pm := c.portMapper
 	if c.pconn6 != nil {
 		c.pconn6.Close()
 	}
@@ -2124,6 +2319,9 @@ func (c *Conn) Close() error {
 	for c.goroutinesRunningLocked() {
 		c.muCond.Wait()
 	}
+	c.mu.Unlock()
+
+	pm.Close()
 	return err
 }
 
@@ -2941,9 +3139,20 @@ func (c *Conn) UpdateStatus(sb *ipnstate.StatusBuilder) {
 		sb.AddPeer(k, ps)
 	}
 
-	c.foreachActiveDerpSortedLocked(func(node int, ad activeDerp) {
-		// TODO(bradfitz): add to ipnstate.StatusBuilder
-		//f("<li><b>derp-%v</b>: cr%v,wr%v</li>", node, simpleDur(now.Sub(ad.createTime)), simpleDur(now.Sub(*ad.lastWrite)))
+	c.foreachActiveDerpSortedLocked(func(regionID int, ad activeDerp) {
+		ds := &ipnstate.DERPStatus{
+			RegionID:   regionID,
+			RegionCode: c.derpRegionCodeOfIDLocked(regionID),
+			Home:       regionID == c.myDerp,
+			Created:    ad.createTime,
+			LastWrite:  *ad.lastWrite,
+			LastPong:   ad.health.lastPong,
+			Latency:    ad.health.latency,
+		}
+		if err := ad.health.err; err != nil {
+			ds.PingError = err.Error()
+		}
+		sb.AddDERP(ds)
 	})
 }
 
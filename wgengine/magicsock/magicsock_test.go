@@ -1337,3 +1337,62 @@ func TestDiscoEndpointAlignment(t *testing.T) {
 		t.Error("expected false on second call")
 	}
 }
+
+func TestShouldPingDerp(t *testing.T) {
+	c := newConn()
+	c.myDerp = 1
+	var idle time.Duration
+	c.idleFunc = func() time.Duration { return idle }
+	now := time.Now()
+	stale := now.Add(-2 * derpPingInterval)
+	home, active, unused := new(derphttp.Client), new(derphttp.Client), new(derphttp.Client)
+	c.activeDerp = map[int]activeDerp{
+		1: {c: home, lastWrite: &stale},
+		2: {c: active, lastWrite: &now},
+		3: {c: unused, lastWrite: &stale},
+	}
+
+	tests := []struct {
+		name     string
+		regionID int
+		dc       *derphttp.Client
+		want     bool
+	}{
+		{"home", 1, home, true},
+		{"active", 2, active, true},
+		{"unused", 3, unused, false},
+		{"replaced", 2, unused, false},
+		{"closed", 4, unused, false},
+	}
+	for _, tt := range tests {
+		if got := c.shouldPingDerp(tt.regionID, tt.dc); got != tt.want {
+			t.Errorf("%s: shouldPingDerp = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+
+	idle = 2 * derpPingMaxIdle
+	if c.shouldPingDerp(1, home) {
+		t.Error("shouldPingDerp = true while idle; want false")
+	}
+}
+
+func TestResolveStaticEndpoints(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	c.SetStaticEndpoints([]string{
+		"1.2.3.4:41641",
+		"[2001:db8::1]:41642",
+		"localhost:41643",
+		"no-port",
+	})
+
+	got := map[string]bool{}
+	for _, ep := range c.resolveStaticEndpoints(context.Background()) {
+		got[ep] = true
+	}
+	for _, want := range []string{"1.2.3.4:41641", "[2001:db8::1]:41642", "127.0.0.1:41643"} {
+		if !got[want] {
+			t.Errorf("missing %q in %v", want, got)
+		}
+	}
+}
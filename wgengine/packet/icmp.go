@@ -13,6 +13,17 @@ const (
 	ICMPTimeExceeded ICMPType = 0x0b
 )
 
+// ICMPv6 types. These share the ICMPType type but not its String
+// method, which only knows the IPv4 values.
+const (
+	ICMPv6Unreachable  ICMPType = 0x01
+	ICMPv6PacketTooBig ICMPType = 0x02
+	ICMPv6TimeExceeded ICMPType = 0x03
+	ICMPv6ParamProblem ICMPType = 0x04
+	ICMPv6EchoRequest  ICMPType = 0x80
+	ICMPv6EchoReply    ICMPType = 0x81
+)
+
 func (t ICMPType) String() string {
 	switch t {
 	case ICMPEchoReply:
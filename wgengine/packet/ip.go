@@ -63,6 +63,8 @@ func (p IPProto) String() string {
 		return "Frag"
 	case ICMP:
 		return "ICMP"
+	case ICMPv6:
+		return "ICMPv6"
 	case UDP:
 		return "UDP"
 	case TCP:
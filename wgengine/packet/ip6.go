@@ -0,0 +1,69 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"fmt"
+	"net"
+
+	"inet.af/netaddr"
+)
+
+// IP6 is an IPv6 address.
+type IP6 struct {
+	Hi, Lo uint64
+}
+
+// NewIP6 converts a standard library IP address into an IP6.
+// It panics if b is not an IPv6 address.
+func NewIP6(b net.IP) IP6 {
+	b16 := b.To16()
+	if b16 == nil || b.To4() != nil {
+		panic(fmt.Sprintf("NewIP6(%v): not an IPv6 address", b))
+	}
+	return IP6{Hi: get64(b16[:8]), Lo: get64(b16[8:])}
+}
+
+// IP6FromNetaddr converts a netaddr.IP to an IP6.
+func IP6FromNetaddr(ip netaddr.IP) IP6 {
+	ipbytes := ip.As16()
+	return IP6{Hi: get64(ipbytes[:8]), Lo: get64(ipbytes[8:])}
+}
+
+// Netaddr converts an IP6 to a netaddr.IP.
+func (ip IP6) Netaddr() netaddr.IP {
+	var b [16]byte
+	put64(b[:8], ip.Hi)
+	put64(b[8:], ip.Lo)
+	return netaddr.IPFrom16(b)
+}
+
+func (ip IP6) String() string {
+	var b [16]byte
+	put64(b[:8], ip.Hi)
+	put64(b[8:], ip.Lo)
+	return net.IP(b[:]).String()
+}
+
+// And returns the bitwise AND of ip and mask.
+func (ip IP6) And(mask IP6) IP6 {
+	return IP6{Hi: ip.Hi & mask.Hi, Lo: ip.Lo & mask.Lo}
+}
+
+// IsMulticast reports whether ip is in ff00::/8.
+func (ip IP6) IsMulticast() bool {
+	return ip.Hi>>56 == 0xff
+}
+
+// IsLinkLocalUnicast reports whether ip is in fe80::/10.
+func (ip IP6) IsLinkLocalUnicast() bool {
+	return ip.Hi>>54 == 0xfe80>>6
+}
+
+const ip6HeaderLength = 40
+
+// ip6FragmentHeader is the NextHeader value of the IPv6 fragment
+// extension header.
+const ip6FragmentHeader = 44
@@ -16,7 +16,10 @@ import (
 const minFrag = 60 + 20 // max IPv4 header + basic TCP header
 
 const (
+	TCPFin    = 0x01
 	TCPSyn    = 0x02
+	TCPRst    = 0x04
+	TCPPsh    = 0x08
 	TCPAck    = 0x10
 	TCPSynAck = TCPSyn | TCPAck
 )
@@ -24,14 +27,18 @@ const (
 var (
 	get16 = binary.BigEndian.Uint16
 	get32 = binary.BigEndian.Uint32
+	get64 = binary.BigEndian.Uint64
 
 	put16 = binary.BigEndian.PutUint16
 	put32 = binary.BigEndian.PutUint32
+	put64 = binary.BigEndian.PutUint64
 )
 
 // ParsedPacket is a minimal decoding of a packet suitable for use in filters.
 //
-// In general, it only supports IPv4. The IPv6 parsing is very minimal.
+// It supports IPv4 and IPv6. IPv6 extension headers other than
+// the fragment header are not supported, and such packets decode
+// as Unknown.
 type ParsedPacket struct {
 	// b is the byte buffer that this decodes.
 	b []byte
@@ -45,8 +52,10 @@ type ParsedPacket struct {
 
 	IPVersion uint8   // 4, 6, or 0
 	IPProto   IPProto // IP subprotocol (UDP, TCP, etc); the NextHeader field for IPv6
-	SrcIP     IP      // IP source address (not used for IPv6)
-	DstIP     IP      // IP destination address (not used for IPv6)
+	SrcIP     IP      // IP source address (IPv4 only)
+	DstIP     IP      // IP destination address (IPv4 only)
+	SrcIP6    IP6     // IP source address (IPv6 only)
+	DstIP6    IP6     // IP destination address (IPv6 only)
 	SrcPort   uint16  // TCP/UDP source port
 	DstPort   uint16  // TCP/UDP destination port
 	TCPFlags  uint8   // TCP flags (SYN, ACK, etc)
@@ -56,13 +65,16 @@ type ParsedPacket struct {
 type NextHeader uint8
 
 func (p *ParsedPacket) String() string {
-	if p.IPVersion == 6 {
-		return fmt.Sprintf("IPv6{Proto=%d}", p.IPProto)
-	}
 	switch p.IPProto {
 	case Unknown:
+		if p.IPVersion == 6 {
+			return "IPv6{???}"
+		}
 		return "Unknown{???}"
 	}
+	if p.IPVersion == 6 {
+		return fmt.Sprintf("%s{[%s]:%d > [%s]:%d}", p.IPProto, p.SrcIP6, p.SrcPort, p.DstIP6, p.DstPort)
+	}
 	sb := strbuilder.Get()
 	sb.WriteString(p.IPProto.String())
 	sb.WriteByte('{')
@@ -105,9 +117,9 @@ func ipChecksum(b []byte) uint16 {
 }
 
 // Decode extracts data from the packet in b into q.
-// It performs extremely simple packet decoding for basic IPv4 packet types.
-// It extracts only the subprotocol id, IP addresses, and (if any) ports,
-// and shouldn't need any memory allocation.
+// It performs extremely simple packet decoding for basic IPv4 and IPv6
+// packet types. It extracts only the subprotocol id, IP addresses,
+// and (if any) ports, and shouldn't need any memory allocation.
 func (q *ParsedPacket) Decode(b []byte) {
 	q.b = b
 
@@ -117,21 +129,20 @@ func (q *ParsedPacket) Decode(b []byte) {
 		return
 	}
 
-	// Check that it's IPv4.
-	// TODO(apenwarr): consider IPv6 support
 	q.IPVersion = (b[0] & 0xF0) >> 4
 	switch q.IPVersion {
 	case 4:
-		q.IPProto = IPProto(b[9])
+		q.decode4(b)
 	case 6:
-		q.IPProto = IPProto(b[6]) // "Next Header" field
-		return
+		q.decode6(b)
 	default:
 		q.IPVersion = 0
 		q.IPProto = Unknown
-		return
 	}
+}
 
+func (q *ParsedPacket) decode4(b []byte) {
+	q.IPProto = IPProto(b[9])
 	q.length = int(get16(b[2:4]))
 	if len(b) < q.length {
 		// Packet was cut off before full IPv4 length.
@@ -142,9 +153,65 @@ func (q *ParsedPacket) Decode(b []byte) {
 	// If it's valid IPv4, then the IP addresses are valid
 	q.SrcIP = IP(get32(b[12:16]))
 	q.DstIP = IP(get32(b[16:20]))
+	q.SrcIP6 = IP6{}
+	q.DstIP6 = IP6{}
 
 	q.subofs = int((b[0] & 0x0F) << 2)
-	sub := b[q.subofs:]
+
+	fragFlags := get16(b[6:8])
+	moreFrags := (fragFlags & 0x20) != 0
+	fragOfs := fragFlags & 0x1FFF
+	q.decodeSub(fragOfs, moreFrags)
+}
+
+func (q *ParsedPacket) decode6(b []byte) {
+	if len(b) < ip6HeaderLength {
+		q.IPProto = Unknown
+		return
+	}
+	q.IPProto = IPProto(b[6]) // "Next Header" field
+	q.length = ip6HeaderLength + int(get16(b[4:6]))
+	if len(b) < q.length {
+		// Packet was cut off before full IPv6 length.
+		q.IPProto = Unknown
+		return
+	}
+
+	q.SrcIP = 0
+	q.DstIP = 0
+	q.SrcIP6 = IP6{Hi: get64(b[8:16]), Lo: get64(b[16:24])}
+	q.DstIP6 = IP6{Hi: get64(b[24:32]), Lo: get64(b[32:40])}
+
+	q.subofs = ip6HeaderLength
+
+	var fragOfs uint16
+	var moreFrags bool
+	if q.IPProto == ip6FragmentHeader {
+		// The fragment header is the only extension header we
+		// look through, so that IPv6 fragments get the same
+		// treatment as IPv4 ones below.
+		if q.length < q.subofs+8 {
+			q.IPProto = Unknown
+			return
+		}
+		frag := b[q.subofs : q.subofs+8]
+		q.IPProto = IPProto(frag[0])
+		fragOfs = get16(frag[2:4]) >> 3
+		moreFrags = (frag[3] & 0x01) != 0
+		q.subofs += 8
+	}
+	q.decodeSub(fragOfs, moreFrags)
+}
+
+// decodeSub decodes the IP subprotocol header that starts at q.subofs.
+// fragOfs and moreFrags are the fragmentation state from the IP header,
+// with fragOfs in units of 8 bytes.
+func (q *ParsedPacket) decodeSub(fragOfs uint16, moreFrags bool) {
+	if q.subofs > q.length {
+		q.IPProto = Unknown
+		return
+	}
+	sub := q.b[q.subofs:q.length]
 
 	// We don't care much about IP fragmentation, except insofar as it's
 	// used for firewall bypass attacks. The trick is make the first
@@ -158,9 +225,6 @@ func (q *ParsedPacket) Decode(b []byte) {
 	// zero reason to send such a short first fragment, so we can treat
 	// it as Unknown. We can also treat any subsequent fragment that starts
 	// at such a low offset as Unknown.
-	fragFlags := get16(b[6:8])
-	moreFrags := (fragFlags & 0x20) != 0
-	fragOfs := fragFlags & 0x1FFF
 	if fragOfs == 0 {
 		// This is the first fragment
 		if moreFrags && len(sub) < minFrag {
@@ -172,7 +236,7 @@ func (q *ParsedPacket) Decode(b []byte) {
 		// or a big enough initial fragment that we can read the
 		// whole subprotocol header.
 		switch q.IPProto {
-		case ICMP:
+		case ICMP, ICMPv6:
 			if len(sub) < icmpHeaderLength {
 				q.IPProto = Unknown
 				return
@@ -234,6 +298,7 @@ func (q *ParsedPacket) IPHeader() IPHeader {
 	}
 }
 
+// ICMPHeader returns the header of q, an IPv4 ICMP packet.
 func (q *ParsedPacket) ICMPHeader() ICMPHeader {
 	return ICMPHeader{
 		IPHeader: q.IPHeader(),
@@ -250,6 +315,46 @@ func (q *ParsedPacket) UDPHeader() UDPHeader {
 	}
 }
 
+// TCPHeader returns the header of q, a TCP packet.
+func (q *ParsedPacket) TCPHeader() TCPHeader {
+	var opts []byte
+	if optofs := q.subofs + tcpHeaderLength; optofs < q.dataofs && q.dataofs <= q.length {
+		opts = q.b[optofs:q.dataofs]
+	}
+	return TCPHeader{
+		IPHeader: q.IPHeader(),
+		SrcPort:  q.SrcPort,
+		DstPort:  q.DstPort,
+		Seq:      get32(q.b[q.subofs+4 : q.subofs+8]),
+		Ack:      get32(q.b[q.subofs+8 : q.subofs+12]),
+		Flags:    q.TCPFlags,
+		Window:   get16(q.b[q.subofs+14 : q.subofs+16]),
+		MSS:      tcpMSSOption(opts),
+	}
+}
+
+// tcpMSSOption returns the maximum segment size in opts, the
+// options of a TCP header, or zero if there is none.
+func tcpMSSOption(opts []byte) uint16 {
+	for len(opts) > 0 {
+		switch opts[0] {
+		case tcpOptionEnd:
+			return 0
+		case tcpOptionNop:
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || int(opts[1]) < 2 || int(opts[1]) > len(opts) {
+			return 0
+		}
+		if opts[0] == tcpOptionMSS && opts[1] == tcpOptionMSSLength {
+			return get16(opts[2:4])
+		}
+		opts = opts[opts[1]:]
+	}
+	return 0
+}
+
 // Buffer returns the entire packet buffer.
 // This is a read-only view; that is, q retains the ownership of the buffer.
 func (q *ParsedPacket) Buffer() []byte {
@@ -268,7 +373,7 @@ func (q *ParsedPacket) Payload() []byte {
 	return q.b[q.dataofs:q.length]
 }
 
-// Trim trims the buffer to its IPv4 length.
+// Trim trims the buffer to its IP length.
 // Sometimes packets arrive from an interface with extra bytes on the end.
 // This removes them.
 func (q *ParsedPacket) Trim() []byte {
@@ -281,31 +386,47 @@ func (q *ParsedPacket) IsTCPSyn() bool {
 	return (q.TCPFlags & TCPSynAck) == TCPSyn
 }
 
-// IsError reports whether q is an IPv4 ICMP "Error" packet.
+// IsError reports whether q is an ICMP or ICMPv6 "Error" packet.
 func (q *ParsedPacket) IsError() bool {
-	if q.IPProto == ICMP && len(q.b) >= q.subofs+8 {
+	if len(q.b) < q.subofs+8 {
+		return false
+	}
+	switch q.IPProto {
+	case ICMP:
 		switch ICMPType(q.b[q.subofs]) {
 		case ICMPUnreachable, ICMPTimeExceeded:
 			return true
 		}
+	case ICMPv6:
+		switch ICMPType(q.b[q.subofs]) {
+		case ICMPv6Unreachable, ICMPv6PacketTooBig, ICMPv6TimeExceeded, ICMPv6ParamProblem:
+			return true
+		}
 	}
 	return false
 }
 
-// IsEchoRequest reports whether q is an IPv4 ICMP Echo Request.
+// IsEchoRequest reports whether q is an ICMP or ICMPv6 Echo Request.
 func (q *ParsedPacket) IsEchoRequest() bool {
-	if q.IPProto == ICMP && len(q.b) >= q.subofs+8 {
-		return ICMPType(q.b[q.subofs]) == ICMPEchoRequest &&
-			ICMPCode(q.b[q.subofs+1]) == ICMPNoCode
-	}
-	return false
+	return q.isICMPType(ICMPEchoRequest, ICMPv6EchoRequest)
 }
 
-// IsEchoRequest reports whether q is an IPv4 ICMP Echo Response.
+// IsEchoResponse reports whether q is an ICMP or ICMPv6 Echo Response.
 func (q *ParsedPacket) IsEchoResponse() bool {
-	if q.IPProto == ICMP && len(q.b) >= q.subofs+8 {
-		return ICMPType(q.b[q.subofs]) == ICMPEchoReply &&
-			ICMPCode(q.b[q.subofs+1]) == ICMPNoCode
+	return q.isICMPType(ICMPEchoReply, ICMPv6EchoReply)
+}
+
+// isICMPType reports whether q is an ICMP packet of type t4 or an
+// ICMPv6 packet of type t6, with no code.
+func (q *ParsedPacket) isICMPType(t4, t6 ICMPType) bool {
+	if len(q.b) < q.subofs+8 || ICMPCode(q.b[q.subofs+1]) != ICMPNoCode {
+		return false
+	}
+	switch q.IPProto {
+	case ICMP:
+		return ICMPType(q.b[q.subofs]) == t4
+	case ICMPv6:
+		return ICMPType(q.b[q.subofs]) == t6
 	}
 	return false
 }
@@ -28,6 +28,26 @@ func TestIPString(t *testing.T) {
 	}
 }
 
+func TestIP6(t *testing.T) {
+	const str = "fd7a:115c:a1e0:ab12:4843:cd96:6258:b240"
+	ip := NewIP6(net.ParseIP(str))
+	if got := ip.String(); got != str {
+		t.Errorf("String = %q; want %q", got, str)
+	}
+	if got := IP6FromNetaddr(ip.Netaddr()); got != ip {
+		t.Errorf("netaddr round trip = %v; want %v", got, ip)
+	}
+	if ip.IsMulticast() || ip.IsLinkLocalUnicast() {
+		t.Errorf("%v is multicast or link-local", ip)
+	}
+	if !NewIP6(net.ParseIP("ff02::2")).IsMulticast() {
+		t.Error("ff02::2 is not multicast")
+	}
+	if !NewIP6(net.ParseIP("fe80::1")).IsLinkLocalUnicast() {
+		t.Error("fe80::1 is not link-local")
+	}
+}
+
 var icmpRequestBuffer = []byte{
 	// IP header up to checksum
 	0x45, 0x00, 0x00, 0x27, 0xde, 0xad, 0x00, 0x00, 0x40, 0x01, 0x8c, 0x15,
@@ -92,9 +112,72 @@ var ipv6PacketBuffer = []byte{
 }
 
 var ipv6PacketDecode = ParsedPacket{
-	b:         ipv6PacketBuffer,
+	b:       ipv6PacketBuffer,
+	subofs:  40,
+	dataofs: 44,
+	length:  len(ipv6PacketBuffer),
+
 	IPVersion: 6,
 	IPProto:   ICMPv6,
+	SrcIP6:    NewIP6(net.ParseIP("fe80::fb57:1dea:9c39:8fb7")),
+	DstIP6:    NewIP6(net.ParseIP("ff02::2")),
+}
+
+var tcp6PacketBuffer = []byte{
+	// IPv6 header: payload length 20, next header TCP
+	0x60, 0x00, 0x00, 0x00, 0x00, 0x14, 0x06, 0x40,
+	// source ip
+	0xfd, 0x7a, 0x11, 0x5c, 0xa1, 0xe0, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+	// destination ip
+	0xfd, 0x7a, 0x11, 0x5c, 0xa1, 0xe0, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02,
+	// TCP header with SYN set
+	0x00, 0x7b, 0x02, 0x37, 0x00, 0x00, 0x12, 0x34, 0x00, 0x00, 0x00, 0x00,
+	0x50, 0x02, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00,
+}
+
+var tcp6PacketDecode = ParsedPacket{
+	b:       tcp6PacketBuffer,
+	subofs:  40,
+	dataofs: 60,
+	length:  len(tcp6PacketBuffer),
+
+	IPVersion: 6,
+	IPProto:   TCP,
+	SrcIP6:    NewIP6(net.ParseIP("fd7a:115c:a1e0::1")),
+	DstIP6:    NewIP6(net.ParseIP("fd7a:115c:a1e0::2")),
+	SrcPort:   123,
+	DstPort:   567,
+	TCPFlags:  TCPSyn,
+}
+
+var udp6FragmentBuffer = []byte{
+	// IPv6 header: payload length 16, next header Fragment
+	0x60, 0x00, 0x00, 0x00, 0x00, 0x10, 0x2c, 0x40,
+	// source ip
+	0xfd, 0x7a, 0x11, 0x5c, 0xa1, 0xe0, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+	// destination ip
+	0xfd, 0x7a, 0x11, 0x5c, 0xa1, 0xe0, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02,
+	// fragment header: next header UDP, offset 0, more fragments
+	0x11, 0x00, 0x00, 0x01, 0xde, 0xad, 0xbe, 0xef,
+	// UDP header
+	0x00, 0x7b, 0x02, 0x37, 0x00, 0x08, 0x00, 0x00,
+}
+
+// udp6FragmentDecode is Unknown, because the first fragment is
+// too short to be legitimate.
+var udp6FragmentDecode = ParsedPacket{
+	b:      udp6FragmentBuffer,
+	subofs: 48,
+	length: len(udp6FragmentBuffer),
+
+	IPVersion: 6,
+	IPProto:   Unknown,
+	SrcIP6:    NewIP6(net.ParseIP("fd7a:115c:a1e0::1")),
+	DstIP6:    NewIP6(net.ParseIP("fd7a:115c:a1e0::2")),
 }
 
 // This is a malformed IPv4 packet.
@@ -200,7 +283,8 @@ func TestParsedPacket(t *testing.T) {
 		{"tcp", tcpPacketDecode, "TCP{1.2.3.4:123 > 5.6.7.8:567}"},
 		{"icmp", icmpRequestDecode, "ICMP{1.2.3.4:0 > 5.6.7.8:0}"},
 		{"unknown", unknownPacketDecode, "Unknown{???}"},
-		{"ipv6", ipv6PacketDecode, "IPv6{Proto=58}"},
+		{"ipv6", ipv6PacketDecode, "ICMPv6{[fe80::fb57:1dea:9c39:8fb7]:0 > [ff02::2]:0}"},
+		{"tcp6", tcp6PacketDecode, "TCP{[fd7a:115c:a1e0::1]:123 > [fd7a:115c:a1e0::2]:567}"},
 	}
 
 	for _, tt := range tests {
@@ -233,6 +317,8 @@ func TestDecode(t *testing.T) {
 		{"unknown", unknownPacketBuffer, unknownPacketDecode},
 		{"tcp", tcpPacketBuffer, tcpPacketDecode},
 		{"udp", udpRequestBuffer, udpRequestDecode},
+		{"tcp6", tcp6PacketBuffer, tcp6PacketDecode},
+		{"udp6_short_fragment", udp6FragmentBuffer, udp6FragmentDecode},
 	}
 
 	for _, tt := range tests {
@@ -347,3 +433,92 @@ func TestMarshalResponse(t *testing.T) {
 		})
 	}
 }
+
+func TestTCPHeaderRoundTrip(t *testing.T) {
+	h := TCPHeader{
+		IPHeader: IPHeader{
+			IPID:  0xbeef,
+			SrcIP: NewIP(net.ParseIP("100.100.100.100")),
+			DstIP: NewIP(net.ParseIP("100.64.0.1")),
+		},
+		SrcPort: 53,
+		DstPort: 34567,
+		Seq:     0x01020304,
+		Ack:     0xfffffffe,
+		Flags:   TCPPsh | TCPAck,
+		Window:  0xffff,
+	}
+	payload := []byte("tcp_payload")
+	b := Generate(&h, payload)
+
+	var p ParsedPacket
+	p.Decode(b)
+	if p.IPProto != TCP {
+		t.Fatalf("IPProto = %v; want TCP", p.IPProto)
+	}
+	want := h
+	want.IPProto = TCP
+	if got := p.TCPHeader(); got != want {
+		t.Errorf("TCPHeader() = %+v; want %+v", got, want)
+	}
+	if !bytes.Equal(p.Payload(), payload) {
+		t.Errorf("Payload() = %q; want %q", p.Payload(), payload)
+	}
+
+	// The checksum over the pseudo header and the segment is zero.
+	pseudo := make([]byte, 12, 12+len(b)-20)
+	copy(pseudo[0:8], b[12:20])
+	pseudo[9] = uint8(TCP)
+	put16(pseudo[10:12], uint16(len(b)-20))
+	if sum := ipChecksum(append(pseudo, b[20:]...)); sum != 0 {
+		t.Errorf("TCP checksum doesn't verify: %#04x", sum)
+	}
+	if sum := ipChecksum(b[:20]); sum != 0 {
+		t.Errorf("IP checksum doesn't verify: %#04x", sum)
+	}
+}
+
+func TestTCPHeaderMSS(t *testing.T) {
+	h := TCPHeader{
+		IPHeader: IPHeader{
+			SrcIP: NewIP(net.ParseIP("100.64.0.1")),
+			DstIP: NewIP(net.ParseIP("100.64.0.2")),
+		},
+		SrcPort: 49152,
+		DstPort: 22,
+		Seq:     1,
+		Flags:   TCPSyn,
+		Window:  0xffff,
+		MSS:     1240,
+	}
+	b := Generate(&h, nil)
+	if len(b) != 44 {
+		t.Fatalf("SYN is %d bytes; want 44", len(b))
+	}
+
+	var p ParsedPacket
+	p.Decode(b)
+	want := h
+	want.IPProto = TCP
+	if got := p.TCPHeader(); got != want {
+		t.Errorf("TCPHeader() = %+v; want %+v", got, want)
+	}
+	if len(p.Payload()) != 0 {
+		t.Errorf("Payload() = %q; want none", p.Payload())
+	}
+
+	for _, tt := range []struct {
+		opts []byte
+		want uint16
+	}{
+		{[]byte{tcpOptionNop, tcpOptionNop, tcpOptionMSS, 4, 0x05, 0xb4}, 1460},
+		{[]byte{3, 3, 7, tcpOptionMSS, 4, 0x05, 0xb4, tcpOptionNop}, 1460},
+		{[]byte{tcpOptionEnd, tcpOptionMSS, 4, 0x05, 0xb4}, 0},
+		{[]byte{tcpOptionMSS, 4, 0x05}, 0},
+		{[]byte{8, 0}, 0},
+	} {
+		if got := tcpMSSOption(tt.opts); got != tt.want {
+			t.Errorf("tcpMSSOption(%x) = %d; want %d", tt.opts, got, tt.want)
+		}
+	}
+}
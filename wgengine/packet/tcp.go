@@ -0,0 +1,84 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+// TCPHeader represents a TCP packet header.
+// The only option it supports is the maximum segment size.
+type TCPHeader struct {
+	IPHeader
+	SrcPort uint16
+	DstPort uint16
+	Seq     uint32
+	Ack     uint32
+	Flags   uint8
+	Window  uint16
+	// MSS, if non-zero, is the maximum segment size option,
+	// only sent in SYN segments.
+	MSS uint16
+}
+
+// tcpTotalHeaderLength is the length of all headers in a TCP packet
+// without options.
+const tcpTotalHeaderLength = ipHeaderLength + tcpHeaderLength
+
+const (
+	tcpOptionEnd = 0
+	tcpOptionNop = 1
+	tcpOptionMSS = 2
+
+	tcpOptionMSSLength = 4
+)
+
+func (h TCPHeader) Len() int {
+	if h.MSS != 0 {
+		return tcpTotalHeaderLength + tcpOptionMSSLength
+	}
+	return tcpTotalHeaderLength
+}
+
+func (h TCPHeader) Marshal(buf []byte) error {
+	hlen := h.Len()
+	if len(buf) < hlen {
+		return errSmallBuffer
+	}
+	if len(buf) > maxPacketLength {
+		return errLargePacket
+	}
+	// The caller does not need to set this.
+	h.IPProto = TCP
+
+	put16(buf[20:22], h.SrcPort)
+	put16(buf[22:24], h.DstPort)
+	put32(buf[24:28], h.Seq)
+	put32(buf[28:32], h.Ack)
+	buf[32] = uint8((hlen-ipHeaderLength)>>2) << 4 // data offset
+	buf[33] = h.Flags
+	put16(buf[34:36], h.Window)
+	put16(buf[36:38], 0) // blank checksum
+	put16(buf[38:40], 0) // urgent pointer
+	if h.MSS != 0 {
+		buf[40] = tcpOptionMSS
+		buf[41] = tcpOptionMSSLength
+		put16(buf[42:44], h.MSS)
+	}
+
+	h.IPHeader.MarshalPseudo(buf)
+
+	// TCP checksum with IP pseudo header.
+	put16(buf[36:38], ipChecksum(buf[8:]))
+
+	h.IPHeader.Marshal(buf)
+
+	return nil
+}
+
+// ToResponse swaps the addresses and ports of h, and its sequence
+// and acknowledgment numbers. The caller is expected to adjust the
+// latter for the segment it answers.
+func (h *TCPHeader) ToResponse() {
+	h.SrcPort, h.DstPort = h.DstPort, h.SrcPort
+	h.Seq, h.Ack = h.Ack, h.Seq
+	h.IPHeader.ToResponse()
+}
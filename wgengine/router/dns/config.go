@@ -15,6 +15,9 @@ import (
 type Config struct {
 	// Nameservers are the IP addresses of the nameservers to use.
 	Nameservers []netaddr.IP
+	// Resolvers are the URLs of the encrypted nameservers
+	// to which proxied DNS requests are sent instead of Nameservers.
+	Resolvers []string
 	// Domains are the search domains to use.
 	Domains []string
 	// PerDomain indicates whether it is preferred to use Nameservers
@@ -37,6 +40,10 @@ func (lhs Config) Equal(rhs Config) bool {
 		return false
 	}
 
+	if len(lhs.Resolvers) != len(rhs.Resolvers) {
+		return false
+	}
+
 	if len(lhs.Domains) != len(rhs.Domains) {
 		return false
 	}
@@ -49,6 +56,12 @@ func (lhs Config) Equal(rhs Config) bool {
 		}
 	}
 
+	for i, resolver := range lhs.Resolvers {
+		if rhs.Resolvers[i] != resolver {
+			return false
+		}
+	}
+
 	// The order of domains, on the other hand, is significant.
 	for i, domain := range lhs.Domains {
 		if rhs.Domains[i] != domain {
@@ -0,0 +1,678 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
+	"inet.af/netaddr"
+)
+
+// netlinkConn is the subset of *netlink.Conn used by netlinkRunner.
+// It exists purely to swap out the kernel for a fake implementation
+// in tests.
+type netlinkConn interface {
+	Execute(netlink.Message) ([]netlink.Message, error)
+}
+
+// netlinkRunner is a commandRunner that performs the ip(8) commands
+// that linuxRouter runs with rtnetlink requests, rather than by
+// running ip. That's faster, works the same on systems with busybox
+// or no ip at all, and yields errno values instead of ip's output.
+//
+// Like ip, it fails with exit status 2 when the object of a request
+// doesn't exist. Other errors from the kernel have their errno as
+// exit status, so that callers that ignore missing objects don't
+// ignore them too.
+type netlinkRunner struct {
+	conn netlinkConn
+	// ifindex returns the index of the named network interface.
+	ifindex func(name string) (uint32, error)
+}
+
+func newNetlinkRunner() (*netlinkRunner, error) {
+	conn, err := netlink.Dial(unix.NETLINK_ROUTE, nil)
+	if err != nil {
+		return nil, fmt.Errorf("dialing netlink socket: %v", err)
+	}
+	return &netlinkRunner{conn: conn, ifindex: interfaceIndex}, nil
+}
+
+func interfaceIndex(name string) (uint32, error) {
+	ifc, err := net.InterfaceByName(name)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(ifc.Index), nil
+}
+
+// Close closes the netlink socket of n.
+func (n *netlinkRunner) Close() error {
+	if c, ok := n.conn.(*netlink.Conn); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Policy routing rule message constants, from linux/fib_rules.h.
+const (
+	fraPriority = 6  // FRA_PRIORITY
+	fraFwmark   = 10 // FRA_FWMARK
+	fraTable    = 15 // FRA_TABLE
+
+	frActToTbl       = 1 // FR_ACT_TO_TBL
+	frActUnreachable = 7 // FR_ACT_UNREACHABLE
+
+	sizeofFibRuleHdr = 12 // sizeof(struct fib_rule_hdr)
+)
+
+// netlinkError is the error of an ip command run by a netlinkRunner.
+type netlinkError struct {
+	args []string
+	err  error
+}
+
+func (e *netlinkError) Error() string {
+	return fmt.Sprintf("netlink %q failed: %v", strings.Join(e.args, " "), e.err)
+}
+
+func (e *netlinkError) Unwrap() error { return e.err }
+
+// ExitStatus returns the exit status of e: 2, as with ip, if the
+// kernel found no such object, the errno of other kernel errors, and
+// 1 otherwise.
+func (e *netlinkError) ExitStatus() int {
+	var errno syscall.Errno
+	if !errors.As(e.err, &errno) {
+		return 1
+	}
+	switch errno {
+	case syscall.ENOENT, syscall.ESRCH:
+		return 2
+	}
+	return int(errno)
+}
+
+// ipArgs is a parsed ip(8) command line.
+type ipArgs struct {
+	args []string
+	fam  int    // 4 or 6, or 0 if unknown
+	obj  string // "link", "addr", "route" or "rule"
+	cmd  string // "add", "del", "set" or "" for listing
+	// prefix is the address or prefix of addr and route commands.
+	prefix string
+	// opts are the remaining keyword/value pairs.
+	opts map[string]string
+}
+
+// parseIPArgs parses the ip command lines that linuxRouter runs.
+func parseIPArgs(args []string) (*ipArgs, error) {
+	unsupported := fmt.Errorf("netlink: unsupported command %q", strings.Join(args, " "))
+	if len(args) < 2 || args[0] != "ip" {
+		return nil, unsupported
+	}
+	a := &ipArgs{args: args, opts: make(map[string]string)}
+	rest := args[1:]
+	if rest[0] == "-6" {
+		a.fam = 6
+		rest = rest[1:]
+	}
+	if len(rest) == 0 {
+		return nil, unsupported
+	}
+	a.obj, rest = rest[0], rest[1:]
+	if len(rest) > 0 {
+		a.cmd, rest = rest[0], rest[1:]
+	}
+
+	switch a.obj {
+	case "link":
+		// ip link set dev NAME up|down
+		if a.cmd != "set" || len(rest) != 3 || rest[0] != "dev" {
+			return nil, unsupported
+		}
+		a.opts["dev"] = rest[1]
+		a.opts[rest[2]] = ""
+		return a, nil
+	case "addr", "route":
+		if len(rest) == 0 {
+			return nil, unsupported
+		}
+		a.prefix, rest = rest[0], rest[1:]
+	case "rule":
+		if a.cmd == "list" || a.cmd == "show" {
+			a.cmd = ""
+		}
+	default:
+		return nil, unsupported
+	}
+	if len(rest)%2 != 0 {
+		return nil, unsupported
+	}
+	for i := 0; i < len(rest); i += 2 {
+		switch {
+		case a.obj == "rule":
+			// Checked by ruleMessage.
+		case rest[i] == "dev":
+		case rest[i] == "table" && a.obj == "route":
+		default:
+			return nil, unsupported
+		}
+		a.opts[rest[i]] = rest[i+1]
+	}
+	return a, nil
+}
+
+func (n *netlinkRunner) run(args ...string) error {
+	_, err := n.output(args...)
+	return err
+}
+
+func (n *netlinkRunner) output(args ...string) ([]byte, error) {
+	a, err := parseIPArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	var msg netlink.Message
+	switch a.obj {
+	case "link":
+		msg, err = n.linkMessage(a)
+	case "addr":
+		msg, err = n.addrMessage(a)
+	case "route":
+		msg, err = n.routeMessage(a)
+	case "rule":
+		if a.cmd == "" {
+			return n.listRules(a)
+		}
+		msg, err = ruleMessage(a)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := n.conn.Execute(msg); err != nil {
+		return nil, &netlinkError{args, err}
+	}
+	return nil, nil
+}
+
+// request returns a netlink request message of type typ, acknowledged
+// by the kernel. If a is an add command, the message fails if the
+// object exists.
+func request(a *ipArgs, add, del netlink.HeaderType, data []byte) (netlink.Message, error) {
+	msg := netlink.Message{
+		Header: netlink.Header{Flags: netlink.Request | netlink.Acknowledge},
+		Data:   data,
+	}
+	switch a.cmd {
+	case "add":
+		msg.Header.Type = add
+		msg.Header.Flags |= netlink.Create | netlink.Excl
+	case "del":
+		msg.Header.Type = del
+	default:
+		return netlink.Message{}, fmt.Errorf("netlink: unsupported command %q", strings.Join(a.args, " "))
+	}
+	return msg, nil
+}
+
+func (n *netlinkRunner) linkMessage(a *ipArgs) (netlink.Message, error) {
+	index, err := n.ifindex(a.opts["dev"])
+	if err != nil {
+		return netlink.Message{}, err
+	}
+	var flags uint32
+	if _, ok := a.opts["up"]; ok {
+		flags = unix.IFF_UP
+	} else if _, ok := a.opts["down"]; !ok {
+		return netlink.Message{}, fmt.Errorf("netlink: unsupported command %q", strings.Join(a.args, " "))
+	}
+	// struct ifinfomsg.
+	b := make([]byte, unix.SizeofIfInfomsg)
+	b[0] = unix.AF_UNSPEC
+	nlenc.PutUint32(b[4:8], index)
+	nlenc.PutUint32(b[8:12], flags)
+	nlenc.PutUint32(b[12:16], unix.IFF_UP) // change mask
+	return netlink.Message{
+		Header: netlink.Header{
+			Type:  unix.RTM_NEWLINK,
+			Flags: netlink.Request | netlink.Acknowledge,
+		},
+		Data: b,
+	}, nil
+}
+
+// parsePrefix parses s, an IP address or prefix, as an address of
+// family a.fam, or of any family if a.fam is 0.
+func parsePrefix(a *ipArgs, s string) (netaddr.IPPrefix, error) {
+	var pfx netaddr.IPPrefix
+	var err error
+	if strings.Contains(s, "/") {
+		pfx, err = netaddr.ParseIPPrefix(s)
+	} else {
+		pfx.IP, err = netaddr.ParseIP(s)
+		pfx.Bits = 128
+		if pfx.IP.Is4() {
+			pfx.Bits = 32
+		}
+	}
+	if err != nil {
+		return netaddr.IPPrefix{}, fmt.Errorf("netlink: %v", err)
+	}
+	if (a.fam == 6) != pfx.IP.Is6() && a.fam != 0 {
+		return netaddr.IPPrefix{}, fmt.Errorf("netlink: %s is not an IPv%d address", s, a.fam)
+	}
+	return pfx, nil
+}
+
+// ipBytes returns ip in its 4 or 16 byte form.
+func ipBytes(ip netaddr.IP) []byte {
+	if ip.Is4() {
+		b := ip.As4()
+		return b[:]
+	}
+	b := ip.As16()
+	return b[:]
+}
+
+func family(ip netaddr.IP) uint8 {
+	if ip.Is4() {
+		return unix.AF_INET
+	}
+	return unix.AF_INET6
+}
+
+func (n *netlinkRunner) addrMessage(a *ipArgs) (netlink.Message, error) {
+	pfx, err := parsePrefix(a, a.prefix)
+	if err != nil {
+		return netlink.Message{}, err
+	}
+	index, err := n.ifindex(a.opts["dev"])
+	if err != nil {
+		return netlink.Message{}, err
+	}
+	return request(a, unix.RTM_NEWADDR, unix.RTM_DELADDR, marshalAddr(pfx, index))
+}
+
+// marshalAddr returns the RTM_NEWADDR and RTM_DELADDR message data for
+// the address pfx of interface index.
+func marshalAddr(pfx netaddr.IPPrefix, index uint32) []byte {
+	// struct ifaddrmsg.
+	b := make([]byte, unix.SizeofIfAddrmsg)
+	b[0] = family(pfx.IP)
+	b[1] = pfx.Bits
+	nlenc.PutUint32(b[4:8], index)
+	attrs, _ := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: unix.IFA_LOCAL, Data: ipBytes(pfx.IP)},
+		{Type: unix.IFA_ADDRESS, Data: ipBytes(pfx.IP)},
+	})
+	return append(b, attrs...)
+}
+
+// unmarshalAddr is the inverse of marshalAddr.
+func unmarshalAddr(b []byte) (pfx netaddr.IPPrefix, index uint32, err error) {
+	if len(b) < unix.SizeofIfAddrmsg {
+		return pfx, 0, errors.New("netlink: short ifaddrmsg")
+	}
+	attrs, err := netlink.UnmarshalAttributes(b[unix.SizeofIfAddrmsg:])
+	if err != nil {
+		return pfx, 0, err
+	}
+	var local, addr net.IP
+	for _, attr := range attrs {
+		switch attr.Type {
+		case unix.IFA_LOCAL:
+			local = attr.Data
+		case unix.IFA_ADDRESS:
+			addr = attr.Data
+		}
+	}
+	// IPv6 addresses only have IFA_ADDRESS.
+	if local == nil {
+		local = addr
+	}
+	ip, ok := netaddr.FromStdIP(local)
+	if !ok {
+		return pfx, 0, errors.New("netlink: address message without address")
+	}
+	return netaddr.IPPrefix{IP: ip, Bits: b[1]}, nlenc.Uint32(b[4:8]), nil
+}
+
+// routeTableID returns the routing table number of s, a table name
+// or number.
+func routeTableID(s string) (uint32, error) {
+	switch s {
+	case "", "main":
+		return unix.RT_TABLE_MAIN, nil
+	case "default":
+		return unix.RT_TABLE_DEFAULT, nil
+	}
+	v, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("netlink: invalid table %q", s)
+	}
+	return uint32(v), nil
+}
+
+func (n *netlinkRunner) routeMessage(a *ipArgs) (netlink.Message, error) {
+	pfx, err := parsePrefix(a, a.prefix)
+	if err != nil {
+		return netlink.Message{}, err
+	}
+	index, err := n.ifindex(a.opts["dev"])
+	if err != nil {
+		return netlink.Message{}, err
+	}
+	table, err := routeTableID(a.opts["table"])
+	if err != nil {
+		return netlink.Message{}, err
+	}
+	return request(a, unix.RTM_NEWROUTE, unix.RTM_DELROUTE, marshalRoute(pfx, index, table, a.cmd == "add"))
+}
+
+// marshalRoute returns the RTM_NEWROUTE (if add is true) or
+// RTM_DELROUTE message data for the route to pfx through interface
+// index, in routing table table.
+//
+// Like ip, it adds routes with the "boot" protocol, and deletes
+// routes of any protocol and scope.
+func marshalRoute(pfx netaddr.IPPrefix, index, table uint32, add bool) []byte {
+	// struct rtmsg.
+	b := make([]byte, unix.SizeofRtMsg)
+	b[0] = family(pfx.IP)
+	b[1] = pfx.Bits
+	b[4] = unix.RT_TABLE_UNSPEC
+	if table < 256 {
+		b[4] = uint8(table)
+	}
+	b[5] = unix.RTPROT_UNSPEC
+	b[6] = unix.RT_SCOPE_NOWHERE
+	if add {
+		b[5] = unix.RTPROT_BOOT
+		b[6] = unix.RT_SCOPE_LINK
+	}
+	b[7] = unix.RTN_UNICAST
+	dst := pfx.IPNet()
+	attrs, _ := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: unix.RTA_DST, Data: ipBytes(netaddrIP(dst.IP.Mask(dst.Mask)))},
+		{Type: unix.RTA_OIF, Data: nlenc.Uint32Bytes(index)},
+		{Type: unix.RTA_TABLE, Data: nlenc.Uint32Bytes(table)},
+	})
+	return append(b, attrs...)
+}
+
+// netlinkRoute is a route, as read by unmarshalRoute.
+type netlinkRoute struct {
+	dst      netaddr.IPPrefix
+	index    uint32 // output interface
+	table    uint32
+	protocol uint8
+	typ      uint8
+}
+
+// unmarshalRoute is the inverse of marshalRoute.
+func unmarshalRoute(b []byte) (netlinkRoute, error) {
+	if len(b) < unix.SizeofRtMsg {
+		return netlinkRoute{}, errors.New("netlink: short rtmsg")
+	}
+	attrs, err := netlink.UnmarshalAttributes(b[unix.SizeofRtMsg:])
+	if err != nil {
+		return netlinkRoute{}, err
+	}
+	r := netlinkRoute{
+		table:    uint32(b[4]),
+		protocol: b[5],
+		typ:      b[7],
+	}
+	dst := netaddr.IPv4(0, 0, 0, 0)
+	if b[0] == unix.AF_INET6 {
+		dst = netaddr.IPFrom16([16]byte{})
+	}
+	for _, attr := range attrs {
+		switch attr.Type {
+		case unix.RTA_DST:
+			dst = netaddrIP(attr.Data)
+		case unix.RTA_OIF:
+			r.index = nlenc.Uint32(attr.Data)
+		case unix.RTA_TABLE:
+			r.table = nlenc.Uint32(attr.Data)
+		}
+	}
+	r.dst = netaddr.IPPrefix{IP: dst, Bits: b[1]}
+	return r, nil
+}
+
+func ruleMessage(a *ipArgs) (netlink.Message, error) {
+	r := netlinkRule{fam: a.fam}
+	if r.fam == 0 {
+		r.fam = 4
+	}
+	for k, v := range a.opts {
+		var err error
+		switch k {
+		case "pref":
+			var pref uint64
+			pref, err = strconv.ParseUint(v, 10, 32)
+			r.pref = uint32(pref)
+		case "fwmark":
+			var mark uint64
+			mark, err = strconv.ParseUint(v, 0, 32)
+			r.fwmark = uint32(mark)
+		case "table":
+			r.table, err = routeTableID(v)
+		case "type":
+			if v != "unreachable" {
+				err = fmt.Errorf("unsupported rule type %q", v)
+			}
+			r.unreachable = true
+		default:
+			err = fmt.Errorf("unsupported rule option %q", k)
+		}
+		if err != nil {
+			return netlink.Message{}, fmt.Errorf("netlink: %q: %v", strings.Join(a.args, " "), err)
+		}
+	}
+	return request(a, unix.RTM_NEWRULE, unix.RTM_DELRULE, r.marshal(a.cmd == "add"))
+}
+
+// netlinkRule is a policy routing rule.
+type netlinkRule struct {
+	fam         int
+	pref        uint32
+	fwmark      uint32 // or 0 to match all packets
+	table       uint32 // or 0, if unreachable
+	unreachable bool
+}
+
+// marshal returns the RTM_NEWRULE (if add is true) or RTM_DELRULE
+// message data for r. Like ip, when deleting it only matches the
+// fields of r that are set.
+func (r netlinkRule) marshal(add bool) []byte {
+	// struct fib_rule_hdr.
+	b := make([]byte, sizeofFibRuleHdr)
+	b[0] = unix.AF_INET
+	if r.fam == 6 {
+		b[0] = unix.AF_INET6
+	}
+	if r.table < 256 {
+		b[4] = uint8(r.table)
+	}
+	switch {
+	case r.unreachable:
+		b[7] = frActUnreachable
+	case add || r.table != 0:
+		b[7] = frActToTbl
+	}
+	var attrs []netlink.Attribute
+	if r.pref != 0 {
+		attrs = append(attrs, netlink.Attribute{Type: fraPriority, Data: nlenc.Uint32Bytes(r.pref)})
+	}
+	if r.fwmark != 0 {
+		attrs = append(attrs, netlink.Attribute{Type: fraFwmark, Data: nlenc.Uint32Bytes(r.fwmark)})
+	}
+	if r.table != 0 {
+		attrs = append(attrs, netlink.Attribute{Type: fraTable, Data: nlenc.Uint32Bytes(r.table)})
+	}
+	ab, _ := netlink.MarshalAttributes(attrs)
+	return append(b, ab...)
+}
+
+// unmarshalRule is the inverse of netlinkRule.marshal.
+func unmarshalRule(b []byte) (netlinkRule, error) {
+	if len(b) < sizeofFibRuleHdr {
+		return netlinkRule{}, errors.New("netlink: short fib_rule_hdr")
+	}
+	attrs, err := netlink.UnmarshalAttributes(b[sizeofFibRuleHdr:])
+	if err != nil {
+		return netlinkRule{}, err
+	}
+	r := netlinkRule{
+		fam:         4,
+		table:       uint32(b[4]),
+		unreachable: b[7] == frActUnreachable,
+	}
+	if b[0] == unix.AF_INET6 {
+		r.fam = 6
+	}
+	for _, attr := range attrs {
+		switch attr.Type {
+		case fraPriority:
+			r.pref = nlenc.Uint32(attr.Data)
+		case fraFwmark:
+			r.fwmark = nlenc.Uint32(attr.Data)
+		case fraTable:
+			r.table = nlenc.Uint32(attr.Data)
+		}
+	}
+	return r, nil
+}
+
+// String returns r in the format of "ip rule list".
+func (r netlinkRule) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d:\tfrom all", r.pref)
+	if r.fwmark != 0 {
+		fmt.Fprintf(&b, " fwmark %#x", r.fwmark)
+	}
+	switch {
+	case r.unreachable:
+		b.WriteString(" unreachable")
+	case r.table == unix.RT_TABLE_MAIN:
+		b.WriteString(" lookup main")
+	case r.table == unix.RT_TABLE_DEFAULT:
+		b.WriteString(" lookup default")
+	case r.table == unix.RT_TABLE_LOCAL:
+		b.WriteString(" lookup local")
+	default:
+		fmt.Fprintf(&b, " lookup %d", r.table)
+	}
+	return b.String()
+}
+
+// dump returns the data of the messages of the kernel's objects of
+// message type typ, for IP family fam. hdrLen is the size of the
+// message header, which starts with the family.
+func (n *netlinkRunner) dump(typ netlink.HeaderType, fam uint8, hdrLen int) ([][]byte, error) {
+	data := make([]byte, hdrLen)
+	data[0] = fam
+	msgs, err := n.conn.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  typ,
+			Flags: netlink.Request | netlink.Dump,
+		},
+		Data: data,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var ret [][]byte
+	for _, msg := range msgs {
+		ret = append(ret, msg.Data)
+	}
+	return ret, nil
+}
+
+func (n *netlinkRunner) listRules(a *ipArgs) ([]byte, error) {
+	fam := uint8(unix.AF_INET)
+	if a.fam == 6 {
+		fam = unix.AF_INET6
+	}
+	msgs, err := n.dump(unix.RTM_GETRULE, fam, sizeofFibRuleHdr)
+	if err != nil {
+		return nil, &netlinkError{a.args, err}
+	}
+	var b strings.Builder
+	for _, msg := range msgs {
+		r, err := unmarshalRule(msg)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintln(&b, r)
+	}
+	return []byte(b.String()), nil
+}
+
+func (n *netlinkRunner) addrs(dev string) ([]netaddr.IPPrefix, error) {
+	index, err := n.ifindex(dev)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := n.dump(unix.RTM_GETADDR, unix.AF_UNSPEC, unix.SizeofIfAddrmsg)
+	if err != nil {
+		return nil, err
+	}
+	var ret []netaddr.IPPrefix
+	for _, msg := range msgs {
+		pfx, idx, err := unmarshalAddr(msg)
+		if err != nil {
+			return nil, err
+		}
+		if idx == index {
+			ret = append(ret, pfx)
+		}
+	}
+	return ret, nil
+}
+
+// routes returns the routes through dev in table that were added like
+// ip adds them, leaving out those that the kernel adds for the
+// addresses of dev.
+func (n *netlinkRunner) routes(dev string, table int) ([]netaddr.IPPrefix, error) {
+	index, err := n.ifindex(dev)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := n.dump(unix.RTM_GETROUTE, unix.AF_UNSPEC, unix.SizeofRtMsg)
+	if err != nil {
+		return nil, err
+	}
+	var ret []netaddr.IPPrefix
+	for _, msg := range msgs {
+		r, err := unmarshalRoute(msg)
+		if err != nil {
+			return nil, err
+		}
+		if r.index == index && r.table == uint32(table) && r.protocol == unix.RTPROT_BOOT && r.typ == unix.RTN_UNICAST {
+			ret = append(ret, r.dst)
+		}
+	}
+	return ret, nil
+}
+
+func netaddrIP(std net.IP) netaddr.IP {
+	ip, _ := netaddr.FromStdIP(std)
+	if ip4 := std.To4(); ip4 != nil {
+		ip = netaddr.IPv4(ip4[0], ip4[1], ip4[2], ip4[3])
+	}
+	return ip
+}
@@ -0,0 +1,342 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
+)
+
+// fakeNetlink implements netlinkConn by translating requests back to
+// ip commands, and running them on a fakeOS.
+type fakeNetlink struct {
+	os *fakeOS
+}
+
+var fakeIfindex = map[string]uint32{
+	"lo":         1,
+	"eth0":       2,
+	"tailscale0": 10,
+	"tailscale1": 11,
+}
+
+func fakeInterfaceIndex(name string) (uint32, error) {
+	if index, ok := fakeIfindex[name]; ok {
+		return index, nil
+	}
+	return 0, fmt.Errorf("no such interface %q", name)
+}
+
+func fakeInterfaceName(index uint32) string {
+	for name, i := range fakeIfindex {
+		if i == index {
+			return name
+		}
+	}
+	return "???"
+}
+
+// newFakeNetlinkOS is like NewFakeOS, but runs the router's ip
+// commands through a netlinkRunner.
+func newFakeNetlinkOS(t *testing.T) *fakeOS {
+	o := NewFakeOS(t)
+	o.nl = &netlinkRunner{
+		conn:    &fakeNetlink{o},
+		ifindex: fakeInterfaceIndex,
+	}
+	return o
+}
+
+func (f *fakeNetlink) Execute(msg netlink.Message) ([]netlink.Message, error) {
+	var args []string
+	cmd := "add"
+	switch msg.Header.Type {
+	case unix.RTM_GETADDR, unix.RTM_GETROUTE, unix.RTM_GETRULE:
+		return f.dump(msg)
+	case unix.RTM_NEWLINK:
+		dev := fakeInterfaceName(nlenc.Uint32(msg.Data[4:8]))
+		state := "down"
+		if nlenc.Uint32(msg.Data[8:12])&unix.IFF_UP != 0 {
+			state = "up"
+		}
+		args = []string{"ip", "link", "set", "dev", dev, state}
+	case unix.RTM_DELADDR:
+		cmd = "del"
+		fallthrough
+	case unix.RTM_NEWADDR:
+		pfx, index, err := unmarshalAddr(msg.Data)
+		if err != nil {
+			return nil, err
+		}
+		args = []string{"ip", "addr", cmd, pfx.String(), "dev", fakeInterfaceName(index)}
+	case unix.RTM_DELROUTE:
+		cmd = "del"
+		fallthrough
+	case unix.RTM_NEWROUTE:
+		r, err := unmarshalRoute(msg.Data)
+		if err != nil {
+			return nil, err
+		}
+		args = []string{"ip", "route", cmd, r.dst.String(), "dev", fakeInterfaceName(r.index)}
+		if r.table != unix.RT_TABLE_MAIN {
+			args = append(args, "table", strconv.Itoa(int(r.table)))
+		}
+	case unix.RTM_DELRULE:
+		cmd = "del"
+		fallthrough
+	case unix.RTM_NEWRULE:
+		r, err := unmarshalRule(msg.Data)
+		if err != nil {
+			return nil, err
+		}
+		args = append(ipCommand(r.fam, "rule", cmd), strings.Fields(fakeRuleArgs(r))...)
+	default:
+		f.os.t.Errorf("unexpected netlink message type %d", msg.Header.Type)
+		return nil, errExec
+	}
+
+	if err := f.os.run(args...); err != nil {
+		if errCode(err) == 2 {
+			if cmd == "del" {
+				return nil, unix.ENOENT
+			}
+			return nil, unix.EEXIST
+		}
+		return nil, err
+	}
+	return nil, nil
+}
+
+// fakeRuleArgs returns the ip args of r, in the order linuxRouter
+// uses.
+func fakeRuleArgs(r netlinkRule) string {
+	s := fmt.Sprintf("pref %d", r.pref)
+	if r.fwmark != 0 {
+		s += fmt.Sprintf(" fwmark %#x", r.fwmark)
+	}
+	switch {
+	case r.unreachable:
+		s += " type unreachable"
+	case r.table == unix.RT_TABLE_MAIN:
+		s += " table main"
+	case r.table == unix.RT_TABLE_DEFAULT:
+		s += " table default"
+	case r.table != 0:
+		s += fmt.Sprintf(" table %d", r.table)
+	}
+	return s
+}
+
+// dump returns the fakeOS's objects of the type requested by msg.
+func (f *fakeNetlink) dump(msg netlink.Message) ([]netlink.Message, error) {
+	var ret []netlink.Message
+	add := func(data []byte) {
+		ret = append(ret, netlink.Message{Data: data})
+	}
+	// parse parses the fakeOS representation of an object, an ip
+	// command without its first three words.
+	parse := func(obj, s string) (*ipArgs, error) {
+		return parseIPArgs(append([]string{"ip", obj, "add"}, strings.Fields(s)...))
+	}
+
+	switch msg.Header.Type {
+	case unix.RTM_GETADDR:
+		for _, s := range f.os.ips {
+			a, err := parse("addr", s)
+			if err != nil {
+				return nil, err
+			}
+			pfx, err := parsePrefix(a, a.prefix)
+			if err != nil {
+				return nil, err
+			}
+			add(marshalAddr(pfx, fakeIfindex[a.opts["dev"]]))
+		}
+	case unix.RTM_GETROUTE:
+		for _, s := range f.os.routes {
+			a, err := parse("route", s)
+			if err != nil {
+				return nil, err
+			}
+			pfx, err := parsePrefix(a, a.prefix)
+			if err != nil {
+				return nil, err
+			}
+			table, err := routeTableID(a.opts["table"])
+			if err != nil {
+				return nil, err
+			}
+			add(marshalRoute(pfx, fakeIfindex[a.opts["dev"]], table, true))
+		}
+	case unix.RTM_GETRULE:
+		rules := f.os.rules
+		if msg.Data[0] == unix.AF_INET6 {
+			rules = f.os.rules6
+		}
+		for _, s := range rules {
+			a, err := parse("rule", s)
+			if err != nil {
+				return nil, err
+			}
+			rmsg, err := ruleMessage(a)
+			if err != nil {
+				return nil, err
+			}
+			add(rmsg.Data)
+		}
+	}
+	return ret, nil
+}
+
+func TestRouterSyncKernelState(t *testing.T) {
+	fake := newFakeNetlinkOS(t)
+	// Left behind by a previous tailscaled, or belonging to
+	// someone else.
+	fake.ips = []string{
+		"10.1.2.3/24 dev eth0",
+		"100.99.1.1/10 dev tailscale0",
+	}
+	fake.routes = []string{
+		"10.7.0.0/16 dev tailscale0",
+		"10.8.0.0/16 dev eth0 table 52",
+		"10.9.0.0/16 dev tailscale0 table 52",
+	}
+
+	router, err := newUserspaceRouterAdvanced(t.Logf, "tailscale0", fake.ipt4, fake.ipt6, fake.runner(), true, true, Options{})
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+	if err := router.Up(); err != nil {
+		t.Fatalf("failed to up router: %v", err)
+	}
+	cfg := &Config{
+		LocalAddrs:    mustCIDRs("100.101.102.103/10"),
+		Routes:        mustCIDRs("100.100.100.100/32", "10.0.0.0/8"),
+		NetfilterMode: NetfilterOff,
+	}
+	want := `
+up
+ip addr add 10.1.2.3/24 dev eth0
+ip addr add 100.101.102.103/10 dev tailscale0
+ip route add 10.0.0.0/8 dev tailscale0 table 52
+ip route add 10.7.0.0/16 dev tailscale0
+ip route add 10.8.0.0/16 dev eth0 table 52
+ip route add 100.100.100.100/32 dev tailscale0 table 52
+ip rule add pref 5210 fwmark 0x80000 table main
+ip rule add pref 5230 fwmark 0x80000 table default
+ip rule add pref 5250 fwmark 0x80000 type unreachable
+ip rule add pref 5270 table 52
+ip -6 rule add pref 5210 fwmark 0x80000 table main
+ip -6 rule add pref 5230 fwmark 0x80000 table default
+ip -6 rule add pref 5250 fwmark 0x80000 type unreachable
+ip -6 rule add pref 5270 table 52
+`
+	if err := router.Set(cfg); err != nil {
+		t.Fatalf("failed to set router config: %v", err)
+	}
+	if diff := cmp.Diff(fake.String(), strings.TrimSpace(want)); diff != "" {
+		t.Fatalf("unexpected OS state after deleting stale state (-got+want):\n%s", diff)
+	}
+
+	// Someone else deletes an address and a route. Set doesn't
+	// notice right away.
+	fake.ips = fake.ips[:1]
+	fake.routes = fake.routes[1:]
+	if err := router.Set(cfg); err != nil {
+		t.Fatalf("failed to set router config: %v", err)
+	}
+	if fake.String() == strings.TrimSpace(want) {
+		t.Fatal("Set synced kernel state again right away")
+	}
+
+	// But a Set after kernelSyncInterval puts them back.
+	router.(*linuxRouter).lastKernelSync = time.Now().Add(-kernelSyncInterval)
+	if err := router.Set(cfg); err != nil {
+		t.Fatalf("failed to set router config: %v", err)
+	}
+	if diff := cmp.Diff(fake.String(), strings.TrimSpace(want)); diff != "" {
+		t.Fatalf("unexpected OS state after restoring missing state (-got+want):\n%s", diff)
+	}
+}
+
+func TestRouterSyncKernelStateLoopbackRule(t *testing.T) {
+	fake := newFakeNetlinkOS(t)
+	router, err := newUserspaceRouterAdvanced(t.Logf, "tailscale0", fake.ipt4, fake.ipt6, fake.runner(), true, true, Options{})
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+	if err := router.Up(); err != nil {
+		t.Fatalf("failed to up router: %v", err)
+	}
+	cfg := &Config{
+		LocalAddrs:    mustCIDRs("100.101.102.103/10"),
+		NetfilterMode: NetfilterOn,
+	}
+	if err := router.Set(cfg); err != nil {
+		t.Fatalf("failed to set router config: %v", err)
+	}
+
+	// Stale addresses, one with its loopback rule.
+	loopbackRule := []string{"-i", "lo", "-s", "100.99.1.1", "-j", "ACCEPT"}
+	fake.ips = append(fake.ips, "100.99.1.1/10 dev tailscale0", "100.99.1.2/10 dev tailscale0")
+	if err := fake.ipt4.Insert("filter", "tailscale0-inp", 1, loopbackRule...); err != nil {
+		t.Fatal(err)
+	}
+	router.(*linuxRouter).lastKernelSync = time.Now().Add(-kernelSyncInterval)
+	if err := router.Set(cfg); err != nil {
+		t.Fatalf("failed to set router config: %v", err)
+	}
+	if strings.Contains(fake.String(), "100.99.1.") {
+		t.Errorf("stale address or rule left behind:\n%s", fake.String())
+	}
+	if ok, _ := fake.ipt4.Exists("filter", "tailscale0-inp", "-i", "lo", "-s", "100.101.102.103", "-j", "ACCEPT"); !ok {
+		t.Error("loopback rule of the current address deleted")
+	}
+}
+
+func TestNetlinkRunnerErrors(t *testing.T) {
+	fake := newFakeNetlinkOS(t)
+	nl := fake.nl
+
+	// Deleting something that doesn't exist fails like ip does.
+	err := nl.run("ip", "route", "del", "10.0.0.0/8", "dev", "tailscale0", "table", "52")
+	if errCode(err) != 2 || !errors.Is(err, unix.ENOENT) {
+		t.Errorf("deleting missing route: errCode(%v) = %d; want 2", err, errCode(err))
+	}
+
+	// Other kernel errors aren't mistaken for missing objects.
+	for _, errno := range []syscall.Errno{unix.EEXIST, unix.EPERM, unix.EINVAL} {
+		err := &netlinkError{[]string{"ip", "rule", "del"}, errno}
+		if got := errCode(err); got != int(errno) {
+			t.Errorf("errCode(%v) = %d; want %d", err, got, int(errno))
+		}
+	}
+	if got := errCode(&netlinkError{[]string{"ip", "rule", "del"}, unix.ESRCH}); got != 2 {
+		t.Errorf("errCode of ESRCH = %d; want 2", got)
+	}
+
+	for _, args := range [][]string{
+		{"ip", "route", "add", "10.0.0.0/8", "via", "10.0.0.1"},
+		{"ip", "-6", "addr", "add", "10.0.0.1/8", "dev", "tailscale0"},
+		{"ip", "rule", "add", "pref", "5270", "type", "blackhole"},
+		{"ip", "link", "set", "dev", "nope0", "up"},
+		{"ip", "neigh", "flush"},
+		{"iptables", "-L"},
+	} {
+		if err := nl.run(args...); err == nil {
+			t.Errorf("run(%q) succeeded; want error", args)
+		}
+	}
+}
@@ -0,0 +1,483 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"inet.af/netaddr"
+)
+
+// nftConn is the subset of *nftables.Conn used by nftablesRunner. It
+// exists purely to swap out netlink for a fake implementation in
+// tests.
+type nftConn interface {
+	AddTable(*nftables.Table) *nftables.Table
+	DelTable(*nftables.Table)
+	AddChain(*nftables.Chain) *nftables.Chain
+	DelChain(*nftables.Chain)
+	FlushChain(*nftables.Chain)
+	AddRule(*nftables.Rule) *nftables.Rule
+	InsertRule(*nftables.Rule) *nftables.Rule
+	DelRule(*nftables.Rule) error
+	GetRule(*nftables.Table, *nftables.Chain) ([]*nftables.Rule, error)
+	Flush() error
+}
+
+// nftablesRunner is a netfilterRunner that programs nftables over
+// netlink instead of running iptables. It owns one table of one IP
+// family, named by nftTableName, and translates the iptables-style
+// rules that linuxRouter uses into nftables expressions. It never
+// touches other tables.
+//
+// The iptables built-in chains filter/INPUT, filter/FORWARD and
+// nat/POSTROUTING are base chains of the table, named after their
+// hooks. Other chains keep their names, so they must be unique
+// across iptables tables.
+type nftablesRunner struct {
+	conn  nftConn
+	v6    bool
+	table *nftables.Table
+	// chains are the chains of the table, keyed by iptables
+	// "table/chain" name.
+	chains map[string]*nftChain
+}
+
+// nftChain is a chain of an nftablesRunner.
+type nftChain struct {
+	chain *nftables.Chain
+	// rules are the chain's rules, in order. Only nftablesRunner
+	// modifies its table, so they mirror the kernel's.
+	rules []nftRule
+}
+
+// nftRule is a rule of an nftChain.
+type nftRule struct {
+	args   string // iptables-style args, space-separated
+	handle uint64
+}
+
+// nftBaseChains are the base chains that stand in for the iptables
+// built-in chains, keyed by iptables "table/chain" name.
+var nftBaseChains = map[string]nftables.Chain{
+	"filter/INPUT": {
+		Name:     "input",
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookInput,
+		Priority: nftables.ChainPriorityFilter,
+	},
+	"filter/FORWARD": {
+		Name:     "forward",
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookForward,
+		Priority: nftables.ChainPriorityFilter,
+	},
+	"nat/POSTROUTING": {
+		Name:     "postrouting",
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityNATSource,
+	},
+}
+
+// nftError is an error of an nftablesRunner. Its exit status mimics
+// the iptables command's, so that errCode works the same with both
+// netfilterRunners.
+type nftError struct {
+	status int
+	msg    string
+}
+
+func (e *nftError) Error() string   { return e.msg }
+func (e *nftError) ExitStatus() int { return e.status }
+
+func errNoChain(table, chain string) error {
+	return &nftError{1, fmt.Sprintf("nftables: no chain %s/%s", table, chain)}
+}
+
+// nftTableName returns the name of the nftables table of the
+// tailscaled using the TUN device tunname: "tailscale" for the default
+// device tailscale0, and "tailscale-" plus the device name otherwise.
+// The tailscaleds of a multi-instance setup each need a table of
+// their own, as each resets its table on startup.
+func nftTableName(tunname string) string {
+	if tunname == "tailscale0" {
+		return "tailscale"
+	}
+	return "tailscale-" + tunname
+}
+
+// newNFTablesRunner returns an nftablesRunner of the named table, for
+// IPv6 if v6 is true, and IPv4 otherwise. Any previous contents of
+// the table, left by an earlier run of the same instance, are
+// deleted.
+func newNFTablesRunner(conn nftConn, table string, v6 bool) (*nftablesRunner, error) {
+	family := nftables.TableFamilyIPv4
+	if v6 {
+		family = nftables.TableFamilyIPv6
+	}
+	r := &nftablesRunner{
+		conn:   conn,
+		v6:     v6,
+		table:  &nftables.Table{Family: family, Name: table},
+		chains: make(map[string]*nftChain),
+	}
+
+	// Adding the table first makes deleting it succeed even if it
+	// doesn't exist yet.
+	conn.AddTable(r.table)
+	conn.DelTable(r.table)
+	conn.AddTable(r.table)
+	for name, base := range nftBaseChains {
+		c := base
+		c.Table = r.table
+		r.chains[name] = &nftChain{chain: conn.AddChain(&c)}
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, fmt.Errorf("nftables: creating table %s: %w", table, err)
+	}
+	return r, nil
+}
+
+// Close deletes r's table.
+func (r *nftablesRunner) Close() error {
+	r.conn.DelTable(r.table)
+	if err := r.conn.Flush(); err != nil {
+		return fmt.Errorf("nftables: deleting table %s: %w", r.table.Name, err)
+	}
+	r.chains = nil
+	return nil
+}
+
+func (r *nftablesRunner) Insert(table, chain string, pos int, args ...string) error {
+	c := r.chains[table+"/"+chain]
+	if c == nil {
+		return errNoChain(table, chain)
+	}
+	if pos < 1 || pos > len(c.rules)+1 {
+		return &nftError{1, fmt.Sprintf("nftables: index %d out of range in %s/%s", pos, table, chain)}
+	}
+	exprs, err := r.ruleExprs(table, args)
+	if err != nil {
+		return err
+	}
+	rule := &nftables.Rule{
+		Table: r.table,
+		Chain: c.chain,
+		Exprs: exprs,
+	}
+	if pos == 1 {
+		r.conn.InsertRule(rule)
+	} else {
+		// Add it after the rule before it.
+		rule.Position = c.rules[pos-2].handle
+		r.conn.AddRule(rule)
+	}
+	if err := r.conn.Flush(); err != nil {
+		return fmt.Errorf("nftables: adding %v in %s/%s: %w", args, table, chain, err)
+	}
+
+	c.rules = append(c.rules, nftRule{})
+	copy(c.rules[pos:], c.rules[pos-1:])
+	c.rules[pos-1] = nftRule{args: strings.Join(args, " ")}
+	return r.getHandles(c)
+}
+
+func (r *nftablesRunner) Append(table, chain string, args ...string) error {
+	c := r.chains[table+"/"+chain]
+	if c == nil {
+		return errNoChain(table, chain)
+	}
+	return r.Insert(table, chain, len(c.rules)+1, args...)
+}
+
+func (r *nftablesRunner) Exists(table, chain string, args ...string) (bool, error) {
+	c := r.chains[table+"/"+chain]
+	if c == nil {
+		return false, errNoChain(table, chain)
+	}
+	return c.index(args) >= 0, nil
+}
+
+func (r *nftablesRunner) Delete(table, chain string, args ...string) error {
+	c := r.chains[table+"/"+chain]
+	if c == nil {
+		return errNoChain(table, chain)
+	}
+	i := c.index(args)
+	if i < 0 {
+		return &nftError{1, fmt.Sprintf("nftables: no rule %v in %s/%s", args, table, chain)}
+	}
+	err := r.conn.DelRule(&nftables.Rule{
+		Table:  r.table,
+		Chain:  c.chain,
+		Handle: c.rules[i].handle,
+	})
+	if err == nil {
+		err = r.conn.Flush()
+	}
+	if err != nil {
+		return fmt.Errorf("nftables: deleting %v in %s/%s: %w", args, table, chain, err)
+	}
+	c.rules = append(c.rules[:i], c.rules[i+1:]...)
+	return nil
+}
+
+func (r *nftablesRunner) ClearChain(table, chain string) error {
+	c := r.chains[table+"/"+chain]
+	if c == nil {
+		return errNoChain(table, chain)
+	}
+	r.conn.FlushChain(c.chain)
+	if err := r.conn.Flush(); err != nil {
+		return fmt.Errorf("nftables: flushing %s/%s: %w", table, chain, err)
+	}
+	c.rules = nil
+	return nil
+}
+
+func (r *nftablesRunner) NewChain(table, chain string) error {
+	name := table + "/" + chain
+	if r.chains[name] != nil {
+		return &nftError{1, fmt.Sprintf("nftables: chain %s already exists", name)}
+	}
+	for _, c := range r.chains {
+		if c.chain.Name == chain {
+			return &nftError{1, fmt.Sprintf("nftables: chain %s clashes with %s", name, chain)}
+		}
+	}
+	c := r.conn.AddChain(&nftables.Chain{
+		Name:  chain,
+		Table: r.table,
+	})
+	if err := r.conn.Flush(); err != nil {
+		return fmt.Errorf("nftables: creating %s: %w", name, err)
+	}
+	r.chains[name] = &nftChain{chain: c}
+	return nil
+}
+
+func (r *nftablesRunner) DeleteChain(table, chain string) error {
+	name := table + "/" + chain
+	c := r.chains[name]
+	if c == nil {
+		return errNoChain(table, chain)
+	}
+	if _, ok := nftBaseChains[name]; ok {
+		return &nftError{1, fmt.Sprintf("nftables: can't delete built-in chain %s", name)}
+	}
+	r.conn.DelChain(c.chain)
+	if err := r.conn.Flush(); err != nil {
+		return fmt.Errorf("nftables: deleting %s: %w", name, err)
+	}
+	delete(r.chains, name)
+	return nil
+}
+
+// index returns the index of the rule of c with the given args, or
+// -1 if there is none.
+func (c *nftChain) index(args []string) int {
+	s := strings.Join(args, " ")
+	for i, rule := range c.rules {
+		if rule.args == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// getHandles fetches the kernel's handles of the rules of c.
+func (r *nftablesRunner) getHandles(c *nftChain) error {
+	rules, err := r.conn.GetRule(r.table, c.chain)
+	if err != nil {
+		return fmt.Errorf("nftables: listing rules of %s: %w", c.chain.Name, err)
+	}
+	if len(rules) != len(c.rules) {
+		return fmt.Errorf("nftables: chain %s has %d rules, want %d; modified by someone else?", c.chain.Name, len(rules), len(c.rules))
+	}
+	for i, rule := range rules {
+		c.rules[i].handle = rule.Handle
+	}
+	return nil
+}
+
+// ruleExprs translates the iptables-style args of a rule in table
+// into nftables expressions. It only supports the matches and targets
+// that linuxRouter uses.
+func (r *nftablesRunner) ruleExprs(table string, args []string) ([]expr.Any, error) {
+	var exprs []expr.Any
+	op := expr.CmpOpEq
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "!" {
+			op = expr.CmpOpNeq
+			continue
+		}
+		if i+1 == len(args) {
+			return nil, fmt.Errorf("nftables: missing value after %q in %v", arg, args)
+		}
+		i++
+		val := args[i]
+		if op == expr.CmpOpNeq && arg != "-i" && arg != "-o" && arg != "-s" && arg != "-d" {
+			return nil, fmt.Errorf("nftables: can't negate %q in %v", arg, args)
+		}
+
+		switch arg {
+		case "-i", "-o":
+			key := expr.MetaKeyIIFNAME
+			if arg == "-o" {
+				key = expr.MetaKeyOIFNAME
+			}
+			exprs = append(exprs,
+				&expr.Meta{Key: key, Register: 1},
+				&expr.Cmp{Op: op, Register: 1, Data: ifname(val)},
+			)
+		case "-s", "-d":
+			e, err := r.addrExprs(arg == "-s", val, op)
+			if err != nil {
+				return nil, err
+			}
+			exprs = append(exprs, e...)
+		case "-m":
+			if i+2 >= len(args) {
+				return nil, fmt.Errorf("nftables: missing value after %q in %v", val, args)
+			}
+			opt, optVal := args[i+1], args[i+2]
+			i += 2
+			switch {
+			case val == "mark" && opt == "--mark":
+				mark, err := parseMark(optVal)
+				if err != nil {
+					return nil, err
+				}
+				exprs = append(exprs,
+					&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+					&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: mark},
+				)
+			case val == "comment" && opt == "--comment":
+				// Comments aren't kept.
+			default:
+				return nil, fmt.Errorf("nftables: unsupported match %q %q in %v", val, opt, args)
+			}
+		case "-j":
+			switch val {
+			case "ACCEPT":
+				exprs = append(exprs, &expr.Verdict{Kind: expr.VerdictAccept})
+			case "DROP":
+				exprs = append(exprs, &expr.Verdict{Kind: expr.VerdictDrop})
+			case "RETURN":
+				exprs = append(exprs, &expr.Verdict{Kind: expr.VerdictReturn})
+			case "MASQUERADE":
+				exprs = append(exprs, &expr.Masq{})
+			case "MARK":
+				if i+2 >= len(args) || args[i+1] != "--set-mark" {
+					return nil, fmt.Errorf("nftables: MARK without --set-mark in %v", args)
+				}
+				mark, err := parseMark(args[i+2])
+				if err != nil {
+					return nil, err
+				}
+				i += 2
+				exprs = append(exprs,
+					&expr.Immediate{Register: 1, Data: mark},
+					&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1},
+				)
+			default:
+				c := r.chains[table+"/"+val]
+				if c == nil {
+					return nil, errNoChain(table, val)
+				}
+				exprs = append(exprs, &expr.Verdict{Kind: expr.VerdictJump, Chain: c.chain.Name})
+			}
+		default:
+			return nil, fmt.Errorf("nftables: unsupported option %q in %v", arg, args)
+		}
+		op = expr.CmpOpEq
+	}
+	return exprs, nil
+}
+
+// addrExprs returns the expressions that match the source address (or
+// the destination address, if src is false) against s, an IP address
+// or prefix.
+func (r *nftablesRunner) addrExprs(src bool, s string, op expr.CmpOp) ([]expr.Any, error) {
+	var pfx netaddr.IPPrefix
+	var err error
+	if strings.Contains(s, "/") {
+		pfx, err = netaddr.ParseIPPrefix(s)
+	} else {
+		pfx.IP, err = netaddr.ParseIP(s)
+		pfx.Bits = 128
+		if pfx.IP.Is4() {
+			pfx.Bits = 32
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("nftables: %w", err)
+	}
+	if pfx.IP.Is6() != r.v6 {
+		return nil, fmt.Errorf("nftables: address %s is of the wrong IP family", s)
+	}
+
+	// Offsets and lengths of the addresses in the IPv4 and IPv6
+	// headers.
+	var offset, length uint32
+	ipnet := pfx.IPNet()
+	ip := ipnet.IP.Mask(ipnet.Mask)
+	switch {
+	case !r.v6 && src:
+		offset, length = 12, 4
+	case !r.v6:
+		offset, length = 16, 4
+	case src:
+		offset, length = 8, 16
+	default:
+		offset, length = 24, 16
+	}
+	ip = ip[len(ip)-int(length):]
+
+	exprs := []expr.Any{
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       offset,
+			Len:          length,
+		},
+	}
+	if int(pfx.Bits) != int(length)*8 {
+		exprs = append(exprs, &expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            length,
+			Mask:           []byte(ipnet.Mask),
+			Xor:            make([]byte, length),
+		})
+	}
+	exprs = append(exprs, &expr.Cmp{Op: op, Register: 1, Data: []byte(ip)})
+	return exprs, nil
+}
+
+// ifname returns the interface name in the format of the kernel's
+// iifname and oifname.
+func ifname(name string) []byte {
+	b := make([]byte, 16) // IFNAMSIZ
+	copy(b, name)
+	return b
+}
+
+// parseMark parses a packet mark in the iptables format, such as
+// "0x40000", into the format of the kernel's meta mark.
+func parseMark(s string) ([]byte, error) {
+	v, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return nil, fmt.Errorf("nftables: invalid mark %q", s)
+	}
+	return binaryutil.NativeEndian.PutUint32(uint32(v)), nil
+}
@@ -0,0 +1,391 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+)
+
+// fakeNFTConn implements nftConn, applying changes immediately
+// instead of on Flush.
+type fakeNFTConn struct {
+	t          *testing.T
+	tables     map[string]bool             // by tableKey
+	chains     map[string][]*nftables.Rule // by chainKey
+	nextHandle uint64
+}
+
+func newFakeNFTConn(t *testing.T) *fakeNFTConn {
+	return &fakeNFTConn{
+		t:      t,
+		tables: make(map[string]bool),
+		chains: make(map[string][]*nftables.Rule),
+	}
+}
+
+func tableKey(t *nftables.Table) string {
+	return fmt.Sprintf("%d/%s", t.Family, t.Name)
+}
+
+func chainKey(t *nftables.Table, chain string) string {
+	return tableKey(t) + "/" + chain
+}
+
+func (c *fakeNFTConn) AddTable(t *nftables.Table) *nftables.Table {
+	c.tables[tableKey(t)] = true
+	return t
+}
+
+func (c *fakeNFTConn) DelTable(t *nftables.Table) {
+	k := tableKey(t)
+	if !c.tables[k] {
+		c.t.Errorf("deleting nonexistent table %s", t.Name)
+	}
+	delete(c.tables, k)
+	for ck := range c.chains {
+		if strings.HasPrefix(ck, k+"/") {
+			delete(c.chains, ck)
+		}
+	}
+}
+
+func (c *fakeNFTConn) AddChain(ch *nftables.Chain) *nftables.Chain {
+	if !c.tables[tableKey(ch.Table)] {
+		c.t.Errorf("adding chain %s to nonexistent table %s", ch.Name, ch.Table.Name)
+	}
+	k := chainKey(ch.Table, ch.Name)
+	if _, ok := c.chains[k]; ok {
+		c.t.Errorf("chain %s already exists", ch.Name)
+	}
+	c.chains[k] = nil
+	return ch
+}
+
+func (c *fakeNFTConn) DelChain(ch *nftables.Chain) {
+	k := chainKey(ch.Table, ch.Name)
+	if len(c.chains[k]) != 0 {
+		c.t.Errorf("chain %s is not empty", ch.Name)
+	}
+	delete(c.chains, k)
+}
+
+func (c *fakeNFTConn) FlushChain(ch *nftables.Chain) {
+	c.chains[chainKey(ch.Table, ch.Name)] = nil
+}
+
+// insert inserts rule in its chain, at index i if the rule has no
+// position, and before or after (if after is true) the rule with that
+// handle otherwise.
+func (c *fakeNFTConn) insert(rule *nftables.Rule, i int, after bool) *nftables.Rule {
+	k := chainKey(rule.Table, rule.Chain.Name)
+	rules, ok := c.chains[k]
+	if !ok {
+		c.t.Errorf("adding rule to nonexistent chain %s", rule.Chain.Name)
+		return rule
+	}
+	if rule.Position != 0 {
+		i = c.index(rules, rule.Position)
+		if i < 0 {
+			c.t.Errorf("no rule with handle %d in %s", rule.Position, rule.Chain.Name)
+			return rule
+		}
+		if after {
+			i++
+		}
+	}
+	c.nextHandle++
+	r := *rule
+	r.Handle = c.nextHandle
+	r.Position = 0
+	rules = append(rules, nil)
+	copy(rules[i+1:], rules[i:])
+	rules[i] = &r
+	c.chains[k] = rules
+	return rule
+}
+
+func (c *fakeNFTConn) index(rules []*nftables.Rule, handle uint64) int {
+	for i, r := range rules {
+		if r.Handle == handle {
+			return i
+		}
+	}
+	return -1
+}
+
+func (c *fakeNFTConn) AddRule(rule *nftables.Rule) *nftables.Rule {
+	return c.insert(rule, len(c.chains[chainKey(rule.Table, rule.Chain.Name)]), true)
+}
+
+func (c *fakeNFTConn) InsertRule(rule *nftables.Rule) *nftables.Rule {
+	return c.insert(rule, 0, false)
+}
+
+func (c *fakeNFTConn) DelRule(rule *nftables.Rule) error {
+	k := chainKey(rule.Table, rule.Chain.Name)
+	rules := c.chains[k]
+	i := c.index(rules, rule.Handle)
+	if i < 0 {
+		c.t.Errorf("deleting unknown rule %d from %s", rule.Handle, rule.Chain.Name)
+		return errExec
+	}
+	c.chains[k] = append(rules[:i], rules[i+1:]...)
+	return nil
+}
+
+func (c *fakeNFTConn) GetRule(t *nftables.Table, ch *nftables.Chain) ([]*nftables.Rule, error) {
+	rules, ok := c.chains[chainKey(t, ch.Name)]
+	if !ok {
+		return nil, errors.New("no such chain")
+	}
+	var ret []*nftables.Rule
+	for _, r := range rules {
+		rr := *r
+		ret = append(ret, &rr)
+	}
+	return ret, nil
+}
+
+func (c *fakeNFTConn) Flush() error { return nil }
+
+// fakeNFTables is an nftablesRunner on a fakeNFTConn.
+type fakeNFTables struct {
+	*nftablesRunner
+	conn *fakeNFTConn
+}
+
+func newFakeNFTables(t *testing.T, v6 bool) *fakeNFTables {
+	conn := newFakeNFTConn(t)
+	r, err := newNFTablesRunner(conn, "tailscale0", v6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeNFTables{r, conn}
+}
+
+// writeTo writes the rules of all chains to b in the same format as
+// fakeIPTables.writeTo, translating them back to iptables rules.
+func (o *fakeNFTables) writeTo(b *strings.Builder, prefix string) {
+	var chains []string
+	for chain := range o.chains {
+		chains = append(chains, chain)
+	}
+	sort.Strings(chains)
+	for _, chain := range chains {
+		for _, rule := range o.conn.chains[chainKey(o.table, o.chains[chain].chain.Name)] {
+			fmt.Fprintf(b, "%s%s %s\n", prefix, chain, decompileNFTRule(rule.Exprs))
+		}
+	}
+}
+
+// decompileNFTRule returns the iptables args of the rule made of
+// exprs, the inverse of nftablesRunner.ruleExprs.
+func decompileNFTRule(exprs []expr.Any) string {
+	var args []string
+	cmp := func(i int) *expr.Cmp {
+		if i >= len(exprs) {
+			return nil
+		}
+		c, _ := exprs[i].(*expr.Cmp)
+		return c
+	}
+	neg := func(c *expr.Cmp) {
+		if c.Op == expr.CmpOpNeq {
+			args = append(args, "!")
+		}
+	}
+	for i := 0; i < len(exprs); i++ {
+		switch e := exprs[i].(type) {
+		case *expr.Meta:
+			if e.SourceRegister {
+				args = append(args, "???")
+				continue
+			}
+			c := cmp(i + 1)
+			if c == nil {
+				args = append(args, "???")
+				continue
+			}
+			i++
+			neg(c)
+			switch e.Key {
+			case expr.MetaKeyIIFNAME:
+				args = append(args, "-i", string(bytes.TrimRight(c.Data, "\x00")))
+			case expr.MetaKeyOIFNAME:
+				args = append(args, "-o", string(bytes.TrimRight(c.Data, "\x00")))
+			case expr.MetaKeyMARK:
+				args = append(args, "-m", "mark", "--mark", fmt.Sprintf("%#x", binaryutil.NativeEndian.Uint32(c.Data)))
+			default:
+				args = append(args, "???")
+			}
+		case *expr.Payload:
+			var mask net.IPMask
+			if i+1 < len(exprs) {
+				if bw, ok := exprs[i+1].(*expr.Bitwise); ok {
+					mask = net.IPMask(bw.Mask)
+					i++
+				}
+			}
+			c := cmp(i + 1)
+			if c == nil {
+				args = append(args, "???")
+				continue
+			}
+			i++
+			neg(c)
+			if e.Offset == 12 || e.Offset == 8 {
+				args = append(args, "-s")
+			} else {
+				args = append(args, "-d")
+			}
+			if mask != nil {
+				args = append(args, (&net.IPNet{IP: c.Data, Mask: mask}).String())
+			} else {
+				args = append(args, net.IP(c.Data).String())
+			}
+		case *expr.Immediate:
+			var m *expr.Meta
+			if i+1 < len(exprs) {
+				m, _ = exprs[i+1].(*expr.Meta)
+			}
+			if m == nil || !m.SourceRegister || m.Key != expr.MetaKeyMARK {
+				args = append(args, "???")
+				continue
+			}
+			i++
+			args = append(args, "-j", "MARK", "--set-mark", fmt.Sprintf("%#x", binaryutil.NativeEndian.Uint32(e.Data)))
+		case *expr.Masq:
+			args = append(args, "-j", "MASQUERADE")
+		case *expr.Verdict:
+			switch e.Kind {
+			case expr.VerdictAccept:
+				args = append(args, "-j", "ACCEPT")
+			case expr.VerdictDrop:
+				args = append(args, "-j", "DROP")
+			case expr.VerdictReturn:
+				args = append(args, "-j", "RETURN")
+			case expr.VerdictJump:
+				args = append(args, "-j", e.Chain)
+			default:
+				args = append(args, "???")
+			}
+		default:
+			args = append(args, "???")
+		}
+	}
+	return strings.Join(args, " ")
+}
+
+func TestNFTablesRunner(t *testing.T) {
+	nft := newFakeNFTables(t, false)
+	if err := nft.NewChain("filter", "ts-fwd"); err != nil {
+		t.Fatal(err)
+	}
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	must(nft.Append("filter", "ts-fwd", "-o", "ts0", "-j", "ACCEPT"))
+	must(nft.Insert("filter", "ts-fwd", 1, "-d", "10.0.0.0/8", "-j", "DROP"))
+	must(nft.Insert("filter", "ts-fwd", 2, "-i", "ts0", "-j", "MARK", "--set-mark", "0x40000"))
+	must(nft.Append("filter", "FORWARD", "-j", "ts-fwd"))
+	must(nft.Delete("filter", "ts-fwd", "-o", "ts0", "-j", "ACCEPT"))
+	must(nft.Append("filter", "ts-fwd", "-m", "comment", "--comment", "x", "-s", "1.2.3.4", "-j", "RETURN"))
+
+	var b strings.Builder
+	nft.writeTo(&b, "")
+	want := `filter/FORWARD -j ts-fwd
+filter/ts-fwd -d 10.0.0.0/8 -j DROP
+filter/ts-fwd -i ts0 -j MARK --set-mark 0x40000
+filter/ts-fwd -s 1.2.3.4 -j RETURN
+`
+	if got := b.String(); got != want {
+		t.Errorf("got rules:\n%s\nwant:\n%s", got, want)
+	}
+
+	if ok, err := nft.Exists("filter", "ts-fwd", "-i", "ts0", "-j", "MARK", "--set-mark", "0x40000"); err != nil || !ok {
+		t.Errorf("Exists = %v, %v; want true, nil", ok, err)
+	}
+	if ok, err := nft.Exists("filter", "ts-fwd", "-o", "ts0", "-j", "ACCEPT"); err != nil || ok {
+		t.Errorf("Exists of deleted rule = %v, %v; want false, nil", ok, err)
+	}
+
+	// Errors that the router relies on look like iptables exiting
+	// with code 1.
+	if err := nft.ClearChain("filter", "nope"); errCode(err) != 1 {
+		t.Errorf("ClearChain of unknown chain: errCode(%v) = %d; want 1", err, errCode(err))
+	}
+	if err := nft.Delete("filter", "ts-fwd", "-j", "ACCEPT"); errCode(err) != 1 {
+		t.Errorf("Delete of unknown rule: errCode(%v) = %d; want 1", err, errCode(err))
+	}
+
+	// Rules that can't be translated are rejected.
+	for _, args := range [][]string{
+		{"-p", "tcp", "-j", "ACCEPT"},
+		{"-s", "fd7a:115c:a1e0::1", "-j", "ACCEPT"},
+		{"-j", "SNAT", "--to-source", "1.2.3.4"},
+		{"!", "-m", "mark", "--mark", "0x40000", "-j", "ACCEPT"},
+		{"-i"},
+	} {
+		if err := nft.Append("filter", "ts-fwd", args...); err == nil {
+			t.Errorf("Append(%q) succeeded; want error", args)
+		}
+	}
+}
+
+func TestNFTablesInstances(t *testing.T) {
+	// Two tailscaleds of a multi-instance setup share the kernel's
+	// nftables, and must leave each other's tables alone.
+	conn := newFakeNFTConn(t)
+	newRunner := func(table string) *nftablesRunner {
+		t.Helper()
+		r, err := newNFTablesRunner(conn, table, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	r0 := newRunner("tailscale0")
+	r1 := newRunner("tailscale1")
+	for _, r := range []*nftablesRunner{r0, r1} {
+		if err := r.Append("filter", "FORWARD", "-o", r.table.Name, "-j", "ACCEPT"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	forwardRules := func(table string) int {
+		return len(conn.chains[chainKey(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: table}, "forward")])
+	}
+
+	// Restarting one instance only resets its own table.
+	r0 = newRunner("tailscale0")
+	if got := forwardRules("tailscale0"); got != 0 {
+		t.Errorf("restarted instance has %d forward rules; want 0", got)
+	}
+	if got := forwardRules("tailscale1"); got != 1 {
+		t.Errorf("other instance has %d forward rules after restart; want 1", got)
+	}
+
+	if err := r0.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if conn.tables[tableKey(r0.table)] {
+		t.Error("table tailscale0 still exists after Close")
+	}
+	if got := forwardRules("tailscale1"); got != 1 {
+		t.Errorf("other instance has %d forward rules after Close; want 1", got)
+	}
+}
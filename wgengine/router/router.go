@@ -30,11 +30,43 @@ type Router interface {
 	Close() error
 }
 
+// Options are the settings of a Router that are fixed when it's
+// created. The zero value is the default.
+//
+// They only matter on Linux, where they let several tailscaled
+// processes run side by side without their routing tables, ip rules
+// and netfilter rules clashing.
+type Options struct {
+	// RouteTable is the policy routing table that holds the
+	// Tailscale routes, between 1 and 252. Zero means 52 plus the
+	// number at the end of the tun interface name, if any: 52 for
+	// tailscale0, 53 for tailscale1.
+	RouteTable int
+	// SubnetRouteMark is the fwmark of packets from the Tailscale
+	// interface to subnet routes. Zero means 0x40000.
+	SubnetRouteMark uint32
+	// BypassMark is the fwmark of packets from tailscaled's own
+	// sockets, which must not be routed over Tailscale. It must
+	// match the mark set with netns.SetBypassMark. Zero means 0x80000.
+	BypassMark uint32
+	// MultiInstance leaves out the netfilter rules that drop
+	// CGNAT-range traffic arriving on other interfaces, which would
+	// otherwise drop the traffic of other Tailscale instances.
+	MultiInstance bool
+	// NetfilterBackend is how netfilter rules are programmed.
+	NetfilterBackend NetfilterBackend
+}
+
 // New returns a new Router for the current platform, using the
 // provided tun device.
 func New(logf logger.Logf, wgdev *device.Device, tundev tun.Device) (Router, error) {
+	return NewWithOptions(logf, wgdev, tundev, Options{})
+}
+
+// NewWithOptions is like New, but with the given Options.
+func NewWithOptions(logf logger.Logf, wgdev *device.Device, tundev tun.Device, opts Options) (Router, error) {
 	logf = logger.WithPrefix(logf, "router: ")
-	return newUserspaceRouter(logf, wgdev, tundev)
+	return newUserspaceRouter(logf, wgdev, tundev, opts)
 }
 
 // Cleanup restores the system network configuration to its original state
@@ -76,6 +108,28 @@ func (m NetfilterMode) String() string {
 	}
 }
 
+// NetfilterBackend is the way Linux netfilter rules are programmed.
+type NetfilterBackend int
+
+const (
+	NetfilterBackendAuto     NetfilterBackend = iota // see detectNetfilterBackend in router_linux.go
+	NetfilterBackendIPTables                         // run the iptables and ip6tables commands
+	NetfilterBackendNFTables                         // program nftables directly over netlink
+)
+
+func (b NetfilterBackend) String() string {
+	switch b {
+	case NetfilterBackendAuto:
+		return "auto"
+	case NetfilterBackendIPTables:
+		return "iptables"
+	case NetfilterBackendNFTables:
+		return "nftables"
+	default:
+		return "???"
+	}
+}
+
 // Config is the subset of Tailscale configuration that is relevant to
 // the OS's network stack.
 type Config struct {
@@ -10,7 +10,7 @@ import (
 	"tailscale.com/types/logger"
 )
 
-func newUserspaceRouter(logf logger.Logf, wgdev *device.Device, tundev tun.Device) (Router, error) {
+func newUserspaceRouter(logf logger.Logf, wgdev *device.Device, tundev tun.Device, _ Options) (Router, error) {
 	return newUserspaceBSDRouter(logf, wgdev, tundev)
 }
 
@@ -5,12 +5,20 @@
 package router
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
 	"regexp"
 	"strconv"
-	"os/exec"
+	"strings"
+	"time"
 
 	"github.com/coreos/go-iptables/iptables"
+	"github.com/google/nftables"
 	"github.com/tailscale/wireguard-go/device"
 	"github.com/tailscale/wireguard-go/tun"
 	"inet.af/netaddr"
@@ -19,8 +27,6 @@ import (
 	"tailscale.com/wgengine/router/dns"
 )
 
-
-
 // netfilterRunner abstracts helpers to run netfilter commands. It
 // exists purely to swap out go-iptables for a fake implementation in
 // tests.
@@ -38,24 +44,38 @@ type linuxRouter struct {
 	logf             func(fmt string, args ...interface{})
 	ipRuleAvailable  bool
 	tunname          string
-	rtable           int16
-	subnetRouteMark  int32
-	bypassMark		 int32
-	multiTS			 bool
+	routeTable       int
+	subnetRouteMark  string
+	bypassMark       string
+	multiInstance    bool
 	addrs            map[netaddr.IPPrefix]bool
 	routes           map[netaddr.IPPrefix]bool
 	snatSubnetRoutes bool
 	netfilterMode    NetfilterMode
 
+	// lastKernelSync is when syncKernelState last ran, or zero to
+	// make the next Set run it.
+	lastKernelSync time.Time
+
+	// v6Available is whether IPv6 addresses, routes, policy routing
+	// rules and ip6tables rules are managed. If false, IPv6
+	// addresses and routes are ignored.
+	v6Available bool
+	// v6NATAvailable is whether ip6tables has a nat table, which is
+	// needed to masquerade IPv6 subnet route traffic.
+	v6NATAvailable bool
+
 	dns *dns.Manager
 
 	ipt4 netfilterRunner
+	ipt6 netfilterRunner // nil if !v6Available
 	cmd  commandRunner
 }
 
-// tailscaleRouteTable is the routing table number for Tailscale
-// network routes. See addIPRules for the detailed policy routing
-// logic that ends up doing lookups within that table.
+// defaultRouteTable is the routing table number for Tailscale
+// network routes, unless set otherwise in Options. See addIPRules for
+// the detailed policy routing logic that ends up doing lookups within
+// that table.
 //
 // NOTE(danderson): We chose 52 because those are the digits above the
 // letters "TS" on a qwerty keyboard, and 52 is sufficiently unlikely
@@ -67,27 +87,39 @@ type linuxRouter struct {
 // implementation believes that table numbers are 8-bit integers, so
 // for maximum compatibility we have to stay in the 0-255 range even
 // though linux itself supports larger numbers.
-var stripLastDigits = regexp.MustCompile("([0-9]+)$")
-func (r *linuxRouter) tailscaleRouteTableNr() int16 {
-	if r.rtable == 0 {
-		lastDigits := stripLastDigits.FindStringSubmatch(r.tunname)
-		if len(lastDigits) != 2 {
-			panic(fmt.Sprintf("to calculate the right routing table nr its required to set the tun atleast with a number:%s", r.tunname))
-		}
-		base, err := strconv.Atoi(lastDigits[1])
-		if err != nil {
-			panic(fmt.Sprintf("can convert to number:%s", lastDigits[1]))
-		}
-		return 52 + int16(base)
-	} else {
-		return r.rtable
+const defaultRouteTable = 52
+
+// mainRouteTable is the kernel's main routing table, which holds the
+// Tailscale routes if policy routing is unavailable.
+const mainRouteTable = 254
+
+// maxRouteTable is the largest table number that isn't reserved by
+// the kernel (253 is "default", 254 "main" and 255 "local").
+const maxRouteTable = 252
+
+// tunNumber matches the number at the end of a tun interface name.
+var tunNumber = regexp.MustCompile("[0-9]+$")
+
+// routeTableForTUN returns the default routing table for the tun
+// interface tunname: defaultRouteTable plus the number at the end of
+// the name, so that several instances with interfaces tailscale0,
+// tailscale1, ... use different tables.
+func routeTableForTUN(tunname string) int {
+	n, err := strconv.Atoi(tunNumber.FindString(tunname))
+	if err != nil {
+		return defaultRouteTable
 	}
+	return defaultRouteTable + n
 }
+
+// tailscaleRouteTable returns the routing table number of r, in the
+// format used by ip(8).
 func (r *linuxRouter) tailscaleRouteTable() string {
-	return fmt.Sprintf("%d", r.tailscaleRouteTableNr())
+	return strconv.Itoa(r.routeTable)
 }
 
-// The following bits are added to packet marks for Tailscale use.
+// The following bits are added to packet marks for Tailscale use,
+// unless set otherwise in Options.
 //
 // We tried to pick bits sufficiently out of the way that it's
 // unlikely to collide with existing uses. We have 4 bytes of mark
@@ -104,33 +136,17 @@ func (r *linuxRouter) tailscaleRouteTable() string {
 // The constants are in the iptables/iproute2 string format for
 // matching and setting the bits, so they can be directly embedded in
 // commands.
-
-// Packet is from Tailscale and to a subnet route destination, so
-// is allowed to be routed through this machine.
-func (r *linuxRouter) tailscaleSubnetRouteMark() string {
-	if r.subnetRouteMark == 0 {
-		rtId := r.tailscaleRouteTableNr()
-		return fmt.Sprintf("0x%x", 0x40000 + int32(rtId))
-	} else {
-		return fmt.Sprintf("0x%x", r.subnetRouteMark)
-	}
-}
-
-// Packet was originated by tailscaled itself, and must not be
-// routed over the Tailscale network.
-//
-// Keep this in sync with tailscaleBypassMark in
-// net/netns/netns_linux.go.
-func (r *linuxRouter) tailscaleBypassMark() string {
-	if r.bypassMark == 0 {
-		rtId := r.tailscaleRouteTableNr()
-		return fmt.Sprintf("0x%x", 0x80000 + int(rtId))
-	} else {
-		return fmt.Sprintf("0x%x", r.bypassMark)
-	}
-}
-
-
+const (
+	// Packet is from Tailscale and to a subnet route destination, so
+	// is allowed to be routed through this machine.
+	tailscaleSubnetRouteMark = "0x40000"
+	// Packet was originated by tailscaled itself, and must not be
+	// routed over the Tailscale network.
+	//
+	// Keep this in sync with tailscaleBypassMark in
+	// net/netns/netns_linux.go.
+	tailscaleBypassMark = "0x80000"
+)
 
 func (r *linuxRouter) inputRule() string {
 	return fmt.Sprintf("%s-inp", r.tunname)
@@ -144,22 +160,97 @@ func (r *linuxRouter) postroutingRule() string {
 	return fmt.Sprintf("%s-prt", r.tunname)
 }
 
-func newUserspaceRouter(logf logger.Logf, _ *device.Device, tunDev tun.Device) (Router, error) {
+func newUserspaceRouter(logf logger.Logf, _ *device.Device, tunDev tun.Device, opts Options) (Router, error) {
 	tunname, err := tunDev.Name()
 	if err != nil {
 		return nil, err
 	}
 
-	ipt4, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
-	if err != nil {
-		return nil, err
+	backend := opts.NetfilterBackend
+	if backend == NetfilterBackendAuto {
+		backend = detectNetfilterBackend()
+	}
+	logf("using %v netfilter backend", backend)
+
+	var cmd commandRunner = osCommandRunner{}
+	if nl, err := newNetlinkRunner(); err != nil {
+		logf("running ip instead of using netlink: %v", err)
+	} else {
+		cmd = nl
+	}
+
+	supportsV6 := false
+	if err := checkIPv6(cmd); err != nil {
+		logf("disabling IPv6 routing: %v", err)
+	} else {
+		supportsV6 = true
+	}
+
+	var nf4, nf6 netfilterRunner
+	supportsV6NAT := false
+	switch backend {
+	case NetfilterBackendNFTables:
+		conn := &nftables.Conn{}
+		nft4, err := newNFTablesRunner(conn, nftTableName(tunname), false)
+		if err != nil {
+			return nil, err
+		}
+		nf4 = nft4
+		if supportsV6 {
+			if nft6, err := newNFTablesRunner(conn, nftTableName(tunname), true); err != nil {
+				logf("disabling IPv6 routing: %v", err)
+				supportsV6 = false
+			} else {
+				nf6 = nft6
+			}
+		}
+		// nftables always has IPv6 NAT, and the kernel loads the
+		// modules it needs on demand.
+		supportsV6NAT = supportsV6
+	default:
+		ipt4, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+		if err != nil {
+			return nil, err
+		}
+		nf4 = ipt4
+		if supportsV6 {
+			if ipt6, err := iptables.NewWithProtocol(iptables.ProtocolIPv6); err != nil {
+				logf("disabling IPv6 routing: ip6tables: %v", err)
+				supportsV6 = false
+			} else {
+				nf6 = ipt6
+			}
+		}
+		supportsV6NAT = supportsV6 && hasIP6TablesNAT()
+		if supportsV6 && !supportsV6NAT {
+			logf("ip6tables has no nat table; not masquerading IPv6 subnet route traffic")
+		}
 	}
 
-	return newUserspaceRouterAdvanced(logf, tunname, ipt4, osCommandRunner{}, 0)
+	return newUserspaceRouterAdvanced(logf, tunname, nf4, nf6, cmd, supportsV6, supportsV6NAT, opts)
 }
 
-func newUserspaceRouterAdvanced(logf logger.Logf, tunname string, netfilter netfilterRunner, cmd commandRunner, rtable int16) (Router, error) {
-	_, err := exec.Command("ip", "rule").Output()
+func newUserspaceRouterAdvanced(logf logger.Logf, tunname string, netfilter4, netfilter6 netfilterRunner, cmd commandRunner, supportsV6, supportsV6NAT bool, opts Options) (Router, error) {
+	routeTable := opts.RouteTable
+	if routeTable == 0 {
+		routeTable = routeTableForTUN(tunname)
+	}
+	if routeTable < 1 || routeTable > maxRouteTable {
+		return nil, fmt.Errorf("routing table %d for %q out of range 1-%d", routeTable, tunname, maxRouteTable)
+	}
+	subnetRouteMark := tailscaleSubnetRouteMark
+	if opts.SubnetRouteMark != 0 {
+		subnetRouteMark = fmt.Sprintf("%#x", opts.SubnetRouteMark)
+	}
+	bypassMark := tailscaleBypassMark
+	if opts.BypassMark != 0 {
+		bypassMark = fmt.Sprintf("%#x", opts.BypassMark)
+	}
+	if subnetRouteMark == bypassMark {
+		return nil, fmt.Errorf("subnet route mark and bypass mark are both %s", bypassMark)
+	}
+
+	_, err := cmd.output("ip", "rule")
 	ipRuleAvailable := (err == nil)
 
 	mconfig := dns.ManagerConfig{
@@ -171,19 +262,146 @@ func newUserspaceRouterAdvanced(logf logger.Logf, tunname string, netfilter netf
 		logf:            logf,
 		ipRuleAvailable: ipRuleAvailable,
 		tunname:         tunname,
-
-		rtable:          rtable,
-		subnetRouteMark: 0,
-		bypassMark:      0,
-		multiTS:		 false,
-
+		routeTable:      routeTable,
+		subnetRouteMark: subnetRouteMark,
+		bypassMark:      bypassMark,
+		multiInstance:   opts.MultiInstance,
 		netfilterMode:   NetfilterOff,
-		ipt4:            netfilter,
+		v6Available:     supportsV6,
+		v6NATAvailable:  supportsV6 && supportsV6NAT,
+		ipt4:            netfilter4,
+		ipt6:            netfilter6,
 		cmd:             cmd,
 		dns:             dns.NewManager(mconfig),
 	}, nil
 }
 
+// checkIPv6 reports an error if the system doesn't appear to support
+// IPv6 routing: if IPv6 is disabled or compiled out of the kernel, or
+// the kernel lacks IPv6 policy routing.
+func checkIPv6(cmd commandRunner) error {
+	bs, err := ioutil.ReadFile("/proc/sys/net/ipv6/conf/all/disable_ipv6")
+	if os.IsNotExist(err) {
+		return errors.New("kernel has no IPv6 support")
+	}
+	if err != nil {
+		return err
+	}
+	disabled, err := strconv.ParseBool(strings.TrimSpace(string(bs)))
+	if err != nil {
+		return fmt.Errorf("invalid disable_ipv6 value %q", bs)
+	}
+	if disabled {
+		return errors.New("IPv6 disabled by sysctl net.ipv6.conf.all.disable_ipv6")
+	}
+	if _, err := cmd.output("ip", "-6", "rule"); err != nil {
+		return fmt.Errorf("no IPv6 policy routing: %v", err)
+	}
+	return nil
+}
+
+// hasIP6TablesNAT reports whether ip6tables has a nat table. Kernels
+// before 3.7 don't.
+func hasIP6TablesNAT() bool {
+	bs, err := ioutil.ReadFile("/proc/net/ip6_tables_names")
+	if err == nil && bytes.Contains(bs, []byte("nat\n")) {
+		return true
+	}
+	// The module may just not be loaded yet, or ip6tables uses
+	// nftables, which leaves that file empty.
+	return exec.Command("modprobe", "ip6table_nat").Run() == nil
+}
+
+// detectNetfilterBackend returns the netfilter backend to use when
+// none is configured, judging by the iptables command and the host's
+// nftables ruleset.
+func detectNetfilterBackend() NetfilterBackend {
+	out, err := exec.Command("iptables", "-V").Output()
+	if err != nil {
+		out = nil
+	}
+	return chooseNetfilterBackend(string(out), hasNativeNFTRuleset)
+}
+
+// chooseNetfilterBackend returns the netfilter backend to use given
+// the output of "iptables -V", which is empty if iptables is missing.
+//
+// Without iptables, it's nftables. With iptables-nft, it's iptables,
+// so that Tailscale's rules go into the same tables as the host's,
+// where they can be ordered before its drops; an accept in a table
+// of our own wouldn't override those. With iptables-legacy, it's
+// nftables if nativeNFT reports that the host has a native nftables
+// ruleset, which legacy rules can't be ordered against either, and
+// iptables otherwise.
+func chooseNetfilterBackend(iptablesVersion string, nativeNFT func() bool) NetfilterBackend {
+	switch {
+	case iptablesVersion == "":
+		return NetfilterBackendNFTables
+	case strings.Contains(iptablesVersion, "(nf_tables)"):
+		return NetfilterBackendIPTables
+	case strings.Contains(iptablesVersion, "(legacy)") && nativeNFT():
+		return NetfilterBackendNFTables
+	}
+	// iptables-legacy without nftables, or an iptables too old to
+	// say which it is.
+	return NetfilterBackendIPTables
+}
+
+// hasNativeNFTRuleset reports whether nftables has chains in tables
+// other than Tailscale's own.
+func hasNativeNFTRuleset() bool {
+	chains, err := (&nftables.Conn{}).ListChains()
+	if err != nil {
+		return false
+	}
+	for _, c := range chains {
+		if c.Table != nil && !strings.HasPrefix(c.Table.Name, "tailscale") {
+			return true
+		}
+	}
+	return false
+}
+
+// netfilters returns the netfilter runners of the IP families that
+// r manages.
+func (r *linuxRouter) netfilters() []netfilterRunner {
+	if r.v6Available {
+		return []netfilterRunner{r.ipt4, r.ipt6}
+	}
+	return []netfilterRunner{r.ipt4}
+}
+
+// natNetfilters is like netfilters, but leaves out ip6tables if it
+// has no nat table.
+func (r *linuxRouter) natNetfilters() []netfilterRunner {
+	if r.v6NATAvailable {
+		return []netfilterRunner{r.ipt4, r.ipt6}
+	}
+	return []netfilterRunner{r.ipt4}
+}
+
+// ipFamilies returns the IP versions, 4 and maybe 6, that r manages.
+func (r *linuxRouter) ipFamilies() []int {
+	if r.v6Available {
+		return []int{4, 6}
+	}
+	return []int{4}
+}
+
+// ipCommand returns the argv of the ip(8) command with the given
+// args, for IP version fam.
+func ipCommand(fam int, args ...string) []string {
+	if fam == 6 {
+		return append([]string{"ip", "-6"}, args...)
+	}
+	return append([]string{"ip"}, args...)
+}
+
+// ignored reports whether r doesn't manage ip's IP family.
+func (r *linuxRouter) ignored(ip netaddr.IP) bool {
+	return ip.Is6() && !r.v6Available
+}
+
 func (r *linuxRouter) Up() error {
 	if err := r.delLegacyNetfilter(); err != nil {
 		return err
@@ -197,6 +415,7 @@ func (r *linuxRouter) Up() error {
 	if err := r.upInterface(); err != nil {
 		return err
 	}
+	r.lastKernelSync = time.Time{}
 
 	return nil
 }
@@ -214,10 +433,23 @@ func (r *linuxRouter) Close() error {
 	if err := r.setNetfilterMode(NetfilterOff); err != nil {
 		return err
 	}
+	for _, nf := range r.netfilters() {
+		if c, ok := nf.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				return err
+			}
+		}
+	}
 
 	r.addrs = nil
 	r.routes = nil
 
+	if c, ok := r.cmd.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -231,6 +463,16 @@ func (r *linuxRouter) Set(cfg *Config) error {
 		return err
 	}
 
+	// Reading back the kernel's state means dumping its routing
+	// tables, so it's done after Up and then only every so often,
+	// rather than on every Set.
+	if now := time.Now(); now.Sub(r.lastKernelSync) >= kernelSyncInterval {
+		r.lastKernelSync = now
+		if err := r.syncKernelState(); err != nil {
+			r.logf("syncing with kernel state: %v", err)
+		}
+	}
+
 	newAddrs, err := cidrDiff("addr", r.addrs, cfg.LocalAddrs, r.addAddress, r.delAddress, r.logf)
 	if err != nil {
 		return err
@@ -381,10 +623,102 @@ func (r *linuxRouter) setNetfilterMode(mode NetfilterMode) error {
 	return nil
 }
 
+// kernelSyncInterval is how often Set checks the addresses and routes
+// of the tunnel interface for changes made behind the router's back.
+const kernelSyncInterval = 5 * time.Minute
+
+// syncKernelState makes the addresses of the tunnel interface and
+// the routes in the Tailscale routing table match r.addrs and
+// r.routes, if r.cmd can read them back: unknown ones are deleted,
+// and missing ones are added back.
+func (r *linuxRouter) syncKernelState() error {
+	ksr, ok := r.cmd.(kernelStateReader)
+	if !ok {
+		return nil
+	}
+
+	addrs, err := ksr.addrs(r.tunname)
+	if err != nil {
+		return fmt.Errorf("reading addresses: %w", err)
+	}
+	haveAddrs := make(map[netaddr.IPPrefix]bool)
+	for _, addr := range addrs {
+		// The kernel may add IPv6 link-local addresses of its own.
+		if r.ignored(addr.IP) || addr.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		haveAddrs[addr] = true
+		if r.addrs[addr] {
+			continue
+		}
+		r.logf("deleting stale address %v", addr)
+		if err := r.delStaleLoopbackRule(addr.IP); err != nil {
+			return err
+		}
+		if err := r.cmd.run("ip", "addr", "del", addr.String(), "dev", r.tunname); err != nil {
+			return fmt.Errorf("deleting address %q from tunnel interface: %w", addr, err)
+		}
+	}
+	for addr := range r.addrs {
+		if haveAddrs[addr] || r.ignored(addr.IP) {
+			continue
+		}
+		// Only the address went missing, so don't add its loopback
+		// rule again like addAddress would.
+		r.logf("restoring missing address %v", addr)
+		if err := r.cmd.run("ip", "addr", "add", addr.String(), "dev", r.tunname); err != nil {
+			return fmt.Errorf("adding address %q to tunnel interface: %w", addr, err)
+		}
+	}
+
+	table := r.routeTable
+	if !r.ipRuleAvailable {
+		table = mainRouteTable
+	}
+	routes, err := ksr.routes(r.tunname, table)
+	if err != nil {
+		return fmt.Errorf("reading routes: %w", err)
+	}
+	// Routes are added with the host bits zeroed, so compare them
+	// that way.
+	wantRoutes := make(map[string]bool)
+	for cidr := range r.routes {
+		wantRoutes[normalizeCIDR(cidr)] = true
+	}
+	haveRoutes := make(map[string]bool)
+	for _, cidr := range routes {
+		if r.ignored(cidr.IP) {
+			continue
+		}
+		haveRoutes[normalizeCIDR(cidr)] = true
+		if wantRoutes[normalizeCIDR(cidr)] {
+			continue
+		}
+		r.logf("deleting stale route %v", cidr)
+		if err := r.delRoute(cidr); err != nil {
+			return err
+		}
+	}
+	for cidr := range r.routes {
+		if haveRoutes[normalizeCIDR(cidr)] || r.ignored(cidr.IP) {
+			continue
+		}
+		r.logf("restoring missing route %v", cidr)
+		if err := r.addRoute(cidr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // addAddress adds an IP/mask to the tunnel interface. Fails if the
 // address is already assigned to the interface, or if the addition
 // fails.
 func (r *linuxRouter) addAddress(addr netaddr.IPPrefix) error {
+	if r.ignored(addr.IP) {
+		return nil
+	}
 	if err := r.cmd.run("ip", "addr", "add", addr.String(), "dev", r.tunname); err != nil {
 		return fmt.Errorf("adding address %q to tunnel interface: %w", addr, err)
 	}
@@ -398,6 +732,9 @@ func (r *linuxRouter) addAddress(addr netaddr.IPPrefix) error {
 // the address is not assigned to the interface, or if the removal
 // fails.
 func (r *linuxRouter) delAddress(addr netaddr.IPPrefix) error {
+	if r.ignored(addr.IP) {
+		return nil
+	}
 	if err := r.delLoopbackRule(addr.IP); err != nil {
 		return err
 	}
@@ -410,10 +747,14 @@ func (r *linuxRouter) delAddress(addr netaddr.IPPrefix) error {
 // addLoopbackRule adds a firewall rule to permit loopback traffic to
 // a local Tailscale IP.
 func (r *linuxRouter) addLoopbackRule(addr netaddr.IP) error {
-	if r.netfilterMode == NetfilterOff {
+	if r.netfilterMode == NetfilterOff || r.ignored(addr) {
 		return nil
 	}
-	if err := r.ipt4.Insert("filter", r.inputRule(), 1, "-i", "lo", "-s", addr.String(), "-j", "ACCEPT"); err != nil {
+	ipt := r.ipt4
+	if addr.Is6() {
+		ipt = r.ipt6
+	}
+	if err := ipt.Insert("filter", r.inputRule(), 1, "-i", "lo", "-s", addr.String(), "-j", "ACCEPT"); err != nil {
 		return fmt.Errorf("adding loopback allow rule for %q: %w", addr, err)
 	}
 	return nil
@@ -422,19 +763,46 @@ func (r *linuxRouter) addLoopbackRule(addr netaddr.IP) error {
 // delLoopbackRule removes the firewall rule permitting loopback
 // traffic to a Tailscale IP.
 func (r *linuxRouter) delLoopbackRule(addr netaddr.IP) error {
-	if r.netfilterMode == NetfilterOff {
+	if r.netfilterMode == NetfilterOff || r.ignored(addr) {
 		return nil
 	}
-	if err := r.ipt4.Delete("filter", r.inputRule(), "-i", "lo", "-s", addr.String(), "-j", "ACCEPT"); err != nil {
+	ipt := r.ipt4
+	if addr.Is6() {
+		ipt = r.ipt6
+	}
+	if err := ipt.Delete("filter", r.inputRule(), "-i", "lo", "-s", addr.String(), "-j", "ACCEPT"); err != nil {
 		return fmt.Errorf("deleting loopback allow rule for %q: %w", addr, err)
 	}
 	return nil
 }
 
+// delStaleLoopbackRule is like delLoopbackRule, but for an address
+// that the router didn't add itself, which may have no rule.
+func (r *linuxRouter) delStaleLoopbackRule(addr netaddr.IP) error {
+	if r.netfilterMode == NetfilterOff || r.ignored(addr) {
+		return nil
+	}
+	ipt := r.ipt4
+	if addr.Is6() {
+		ipt = r.ipt6
+	}
+	exists, err := ipt.Exists("filter", r.inputRule(), "-i", "lo", "-s", addr.String(), "-j", "ACCEPT")
+	if err != nil {
+		return fmt.Errorf("checking loopback allow rule for %q: %w", addr, err)
+	}
+	if !exists {
+		return nil
+	}
+	return r.delLoopbackRule(addr)
+}
+
 // addRoute adds a route for cidr, pointing to the tunnel
 // interface. Fails if the route already exists, or if adding the
 // route fails.
 func (r *linuxRouter) addRoute(cidr netaddr.IPPrefix) error {
+	if r.ignored(cidr.IP) {
+		return nil
+	}
 	args := []string{
 		"ip", "route", "add",
 		normalizeCIDR(cidr),
@@ -450,6 +818,9 @@ func (r *linuxRouter) addRoute(cidr netaddr.IPPrefix) error {
 // interface. Fails if the route doesn't exist, or if removing the
 // route fails.
 func (r *linuxRouter) delRoute(cidr netaddr.IPPrefix) error {
+	if r.ignored(cidr.IP) {
+		return nil
+	}
 	args := []string{
 		"ip", "route", "del",
 		normalizeCIDR(cidr),
@@ -499,44 +870,46 @@ func (r *linuxRouter) addIPRules() error {
 	// checking for the lack of a fwmark, only the presence. The technique
 	// below works even on very old kernels.
 
-	// Packets from us, tagged with our fwmark, first try the kernel's
-	// main routing table.
-	rg.Run(
-		"ip", "rule", "add",
-		"pref", r.tailscaleRouteTable()+"10",
-		"fwmark", r.tailscaleBypassMark(),
-		"table", "main",
-	)
-	// ...and then we try the 'default' table, for correctness,
-	// even though it's been empty on every Linux system I've ever seen.
-	rg.Run(
-		"ip", "rule", "add",
-		"pref", r.tailscaleRouteTable()+"30",
-		"fwmark", r.tailscaleBypassMark(),
-		"table", "default",
-	)
-	// If neither of those matched (no default route on this system?)
-	// then packets from us should be aborted rather than falling through
-	// to the tailscale routes, because that would create routing loops.
-	rg.Run(
-		"ip", "rule", "add",
-		"pref", r.tailscaleRouteTable()+"50",
-		"fwmark", r.tailscaleBypassMark(),
-		"type", "unreachable",
-	)
-	// If we get to this point, capture all packets and send them
-	// through to the tailscale route table. For apps other than us
-	// (ie. with no fwmark set), this is the first routing table, so
-	// it takes precedence over all the others, ie. VPN routes always
-	// beat non-VPN routes.
-	//
-	// NOTE(apenwarr): tables >255 are not supported in busybox, so we
-	// can't use a table number that aligns with the rule preferences.
-	rg.Run(
-		"ip", "rule", "add",
-		"pref", r.tailscaleRouteTable()+"70",
-		"table", r.tailscaleRouteTable(),
-	)
+	for _, fam := range r.ipFamilies() {
+		// Packets from us, tagged with our fwmark, first try the kernel's
+		// main routing table.
+		rg.Run(ipCommand(fam,
+			"rule", "add",
+			"pref", r.tailscaleRouteTable()+"10",
+			"fwmark", r.bypassMark,
+			"table", "main",
+		)...)
+		// ...and then we try the 'default' table, for correctness,
+		// even though it's been empty on every Linux system I've ever seen.
+		rg.Run(ipCommand(fam,
+			"rule", "add",
+			"pref", r.tailscaleRouteTable()+"30",
+			"fwmark", r.bypassMark,
+			"table", "default",
+		)...)
+		// If neither of those matched (no default route on this system?)
+		// then packets from us should be aborted rather than falling through
+		// to the tailscale routes, because that would create routing loops.
+		rg.Run(ipCommand(fam,
+			"rule", "add",
+			"pref", r.tailscaleRouteTable()+"50",
+			"fwmark", r.bypassMark,
+			"type", "unreachable",
+		)...)
+		// If we get to this point, capture all packets and send them
+		// through to the tailscale route table. For apps other than us
+		// (ie. with no fwmark set), this is the first routing table, so
+		// it takes precedence over all the others, ie. VPN routes always
+		// beat non-VPN routes.
+		//
+		// NOTE(apenwarr): tables >255 are not supported in busybox, so we
+		// can't use a table number that aligns with the rule preferences.
+		rg.Run(ipCommand(fam,
+			"rule", "add",
+			"pref", r.tailscaleRouteTable()+"70",
+			"table", r.tailscaleRouteTable(),
+		)...)
+	}
 	// If that didn't match, then non-fwmark packets fall through to the
 	// usual rules (pref 32766 and 32767, ie. main and default).
 
@@ -574,50 +947,56 @@ func (r *linuxRouter) delIPRules() error {
 	)
 
 	// Delete new-style tailscale rules.
-	rg.Run(
-		"ip", "rule", "del",
-		"pref", r.tailscaleRouteTable()+"10",
-		"table", "main",
-	)
-	rg.Run(
-		"ip", "rule", "del",
-		"pref", r.tailscaleRouteTable()+"30",
-		"table", "default",
-	)
-	rg.Run(
-		"ip", "rule", "del",
-		"pref", r.tailscaleRouteTable()+"50",
-		"type", "unreachable",
-	)
-	rg.Run(
-		"ip", "rule", "del",
-		"pref", r.tailscaleRouteTable()+"70",
-		"table", r.tailscaleRouteTable(),
-	)
+	for _, fam := range r.ipFamilies() {
+		rg.Run(ipCommand(fam,
+			"rule", "del",
+			"pref", r.tailscaleRouteTable()+"10",
+			"table", "main",
+		)...)
+		rg.Run(ipCommand(fam,
+			"rule", "del",
+			"pref", r.tailscaleRouteTable()+"30",
+			"table", "default",
+		)...)
+		rg.Run(ipCommand(fam,
+			"rule", "del",
+			"pref", r.tailscaleRouteTable()+"50",
+			"type", "unreachable",
+		)...)
+		rg.Run(ipCommand(fam,
+			"rule", "del",
+			"pref", r.tailscaleRouteTable()+"70",
+			"table", r.tailscaleRouteTable(),
+		)...)
+	}
 	return rg.ErrAcc
 }
 
 // addNetfilterChains creates custom Tailscale chains in netfilter.
 func (r *linuxRouter) addNetfilterChains() error {
-	create := func(table, chain string) error {
-		err := r.ipt4.ClearChain(table, chain)
+	create := func(ipt netfilterRunner, table, chain string) error {
+		err := ipt.ClearChain(table, chain)
 		if errCode(err) == 1 {
 			// nonexistent chain. let's create it!
-			return r.ipt4.NewChain(table, chain)
+			return ipt.NewChain(table, chain)
 		}
 		if err != nil {
 			return fmt.Errorf("setting up %s/%s: %w", table, chain, err)
 		}
 		return nil
 	}
-	if err := create("filter", r.inputRule()); err != nil {
-		return err
-	}
-	if err := create("filter", r.forwardRule()); err != nil {
-		return err
+	for _, ipt := range r.netfilters() {
+		if err := create(ipt, "filter", r.inputRule()); err != nil {
+			return err
+		}
+		if err := create(ipt, "filter", r.forwardRule()); err != nil {
+			return err
+		}
 	}
-	if err := create("nat", r.postroutingRule()); err != nil {
-		return err
+	for _, ipt := range r.natNetfilters() {
+		if err := create(ipt, "nat", r.postroutingRule()); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -630,12 +1009,14 @@ func (r *linuxRouter) addNetfilterBase() error {
 	// which we fall out of the Tailscale chain.
 	//
 	// Note, this will definitely break nodes that end up using the
-	// CGNAT range for other purposes :(.
+	// CGNAT range for other purposes :(. It also breaks other
+	// Tailscale instances on the same machine, so the DROP rules
+	// are left out in multi-instance mode.
 	args := []string{"!", "-i", r.tunname, "-s", tsaddr.ChromeOSVMRange().String(), "-j", "RETURN"}
 	if err := r.ipt4.Append("filter", r.inputRule(), args...); err != nil {
 		return fmt.Errorf("adding %v in filter/%s: %w", args, r.inputRule(), err)
 	}
-	if !r.multiTS {
+	if !r.multiInstance {
 		args = []string{"!", "-i", r.tunname, "-s", tsaddr.CGNATRange().String(), "-j", "DROP"}
 		if err := r.ipt4.Append("filter", r.inputRule(), args...); err != nil {
 			return fmt.Errorf("adding %v in filter/%s: %w", args, r.inputRule(), err)
@@ -653,23 +1034,29 @@ func (r *linuxRouter) addNetfilterBase() error {
 	// POSTROUTING. So instead, we match on the inbound interface in
 	// filter/FORWARD, and set a packet mark that nat/POSTROUTING can
 	// use to effectively run that same test again.
-	args = []string{"-i", r.tunname, "-j", "MARK", "--set-mark", r.tailscaleSubnetRouteMark()}
-	if err := r.ipt4.Append("filter", r.forwardRule(), args...); err != nil {
-		return fmt.Errorf("adding %v in filter/%s: %w", args, r.forwardRule(), err)
-	}
-	args = []string{"-m", "mark", "--mark", r.tailscaleSubnetRouteMark(), "-j", "ACCEPT"}
-	if err := r.ipt4.Append("filter", r.forwardRule(), args...); err != nil {
-		return fmt.Errorf("adding %v in filter/%s: %w", args, r.forwardRule(), err)
+	//
+	// IPv6 gets the same rules, except for the CGNAT one.
+	for _, ipt := range r.netfilters() {
+		args = []string{"-i", r.tunname, "-j", "MARK", "--set-mark", r.subnetRouteMark}
+		if err := ipt.Append("filter", r.forwardRule(), args...); err != nil {
+			return fmt.Errorf("adding %v in filter/%s: %w", args, r.forwardRule(), err)
+		}
+		args = []string{"-m", "mark", "--mark", r.subnetRouteMark, "-j", "ACCEPT"}
+		if err := ipt.Append("filter", r.forwardRule(), args...); err != nil {
+			return fmt.Errorf("adding %v in filter/%s: %w", args, r.forwardRule(), err)
+		}
 	}
-	if !r.multiTS {
+	if !r.multiInstance {
 		args = []string{"-o", r.tunname, "-s", tsaddr.CGNATRange().String(), "-j", "DROP"}
 		if err := r.ipt4.Append("filter", r.forwardRule(), args...); err != nil {
 			return fmt.Errorf("adding %v in filter/%s: %w", args, r.forwardRule(), err)
 		}
 	}
 	args = []string{"-o", r.tunname, "-j", "ACCEPT"}
-	if err := r.ipt4.Append("filter", r.forwardRule(), args...); err != nil {
-		return fmt.Errorf("adding %v in filter/%s: %w", args, r.forwardRule(), err)
+	for _, ipt := range r.netfilters() {
+		if err := ipt.Append("filter", r.forwardRule(), args...); err != nil {
+			return fmt.Errorf("adding %v in filter/%s: %w", args, r.forwardRule(), err)
+		}
 	}
 
 	return nil
@@ -677,8 +1064,8 @@ func (r *linuxRouter) addNetfilterBase() error {
 
 // delNetfilterChains removes the custom Tailscale chains from netfilter.
 func (r *linuxRouter) delNetfilterChains() error {
-	del := func(table, chain string) error {
-		if err := r.ipt4.ClearChain(table, chain); err != nil {
+	del := func(ipt netfilterRunner, table, chain string) error {
+		if err := ipt.ClearChain(table, chain); err != nil {
 			if errCode(err) == 1 {
 				// nonexistent chain. That's fine, since it's
 				// the desired state anyway.
@@ -686,7 +1073,7 @@ func (r *linuxRouter) delNetfilterChains() error {
 			}
 			return fmt.Errorf("flushing %s/%s: %w", table, chain, err)
 		}
-		if err := r.ipt4.DeleteChain(table, chain); err != nil {
+		if err := ipt.DeleteChain(table, chain); err != nil {
 			// this shouldn't fail, because if the chain didn't
 			// exist, we would have returned after ClearChain.
 			return fmt.Errorf("deleting %s/%s: %v", table, chain, err)
@@ -694,14 +1081,18 @@ func (r *linuxRouter) delNetfilterChains() error {
 		return nil
 	}
 
-	if err := del("filter", r.inputRule()); err != nil {
-		return err
-	}
-	if err := del("filter", r.forwardRule()); err != nil {
-		return err
+	for _, ipt := range r.netfilters() {
+		if err := del(ipt, "filter", r.inputRule()); err != nil {
+			return err
+		}
+		if err := del(ipt, "filter", r.forwardRule()); err != nil {
+			return err
+		}
 	}
-	if err := del("nat", r.postroutingRule()); err != nil {
-		return err
+	for _, ipt := range r.natNetfilters() {
+		if err := del(ipt, "nat", r.postroutingRule()); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -710,8 +1101,8 @@ func (r *linuxRouter) delNetfilterChains() error {
 // delNetfilterBase empties but does not remove custom Tailscale chains from
 // netfilter.
 func (r *linuxRouter) delNetfilterBase() error {
-	del := func(table, chain string) error {
-		if err := r.ipt4.ClearChain(table, chain); err != nil {
+	del := func(ipt netfilterRunner, table, chain string) error {
+		if err := ipt.ClearChain(table, chain); err != nil {
 			if errCode(err) == 1 {
 				// nonexistent chain. That's fine, since it's
 				// the desired state anyway.
@@ -722,14 +1113,18 @@ func (r *linuxRouter) delNetfilterBase() error {
 		return nil
 	}
 
-	if err := del("filter", r.inputRule()); err != nil {
-		return err
-	}
-	if err := del("filter", r.forwardRule()); err != nil {
-		return err
+	for _, ipt := range r.netfilters() {
+		if err := del(ipt, "filter", r.inputRule()); err != nil {
+			return err
+		}
+		if err := del(ipt, "filter", r.forwardRule()); err != nil {
+			return err
+		}
 	}
-	if err := del("nat", r.postroutingRule()); err != nil {
-		return err
+	for _, ipt := range r.natNetfilters() {
+		if err := del(ipt, "nat", r.postroutingRule()); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -739,29 +1134,33 @@ func (r *linuxRouter) delNetfilterBase() error {
 // the relevant main netfilter chains. The tailscale chains must
 // already exist.
 func (r *linuxRouter) addNetfilterHooks() error {
-	divert := func(table, ichain string, ochain string) error {
+	divert := func(ipt netfilterRunner, table, ichain string, ochain string) error {
 		args := []string{"-j", ochain}
-		exists, err := r.ipt4.Exists(table, ichain, args...)
+		exists, err := ipt.Exists(table, ichain, args...)
 		if err != nil {
 			return fmt.Errorf("checking for %v in %s/%s:%s %w", args, table, ichain, ochain, err)
 		}
 		if exists {
 			return nil
 		}
-		if err := r.ipt4.Insert(table, ichain, 1, args...); err != nil {
+		if err := ipt.Insert(table, ichain, 1, args...); err != nil {
 			return fmt.Errorf("adding %v in %s/%s:%s %w", args, table, ichain, ochain, err)
 		}
 		return nil
 	}
 
-	if err := divert("filter", "INPUT", r.inputRule()); err != nil {
-		return err
-	}
-	if err := divert("filter", "FORWARD", r.forwardRule()); err != nil {
-		return err
+	for _, ipt := range r.netfilters() {
+		if err := divert(ipt, "filter", "INPUT", r.inputRule()); err != nil {
+			return err
+		}
+		if err := divert(ipt, "filter", "FORWARD", r.forwardRule()); err != nil {
+			return err
+		}
 	}
-	if err := divert("nat", "POSTROUTING", r.postroutingRule()); err != nil {
-		return err
+	for _, ipt := range r.natNetfilters() {
+		if err := divert(ipt, "nat", "POSTROUTING", r.postroutingRule()); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -769,9 +1168,9 @@ func (r *linuxRouter) addNetfilterHooks() error {
 // delNetfilterHooks deletes the calls to tailscale's netfilter chains
 // in the relevant main netfilter chains.
 func (r *linuxRouter) delNetfilterHooks() error {
-	del := func(table, ichain string, ochain string) error {
+	del := func(ipt netfilterRunner, table, ichain string, ochain string) error {
 		args := []string{"-j", ochain}
-		if err := r.ipt4.Delete(table, ichain, args...); err != nil {
+		if err := ipt.Delete(table, ichain, args...); err != nil {
 			// TODO(apenwarr): check for errCode(1) here.
 			// Unfortunately the error code from the iptables
 			// module resists unwrapping, unlike with other
@@ -783,14 +1182,18 @@ func (r *linuxRouter) delNetfilterHooks() error {
 		return nil
 	}
 
-	if err := del("filter", "INPUT", r.inputRule()); err != nil {
-		return err
-	}
-	if err := del("filter", "FORWARD", r.forwardRule()); err != nil {
-		return err
+	for _, ipt := range r.netfilters() {
+		if err := del(ipt, "filter", "INPUT", r.inputRule()); err != nil {
+			return err
+		}
+		if err := del(ipt, "filter", "FORWARD", r.forwardRule()); err != nil {
+			return err
+		}
 	}
-	if err := del("nat", "POSTROUTING", r.postroutingRule()); err != nil {
-		return err
+	for _, ipt := range r.natNetfilters() {
+		if err := del(ipt, "nat", "POSTROUTING", r.postroutingRule()); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -802,9 +1205,11 @@ func (r *linuxRouter) addSNATRule() error {
 		return nil
 	}
 
-	args := []string{"-m", "mark", "--mark", r.tailscaleSubnetRouteMark(), "-j", "MASQUERADE"}
-	if err := r.ipt4.Append("nat", r.postroutingRule(), args...); err != nil {
-		return fmt.Errorf("adding %v in nat/%s: %w", args, r.postroutingRule(), err)
+	args := []string{"-m", "mark", "--mark", r.subnetRouteMark, "-j", "MASQUERADE"}
+	for _, ipt := range r.natNetfilters() {
+		if err := ipt.Append("nat", r.postroutingRule(), args...); err != nil {
+			return fmt.Errorf("adding %v in nat/%s: %w", args, r.postroutingRule(), err)
+		}
 	}
 	return nil
 }
@@ -816,9 +1221,11 @@ func (r *linuxRouter) delSNATRule() error {
 		return nil
 	}
 
-	args := []string{"-m", "mark", "--mark", r.tailscaleSubnetRouteMark(), "-j", "MASQUERADE"}
-	if err := r.ipt4.Delete("nat", r.postroutingRule(), args...); err != nil {
-		return fmt.Errorf("deleting %v in nat/%s: %w", args, r.postroutingRule(), err)
+	args := []string{"-m", "mark", "--mark", r.subnetRouteMark, "-j", "MASQUERADE"}
+	for _, ipt := range r.natNetfilters() {
+		if err := ipt.Delete("nat", r.postroutingRule(), args...); err != nil {
+			return fmt.Errorf("deleting %v in nat/%s: %w", args, r.postroutingRule(), err)
+		}
 	}
 	return nil
 }
@@ -33,11 +33,36 @@ func mustCIDRs(ss ...string) []netaddr.IPPrefix {
 }
 
 func TestRouterStates(t *testing.T) {
+	t.Run("iptables", func(t *testing.T) { testRouterStates(t, NewFakeOS(t)) })
+	t.Run("nftables", func(t *testing.T) { testRouterStates(t, newFakeNFTablesOS(t)) })
+	t.Run("netlink", func(t *testing.T) { testRouterStates(t, newFakeNetlinkOS(t)) })
+}
+
+// testRouterStates runs the router through a series of states, with
+// fake's netfilter backend and commandRunner.
+func testRouterStates(t *testing.T, fake *fakeOS) {
 	basic := `
 ip rule add pref 5210 fwmark 0x80000 table main
 ip rule add pref 5230 fwmark 0x80000 table default
 ip rule add pref 5250 fwmark 0x80000 type unreachable
 ip rule add pref 5270 table 52
+ip -6 rule add pref 5210 fwmark 0x80000 table main
+ip -6 rule add pref 5230 fwmark 0x80000 table default
+ip -6 rule add pref 5250 fwmark 0x80000 type unreachable
+ip -6 rule add pref 5270 table 52
+`
+	// The IPv6 netfilter rules, for states without IPv6 addresses
+	// or SNAT.
+	v6Netfilter := `v6/filter/FORWARD -j tailscale0-fwd
+v6/filter/INPUT -j tailscale0-inp
+v6/filter/tailscale0-fwd -i tailscale0 -j MARK --set-mark 0x40000
+v6/filter/tailscale0-fwd -m mark --mark 0x40000 -j ACCEPT
+v6/filter/tailscale0-fwd -o tailscale0 -j ACCEPT
+v6/nat/POSTROUTING -j tailscale0-prt
+`
+	v6HalfNetfilter := `v6/filter/tailscale0-fwd -i tailscale0 -j MARK --set-mark 0x40000
+v6/filter/tailscale0-fwd -m mark --mark 0x40000 -j ACCEPT
+v6/filter/tailscale0-fwd -o tailscale0 -j ACCEPT
 `
 	states := []struct {
 		name string
@@ -115,6 +140,13 @@ filter/tailscale0-inp ! -i tailscale0 -s 100.115.92.0/23 -j RETURN
 filter/tailscale0-inp ! -i tailscale0 -s 100.64.0.0/10 -j DROP
 nat/POSTROUTING -j tailscale0-prt
 nat/tailscale0-prt -m mark --mark 0x40000 -j MASQUERADE
+v6/filter/FORWARD -j tailscale0-fwd
+v6/filter/INPUT -j tailscale0-inp
+v6/filter/tailscale0-fwd -i tailscale0 -j MARK --set-mark 0x40000
+v6/filter/tailscale0-fwd -m mark --mark 0x40000 -j ACCEPT
+v6/filter/tailscale0-fwd -o tailscale0 -j ACCEPT
+v6/nat/POSTROUTING -j tailscale0-prt
+v6/nat/tailscale0-prt -m mark --mark 0x40000 -j MASQUERADE
 `,
 		},
 		{
@@ -139,7 +171,7 @@ filter/tailscale0-inp -i lo -s 100.101.102.104 -j ACCEPT
 filter/tailscale0-inp ! -i tailscale0 -s 100.115.92.0/23 -j RETURN
 filter/tailscale0-inp ! -i tailscale0 -s 100.64.0.0/10 -j DROP
 nat/POSTROUTING -j tailscale0-prt
-`,
+` + v6Netfilter,
 		},
 
 		{
@@ -166,7 +198,7 @@ filter/tailscale0-inp -i lo -s 100.101.102.104 -j ACCEPT
 filter/tailscale0-inp ! -i tailscale0 -s 100.115.92.0/23 -j RETURN
 filter/tailscale0-inp ! -i tailscale0 -s 100.64.0.0/10 -j DROP
 nat/POSTROUTING -j tailscale0-prt
-`,
+` + v6Netfilter,
 		},
 		{
 			name: "addr and routes with netfilter",
@@ -190,7 +222,7 @@ filter/tailscale0-inp -i lo -s 100.101.102.104 -j ACCEPT
 filter/tailscale0-inp ! -i tailscale0 -s 100.115.92.0/23 -j RETURN
 filter/tailscale0-inp ! -i tailscale0 -s 100.64.0.0/10 -j DROP
 nat/POSTROUTING -j tailscale0-prt
-`,
+` + v6Netfilter,
 		},
 
 		{
@@ -212,7 +244,7 @@ filter/tailscale0-fwd -o tailscale0 -j ACCEPT
 filter/tailscale0-inp -i lo -s 100.101.102.104 -j ACCEPT
 filter/tailscale0-inp ! -i tailscale0 -s 100.115.92.0/23 -j RETURN
 filter/tailscale0-inp ! -i tailscale0 -s 100.64.0.0/10 -j DROP
-`,
+` + v6HalfNetfilter,
 		},
 		{
 			name: "addr and routes with netfilter2",
@@ -236,12 +268,47 @@ filter/tailscale0-inp -i lo -s 100.101.102.104 -j ACCEPT
 filter/tailscale0-inp ! -i tailscale0 -s 100.115.92.0/23 -j RETURN
 filter/tailscale0-inp ! -i tailscale0 -s 100.64.0.0/10 -j DROP
 nat/POSTROUTING -j tailscale0-prt
+` + v6Netfilter,
+		},
+		{
+			name: "IPv6 addr and routes and subnet routes with netfilter",
+			in: &Config{
+				LocalAddrs:       mustCIDRs("100.101.102.104/10", "fd7a:115c:a1e0::1/128"),
+				Routes:           mustCIDRs("100.100.100.100/32", "fd7a:115c:a1e0::/48"),
+				SubnetRoutes:     mustCIDRs("2001:db8::/32"),
+				SNATSubnetRoutes: true,
+				NetfilterMode:    NetfilterOn,
+			},
+			want: `
+up
+ip addr add 100.101.102.104/10 dev tailscale0
+ip addr add fd7a:115c:a1e0::1/128 dev tailscale0
+ip route add 100.100.100.100/32 dev tailscale0 table 52
+ip route add fd7a:115c:a1e0::/48 dev tailscale0 table 52` + basic +
+				`filter/FORWARD -j tailscale0-fwd
+filter/INPUT -j tailscale0-inp
+filter/tailscale0-fwd -i tailscale0 -j MARK --set-mark 0x40000
+filter/tailscale0-fwd -m mark --mark 0x40000 -j ACCEPT
+filter/tailscale0-fwd -o tailscale0 -s 100.64.0.0/10 -j DROP
+filter/tailscale0-fwd -o tailscale0 -j ACCEPT
+filter/tailscale0-inp -i lo -s 100.101.102.104 -j ACCEPT
+filter/tailscale0-inp ! -i tailscale0 -s 100.115.92.0/23 -j RETURN
+filter/tailscale0-inp ! -i tailscale0 -s 100.64.0.0/10 -j DROP
+nat/POSTROUTING -j tailscale0-prt
+nat/tailscale0-prt -m mark --mark 0x40000 -j MASQUERADE
+v6/filter/FORWARD -j tailscale0-fwd
+v6/filter/INPUT -j tailscale0-inp
+v6/filter/tailscale0-fwd -i tailscale0 -j MARK --set-mark 0x40000
+v6/filter/tailscale0-fwd -m mark --mark 0x40000 -j ACCEPT
+v6/filter/tailscale0-fwd -o tailscale0 -j ACCEPT
+v6/filter/tailscale0-inp -i lo -s fd7a:115c:a1e0::1 -j ACCEPT
+v6/nat/POSTROUTING -j tailscale0-prt
+v6/nat/tailscale0-prt -m mark --mark 0x40000 -j MASQUERADE
 `,
 		},
 	}
 
-	fake := NewFakeOS(t)
-	router, err := newUserspaceRouterAdvanced(t.Logf, "tailscale0", fake, fake)
+	router, err := newUserspaceRouterAdvanced(t.Logf, "tailscale0", fake.ipt4, fake.ipt6, fake.runner(), true, true, Options{})
 	if err != nil {
 		t.Fatalf("failed to create router: %v", err)
 	}
@@ -275,19 +342,211 @@ nat/POSTROUTING -j tailscale0-prt
 	}
 }
 
-// fakeOS implements netfilterRunner and commandRunner, but captures
-// changes without touching the OS.
+func TestRouterMultiInstance(t *testing.T) {
+	fake := NewFakeOS(t)
+	router, err := newUserspaceRouterAdvanced(t.Logf, "tailscale1", fake.ipt4, fake.ipt6, fake, true, true, Options{
+		SubnetRouteMark: 0x100000,
+		BypassMark:      0x200000,
+		MultiInstance:   true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+	if err := router.Up(); err != nil {
+		t.Fatalf("failed to up router: %v", err)
+	}
+	err = router.Set(&Config{
+		LocalAddrs:       mustCIDRs("100.101.102.104/10"),
+		Routes:           mustCIDRs("100.100.100.100/32"),
+		SNATSubnetRoutes: true,
+		NetfilterMode:    NetfilterOn,
+	})
+	if err != nil {
+		t.Fatalf("failed to set router config: %v", err)
+	}
+
+	// The routing table is derived from the interface name, and the
+	// CGNAT DROP rules are left out.
+	want := `
+up
+ip addr add 100.101.102.104/10 dev tailscale1
+ip route add 100.100.100.100/32 dev tailscale1 table 53
+ip rule add pref 5310 fwmark 0x200000 table main
+ip rule add pref 5330 fwmark 0x200000 table default
+ip rule add pref 5350 fwmark 0x200000 type unreachable
+ip rule add pref 5370 table 53
+ip -6 rule add pref 5310 fwmark 0x200000 table main
+ip -6 rule add pref 5330 fwmark 0x200000 table default
+ip -6 rule add pref 5350 fwmark 0x200000 type unreachable
+ip -6 rule add pref 5370 table 53
+filter/FORWARD -j tailscale1-fwd
+filter/INPUT -j tailscale1-inp
+filter/tailscale1-fwd -i tailscale1 -j MARK --set-mark 0x100000
+filter/tailscale1-fwd -m mark --mark 0x100000 -j ACCEPT
+filter/tailscale1-fwd -o tailscale1 -j ACCEPT
+filter/tailscale1-inp -i lo -s 100.101.102.104 -j ACCEPT
+filter/tailscale1-inp ! -i tailscale1 -s 100.115.92.0/23 -j RETURN
+nat/POSTROUTING -j tailscale1-prt
+nat/tailscale1-prt -m mark --mark 0x100000 -j MASQUERADE
+v6/filter/FORWARD -j tailscale1-fwd
+v6/filter/INPUT -j tailscale1-inp
+v6/filter/tailscale1-fwd -i tailscale1 -j MARK --set-mark 0x100000
+v6/filter/tailscale1-fwd -m mark --mark 0x100000 -j ACCEPT
+v6/filter/tailscale1-fwd -o tailscale1 -j ACCEPT
+v6/nat/POSTROUTING -j tailscale1-prt
+v6/nat/tailscale1-prt -m mark --mark 0x100000 -j MASQUERADE
+`
+	if diff := cmp.Diff(fake.String(), strings.TrimSpace(want)); diff != "" {
+		t.Fatalf("unexpected OS state (-got+want):\n%s", diff)
+	}
+}
+
+func TestRouterNoIPv6(t *testing.T) {
+	fake := NewFakeOS(t)
+	router, err := newUserspaceRouterAdvanced(t.Logf, "tailscale0", fake.ipt4, nil, fake, false, false, Options{})
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+	if err := router.Up(); err != nil {
+		t.Fatalf("failed to up router: %v", err)
+	}
+	cfg := &Config{
+		LocalAddrs:       mustCIDRs("100.101.102.104/10", "fd7a:115c:a1e0::1/128"),
+		Routes:           mustCIDRs("fd7a:115c:a1e0::/48"),
+		SNATSubnetRoutes: true,
+		NetfilterMode:    NetfilterOn,
+	}
+	if err := router.Set(cfg); err != nil {
+		t.Fatalf("failed to set router config: %v", err)
+	}
+
+	// The IPv6 address and route are ignored, and no IPv6 rules
+	// are added.
+	want := `
+up
+ip addr add 100.101.102.104/10 dev tailscale0
+ip rule add pref 5210 fwmark 0x80000 table main
+ip rule add pref 5230 fwmark 0x80000 table default
+ip rule add pref 5250 fwmark 0x80000 type unreachable
+ip rule add pref 5270 table 52
+filter/FORWARD -j tailscale0-fwd
+filter/INPUT -j tailscale0-inp
+filter/tailscale0-fwd -i tailscale0 -j MARK --set-mark 0x40000
+filter/tailscale0-fwd -m mark --mark 0x40000 -j ACCEPT
+filter/tailscale0-fwd -o tailscale0 -s 100.64.0.0/10 -j DROP
+filter/tailscale0-fwd -o tailscale0 -j ACCEPT
+filter/tailscale0-inp -i lo -s 100.101.102.104 -j ACCEPT
+filter/tailscale0-inp ! -i tailscale0 -s 100.115.92.0/23 -j RETURN
+filter/tailscale0-inp ! -i tailscale0 -s 100.64.0.0/10 -j DROP
+nat/POSTROUTING -j tailscale0-prt
+nat/tailscale0-prt -m mark --mark 0x40000 -j MASQUERADE
+`
+	if diff := cmp.Diff(fake.String(), strings.TrimSpace(want)); diff != "" {
+		t.Fatalf("unexpected OS state (-got+want):\n%s", diff)
+	}
+
+	if err := router.Set(nil); err != nil {
+		t.Fatalf("failed to set router config: %v", err)
+	}
+	if err := router.Close(); err != nil {
+		t.Fatalf("failed to close router: %v", err)
+	}
+}
+
+func TestRouterOptionsInvalid(t *testing.T) {
+	tests := []struct {
+		tunname string
+		opts    Options
+	}{
+		{"tailscale300", Options{}},
+		{"tailscale0", Options{RouteTable: 254}},
+		{"tailscale0", Options{SubnetRouteMark: 0x80000}},
+	}
+	for _, tt := range tests {
+		fake := NewFakeOS(t)
+		if _, err := newUserspaceRouterAdvanced(t.Logf, tt.tunname, fake.ipt4, fake.ipt6, fake, true, true, tt.opts); err == nil {
+			t.Errorf("newUserspaceRouterAdvanced(%q, %+v) succeeded; want error", tt.tunname, tt.opts)
+		}
+	}
+}
+
+func TestChooseNetfilterBackend(t *testing.T) {
+	tests := []struct {
+		version   string
+		nativeNFT bool
+		want      NetfilterBackend
+	}{
+		{"", false, NetfilterBackendNFTables},
+		{"iptables v1.8.4 (nf_tables)\n", false, NetfilterBackendIPTables},
+		{"iptables v1.8.4 (nf_tables)\n", true, NetfilterBackendIPTables},
+		{"iptables v1.8.4 (legacy)\n", false, NetfilterBackendIPTables},
+		{"iptables v1.8.4 (legacy)\n", true, NetfilterBackendNFTables},
+		{"iptables v1.6.1\n", true, NetfilterBackendIPTables},
+	}
+	for _, tt := range tests {
+		got := chooseNetfilterBackend(tt.version, func() bool { return tt.nativeNFT })
+		if got != tt.want {
+			t.Errorf("chooseNetfilterBackend(%q, %v) = %v; want %v", tt.version, tt.nativeNFT, got, tt.want)
+		}
+	}
+}
+
+func TestNFTTableName(t *testing.T) {
+	for tun, want := range map[string]string{
+		"tailscale0": "tailscale",
+		"tailscale1": "tailscale-tailscale1",
+	} {
+		if got := nftTableName(tun); got != want {
+			t.Errorf("nftTableName(%q) = %q; want %q", tun, got, want)
+		}
+	}
+}
+
+// fakeOS implements commandRunner, and holds a fake netfilterRunner
+// per IP family, but captures changes without touching the OS.
 type fakeOS struct {
-	t         *testing.T
-	up        bool
-	ips       []string
-	routes    []string
-	rules     []string
-	netfilter map[string][]string
+	t      *testing.T
+	up     bool
+	ips    []string
+	routes []string
+	rules  []string
+	rules6 []string
+	ipt4   fakeNetfilter
+	ipt6   fakeNetfilter
+	nl     *netlinkRunner // if non-nil, runs commands as netlink requests
+}
+
+// fakeNetfilter is a netfilterRunner that can print its rules.
+type fakeNetfilter interface {
+	netfilterRunner
+	writeTo(b *strings.Builder, prefix string)
 }
 
 func NewFakeOS(t *testing.T) *fakeOS {
 	return &fakeOS{
+		t:    t,
+		ipt4: newFakeIPTables(t),
+		ipt6: newFakeIPTables(t),
+	}
+}
+
+// newFakeNFTablesOS is like NewFakeOS, but with the nftables backend.
+func newFakeNFTablesOS(t *testing.T) *fakeOS {
+	return &fakeOS{
+		t:    t,
+		ipt4: newFakeNFTables(t, false),
+		ipt6: newFakeNFTables(t, true),
+	}
+}
+
+// fakeIPTables implements netfilterRunner for one IP family.
+type fakeIPTables struct {
+	t         *testing.T
+	netfilter map[string][]string
+}
+
+func newFakeIPTables(t *testing.T) *fakeIPTables {
+	return &fakeIPTables{
 		t: t,
 		netfilter: map[string][]string{
 			"filter/INPUT":    nil,
@@ -302,6 +561,14 @@ func NewFakeOS(t *testing.T) *fakeOS {
 
 var errExec = errors.New("execution failed")
 
+// runner returns the commandRunner for a router on o.
+func (o *fakeOS) runner() commandRunner {
+	if o.nl != nil {
+		return o.nl
+	}
+	return o
+}
+
 func (o *fakeOS) String() string {
 	var b strings.Builder
 	if o.up {
@@ -322,6 +589,18 @@ func (o *fakeOS) String() string {
 		fmt.Fprintf(&b, "ip rule add %s\n", rule)
 	}
 
+	for _, rule := range o.rules6 {
+		fmt.Fprintf(&b, "ip -6 rule add %s\n", rule)
+	}
+
+	o.ipt4.writeTo(&b, "")
+	o.ipt6.writeTo(&b, "v6/")
+	return b.String()[:len(b.String())-1]
+}
+
+// writeTo writes the rules of all chains to b, one per line, each
+// prefixed with prefix and the table/chain name.
+func (o *fakeIPTables) writeTo(b *strings.Builder, prefix string) {
 	var chains []string
 	for chain := range o.netfilter {
 		chains = append(chains, chain)
@@ -329,13 +608,12 @@ func (o *fakeOS) String() string {
 	sort.Strings(chains)
 	for _, chain := range chains {
 		for _, rule := range o.netfilter[chain] {
-			fmt.Fprintf(&b, "%s %s\n", chain, rule)
+			fmt.Fprintf(b, "%s%s %s\n", prefix, chain, rule)
 		}
 	}
-	return b.String()[:len(b.String())-1]
 }
 
-func (o *fakeOS) Insert(table, chain string, pos int, args ...string) error {
+func (o *fakeIPTables) Insert(table, chain string, pos int, args ...string) error {
 	k := table + "/" + chain
 	if rules, ok := o.netfilter[k]; ok {
 		if pos > len(rules)+1 {
@@ -353,12 +631,12 @@ func (o *fakeOS) Insert(table, chain string, pos int, args ...string) error {
 	return nil
 }
 
-func (o *fakeOS) Append(table, chain string, args ...string) error {
+func (o *fakeIPTables) Append(table, chain string, args ...string) error {
 	k := table + "/" + chain
 	return o.Insert(table, chain, len(o.netfilter[k])+1, args...)
 }
 
-func (o *fakeOS) Exists(table, chain string, args ...string) (bool, error) {
+func (o *fakeIPTables) Exists(table, chain string, args ...string) (bool, error) {
 	k := table + "/" + chain
 	if rules, ok := o.netfilter[k]; ok {
 		for _, rule := range rules {
@@ -373,7 +651,7 @@ func (o *fakeOS) Exists(table, chain string, args ...string) (bool, error) {
 	}
 }
 
-func (o *fakeOS) Delete(table, chain string, args ...string) error {
+func (o *fakeIPTables) Delete(table, chain string, args ...string) error {
 	k := table + "/" + chain
 	if rules, ok := o.netfilter[k]; ok {
 		for i, rule := range rules {
@@ -391,7 +669,7 @@ func (o *fakeOS) Delete(table, chain string, args ...string) error {
 	}
 }
 
-func (o *fakeOS) ListChains(table string) (ret []string, err error) {
+func (o *fakeIPTables) ListChains(table string) (ret []string, err error) {
 	for chain := range o.netfilter {
 		pfx := table + "/"
 		if strings.HasPrefix(chain, pfx) {
@@ -401,7 +679,7 @@ func (o *fakeOS) ListChains(table string) (ret []string, err error) {
 	return ret, nil
 }
 
-func (o *fakeOS) ClearChain(table, chain string) error {
+func (o *fakeIPTables) ClearChain(table, chain string) error {
 	k := table + "/" + chain
 	if _, ok := o.netfilter[k]; ok {
 		o.netfilter[k] = nil
@@ -412,7 +690,7 @@ func (o *fakeOS) ClearChain(table, chain string) error {
 	}
 }
 
-func (o *fakeOS) NewChain(table, chain string) error {
+func (o *fakeIPTables) NewChain(table, chain string) error {
 	k := table + "/" + chain
 	if _, ok := o.netfilter[k]; ok {
 		o.t.Errorf("table/chain %s already exists", k)
@@ -422,7 +700,7 @@ func (o *fakeOS) NewChain(table, chain string) error {
 	return nil
 }
 
-func (o *fakeOS) DeleteChain(table, chain string) error {
+func (o *fakeIPTables) DeleteChain(table, chain string) error {
 	k := table + "/" + chain
 	if rules, ok := o.netfilter[k]; ok {
 		if len(rules) != 0 {
@@ -445,17 +723,24 @@ func (o *fakeOS) run(args ...string) error {
 	if args[0] != "ip" {
 		return unexpected()
 	}
+	v6 := false
+	if args[1] == "-6" {
+		v6 = true
+		args = args[1:]
+	}
 
 	rest := strings.Join(args[3:], " ")
 
 	var l *[]string
 	switch args[1] {
 	case "link":
-		got := strings.Join(args[2:], " ")
-		switch got {
-		case "set dev tailscale0 up":
+		if len(args) != 6 || args[2] != "set" || args[3] != "dev" {
+			return unexpected()
+		}
+		switch args[5] {
+		case "up":
 			o.up = true
-		case "set dev tailscale0 down":
+		case "down":
 			o.up = false
 		default:
 			return unexpected()
@@ -467,6 +752,9 @@ func (o *fakeOS) run(args ...string) error {
 		l = &o.routes
 	case "rule":
 		l = &o.rules
+		if v6 {
+			l = &o.rules6
+		}
 	default:
 		return unexpected()
 	}
@@ -513,8 +801,14 @@ func (o *fakeOS) run(args ...string) error {
 }
 
 func (o *fakeOS) output(args ...string) ([]byte, error) {
-	want := "ip rule list priority 10000"
 	got := strings.Join(args, " ")
+	switch got {
+	case "ip rule":
+		return []byte(strings.Join(o.rules, "\n")), nil
+	case "ip -6 rule":
+		return []byte(strings.Join(o.rules6, "\n")), nil
+	}
+	want := "ip rule list priority 10000"
 	if got != want {
 		o.t.Errorf("unexpected command that wants output: %v", got)
 		return nil, errExec
@@ -24,7 +24,7 @@ type winRouter struct {
 	dns                 *dns.Manager
 }
 
-func newUserspaceRouter(logf logger.Logf, wgdev *device.Device, tundev tun.Device) (Router, error) {
+func newUserspaceRouter(logf logger.Logf, wgdev *device.Device, tundev tun.Device, _ Options) (Router, error) {
 	tunname, err := tundev.Name()
 	if err != nil {
 		return nil, err
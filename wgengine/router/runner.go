@@ -12,6 +12,8 @@ import (
 	"os/exec"
 	"strconv"
 	"strings"
+
+	"inet.af/netaddr"
 )
 
 // commandRunner abstracts helpers to run OS commands. It exists
@@ -22,6 +24,18 @@ type commandRunner interface {
 	output(...string) ([]byte, error)
 }
 
+// kernelStateReader is implemented by commandRunners that can read
+// back the addresses and routes that linuxRouter manages, so that it
+// can undo changes made behind its back, such as routes left over by
+// a tailscaled that crashed.
+type kernelStateReader interface {
+	// addrs returns the addresses of the interface dev.
+	addrs(dev string) ([]netaddr.IPPrefix, error)
+	// routes returns the routes through the interface dev in the
+	// given routing table, that were added with "ip route add".
+	routes(dev string, table int) ([]netaddr.IPPrefix, error)
+}
+
 type osCommandRunner struct{}
 
 func errCode(err error) int {
@@ -32,6 +46,10 @@ func errCode(err error) int {
 	if ok := errors.As(err, &e); ok {
 		return e.ExitCode()
 	}
+	var es interface{ ExitStatus() int }
+	if ok := errors.As(err, &es); ok {
+		return es.ExitStatus()
+	}
 	s := err.Error()
 	if strings.HasPrefix(s, "exitcode:") {
 		code, err := strconv.Atoi(s[9:])
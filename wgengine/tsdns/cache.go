@@ -0,0 +1,244 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"encoding/binary"
+	"expvar"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/groupcache/lru"
+	dns "golang.org/x/net/dns/dnsmessage"
+)
+
+// cacheSize is the maximum number of upstream responses a Resolver
+// caches.
+const cacheSize = 1024
+
+// maxCacheTTL caps how long a response is cached, whatever its TTLs.
+const maxCacheTTL = time.Hour
+
+var (
+	metricCacheHits   = new(expvar.Int)
+	metricCacheMisses = new(expvar.Int)
+)
+
+func init() {
+	expvar.Publish("counter_tsdns_cache_hits", metricCacheHits)
+	expvar.Publish("counter_tsdns_cache_misses", metricCacheMisses)
+}
+
+// cacheKey identifies the question that a cached response answers,
+// and the bits of the query that change what the upstream puts in
+// the response.
+type cacheKey struct {
+	name  string // lower case, in canonical form
+	typ   dns.Type
+	class dns.Class
+	edns  bool // the response has an OPT record only if the query did
+	do    bool // DNSSEC OK: the response has DNSSEC records
+	cd    bool // checking disabled: the response may fail validation
+}
+
+// newCacheKey returns the cache key of the query parsed into resp.
+func newCacheKey(resp *response) cacheKey {
+	return cacheKey{
+		name:  strings.ToLower(resp.Question.Name.String()),
+		typ:   resp.Question.Type,
+		class: resp.Question.Class,
+		edns:  resp.EDNS,
+		do:    resp.DNSSECOK,
+		cd:    resp.CheckingDisabled,
+	}
+}
+
+type cacheEntry struct {
+	msg     []byte // the response as received, but for its ID
+	ttlOffs []int  // offsets in msg of the TTLs of its records
+	added   time.Time
+	expires time.Time
+}
+
+// responseCache is a size-limited cache of upstream responses, which
+// it keeps for as long as their TTLs allow. It caches negative
+// responses too, as described by RFC 2308.
+type responseCache struct {
+	mu  sync.Mutex
+	lru *lru.Cache // of cacheKey to *cacheEntry
+}
+
+func newResponseCache(size int) *responseCache {
+	return &responseCache{lru: lru.New(size)}
+}
+
+// get returns the response cached for k with its ID set to id and its
+// TTLs lowered by the time it's been cached. It reports false if there
+// is no unexpired response for k.
+func (c *responseCache) get(k cacheKey, id uint16, now time.Time) ([]byte, bool) {
+	c.mu.Lock()
+	v, ok := c.lru.Get(k)
+	if ok && !now.Before(v.(*cacheEntry).expires) {
+		c.lru.Remove(k)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	e := v.(*cacheEntry)
+	out := append([]byte(nil), e.msg...)
+	binary.BigEndian.PutUint16(out, id)
+	age := uint32(now.Sub(e.added) / time.Second)
+	for _, off := range e.ttlOffs {
+		ttl := binary.BigEndian.Uint32(out[off:])
+		if ttl > age {
+			ttl -= age
+		} else {
+			ttl = 0
+		}
+		binary.BigEndian.PutUint32(out[off:], ttl)
+	}
+	return out, true
+}
+
+// put caches the response msg to the question k, if it may be cached.
+// It takes ownership of msg.
+func (c *responseCache) put(k cacheKey, msg []byte, now time.Time) {
+	ttl, ttlOffs, ok := cacheTTL(msg)
+	if !ok || ttl <= 0 {
+		return
+	}
+	if ttl > maxCacheTTL {
+		ttl = maxCacheTTL
+	}
+	e := &cacheEntry{
+		msg:     msg,
+		ttlOffs: ttlOffs,
+		added:   now,
+		expires: now.Add(ttl),
+	}
+	c.mu.Lock()
+	c.lru.Add(k, e)
+	c.mu.Unlock()
+}
+
+// flush removes all cached responses.
+func (c *responseCache) flush() {
+	c.mu.Lock()
+	c.lru.Clear()
+	c.mu.Unlock()
+}
+
+// len returns the number of cached responses.
+func (c *responseCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// dnsHeaderLen is the length of a DNS message header.
+const dnsHeaderLen = 12
+
+// Flag bits of the DNS header.
+const (
+	headerBitTC = 1 << 9 // truncated
+	headerBitCD = 1 << 4 // checking disabled
+)
+
+// cacheTTL returns how long the response msg may be cached and the
+// offsets in msg of the TTLs of its records, other than OPT.
+//
+// A positive response may be cached for the lowest TTL of its
+// answers. A negative one, NXDOMAIN or no answers, may be cached for
+// the lower of the TTL and the minimum field of the SOA record in its
+// authority section; without one it's not cached. Truncated
+// responses and errors aren't cached either; ok is false for those
+// and for malformed messages.
+func cacheTTL(msg []byte) (ttl time.Duration, ttlOffs []int, ok bool) {
+	if len(msg) < dnsHeaderLen {
+		return 0, nil, false
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&headerBitTC != 0 {
+		return 0, nil, false
+	}
+	rcode := dns.RCode(flags & 0xf)
+	if rcode != dns.RCodeSuccess && rcode != dns.RCodeNameError {
+		return 0, nil, false
+	}
+	qdCount := int(binary.BigEndian.Uint16(msg[4:]))
+	anCount := int(binary.BigEndian.Uint16(msg[6:]))
+	nsCount := int(binary.BigEndian.Uint16(msg[8:]))
+	arCount := int(binary.BigEndian.Uint16(msg[10:]))
+	negative := rcode == dns.RCodeNameError || anCount == 0
+
+	off := dnsHeaderLen
+	for i := 0; i < qdCount; i++ {
+		if off, ok = skipName(msg, off); !ok {
+			return 0, nil, false
+		}
+		off += 4 // type and class
+	}
+
+	min := uint32(math.MaxUint32)
+	found := false
+	for i := 0; i < anCount+nsCount+arCount; i++ {
+		if off, ok = skipName(msg, off); !ok || off+10 > len(msg) {
+			return 0, nil, false
+		}
+		typ := dns.Type(binary.BigEndian.Uint16(msg[off:]))
+		rrTTL := binary.BigEndian.Uint32(msg[off+4:])
+		end := off + 10 + int(binary.BigEndian.Uint16(msg[off+8:]))
+		if end > len(msg) {
+			return 0, nil, false
+		}
+		if typ != dns.TypeOPT {
+			ttlOffs = append(ttlOffs, off+4)
+		}
+		switch {
+		case i < anCount && !negative:
+			if rrTTL < min {
+				min = rrTTL
+			}
+			found = true
+		case i >= anCount && i < anCount+nsCount && negative && typ == dns.TypeSOA && end-off >= 14:
+			if soaMin := binary.BigEndian.Uint32(msg[end-4:]); soaMin < rrTTL {
+				rrTTL = soaMin
+			}
+			if rrTTL < min {
+				min = rrTTL
+			}
+			found = true
+		}
+		off = end
+	}
+	if !found {
+		return 0, nil, false
+	}
+	return time.Duration(min) * time.Second, ttlOffs, true
+}
+
+// skipName returns the offset in msg just past the name at off.
+func skipName(msg []byte, off int) (int, bool) {
+	for off < len(msg) {
+		n := int(msg[off])
+		switch n & 0xC0 {
+		case 0x00:
+			if n == 0 {
+				return off + 1, true
+			}
+			off += 1 + n
+		case 0xC0: // compression pointer; the name ends there
+			return off + 2, off+2 <= len(msg)
+		default:
+			return 0, false
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,185 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+)
+
+// testResponse returns a response to an A query for name with an
+// answer of each TTL in answerTTLs. If soaTTL is nonzero, the
+// authority section holds an SOA record with that TTL and a minimum
+// of soaMin.
+func testResponse(t *testing.T, name string, rcode dns.RCode, answerTTLs []uint32, soaTTL, soaMin uint32) []byte {
+	t.Helper()
+	b := dns.NewBuilder(nil, dns.Header{ID: 1, Response: true, RCode: rcode})
+	b.EnableCompression()
+	q := dns.Question{Name: dns.MustNewName(name), Type: dns.TypeA, Class: dns.ClassINET}
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAnswers()
+	for i, ttl := range answerTTLs {
+		hdr := dns.ResourceHeader{Name: q.Name, Type: dns.TypeA, Class: dns.ClassINET, TTL: ttl}
+		if err := b.AResource(hdr, dns.AResource{A: [4]byte{10, 0, 0, byte(i)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.StartAuthorities()
+	if soaTTL != 0 {
+		hdr := dns.ResourceHeader{Name: dns.MustNewName("example.com."), Type: dns.TypeSOA, Class: dns.ClassINET, TTL: soaTTL}
+		soa := dns.SOAResource{
+			NS:     dns.MustNewName("ns.example.com."),
+			MBox:   dns.MustNewName("hostmaster.example.com."),
+			MinTTL: soaMin,
+		}
+		if err := b.SOAResource(hdr, soa); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.StartAdditionals()
+	if err := b.OPTResource(dns.ResourceHeader{Name: dns.MustNewName("."), Type: dns.TypeOPT, Class: 4096}, dns.OPTResource{}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestCacheTTL(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     []byte
+		wantTTL time.Duration
+		wantOK  bool
+	}{
+		{"positive", testResponse(t, "a.example.com.", dns.RCodeSuccess, []uint32{300, 60}, 0, 0), 60 * time.Second, true},
+		{"nxdomain", testResponse(t, "b.example.com.", dns.RCodeNameError, nil, 900, 120), 120 * time.Second, true},
+		{"nodata", testResponse(t, "c.example.com.", dns.RCodeSuccess, nil, 30, 120), 30 * time.Second, true},
+		{"negative_without_soa", testResponse(t, "d.example.com.", dns.RCodeNameError, nil, 0, 0), 0, false},
+		{"servfail", testResponse(t, "e.example.com.", dns.RCodeServerFailure, []uint32{300}, 0, 0), 0, false},
+		{"truncated", func() []byte {
+			msg := testResponse(t, "f.example.com.", dns.RCodeSuccess, []uint32{300}, 0, 0)
+			msg[2] |= headerBitTC >> 8
+			return msg
+		}(), 0, false},
+		{"short", []byte{0, 1, 2}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ttl, _, ok := cacheTTL(tt.msg)
+			if ok != tt.wantOK || ttl != tt.wantTTL {
+				t.Errorf("cacheTTL = %v, %v; want %v, %v", ttl, ok, tt.wantTTL, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	c := newResponseCache(2)
+	now := time.Unix(1000, 0)
+	key := func(name string) cacheKey {
+		return cacheKey{name: name, typ: dns.TypeA, class: dns.ClassINET}
+	}
+
+	msg := testResponse(t, "a.example.com.", dns.RCodeSuccess, []uint32{60, 300}, 0, 0)
+	c.put(key("a.example.com."), msg, now)
+
+	out, ok := c.get(key("a.example.com."), 0x4242, now.Add(20*time.Second))
+	if !ok {
+		t.Fatal("cached response not found")
+	}
+	var p dns.Parser
+	h, err := p.Start(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.ID != 0x4242 {
+		t.Errorf("ID = %#x; want 0x4242", h.ID)
+	}
+	p.SkipAllQuestions()
+	answers, err := p.AllAnswers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answers) != 2 || answers[0].Header.TTL != 40 || answers[1].Header.TTL != 280 {
+		t.Errorf("answers = %+v; want TTLs 40 and 280", answers)
+	}
+	if _, ok := c.get(key("a.example.com."), 0, now.Add(60*time.Second)); ok {
+		t.Error("response found after its TTL")
+	}
+
+	// Uncacheable responses are not kept.
+	c.put(key("b.example.com."), testResponse(t, "b.example.com.", dns.RCodeServerFailure, nil, 0, 0), now)
+	if _, ok := c.get(key("b.example.com."), 0, now); ok {
+		t.Error("SERVFAIL response was cached")
+	}
+
+	// The least recently used response is evicted.
+	for _, name := range []string{"c.example.com.", "d.example.com.", "e.example.com."} {
+		c.put(key(name), testResponse(t, name, dns.RCodeSuccess, []uint32{60}, 0, 0), now)
+	}
+	if n := c.len(); n != 2 {
+		t.Errorf("len = %d; want 2", n)
+	}
+	if _, ok := c.get(key("c.example.com."), 0, now); ok {
+		t.Error("least recently used response not evicted")
+	}
+
+	c.flush()
+	if n := c.len(); n != 0 {
+		t.Errorf("len after flush = %d; want 0", n)
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	withFlags := func(query []byte, ttl uint32, cd bool) []byte {
+		// The OPT record's TTL holds the DO bit. The OPT record
+		// is last and has no data, so its TTL is followed only by
+		// the 2-byte data length.
+		if ttl != 0 {
+			binary.BigEndian.PutUint32(query[len(query)-6:], ttl)
+		}
+		if cd {
+			query[3] |= headerBitCD
+		}
+		return query
+	}
+	const doBit = 1 << 15
+	queries := map[string][]byte{
+		"plain": dnspacket("example.com.", dns.TypeA),
+		"edns":  ednspacket("example.com.", dns.TypeA, 4096),
+		"do":    withFlags(ednspacket("example.com.", dns.TypeA, 4096), doBit, false),
+		"cd":    withFlags(dnspacket("example.com.", dns.TypeA), 0, true),
+		"do_cd": withFlags(ednspacket("example.com.", dns.TypeA, 4096), doBit, true),
+		"aaaa":  ednspacket("example.com.", dns.TypeAAAA, 4096),
+	}
+	keys := map[cacheKey]string{}
+	var r Resolver
+	for name, query := range queries {
+		var resp response
+		if err := r.parseQuery(query, &resp); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		k := newCacheKey(&resp)
+		if other, ok := keys[k]; ok {
+			t.Errorf("%s and %s have the same cache key %+v", name, other, k)
+		}
+		keys[k] = name
+	}
+
+	// The name's case and the advertised UDP size don't matter.
+	var a, b response
+	r.parseQuery(ednspacket("Example.COM.", dns.TypeA, 1232), &a)
+	r.parseQuery(ednspacket("example.com.", dns.TypeA, 4096), &b)
+	if newCacheKey(&a) != newCacheKey(&b) {
+		t.Errorf("cache keys %+v and %+v differ", newCacheKey(&a), newCacheKey(&b))
+	}
+}
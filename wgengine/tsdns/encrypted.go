@@ -0,0 +1,264 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"tailscale.com/net/dnscache"
+	"tailscale.com/net/tlsdial"
+)
+
+// Encrypted upstream nameservers are given as URLs instead of ip:port:
+// https://host[:port]/path for DNS over HTTPS (RFC 8484), and
+// tls://host[:port] for DNS over TLS (RFC 7858). Their host names are
+// resolved with dnscache, which uses the system resolver, so it's best
+// to use their IPs, or names that resolve without MagicDNS.
+const (
+	dohPrefix = "https://"
+	dotPrefix = "tls://"
+)
+
+// dotPort is the default port of DNS-over-TLS servers.
+const dotPort = "853"
+
+// dohMediaType is the content type of DNS-over-HTTPS requests and responses.
+const dohMediaType = "application/dns-message"
+
+// maxIdleDoTConns is the maximum number of idle connections
+// kept open to each DNS-over-TLS server.
+const maxIdleDoTConns = 2
+
+// ParseUpstream checks the upstream nameserver s and returns it in the
+// form that Resolver.SetRoutes expects: an https:// or tls:// URL, or
+// an IP with an optional port, which defaults to 53, as ip:port.
+func ParseUpstream(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, dohPrefix):
+		u, err := url.Parse(s)
+		if err != nil {
+			return "", err
+		}
+		if u.Host == "" {
+			return "", fmt.Errorf("DNS-over-HTTPS URL %q has no host", s)
+		}
+		return s, nil
+	case strings.HasPrefix(s, dotPrefix):
+		if _, _, err := splitDoT(s); err != nil {
+			return "", err
+		}
+		return s, nil
+	}
+	return parseNameserver(s)
+}
+
+// splitDoT returns the host and host:port of server, a tls:// URL.
+func splitDoT(server string) (host, hostport string, err error) {
+	hostport = strings.TrimPrefix(server, dotPrefix)
+	if strings.ContainsAny(hostport, "/?#") {
+		return "", "", fmt.Errorf("DNS-over-TLS URL %q has more than a host and port", server)
+	}
+	host, _, err = net.SplitHostPort(hostport)
+	if err != nil {
+		// No port; use the default.
+		host = strings.TrimSuffix(strings.TrimPrefix(hostport, "["), "]")
+		hostport = net.JoinHostPort(host, dotPort)
+	}
+	if host == "" {
+		return "", "", fmt.Errorf("DNS-over-TLS URL %q has no host", server)
+	}
+	return host, hostport, nil
+}
+
+// dialUpstream connects to addr, a host:port, through the resolver's
+// netns dialer, after resolving the host with dnscache.
+func (r *Resolver) dialUpstream(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := dnscache.Get().LookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return r.dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+}
+
+// dohClient returns the HTTP client used for DNS-over-HTTPS queries,
+// which keeps connections to the servers open for reuse.
+func (r *Resolver) dohClient() *http.Client {
+	r.encMu.Lock()
+	defer r.encMu.Unlock()
+	if r.doh == nil {
+		r.doh = &http.Client{
+			Transport: &http.Transport{
+				DialContext:         r.dialUpstream,
+				TLSClientConfig:     r.tlsConfig,
+				ForceAttemptHTTP2:   true,
+				TLSHandshakeTimeout: delegateTimeout,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		}
+	}
+	return r.doh
+}
+
+// queryDoH obtains a DNS response by querying server, an https:// URL.
+func (r *Resolver) queryDoH(ctx context.Context, server string, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", server, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dohMediaType)
+	req.Header.Set("Accept", dohMediaType)
+
+	res, err := r.dohClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %s", res.Status)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != dohMediaType {
+		return nil, fmt.Errorf("unexpected Content-Type %q", ct)
+	}
+	out, err := ioutil.ReadAll(io.LimitReader(res.Body, maxTCPSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > maxTCPSize {
+		return nil, errors.New("response too large")
+	}
+	return out, nil
+}
+
+// queryDoT obtains a DNS response by querying server, a tls:// URL,
+// on an idle connection to it if there is one.
+func (r *Resolver) queryDoT(ctx context.Context, server string, query []byte) ([]byte, error) {
+	if len(query) > maxTCPSize {
+		return nil, errQueryTooLarge
+	}
+	if conn := r.getDoTConn(server); conn != nil {
+		out, err := r.exchangeDoT(ctx, server, conn, query)
+		if err == nil || ctx.Err() != nil {
+			return out, err
+		}
+		// The server may have closed the idle connection; try a new one.
+	}
+	conn, err := r.dialDoT(ctx, server)
+	if err != nil {
+		return nil, err
+	}
+	return r.exchangeDoT(ctx, server, conn, query)
+}
+
+// dialDoT opens a connection to server, a tls:// URL.
+func (r *Resolver) dialDoT(ctx context.Context, server string) (*tls.Conn, error) {
+	host, hostport, err := splitDoT(server)
+	if err != nil {
+		return nil, err
+	}
+	c, err := r.dialUpstream(ctx, "tcp", hostport)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(c, tlsdial.Config(host, r.tlsConfig))
+	if d, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(d)
+	}
+	if err := conn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// exchangeDoT sends query on conn, a connection to server, and reads
+// the response. It keeps conn for reuse if the exchange went through
+// uninterrupted, and closes it otherwise.
+func (r *Resolver) exchangeDoT(ctx context.Context, server string, conn *tls.Conn, query []byte) ([]byte, error) {
+	if d, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(d)
+	}
+	// Interrupt the exchange when the context is cancelled,
+	// and tell whether that happened.
+	stop := make(chan struct{})
+	interrupted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+			interrupted <- true
+		case <-stop:
+			interrupted <- false
+		}
+	}()
+
+	out, err := exchangeTCP(conn, query)
+	close(stop)
+	if <-interrupted || err != nil {
+		conn.Close()
+		return out, err
+	}
+	conn.SetDeadline(time.Time{})
+	r.putDoTConn(server, conn)
+	return out, nil
+}
+
+func (r *Resolver) getDoTConn(server string) *tls.Conn {
+	r.encMu.Lock()
+	defer r.encMu.Unlock()
+	conns := r.dotIdle[server]
+	if len(conns) == 0 {
+		return nil
+	}
+	conn := conns[len(conns)-1]
+	r.dotIdle[server] = conns[:len(conns)-1]
+	return conn
+}
+
+func (r *Resolver) putDoTConn(server string, conn *tls.Conn) {
+	r.encMu.Lock()
+	defer r.encMu.Unlock()
+	if len(r.dotIdle[server]) >= maxIdleDoTConns {
+		conn.Close()
+		return
+	}
+	if r.dotIdle == nil {
+		r.dotIdle = make(map[string][]*tls.Conn)
+	}
+	r.dotIdle[server] = append(r.dotIdle[server], conn)
+}
+
+// closeIdleUpstreams closes the idle connections to encrypted
+// upstream nameservers, except those to the servers in keep.
+func (r *Resolver) closeIdleUpstreams(keep map[string]bool) {
+	r.encMu.Lock()
+	defer r.encMu.Unlock()
+	for server, conns := range r.dotIdle {
+		if keep[server] {
+			continue
+		}
+		for _, conn := range conns {
+			conn.Close()
+		}
+		delete(r.dotIdle, server)
+	}
+	if r.doh != nil && len(keep) == 0 {
+		r.doh.CloseIdleConnections()
+	}
+}
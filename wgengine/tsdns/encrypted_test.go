@@ -0,0 +1,234 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+)
+
+func TestParseUpstream(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "1.1.1.1", want: "1.1.1.1:53"},
+		{in: "https://dns.example.com/dns-query", want: "https://dns.example.com/dns-query"},
+		{in: "https://1.1.1.1:8443/dns-query", want: "https://1.1.1.1:8443/dns-query"},
+		{in: "tls://dns.example.com", want: "tls://dns.example.com"},
+		{in: "tls://[2606:4700::1111]:853", want: "tls://[2606:4700::1111]:853"},
+		{in: "https:///dns-query", wantErr: true},
+		{in: "tls://", wantErr: true},
+		{in: "tls://dns.example.com/dns-query", wantErr: true},
+		{in: "dns.example.com", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseUpstream(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseUpstream(%q) error = %v; want error: %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseUpstream(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+
+	for _, tt := range []struct{ in, host, hostport string }{
+		{"tls://dns.example.com", "dns.example.com", "dns.example.com:853"},
+		{"tls://1.1.1.1:8853", "1.1.1.1", "1.1.1.1:8853"},
+		{"tls://[2606:4700::1111]", "2606:4700::1111", "[2606:4700::1111]:853"},
+	} {
+		host, hostport, err := splitDoT(tt.in)
+		if err != nil || host != tt.host || hostport != tt.hostport {
+			t.Errorf("splitDoT(%q) = %q, %q, %v; want %q, %q", tt.in, host, hostport, err, tt.host, tt.hostport)
+		}
+	}
+}
+
+// testTLSConfig returns a client TLS configuration that trusts the
+// certificate of the test server ts.
+func testTLSConfig(ts *httptest.Server) *tls.Config {
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	return &tls.Config{RootCAs: roots}
+}
+
+// queryA sends an A query for name through r and checks that the answer is ip.
+func queryA(t *testing.T, r *Resolver, name string, ip [4]byte) {
+	t.Helper()
+	resp, err := syncRespond(r, dnspacket(name, dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, code, err := extractipcode(resp)
+	if err != nil || code != dns.RCodeSuccess {
+		t.Fatalf("%s: code = %v, err = %v", name, code, err)
+	}
+	if got.As4() != ip {
+		t.Errorf("%s: ip = %v; want %v", name, got, ip)
+	}
+}
+
+func TestDelegateDoH(t *testing.T) {
+	upstream := &testUpstream{ip: [4]byte{1, 2, 3, 4}}
+	var conns, queries int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" || req.URL.Path != "/dns-query" || req.Header.Get("Content-Type") != dohMediaType {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		query, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(&queries, 1)
+		w.Header().Set("Content-Type", dohMediaType)
+		w.Write(upstream.answer(query, false))
+	}))
+	ts.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	r := NewResolver(t.Logf, "ipn.dev.")
+	r.tlsConfig = testTLSConfig(ts)
+	r.SetRoutes(map[string][]string{".": {ts.URL + "/dns-query"}})
+	r.Start()
+	defer r.Close()
+
+	queryA(t, r, "a.example.com.", upstream.ip)
+	queryA(t, r, "b.example.com.", upstream.ip)
+	if n := atomic.LoadInt32(&queries); n != 2 {
+		t.Errorf("server got %d queries; want 2", n)
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("server got %d connections; want 1", n)
+	}
+
+	// Errors from the server are failures of the upstream.
+	r.SetRoutes(map[string][]string{".": {ts.URL + "/other"}})
+	if _, err := syncRespond(r, dnspacket("c.example.com.", dns.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+	if got := metricUpstreamFailures.Get(ts.URL + "/other").Value(); got != 1 {
+		t.Errorf("failures = %d; want 1", got)
+	}
+}
+
+// testDoTServer is a DNS-over-TLS server answering like upstream.
+type testDoTServer struct {
+	upstream *testUpstream
+	ln       net.Listener
+	accepts  int32 // atomic
+	queries  int32 // atomic
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func (s *testDoTServer) serve() {
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(&s.accepts, 1)
+		s.mu.Lock()
+		s.conns = append(s.conns, c)
+		s.mu.Unlock()
+		go func() {
+			defer c.Close()
+			for {
+				var length [2]byte
+				if _, err := io.ReadFull(c, length[:]); err != nil {
+					return
+				}
+				query := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(c, query); err != nil {
+					return
+				}
+				atomic.AddInt32(&s.queries, 1)
+				resp := s.upstream.answer(query, false)
+				binary.BigEndian.PutUint16(length[:], uint16(len(resp)))
+				if _, err := c.Write(append(length[:], resp...)); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// closeConns closes the connections the server has accepted,
+// as a server does with idle ones.
+func (s *testDoTServer) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.conns = nil
+}
+
+func TestDelegateDoT(t *testing.T) {
+	// Borrow the certificate of an httptest server.
+	ts := httptest.NewUnstartedServer(nil)
+	ts.StartTLS()
+	defer ts.Close()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: ts.TLS.Certificates})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := &testDoTServer{upstream: &testUpstream{ip: [4]byte{1, 2, 3, 4}}, ln: ln}
+	go s.serve()
+
+	r := NewResolver(t.Logf, "ipn.dev.")
+	r.tlsConfig = testTLSConfig(ts)
+	server := "tls://" + ln.Addr().String()
+	r.SetRoutes(map[string][]string{".": {server}})
+	r.Start()
+	defer r.Close()
+
+	queryA(t, r, "a.example.com.", s.upstream.ip)
+	queryA(t, r, "b.example.com.", s.upstream.ip)
+	if n := atomic.LoadInt32(&s.queries); n != 2 {
+		t.Errorf("server got %d queries; want 2", n)
+	}
+	if n := atomic.LoadInt32(&s.accepts); n != 1 {
+		t.Errorf("server accepted %d connections; want 1", n)
+	}
+
+	// When the server closes the idle connection, a new one is made.
+	s.closeConns()
+	queryA(t, r, "c.example.com.", s.upstream.ip)
+	if n := atomic.LoadInt32(&s.accepts); n != 2 {
+		t.Errorf("server accepted %d connections; want 2", n)
+	}
+
+	// Idle connections to servers no longer in use are closed.
+	r.SetRoutes(nil)
+	r.encMu.Lock()
+	idle := len(r.dotIdle[server])
+	r.encMu.Unlock()
+	if idle != 0 {
+		t.Errorf("%d idle connections after SetRoutes; want 0", idle)
+	}
+}
@@ -9,75 +9,233 @@ import (
 	"sort"
 	"strings"
 
+	dns "golang.org/x/net/dns/dnsmessage"
 	"inet.af/netaddr"
 )
 
+// Record is the DNS data of a name in a Map.
+type Record struct {
+	// IPs are the IPv4 and IPv6 addresses of the name.
+	IPs []netaddr.IP
+	// CNAME, if non-empty, makes the name an alias of the canonical
+	// name CNAME. An alias has no other data (RFC 1034, section 3.6.2),
+	// so the other fields are ignored.
+	CNAME string
+	// SRV are the services at the name, which is then of the form
+	// _service._proto.domain (RFC 2782).
+	SRV []SRV
+	// TXT are the text records of the name.
+	TXT []string
+}
+
+// SRV is the data of a DNS SRV record.
+type SRV struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   string
+}
+
+// has reports whether rec holds data of type typ.
+func (rec *Record) has(typ dns.Type) bool {
+	switch typ {
+	case dns.TypeA, dns.TypeAAAA:
+		for _, ip := range rec.IPs {
+			if ip.Is4() == (typ == dns.TypeA) {
+				return true
+			}
+		}
+	case dns.TypeCNAME:
+		return rec.CNAME != ""
+	case dns.TypeSRV:
+		return len(rec.SRV) > 0
+	case dns.TypeTXT:
+		return len(rec.TXT) > 0
+	case dns.TypeALL:
+		return len(rec.IPs) > 0 || rec.CNAME != "" || len(rec.SRV) > 0 || len(rec.TXT) > 0
+	}
+	return false
+}
+
 // Map is all the data Resolver needs to resolve DNS queries within the Tailscale network.
 type Map struct {
-	// nameToIP is a mapping of Tailscale domain names to their IP addresses.
-	// For example, monitoring.tailscale.us -> 100.64.0.1.
-	nameToIP map[string]netaddr.IP
-	// ipToName is the inverse of nameToIP.
+	// records is a mapping of Tailscale domain names in canonical form
+	// to their records.
+	// For example, monitoring.tailscale.us. -> {IPs: [100.64.0.1]}.
+	records map[string]*Record
+	// ipToName maps the addresses in records to their names.
+	// An address of several names maps to the first of them in sorted order.
 	ipToName map[netaddr.IP]string
-	// names are the keys of nameToIP in sorted order.
+	// parents holds the ancestors of the names in records, which exist
+	// even without records of their own (RFC 8020).
+	parents map[string]bool
+	// names are the keys of records in sorted order.
 	names []string
 }
 
 // NewMap returns a new Map with name to address mapping given by nameToIP.
 func NewMap(initNameToIP map[string]netaddr.IP) *Map {
-	// TODO(dmytro): we have to allocate names and ipToName, but nameToIP can be avoided.
+	records := make(map[string]Record, len(initNameToIP))
+	for name, ip := range initNameToIP {
+		records[name] = Record{IPs: []netaddr.IP{ip}}
+	}
+	return NewRecordMap(records)
+}
+
+// NewRecordMap returns a new Map with the records given by initRecords,
+// keyed by name.
+func NewRecordMap(initRecords map[string]Record) *Map {
+	// TODO(dmytro): we have to allocate names and ipToName, but records can be avoided.
 	// It is here because control sends us names not in canonical form. Change this.
-	names := make([]string, 0, len(initNameToIP))
-	nameToIP := make(map[string]netaddr.IP, len(initNameToIP))
-	ipToName := make(map[netaddr.IP]string, len(initNameToIP))
+	names := make([]string, 0, len(initRecords))
+	records := make(map[string]*Record, len(initRecords))
+	ipToName := make(map[netaddr.IP]string, len(initRecords))
+	parents := make(map[string]bool)
 
-	for name, ip := range initNameToIP {
+	for name, rec := range initRecords {
 		if len(name) == 0 {
 			// Nothing useful can be done with empty names.
 			continue
 		}
-		if name[len(name)-1] != '.' {
-			name += "."
+		name = canonicalName(name)
+		rec := rec
+		if rec.CNAME != "" {
+			rec = Record{CNAME: canonicalName(rec.CNAME)}
+		}
+		rec.SRV = append([]SRV(nil), rec.SRV...)
+		for i := range rec.SRV {
+			rec.SRV[i].Target = canonicalName(rec.SRV[i].Target)
 		}
 		names = append(names, name)
-		nameToIP[name] = ip
-		ipToName[ip] = name
+		records[name] = &rec
 	}
 	sort.Strings(names)
 
+	for _, name := range names {
+		for _, ip := range records[name].IPs {
+			if _, ok := ipToName[ip]; !ok {
+				ipToName[ip] = name
+			}
+		}
+		for parent := name; ; {
+			i := strings.IndexByte(parent, '.')
+			if i < 0 || i == len(parent)-1 {
+				break
+			}
+			parent = parent[i+1:]
+			parents[parent] = true
+		}
+	}
+
 	return &Map{
-		nameToIP: nameToIP,
+		records:  records,
 		ipToName: ipToName,
+		parents:  parents,
 		names:    names,
 	}
 }
 
+// canonicalName returns name in lower case with a trailing period.
+func canonicalName(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
+
+// lookup returns the records of name, a domain name with a trailing
+// period, and whether name exists at all, with or without records.
+func (m *Map) lookup(name []byte) (rec *Record, exists bool) {
+	if rec, ok := m.records[string(name)]; ok {
+		return rec, true
+	}
+	if m.parents[string(name)] {
+		return nil, true
+	}
+	for _, c := range name {
+		if 'A' <= c && c <= 'Z' {
+			lower := strings.ToLower(string(name))
+			return m.records[lower], m.records[lower] != nil || m.parents[lower]
+		}
+	}
+	return nil, false
+}
+
 func printSingleNameIP(buf *strings.Builder, name string, ip netaddr.IP) {
 	// Output width is exactly 80 columns.
 	fmt.Fprintf(buf, "%s\t%s\n", name, ip)
 }
 
+// printRecord prints the records of name, one per line,
+// each preceded by prefix if it's not zero.
+func printRecord(buf *strings.Builder, prefix byte, name string, rec *Record) {
+	line := func() {
+		if prefix != 0 {
+			buf.WriteByte(prefix)
+		}
+	}
+	for _, ip := range rec.IPs {
+		line()
+		printSingleNameIP(buf, name, ip)
+	}
+	if rec.CNAME != "" {
+		line()
+		fmt.Fprintf(buf, "%s\tCNAME %s\n", name, rec.CNAME)
+	}
+	for _, srv := range rec.SRV {
+		line()
+		fmt.Fprintf(buf, "%s\tSRV %d %d %d %s\n", name, srv.Priority, srv.Weight, srv.Port, srv.Target)
+	}
+	for _, txt := range rec.TXT {
+		line()
+		fmt.Fprintf(buf, "%s\tTXT %q\n", name, txt)
+	}
+}
+
+func recordsEqual(a, b *Record) bool {
+	if len(a.IPs) != len(b.IPs) || a.CNAME != b.CNAME || len(a.SRV) != len(b.SRV) || len(a.TXT) != len(b.TXT) {
+		return false
+	}
+	for i := range a.IPs {
+		if a.IPs[i] != b.IPs[i] {
+			return false
+		}
+	}
+	for i := range a.SRV {
+		if a.SRV[i] != b.SRV[i] {
+			return false
+		}
+	}
+	for i := range a.TXT {
+		if a.TXT[i] != b.TXT[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func (m *Map) Pretty() string {
 	buf := new(strings.Builder)
 	for _, name := range m.names {
-		printSingleNameIP(buf, name, m.nameToIP[name])
+		printRecord(buf, 0, name, m.records[name])
 	}
 	return buf.String()
 }
 
 func (m *Map) PrettyDiffFrom(old *Map) string {
 	var (
-		oldNameToIP map[string]netaddr.IP
-		newNameToIP map[string]netaddr.IP
-		oldNames    []string
-		newNames    []string
+		oldRecords map[string]*Record
+		newRecords map[string]*Record
+		oldNames   []string
+		newNames   []string
 	)
 	if old != nil {
-		oldNameToIP = old.nameToIP
+		oldRecords = old.records
 		oldNames = old.names
 	}
 	if m != nil {
-		newNameToIP = m.nameToIP
+		newRecords = m.records
 		newNames = m.names
 	}
 
@@ -100,34 +258,28 @@ func (m *Map) PrettyDiffFrom(old *Map) string {
 			newNames = newNames[1:]
 		}
 
-		ipOld, inOld := oldNameToIP[name]
-		ipNew, inNew := newNameToIP[name]
+		recOld, inOld := oldRecords[name]
+		recNew, inNew := newRecords[name]
 		switch {
 		case !inOld:
-			buf.WriteByte('+')
-			printSingleNameIP(buf, name, ipNew)
+			printRecord(buf, '+', name, recNew)
 		case !inNew:
-			buf.WriteByte('-')
-			printSingleNameIP(buf, name, ipOld)
-		case ipOld != ipNew:
-			buf.WriteByte('-')
-			printSingleNameIP(buf, name, ipOld)
-			buf.WriteByte('+')
-			printSingleNameIP(buf, name, ipNew)
+			printRecord(buf, '-', name, recOld)
+		case !recordsEqual(recOld, recNew):
+			printRecord(buf, '-', name, recOld)
+			printRecord(buf, '+', name, recNew)
 		}
 	}
 
 	for _, name := range oldNames {
-		if _, ok := newNameToIP[name]; !ok {
-			buf.WriteByte('-')
-			printSingleNameIP(buf, name, oldNameToIP[name])
+		if _, ok := newRecords[name]; !ok {
+			printRecord(buf, '-', name, oldRecords[name])
 		}
 	}
 
 	for _, name := range newNames {
-		if _, ok := oldNameToIP[name]; !ok {
-			buf.WriteByte('+')
-			printSingleNameIP(buf, name, newNameToIP[name])
+		if _, ok := oldRecords[name]; !ok {
+			printRecord(buf, '+', name, newRecords[name])
 		}
 	}
 
@@ -32,6 +32,21 @@ func TestPretty(t *testing.T) {
 			}),
 			"test1.domain.\t100.101.102.103\ntest2.sub.domain.\t100.99.9.1\n",
 		},
+		{
+			"records",
+			NewRecordMap(map[string]Record{
+				"Node.ipn.dev": {IPs: []netaddr.IP{netaddr.IPv4(100, 64, 0, 1), netaddr.IPv4(100, 64, 0, 2)}},
+				"wiki.ipn.dev": {CNAME: "Node.ipn.dev", IPs: []netaddr.IP{netaddr.IPv4(100, 64, 0, 3)}},
+				"_ssh._tcp.node.ipn.dev": {
+					SRV: []SRV{{Port: 22, Target: "node.ipn.dev"}},
+					TXT: []string{"sshd"},
+				},
+			}),
+			"_ssh._tcp.node.ipn.dev.\tSRV 0 0 22 node.ipn.dev.\n" +
+				"_ssh._tcp.node.ipn.dev.\tTXT \"sshd\"\n" +
+				"node.ipn.dev.\t100.64.0.1\nnode.ipn.dev.\t100.64.0.2\n" +
+				"wiki.ipn.dev.\tCNAME node.ipn.dev.\n",
+		},
 	}
 
 	for _, tt := range tests {
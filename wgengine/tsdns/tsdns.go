@@ -9,8 +9,14 @@ package tsdns
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -20,8 +26,18 @@ import (
 	"tailscale.com/types/logger"
 )
 
-// maxResponseSize is the maximum size of a response from a Resolver.
-const maxResponseSize = 512
+// defaultUDPSize is the largest response a client accepts over UDP,
+// unless it advertises a larger size with EDNS0.
+const defaultUDPSize = 512
+
+// maxUDPSize is the largest response Resolver sends over UDP,
+// whatever the client advertises, and the size it advertises itself.
+// Clients get larger responses over TCP.
+const maxUDPSize = 4096
+
+// maxTCPSize is the largest DNS message that can be sent over TCP,
+// where each message is preceded by its 16-bit length.
+const maxTCPSize = 65535
 
 // queueSize is the maximal number of DNS requests that can be pending at a time.
 // If EnqueueRequest is called when this many requests are already pending,
@@ -32,19 +48,28 @@ const queueSize = 8
 // for upstream nameservers to process a query.
 const delegateTimeout = 5 * time.Second
 
-// defaultTTL is the TTL of all responses from Resolver.
+// defaultTTL is the TTL of the records in responses from Resolver.
 const defaultTTL = 600 * time.Second
 
+// negativeTTL is how long negative responses from Resolver may be
+// cached. It is short, as nodes come and go.
+const negativeTTL = 60 * time.Second
+
+// maxCNAMEChain is the maximal number of aliases Resolver follows to
+// answer a query.
+const maxCNAMEChain = 8
+
 // ErrClosed indicates that the resolver has been closed and readers should exit.
 var ErrClosed = errors.New("closed")
 
 var (
-	errAllFailed      = errors.New("all upstream nameservers failed")
-	errFullQueue      = errors.New("request queue full")
-	errNoNameservers  = errors.New("no upstream nameservers set")
-	errMapNotSet      = errors.New("domain map not set")
-	errNotImplemented = errors.New("query type not implemented")
-	errNotQuery       = errors.New("not a DNS query")
+	errAllFailed     = errors.New("all upstream nameservers failed")
+	errFullQueue     = errors.New("request queue full")
+	errNoNameservers = errors.New("no upstream nameservers set")
+	errMapNotSet     = errors.New("domain map not set")
+	errCNAMELoop     = errors.New("CNAME chain too long")
+	errNotQuery      = errors.New("not a DNS query")
+	errQueryTooLarge = errors.New("query too large")
 )
 
 // Packet represents a DNS payload together with the address of its origin.
@@ -55,12 +80,23 @@ type Packet struct {
 	Payload []byte
 	// Addr is the source address for a request and the destination address for a response.
 	Addr netaddr.IPPort
+	// TCP is whether the request came, and so the response goes, over TCP
+	// rather than UDP. Responses over UDP are truncated to the size the
+	// client accepts.
+	TCP bool
+}
+
+// requestError is a request that Resolver failed to answer.
+type requestError struct {
+	req Packet // with a SERVFAIL response as payload, or nil
+	err error
 }
 
 // Resolver is a DNS resolver for nodes on the Tailscale network,
 // associating them with domain names of the form <mynode>.<mydomain>.<root>.
 // If it is asked to resolve a domain that is not of that form,
-// it delegates to upstream nameservers if any are set.
+// it delegates to the upstream nameservers set for the domain, if any,
+// and caches their responses.
 type Resolver struct {
 	logf logger.Logf
 
@@ -71,8 +107,9 @@ type Resolver struct {
 	queue chan Packet
 	// responses is an unbuffered channel to which responses are sent.
 	responses chan Packet
-	// errors is an unbuffered channel to which errors are sent.
-	errors chan error
+	// errors is an unbuffered channel to which the requests that
+	// couldn't be answered are sent.
+	errors chan requestError
 	// closed notifies the poll goroutines to stop.
 	closed chan struct{}
 	// pollGroup signals when all poll goroutines have stopped.
@@ -84,14 +121,36 @@ type Resolver struct {
 	// dialer is the netns.Dialer used for delegation.
 	dialer netns.Dialer
 
+	// cache holds the responses of upstream nameservers.
+	cache *responseCache
+
+	// tlsConfig is the base TLS configuration for encrypted upstream
+	// nameservers. It is nil except in tests.
+	tlsConfig *tls.Config
+	// encMu guards the following fields, which keep connections to
+	// encrypted upstream nameservers open for reuse.
+	encMu sync.Mutex
+	// doh is the HTTP client for DNS-over-HTTPS, created on first use.
+	doh *http.Client
+	// dotIdle holds the idle DNS-over-TLS connections by server.
+	dotIdle map[string][]*tls.Conn
+
 	// mu guards the following fields from being updated while used.
 	mu sync.Mutex
 	// dnsMap is the map most recently received from the control server.
 	dnsMap *Map
-	// nameservers is the list of nameserver addresses that should be used
-	// if the received query is not for a Tailscale node.
-	// The addresses are strings of the form ip:port, as expected by Dial.
-	nameservers []string
+	// serial is the serial number in the SOA record of the root domain.
+	// SetMap increments it.
+	serial uint32
+	// routes maps domain suffixes in canonical form to the addresses
+	// of the nameservers that should be used for queries that end
+	// in them and are not for a Tailscale node.
+	// The addresses are strings of the form ip:port, as expected by Dial,
+	// or the https:// and tls:// URLs of encrypted nameservers.
+	routes map[string][]string
+	// health tracks the upstream nameservers that have failed recently,
+	// by address.
+	health map[string]*upstreamHealth
 }
 
 // NewResolver constructs a resolver associated with the given root domain.
@@ -101,10 +160,11 @@ func NewResolver(logf logger.Logf, rootDomain string) *Resolver {
 		logf:       logger.WithPrefix(logf, "tsdns: "),
 		queue:      make(chan Packet, queueSize),
 		responses:  make(chan Packet),
-		errors:     make(chan error),
+		errors:     make(chan requestError),
 		closed:     make(chan struct{}),
 		rootDomain: []byte(rootDomain),
 		dialer:     netns.NewDialer(),
+		cache:      newResponseCache(cacheSize),
 	}
 
 	return r
@@ -127,6 +187,7 @@ func (r *Resolver) Close() {
 	}
 	close(r.closed)
 	r.pollGroup.Wait()
+	r.closeIdleUpstreams(nil)
 }
 
 // SetMap sets the resolver's DNS map, taking ownership of it.
@@ -134,18 +195,17 @@ func (r *Resolver) SetMap(m *Map) {
 	r.mu.Lock()
 	oldMap := r.dnsMap
 	r.dnsMap = m
+	r.serial++
 	r.mu.Unlock()
 	r.logf("map diff:\n%s", m.PrettyDiffFrom(oldMap))
 }
 
-// SetUpstreamNameservers sets the addresses of the resolver's
-// upstream nameservers, taking ownership of the argument.
+// SetNameservers sets the addresses of the resolver's
+// upstream nameservers for all domains, taking ownership of the argument.
 // The addresses should be strings of the form ip:port,
 // matching what Dial("udp", addr) expects as addr.
 func (r *Resolver) SetNameservers(nameservers []string) {
-	r.mu.Lock()
-	r.nameservers = nameservers
-	r.mu.Unlock()
+	r.SetRoutes(map[string][]string{".": nameservers})
 }
 
 // EnqueueRequest places the given DNS request in the resolver's queue.
@@ -162,18 +222,22 @@ func (r *Resolver) EnqueueRequest(request Packet) error {
 
 // NextResponse returns a DNS response to a previously enqueued request.
 // It blocks until a response is available and gives up ownership of the response payload.
+//
+// If a request couldn't be answered, NextResponse returns the error
+// along with a response to the request's address whose payload is a
+// SERVFAIL response, or nil if the query was too malformed for one.
 func (r *Resolver) NextResponse() (Packet, error) {
 	select {
 	case resp := <-r.responses:
 		return resp, nil
-	case err := <-r.errors:
-		return Packet{}, err
+	case e := <-r.errors:
+		return e.req, e.err
 	case <-r.closed:
 		return Packet{}, ErrClosed
 	}
 }
 
-// Resolve maps a given domain name to the IP address of the host that owns it.
+// Resolve maps a given domain name to the first IP address of the host that owns it.
 // The domain name must be in canonical form (with a trailing period).
 func (r *Resolver) Resolve(domain string) (netaddr.IP, dns.RCode, error) {
 	r.mu.Lock()
@@ -184,11 +248,69 @@ func (r *Resolver) Resolve(domain string) (netaddr.IP, dns.RCode, error) {
 		return netaddr.IP{}, dns.RCodeServerFailure, errMapNotSet
 	}
 
-	addr, found := dnsMap.nameToIP[domain]
-	if !found {
+	rec, _ := dnsMap.lookup([]byte(domain))
+	if rec == nil || len(rec.IPs) == 0 {
 		return netaddr.IP{}, dns.RCodeNameError, nil
 	}
-	return addr, dns.RCodeSuccess, nil
+	return rec.IPs[0], dns.RCodeSuccess, nil
+}
+
+// resolve answers the forward query in resp, for a name within the
+// root domain, from the DNS map. It follows aliases within the map,
+// and tells apart names that don't exist from those that exist but
+// have no records of the type asked for.
+func (r *Resolver) resolve(resp *response) error {
+	r.mu.Lock()
+	dnsMap := r.dnsMap
+	serial := r.serial
+	r.mu.Unlock()
+
+	if dnsMap == nil {
+		resp.Header.RCode = dns.RCodeServerFailure
+		return errMapNotSet
+	}
+
+	typ := resp.Question.Type
+	name := resp.Question.Name.Data[:resp.Question.Name.Length]
+	if bytes.Equal(bytes.TrimSuffix(name, []byte(".")), bytes.TrimSuffix(r.rootDomain, []byte("."))) {
+		// The root domain itself.
+		resp.Header.RCode = dns.RCodeSuccess
+		resp.SOA = canonicalName(string(r.rootDomain))
+		resp.Serial = serial
+		resp.SOAAnswer = typ == dns.TypeSOA || typ == dns.TypeALL
+		return nil
+	}
+
+	rec, exists := dnsMap.lookup(name)
+	for rec != nil {
+		if resp.ChainLen == len(resp.Chain) {
+			resp.Header.RCode = dns.RCodeServerFailure
+			return errCNAMELoop
+		}
+		resp.Chain[resp.ChainLen] = rec
+		resp.ChainLen++
+		if rec.CNAME == "" || typ == dns.TypeCNAME {
+			break
+		}
+		if !strings.HasSuffix(rec.CNAME, canonicalName(string(r.rootDomain))) {
+			// The client resolves names outside the root domain.
+			resp.Header.RCode = dns.RCodeSuccess
+			return nil
+		}
+		rec, exists = dnsMap.lookup([]byte(rec.CNAME))
+	}
+
+	resp.Header.RCode = dns.RCodeSuccess
+	switch {
+	case rec != nil && rec.has(typ):
+		return nil
+	case !exists:
+		// The last name in the chain doesn't exist (RFC 6604).
+		resp.Header.RCode = dns.RCodeNameError
+	}
+	resp.SOA = canonicalName(string(r.rootDomain))
+	resp.Serial = serial
+	return nil
 }
 
 // ResolveReverse returns the unique domain name that maps to the given address.
@@ -223,10 +345,12 @@ func (r *Resolver) poll() {
 			return
 		}
 
-		packet.Payload, err = r.respond(packet.Payload)
+		query := packet.Payload
+		packet.Payload, err = r.respond(query, packet.TCP)
 		if err != nil {
+			packet.Payload = servfail(query)
 			select {
-			case r.errors <- err:
+			case r.errors <- requestError{req: packet, err: err}:
 				// continue
 			case <-r.closed:
 				return
@@ -242,8 +366,25 @@ func (r *Resolver) poll() {
 	}
 }
 
-// queryServer obtains a DNS response by querying the given server.
+// queryServer obtains a DNS response by querying the given server
+// over UDP, and then over TCP if the response was truncated.
+// Encrypted servers are queried over HTTPS or TLS instead.
 func (r *Resolver) queryServer(ctx context.Context, server string, query []byte) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(server, dohPrefix):
+		return r.queryDoH(ctx, server, query)
+	case strings.HasPrefix(server, dotPrefix):
+		return r.queryDoT(ctx, server, query)
+	}
+	resp, err := r.queryServerUDP(ctx, server, query)
+	if err != nil || !isTruncated(resp) {
+		return resp, err
+	}
+	return r.queryServerTCP(ctx, server, query)
+}
+
+// queryServerUDP obtains a DNS response by querying the given server over UDP.
+func (r *Resolver) queryServerUDP(ctx context.Context, server string, query []byte) ([]byte, error) {
 	conn, err := r.dialer.DialContext(ctx, "udp", server)
 	if err != nil {
 		return nil, err
@@ -261,21 +402,77 @@ func (r *Resolver) queryServer(ctx context.Context, server string, query []byte)
 		return nil, err
 	}
 
-	out := make([]byte, maxResponseSize)
+	// One byte more than the largest response we'll pass on over UDP,
+	// to tell when the read cut off a larger one.
+	out := make([]byte, maxUDPSize+1)
 	n, err := conn.Read(out)
 	if err != nil {
 		return nil, err
 	}
+	if n > maxUDPSize {
+		// Get the whole response over TCP instead.
+		setTruncated(out)
+	}
 
 	return out[:n], nil
 }
 
-// delegate forwards the query to all upstream nameservers and returns the first response.
-func (r *Resolver) delegate(query []byte) ([]byte, error) {
-	r.mu.Lock()
-	nameservers := r.nameservers
-	r.mu.Unlock()
+// queryServerTCP obtains a DNS response by querying the given server over TCP.
+func (r *Resolver) queryServerTCP(ctx context.Context, server string, query []byte) ([]byte, error) {
+	if len(query) > maxTCPSize {
+		return nil, errQueryTooLarge
+	}
+
+	conn, err := r.dialer.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// Interrupt the current operation when the context is cancelled.
+	go func() {
+		<-ctx.Done()
+		conn.SetDeadline(time.Unix(1, 0))
+	}()
+
+	return exchangeTCP(conn, query)
+}
+
+// exchangeTCP sends query on conn and reads the response,
+// each preceded by its 16-bit length as in DNS over TCP.
+func exchangeTCP(conn net.Conn, query []byte) ([]byte, error) {
+	req := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(req, uint16(len(query)))
+	copy(req[2:], query)
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	out := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, out); err != nil {
+		return nil, err
+	}
 
+	return out, nil
+}
+
+// delegate answers the query, parsed into resp, from the cache,
+// or else forwards it to the healthy upstream nameservers for its
+// name and returns the first response.
+func (r *Resolver) delegate(query []byte, resp *response) ([]byte, error) {
+	key := newCacheKey(resp)
+	id := binary.BigEndian.Uint16(query)
+	if out, ok := r.cache.get(key, id, time.Now()); ok {
+		metricCacheHits.Add(1)
+		return out, nil
+	}
+	metricCacheMisses.Add(1)
+
+	nameservers := r.upstreamsFor(key.name, time.Now())
 	if len(nameservers) == 0 {
 		return nil, errNoNameservers
 	}
@@ -285,16 +482,25 @@ func (r *Resolver) delegate(query []byte) ([]byte, error) {
 
 	// Common case, don't spawn goroutines.
 	if len(nameservers) == 1 {
-		return r.queryServer(ctx, nameservers[0], query)
+		resp, err := r.queryServer(ctx, nameservers[0], query)
+		r.markUpstream(nameservers[0], err, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		r.cache.put(key, append([]byte(nil), resp...), time.Now())
+		return resp, nil
 	}
 
 	datach := make(chan []byte)
 	for _, server := range nameservers {
 		go func(s string) {
 			resp, err := r.queryServer(ctx, s, query)
-			// Only print errors not due to cancelation after first response.
-			if err != nil && ctx.Err() != context.Canceled {
-				r.logf("querying %s: %v", s, err)
+			// Only count and print errors not due to cancelation after first response.
+			if err == nil || ctx.Err() != context.Canceled {
+				r.markUpstream(s, err, time.Now())
+				if err != nil {
+					r.logf("querying %s: %v", s, err)
+				}
 			}
 
 			datach <- resp
@@ -314,6 +520,7 @@ func (r *Resolver) delegate(query []byte) ([]byte, error) {
 	if response == nil {
 		return nil, errAllFailed
 	}
+	r.cache.put(key, append([]byte(nil), response...), time.Now())
 	return response, nil
 }
 
@@ -322,8 +529,27 @@ type response struct {
 	Question dns.Question
 	// Name is the response to a PTR query.
 	Name string
-	// IP is the response to an A, AAAA, or ANY query.
-	IP netaddr.IP
+	// Chain holds the records answering a forward query: those of the
+	// aliases followed, if any, and then those of the name they lead to.
+	// Its first ChainLen entries are used.
+	Chain    [maxCNAMEChain + 1]*Record
+	ChainLen int
+	// SOA, if non-empty, is the root domain, whose SOA record goes in
+	// the authority section, as in negative responses, or in the
+	// answer section if SOAAnswer.
+	SOA       string
+	SOAAnswer bool
+	// Serial is the serial number of the SOA record.
+	Serial uint32
+	// EDNS is whether the query has an EDNS0 OPT record,
+	// in which case so does the response.
+	EDNS bool
+	// DNSSECOK is whether the query's OPT record has the DO bit set.
+	DNSSECOK bool
+	// CheckingDisabled is whether the query has the CD bit set.
+	CheckingDisabled bool
+	// MaxSize is the size of the largest response the client accepts.
+	MaxSize int
 }
 
 // parseQuery parses the query in given packet into a response struct.
@@ -344,8 +570,36 @@ func (r *Resolver) parseQuery(query []byte, resp *response) error {
 	if err != nil {
 		return err
 	}
+	resp.CheckingDisabled = binary.BigEndian.Uint16(query[2:])&headerBitCD != 0
 
-	return nil
+	// Look for an EDNS0 OPT record advertising a larger UDP size
+	// (RFC 6891, section 6.2.3). The rest of the query is of no
+	// interest, so don't fail it if it's malformed.
+	resp.MaxSize = defaultUDPSize
+	if parser.SkipAllQuestions() != nil || parser.SkipAllAnswers() != nil || parser.SkipAllAuthorities() != nil {
+		return nil
+	}
+	for {
+		h, err := parser.AdditionalHeader()
+		if err != nil {
+			return nil
+		}
+		if h.Type == dns.TypeOPT {
+			resp.EDNS = true
+			resp.DNSSECOK = h.DNSSECAllowed()
+			resp.MaxSize = int(h.Class)
+			if resp.MaxSize < defaultUDPSize {
+				resp.MaxSize = defaultUDPSize
+			}
+			if resp.MaxSize > maxUDPSize {
+				resp.MaxSize = maxUDPSize
+			}
+			return nil
+		}
+		if err := parser.SkipAdditional(); err != nil {
+			return nil
+		}
+	}
 }
 
 // marshalARecord serializes an A record into an active builder.
@@ -399,6 +653,175 @@ func marshalPTRRecord(queryName dns.Name, name string, builder *dns.Builder) err
 	return builder.PTRResource(answerHeader, answer)
 }
 
+// marshalCNAMERecord serializes a CNAME record into an active builder.
+// The caller may continue using the builder following the call.
+func marshalCNAMERecord(name dns.Name, cname string, builder *dns.Builder) error {
+	var answer dns.CNAMEResource
+	var err error
+
+	answerHeader := dns.ResourceHeader{
+		Name:  name,
+		Type:  dns.TypeCNAME,
+		Class: dns.ClassINET,
+		TTL:   uint32(defaultTTL / time.Second),
+	}
+	answer.CNAME, err = dns.NewName(cname)
+	if err != nil {
+		return err
+	}
+	return builder.CNAMEResource(answerHeader, answer)
+}
+
+// marshalSRVRecord serializes an SRV record into an active builder.
+// The caller may continue using the builder following the call.
+func marshalSRVRecord(name dns.Name, srv SRV, builder *dns.Builder) error {
+	var err error
+
+	answerHeader := dns.ResourceHeader{
+		Name:  name,
+		Type:  dns.TypeSRV,
+		Class: dns.ClassINET,
+		TTL:   uint32(defaultTTL / time.Second),
+	}
+	answer := dns.SRVResource{
+		Priority: srv.Priority,
+		Weight:   srv.Weight,
+		Port:     srv.Port,
+	}
+	answer.Target, err = dns.NewName(srv.Target)
+	if err != nil {
+		return err
+	}
+	return builder.SRVResource(answerHeader, answer)
+}
+
+// marshalTXTRecord serializes a TXT record holding txt into an active builder,
+// splitting txt into strings of at most 255 bytes.
+// The caller may continue using the builder following the call.
+func marshalTXTRecord(name dns.Name, txt string, builder *dns.Builder) error {
+	var answer dns.TXTResource
+
+	answerHeader := dns.ResourceHeader{
+		Name:  name,
+		Type:  dns.TypeTXT,
+		Class: dns.ClassINET,
+		TTL:   uint32(defaultTTL / time.Second),
+	}
+	for len(txt) > 255 {
+		answer.TXT = append(answer.TXT, txt[:255])
+		txt = txt[255:]
+	}
+	answer.TXT = append(answer.TXT, txt)
+	return builder.TXTResource(answerHeader, answer)
+}
+
+// marshalSOARecord serializes the SOA record of the zone into an active builder.
+// The caller may continue using the builder following the call.
+func marshalSOARecord(zone string, serial uint32, builder *dns.Builder) error {
+	var answer dns.SOAResource
+	var err error
+
+	answerHeader := dns.ResourceHeader{
+		Class: dns.ClassINET,
+		Type:  dns.TypeSOA,
+		TTL:   uint32(negativeTTL / time.Second),
+	}
+	answerHeader.Name, err = dns.NewName(zone)
+	if err != nil {
+		return err
+	}
+	answer.NS = answerHeader.Name
+	answer.MBox, err = dns.NewName("hostmaster." + zone)
+	if err != nil {
+		return err
+	}
+	answer.Serial = serial
+	answer.Refresh = uint32(defaultTTL / time.Second)
+	answer.Retry = uint32(defaultTTL / time.Second)
+	answer.Expire = uint32(defaultTTL / time.Second)
+	answer.MinTTL = uint32(negativeTTL / time.Second)
+	return builder.SOAResource(answerHeader, answer)
+}
+
+// marshalChain serializes the records in resp.Chain that answer
+// resp.Question into an active builder.
+// The caller may continue using the builder following the call.
+func marshalChain(resp *response, builder *dns.Builder) error {
+	var err error
+
+	typ := resp.Question.Type
+	name := resp.Question.Name
+	for _, rec := range resp.Chain[:resp.ChainLen] {
+		if rec.CNAME != "" {
+			err = marshalCNAMERecord(name, rec.CNAME, builder)
+			if err != nil {
+				return err
+			}
+			name, err = dns.NewName(rec.CNAME)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		for _, ip := range rec.IPs {
+			switch {
+			case ip.Is4() && (typ == dns.TypeA || typ == dns.TypeALL):
+				err = marshalARecord(name, ip, builder)
+			case !ip.Is4() && (typ == dns.TypeAAAA || typ == dns.TypeALL):
+				err = marshalAAAARecord(name, ip, builder)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if typ == dns.TypeSRV || typ == dns.TypeALL {
+			for _, srv := range rec.SRV {
+				err = marshalSRVRecord(name, srv, builder)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if typ == dns.TypeTXT || typ == dns.TypeALL {
+			for _, txt := range rec.TXT {
+				err = marshalTXTRecord(name, txt, builder)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// servfail returns a SERVFAIL response to query, with the query's
+// question if it has one, or nil if query isn't a DNS message.
+func servfail(query []byte) []byte {
+	var parser dns.Parser
+	h, err := parser.Start(query)
+	if err != nil {
+		return nil
+	}
+	builder := dns.NewBuilder(nil, dns.Header{
+		ID:                 h.ID,
+		Response:           true,
+		OpCode:             h.OpCode,
+		RecursionDesired:   h.RecursionDesired,
+		RecursionAvailable: h.RecursionDesired,
+		RCode:              dns.RCodeServerFailure,
+	})
+	if q, err := parser.Question(); err == nil {
+		if builder.StartQuestions() != nil || builder.Question(q) != nil {
+			return nil
+		}
+	}
+	out, err := builder.Finish()
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
 // marshalResponse serializes the DNS response into a new buffer.
 func marshalResponse(resp *response) ([]byte, error) {
 	resp.Header.Response = true
@@ -419,33 +842,111 @@ func marshalResponse(resp *response) ([]byte, error) {
 		return nil, err
 	}
 
-	// Only successful responses contain answers.
-	if resp.Header.RCode != dns.RCodeSuccess {
-		return builder.Finish()
-	}
-
 	err = builder.StartAnswers()
 	if err != nil {
 		return nil, err
 	}
-
-	switch resp.Question.Type {
-	case dns.TypeA, dns.TypeAAAA, dns.TypeALL:
-		if resp.IP.Is4() {
-			err = marshalARecord(resp.Question.Name, resp.IP, &builder)
-		} else {
-			err = marshalAAAARecord(resp.Question.Name, resp.IP, &builder)
-		}
-	case dns.TypePTR:
+	// Only successful responses contain answers,
+	// except for the aliases leading to a name that doesn't exist.
+	switch {
+	case resp.Header.RCode == dns.RCodeSuccess && resp.Question.Type == dns.TypePTR:
 		err = marshalPTRRecord(resp.Question.Name, resp.Name, &builder)
+	case resp.Header.RCode == dns.RCodeSuccess && resp.SOAAnswer:
+		err = marshalSOARecord(resp.SOA, resp.Serial, &builder)
+	case resp.Header.RCode == dns.RCodeSuccess || resp.Header.RCode == dns.RCodeNameError:
+		err = marshalChain(resp, &builder)
 	}
 	if err != nil {
 		return nil, err
 	}
 
+	if resp.SOA != "" && !resp.SOAAnswer {
+		err = builder.StartAuthorities()
+		if err != nil {
+			return nil, err
+		}
+		err = marshalSOARecord(resp.SOA, resp.Serial, &builder)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if resp.EDNS {
+		err = builder.StartAdditionals()
+		if err != nil {
+			return nil, err
+		}
+		err = marshalOPTRecord(&builder)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return builder.Finish()
 }
 
+// marshalTruncatedResponse is like marshalResponse, but truncates the
+// response if it's larger than the client accepts.
+func marshalTruncatedResponse(resp *response) ([]byte, error) {
+	out, err := marshalResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+	return truncateResponse(out, resp.MaxSize), nil
+}
+
+// marshalOPTRecord serializes an EDNS0 OPT record advertising maxUDPSize
+// into an active builder.
+// The caller may continue using the builder following the call.
+func marshalOPTRecord(builder *dns.Builder) error {
+	optHeader := dns.ResourceHeader{
+		Name:  rootName,
+		Type:  dns.TypeOPT,
+		Class: dns.Class(maxUDPSize),
+	}
+	return builder.OPTResource(optHeader, dns.OPTResource{})
+}
+
+var rootName = dns.MustNewName(".")
+
+// isTruncated reports whether the DNS message msg has the TC bit set.
+func isTruncated(msg []byte) bool {
+	return len(msg) >= dnsHeaderLen && binary.BigEndian.Uint16(msg[2:])&headerBitTC != 0
+}
+
+// setTruncated sets the TC bit of the DNS message msg.
+func setTruncated(msg []byte) {
+	msg[2] |= headerBitTC >> 8
+}
+
+// truncateResponse returns the response msg if it is at most max bytes long.
+// Otherwise, it cuts msg down to its header and question and sets its
+// TC bit, telling the client to retry over TCP.
+func truncateResponse(msg []byte, max int) []byte {
+	if len(msg) <= max || len(msg) < dnsHeaderLen {
+		return msg
+	}
+	off := dnsHeaderLen
+	qdCount := int(binary.BigEndian.Uint16(msg[4:]))
+	for i := 0; i < qdCount; i++ {
+		var ok bool
+		off, ok = skipName(msg, off)
+		if !ok || off+4 > len(msg) {
+			// Can't tell where the question ends, so leave it out.
+			off, qdCount = dnsHeaderLen, 0
+			break
+		}
+		off += 4 // type and class
+	}
+	msg = msg[:off]
+	setTruncated(msg)
+	binary.BigEndian.PutUint16(msg[4:], uint16(qdCount))
+	binary.BigEndian.PutUint16(msg[6:], 0)  // answers
+	binary.BigEndian.PutUint16(msg[8:], 0)  // authorities
+	binary.BigEndian.PutUint16(msg[10:], 0) // additionals
+	return msg
+}
+
 var (
 	rdnsv4Suffix = []byte(".in-addr.arpa.")
 	rdnsv6Suffix = []byte(".ip6.arpa.")
@@ -548,20 +1049,21 @@ func (r *Resolver) respondReverse(query []byte, resp *response) ([]byte, error)
 	}
 
 	if shouldDelegate {
-		out, err := r.delegate(query)
+		out, err := r.delegate(query, resp)
 		if err != nil {
 			r.logf("delegating rdns: %v", err)
 			resp.Header.RCode = dns.RCodeServerFailure
-			return marshalResponse(resp)
+			return marshalTruncatedResponse(resp)
 		}
-		return out, nil
+		return truncateResponse(out, resp.MaxSize), nil
 	}
 
-	return marshalResponse(resp)
+	return marshalTruncatedResponse(resp)
 }
 
-// respond returns a DNS response to query.
-func (r *Resolver) respond(query []byte) ([]byte, error) {
+// respond returns a DNS response to query,
+// which came over TCP if tcp is true and UDP otherwise.
+func (r *Resolver) respond(query []byte, tcp bool) ([]byte, error) {
 	resp := new(response)
 
 	// ParseQuery is sufficiently fast to run on every DNS packet.
@@ -574,6 +1076,9 @@ func (r *Resolver) respond(query []byte) ([]byte, error) {
 		resp.Header.RCode = dns.RCodeFormatError
 		return marshalResponse(resp)
 	}
+	if tcp {
+		resp.MaxSize = maxTCPSize
+	}
 
 	// Always try to handle reverse lookups; delegate inside when not found.
 	// This way, queries for exitent nodes do not leak,
@@ -586,27 +1091,20 @@ func (r *Resolver) respond(query []byte) ([]byte, error) {
 	// We do this on bytes because Name.String() allocates.
 	rawName := resp.Question.Name.Data[:resp.Question.Name.Length]
 	if !bytes.HasSuffix(rawName, r.rootDomain) {
-		out, err := r.delegate(query)
+		out, err := r.delegate(query, resp)
 		if err != nil {
 			r.logf("delegating: %v", err)
 			resp.Header.RCode = dns.RCodeServerFailure
-			return marshalResponse(resp)
+			return marshalTruncatedResponse(resp)
 		}
-		return out, nil
+		return truncateResponse(out, resp.MaxSize), nil
 	}
 
-	switch resp.Question.Type {
-	case dns.TypeA, dns.TypeAAAA, dns.TypeALL:
-		name := resp.Question.Name.String()
-		resp.IP, resp.Header.RCode, err = r.Resolve(name)
-	default:
-		resp.Header.RCode = dns.RCodeNotImplemented
-		err = errNotImplemented
-	}
+	err = r.resolve(resp)
 	// We will not return this error: it is the sender's fault.
 	if err != nil {
 		r.logf("resolving: %v", err)
 	}
 
-	return marshalResponse(resp)
+	return marshalTruncatedResponse(resp)
 }
@@ -7,7 +7,11 @@ package tsdns
 import (
 	"bytes"
 	"errors"
+	"fmt"
+	"reflect"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 
 	dns "golang.org/x/net/dns/dnsmessage"
@@ -408,10 +412,25 @@ var nxdomainResponse = []byte{
 	0x84, 0x03, // flags: response, authoritative, error: nxdomain
 	0x00, 0x01, // one question
 	0x00, 0x00, // no answers
-	0x00, 0x00, 0x00, 0x00, // no authority or additional RRs
+	0x00, 0x01, // one authority RR
+	0x00, 0x00, // no additional RRs
 	// Question:
 	0x05, 0x74, 0x65, 0x73, 0x74, 0x33, 0x03, 0x69, 0x70, 0x6e, 0x03, 0x64, 0x65, 0x76, 0x00, // name
 	0x00, 0x01, 0x00, 0x01, // type A, class IN
+	// Authority: ipn.dev
+	0x03, 0x69, 0x70, 0x6e, 0x03, 0x64, 0x65, 0x76, 0x00,
+	0x00, 0x06, 0x00, 0x01, // type SOA, class IN
+	0x00, 0x00, 0x00, 0x3c, // TTL: 60
+	0x00, 0x31, // length: 49 bytes
+	// MNAME: ipn.dev
+	0x03, 0x69, 0x70, 0x6e, 0x03, 0x64, 0x65, 0x76, 0x00,
+	// RNAME: hostmaster.ipn.dev
+	0x0a, 0x68, 0x6f, 0x73, 0x74, 0x6d, 0x61, 0x73, 0x74, 0x65, 0x72, 0x03, 0x69, 0x70, 0x6e, 0x03, 0x64, 0x65, 0x76, 0x00,
+	0x00, 0x00, 0x00, 0x01, // serial: 1
+	0x00, 0x00, 0x02, 0x58, // refresh: 600
+	0x00, 0x00, 0x02, 0x58, // retry: 600
+	0x00, 0x00, 0x02, 0x58, // expire: 600
+	0x00, 0x00, 0x00, 0x3c, // minimum: 60
 }
 
 func TestFull(t *testing.T) {
@@ -444,6 +463,114 @@ func TestFull(t *testing.T) {
 	}
 }
 
+// describeRecords returns a short description of each resource in rrs.
+func describeRecords(rrs []dns.Resource) []string {
+	var out []string
+	for _, rr := range rrs {
+		var desc string
+		switch body := rr.Body.(type) {
+		case *dns.AResource:
+			desc = "A " + netaddr.IPv4(body.A[0], body.A[1], body.A[2], body.A[3]).String()
+		case *dns.AAAAResource:
+			desc = "AAAA " + netaddr.IPv6Raw(body.AAAA).String()
+		case *dns.CNAMEResource:
+			desc = "CNAME " + body.CNAME.String()
+		case *dns.SRVResource:
+			desc = fmt.Sprintf("SRV %d %s", body.Port, body.Target)
+		case *dns.TXTResource:
+			desc = "TXT " + strings.Join(body.TXT, "")
+		case *dns.SOAResource:
+			desc = "SOA " + rr.Header.Name.String()
+		default:
+			desc = rr.Header.Type.String()
+		}
+		out = append(out, rr.Header.Name.String()+" "+desc)
+	}
+	return out
+}
+
+func TestRecords(t *testing.T) {
+	r := NewResolver(t.Logf, "ipn.dev.")
+	r.SetMap(NewRecordMap(map[string]Record{
+		"node1.ipn.dev": {IPs: []netaddr.IP{
+			netaddr.IPv4(100, 64, 0, 1),
+			mustIP("fd7a:115c:a1e0::1"),
+		}},
+		"Wiki.ipn.dev":   {CNAME: "node1.ipn.dev"},
+		"www.ipn.dev":    {CNAME: "Wiki.ipn.dev"},
+		"search.ipn.dev": {CNAME: "www.example.com"},
+		"gone.ipn.dev":   {CNAME: "nowhere.ipn.dev"},
+		"loop1.ipn.dev":  {CNAME: "loop2.ipn.dev"},
+		"loop2.ipn.dev":  {CNAME: "loop1.ipn.dev"},
+		"_ssh._tcp.node1.ipn.dev": {
+			SRV: []SRV{{Port: 22, Target: "node1.ipn.dev"}},
+			TXT: []string{"sshd"},
+		},
+	}))
+	r.Start()
+	defer r.Close()
+
+	tests := []struct {
+		name        string
+		qname       string
+		qtype       dns.Type
+		code        dns.RCode
+		answers     []string
+		authorities []string
+	}{
+		{"a", "node1.ipn.dev.", dns.TypeA, dns.RCodeSuccess,
+			[]string{"node1.ipn.dev. A 100.64.0.1"}, nil},
+		{"aaaa", "node1.ipn.dev.", dns.TypeAAAA, dns.RCodeSuccess,
+			[]string{"node1.ipn.dev. AAAA fd7a:115c:a1e0::1"}, nil},
+		{"any", "node1.ipn.dev.", dns.TypeALL, dns.RCodeSuccess,
+			[]string{"node1.ipn.dev. A 100.64.0.1", "node1.ipn.dev. AAAA fd7a:115c:a1e0::1"}, nil},
+		{"nodata", "node1.ipn.dev.", dns.TypeMX, dns.RCodeSuccess,
+			nil, []string{"ipn.dev. SOA ipn.dev."}},
+		{"nxdomain", "node2.ipn.dev.", dns.TypeMX, dns.RCodeNameError,
+			nil, []string{"ipn.dev. SOA ipn.dev."}},
+		{"cname_chain", "www.ipn.dev.", dns.TypeA, dns.RCodeSuccess,
+			[]string{"www.ipn.dev. CNAME wiki.ipn.dev.", "wiki.ipn.dev. CNAME node1.ipn.dev.", "node1.ipn.dev. A 100.64.0.1"}, nil},
+		{"cname_query", "wiki.ipn.dev.", dns.TypeCNAME, dns.RCodeSuccess,
+			[]string{"wiki.ipn.dev. CNAME node1.ipn.dev."}, nil},
+		{"cname_foreign", "search.ipn.dev.", dns.TypeA, dns.RCodeSuccess,
+			[]string{"search.ipn.dev. CNAME www.example.com."}, nil},
+		{"cname_nxdomain", "gone.ipn.dev.", dns.TypeA, dns.RCodeNameError,
+			[]string{"gone.ipn.dev. CNAME nowhere.ipn.dev."}, []string{"ipn.dev. SOA ipn.dev."}},
+		{"cname_loop", "loop1.ipn.dev.", dns.TypeA, dns.RCodeServerFailure, nil, nil},
+		{"srv", "_ssh._tcp.node1.ipn.dev.", dns.TypeSRV, dns.RCodeSuccess,
+			[]string{"_ssh._tcp.node1.ipn.dev. SRV 22 node1.ipn.dev."}, nil},
+		{"txt", "_ssh._tcp.node1.ipn.dev.", dns.TypeTXT, dns.RCodeSuccess,
+			[]string{"_ssh._tcp.node1.ipn.dev. TXT sshd"}, nil},
+		{"empty_non_terminal", "_tcp.node1.ipn.dev.", dns.TypeA, dns.RCodeSuccess,
+			nil, []string{"ipn.dev. SOA ipn.dev."}},
+		{"apex_soa", "ipn.dev.", dns.TypeSOA, dns.RCodeSuccess,
+			[]string{"ipn.dev. SOA ipn.dev."}, nil},
+		{"apex_nodata", "ipn.dev.", dns.TypeA, dns.RCodeSuccess,
+			nil, []string{"ipn.dev. SOA ipn.dev."}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := syncRespond(r, dnspacket(tt.qname, tt.qtype))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var msg dns.Message
+			if err := msg.Unpack(resp); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Header.RCode != tt.code {
+				t.Errorf("code = %v; want %v", msg.Header.RCode, tt.code)
+			}
+			if got := describeRecords(msg.Answers); !reflect.DeepEqual(got, tt.answers) {
+				t.Errorf("answers = %q; want %q", got, tt.answers)
+			}
+			if got := describeRecords(msg.Authorities); !reflect.DeepEqual(got, tt.authorities) {
+				t.Errorf("authorities = %q; want %q", got, tt.authorities)
+			}
+		})
+	}
+}
+
 func TestAllocs(t *testing.T) {
 	r := NewResolver(t.Logf, "ipn.dev.")
 	r.SetMap(dnsMap)
@@ -494,3 +621,194 @@ func BenchmarkFull(b *testing.B) {
 		})
 	}
 }
+
+// ednspacket is like dnspacket, but the query has an EDNS0 OPT record
+// advertising a UDP size of size.
+func ednspacket(domain string, tp dns.Type, size uint16) []byte {
+	builder := dns.NewBuilder(nil, dns.Header{})
+	builder.StartQuestions()
+	builder.Question(dns.Question{
+		Name:  dns.MustNewName(domain),
+		Type:  tp,
+		Class: dns.ClassINET,
+	})
+	builder.StartAdditionals()
+	builder.OPTResource(dns.ResourceHeader{
+		Name:  dns.MustNewName("."),
+		Type:  dns.TypeOPT,
+		Class: dns.Class(size),
+	}, dns.OPTResource{})
+	payload, _ := builder.Finish()
+
+	return payload
+}
+
+func TestTruncateResponse(t *testing.T) {
+	short := testResponse(t, "a.example.com.", dns.RCodeSuccess, []uint32{60}, 0, 0)
+	if got := truncateResponse(short, 512); !bytes.Equal(got, short) {
+		t.Errorf("short response changed: %x", got)
+	}
+
+	long := testResponse(t, "a.example.com.", dns.RCodeSuccess, make([]uint32, 40), 0, 0)
+	got := truncateResponse(long, 512)
+	var p dns.Parser
+	h, err := p.Start(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.Truncated {
+		t.Error("TC bit not set")
+	}
+	q, err := p.Question()
+	if err != nil || q.Name.String() != "a.example.com." {
+		t.Errorf("question = %v, %v; want a.example.com.", q, err)
+	}
+	p.SkipAllQuestions()
+	if _, err := p.AnswerHeader(); err != dns.ErrSectionDone {
+		t.Errorf("answers left: %v", err)
+	}
+}
+
+func TestServfail(t *testing.T) {
+	query := dnspacket("test1.ipn.dev.", dns.TypeA)
+	resp := servfail(query)
+	var p dns.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.Response || h.RCode != dns.RCodeServerFailure {
+		t.Errorf("header = %+v; want a SERVFAIL response", h)
+	}
+	q, err := p.Question()
+	if err != nil || q.Name.String() != "test1.ipn.dev." {
+		t.Errorf("question = %v, %v; want test1.ipn.dev.", q, err)
+	}
+
+	if resp := servfail([]byte("junk")); resp != nil {
+		t.Errorf("servfail(junk) = %x; want nil", resp)
+	}
+}
+
+func TestEDNSAndTruncation(t *testing.T) {
+	const numAnswers = 40 // too many for 512 bytes
+	upstream := (&testUpstream{ip: [4]byte{1, 2, 3, 4}, answers: numAnswers, truncateUDP: true}).start(t)
+	defer upstream.close()
+
+	r := NewResolver(t.Logf, "ipn.dev.")
+	r.SetMap(dnsMap)
+	r.SetNameservers([]string{upstream.addr()})
+	r.Start()
+	defer r.Close()
+
+	parse := func(resp []byte) (h dns.Header, answers []dns.Resource, opt *dns.Resource) {
+		t.Helper()
+		var p dns.Parser
+		h, err := p.Start(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.SkipAllQuestions()
+		answers, err = p.AllAnswers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.SkipAllAuthorities()
+		additionals, err := p.AllAdditionals()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range additionals {
+			if additionals[i].Header.Type == dns.TypeOPT {
+				opt = &additionals[i]
+			}
+		}
+		return h, answers, opt
+	}
+
+	tests := []struct {
+		name      string
+		packet    Packet
+		wantTC    bool
+		wantCount int
+		wantOPT   bool
+	}{
+		{"udp", Packet{Payload: dnspacket("big.example.com.", dns.TypeA)}, true, 0, false},
+		{"udp_edns", Packet{Payload: ednspacket("big.example.com.", dns.TypeA, 4096)}, false, numAnswers, false},
+		{"tcp", Packet{Payload: dnspacket("big.example.com.", dns.TypeA), TCP: true}, false, numAnswers, false},
+		{"local_edns", Packet{Payload: ednspacket("test1.ipn.dev.", dns.TypeA, 1232)}, false, 1, true},
+		{"local_nxdomain_edns", Packet{Payload: ednspacket("test3.ipn.dev.", dns.TypeA, 1232)}, false, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r.EnqueueRequest(tt.packet)
+			resp, err := r.NextResponse()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.TCP != tt.packet.TCP {
+				t.Errorf("response TCP = %v; want %v", resp.TCP, tt.packet.TCP)
+			}
+			h, answers, opt := parse(resp.Payload)
+			if h.Truncated != tt.wantTC {
+				t.Errorf("TC = %v; want %v", h.Truncated, tt.wantTC)
+			}
+			if len(answers) != tt.wantCount {
+				t.Errorf("%d answers; want %d", len(answers), tt.wantCount)
+			}
+			if (opt != nil) != tt.wantOPT {
+				t.Errorf("OPT record = %v; want one: %v", opt, tt.wantOPT)
+			}
+			if opt != nil && opt.Header.Class != maxUDPSize {
+				t.Errorf("OPT UDP size = %d; want %d", opt.Header.Class, maxUDPSize)
+			}
+		})
+	}
+
+	// Each delegated query was retried over TCP, as the UDP response
+	// was truncated.
+	if n := atomic.LoadInt32(&upstream.tcpQueries); n != 3 {
+		t.Errorf("upstream got %d TCP queries; want 3", n)
+	}
+}
+
+func TestLocalTruncation(t *testing.T) {
+	txt := make([]string, 10)
+	for i := range txt {
+		txt[i] = strings.Repeat(string('a'+rune(i)), 100)
+	}
+	r := NewResolver(t.Logf, "ipn.dev.")
+	r.SetMap(NewRecordMap(map[string]Record{"big.ipn.dev": {TXT: txt}}))
+	r.Start()
+	defer r.Close()
+
+	tests := []struct {
+		name      string
+		packet    Packet
+		wantTC    bool
+		wantCount int
+	}{
+		{"udp", Packet{Payload: dnspacket("big.ipn.dev.", dns.TypeTXT)}, true, 0},
+		{"udp_edns", Packet{Payload: ednspacket("big.ipn.dev.", dns.TypeTXT, 4096)}, false, len(txt)},
+		{"tcp", Packet{Payload: dnspacket("big.ipn.dev.", dns.TypeTXT), TCP: true}, false, len(txt)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r.EnqueueRequest(tt.packet)
+			resp, err := r.NextResponse()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var msg dns.Message
+			if err := msg.Unpack(resp.Payload); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Header.Truncated != tt.wantTC {
+				t.Errorf("TC = %v; want %v", msg.Header.Truncated, tt.wantTC)
+			}
+			if len(msg.Answers) != tt.wantCount {
+				t.Errorf("%d answers; want %d", len(msg.Answers), tt.wantCount)
+			}
+		})
+	}
+}
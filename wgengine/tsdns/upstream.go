@@ -0,0 +1,230 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/metrics"
+)
+
+// unhealthyFailures is the number of consecutive failures after which
+// an upstream nameserver is considered unhealthy.
+const unhealthyFailures = 3
+
+// unhealthyDuration is how long an unhealthy upstream nameserver is
+// skipped for, while other nameservers for the same domain are up.
+const unhealthyDuration = 30 * time.Second
+
+var metricUpstreamFailures = &metrics.LabelMap{Label: "upstream"}
+
+func init() {
+	expvar.Publish("counter_tsdns_upstream_failures", metricUpstreamFailures)
+}
+
+// upstreamHealth is the health of an upstream nameserver.
+type upstreamHealth struct {
+	// failures is the number of consecutive failed queries.
+	failures int
+	// downUntil is when to try the nameserver again,
+	// once it has failed unhealthyFailures times.
+	downUntil time.Time
+}
+
+// canonicalSuffix returns the domain suffix s in the form used as a
+// key of a routing table: lower case, with a trailing period and no
+// leading one. The root is ".".
+func canonicalSuffix(s string) string {
+	s = strings.ToLower(strings.Trim(s, "."))
+	if s == "" {
+		return "."
+	}
+	return s + "."
+}
+
+// matchRoute returns the nameservers that routes assigns to the
+// longest suffix of name, a domain in canonical form.
+func matchRoute(routes map[string][]string, name string) []string {
+	name = strings.ToLower(name)
+	if name == "" {
+		name = "."
+	}
+	for {
+		if servers, ok := routes[name]; ok {
+			return servers
+		}
+		if name == "." {
+			return nil
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 || i == len(name)-1 {
+			name = "."
+		} else {
+			name = name[i+1:]
+		}
+	}
+}
+
+// ParseRoutes parses a DNS routing table of the form
+//
+//	corp.example.com=10.0.0.53,10.0.0.54 .=1.1.1.1:53,tls://1.0.0.1
+//
+// into a map from domain suffix to nameserver addresses, as expected
+// by Resolver.SetRoutes. Routes are separated by spaces and the
+// nameservers of a route by commas. A nameserver without a port uses
+// port 53. Encrypted nameservers are given as https:// or tls:// URLs;
+// see ParseUpstream. The suffix "." matches all domains.
+func ParseRoutes(s string) (map[string][]string, error) {
+	routes := make(map[string][]string)
+	for _, route := range strings.Fields(s) {
+		eq := strings.IndexByte(route, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("route %q: missing '='", route)
+		}
+		suffix := canonicalSuffix(route[:eq])
+		for _, server := range strings.Split(route[eq+1:], ",") {
+			addr, err := ParseUpstream(server)
+			if err != nil {
+				return nil, fmt.Errorf("route %q: %v", route, err)
+			}
+			routes[suffix] = append(routes[suffix], addr)
+		}
+	}
+	return routes, nil
+}
+
+// parseNameserver returns the nameserver s, an IP with an optional
+// port, as an ip:port string.
+func parseNameserver(s string) (string, error) {
+	if ip, err := netaddr.ParseIP(s); err == nil {
+		return net.JoinHostPort(ip.String(), "53"), nil
+	}
+	ipp, err := netaddr.ParseIPPort(s)
+	if err != nil {
+		return "", fmt.Errorf("bad nameserver %q", s)
+	}
+	return ipp.String(), nil
+}
+
+// SetRoutes sets the resolver's routing table, which maps domain
+// suffixes to the addresses of the upstream nameservers that queries
+// for them are sent to. A query goes to the nameservers of its
+// longest matching suffix; the suffix "." matches all domains.
+// The addresses should be strings of the form ip:port,
+// matching what Dial("udp", addr) expects as addr,
+// or the URLs of encrypted nameservers, as returned by ParseUpstream.
+// SetRoutes takes ownership of the nameserver slices. If the routes
+// differ from the current ones, it flushes the response cache.
+func (r *Resolver) SetRoutes(routes map[string][]string) {
+	canon := make(map[string][]string, len(routes))
+	inUse := make(map[string]bool)
+	for suffix, servers := range routes {
+		canon[canonicalSuffix(suffix)] = servers
+		for _, s := range servers {
+			inUse[s] = true
+		}
+	}
+
+	r.mu.Lock()
+	changed := !routesEqual(r.routes, canon)
+	r.routes = canon
+	for s := range r.health {
+		if !inUse[s] {
+			delete(r.health, s)
+		}
+	}
+	r.mu.Unlock()
+	if changed {
+		r.cache.flush()
+	}
+	r.closeIdleUpstreams(inUse)
+}
+
+// routesEqual reports whether the routing tables a and b send each
+// suffix to the same nameservers, in the same order.
+func routesEqual(a, b map[string][]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for suffix, as := range a {
+		bs, ok := b[suffix]
+		if !ok || len(as) != len(bs) {
+			return false
+		}
+		for i := range as {
+			if as[i] != bs[i] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// upstreamsFor returns the upstream nameservers to send a query for
+// name to. Unhealthy nameservers are left out, unless all of them
+// are unhealthy.
+func (r *Resolver) upstreamsFor(name string, now time.Time) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	servers := matchRoute(r.routes, name)
+	var healthy []string
+	for i, s := range servers {
+		if h := r.health[s]; h != nil && now.Before(h.downUntil) {
+			if healthy == nil {
+				healthy = append(make([]string, 0, len(servers)), servers[:i]...)
+			}
+			continue
+		}
+		if healthy != nil {
+			healthy = append(healthy, s)
+		}
+	}
+	if len(healthy) == 0 {
+		// Either all are healthy, or none are:
+		// in both cases, try them all.
+		return servers
+	}
+	return healthy
+}
+
+// markUpstream records the outcome of a query to the upstream
+// nameserver server; err is nil if it answered.
+func (r *Resolver) markUpstream(server string, err error, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	h := r.health[server]
+	if err == nil {
+		if h != nil {
+			if h.failures >= unhealthyFailures {
+				r.logf("upstream %s is healthy again", server)
+			}
+			delete(r.health, server)
+		}
+		return
+	}
+
+	metricUpstreamFailures.Get(server).Add(1)
+	if h == nil {
+		h = new(upstreamHealth)
+		if r.health == nil {
+			r.health = make(map[string]*upstreamHealth)
+		}
+		r.health[server] = h
+	}
+	h.failures++
+	if h.failures >= unhealthyFailures {
+		if h.failures == unhealthyFailures {
+			r.logf("upstream %s is unhealthy after %d failures: %v", server, h.failures, err)
+		}
+		h.downUntil = now.Add(unhealthyDuration)
+	}
+}
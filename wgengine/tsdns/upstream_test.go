@@ -0,0 +1,303 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+)
+
+func TestParseRoutes(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    map[string][]string
+		wantErr bool
+	}{
+		{in: "", want: map[string][]string{}},
+		{
+			in: "Corp.Example.com=10.0.0.53,10.0.0.54:5353 .=1.1.1.1 ts.net.=[fd7a::53]:53",
+			want: map[string][]string{
+				"corp.example.com.": {"10.0.0.53:53", "10.0.0.54:5353"},
+				".":                 {"1.1.1.1:53"},
+				"ts.net.":           {"[fd7a::53]:53"},
+			},
+		},
+		{
+			in: ".=https://1.1.1.1/dns-query,tls://1.0.0.1,9.9.9.9",
+			want: map[string][]string{
+				".": {"https://1.1.1.1/dns-query", "tls://1.0.0.1", "9.9.9.9:53"},
+			},
+		},
+		{in: "corp.example.com", wantErr: true},
+		{in: "corp.example.com=", wantErr: true},
+		{in: "corp.example.com=ns.example.com", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRoutes(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseRoutes(%q) error = %v; want error: %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseRoutes(%q) = %v; want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestMatchRoute(t *testing.T) {
+	routes := map[string][]string{
+		".":                 {"root"},
+		"example.com.":      {"example"},
+		"corp.example.com.": {"corp"},
+	}
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"corp.example.com.", "corp"},
+		{"host.CORP.example.com.", "corp"},
+		{"notcorp.example.com.", "example"},
+		{"example.com.", "example"},
+		{"example.org.", "root"},
+		{".", "root"},
+	}
+	for _, tt := range tests {
+		got := matchRoute(routes, tt.name)
+		if len(got) != 1 || got[0] != tt.want {
+			t.Errorf("matchRoute(%q) = %v; want [%s]", tt.name, got, tt.want)
+		}
+	}
+
+	delete(routes, ".")
+	if got := matchRoute(routes, "example.org."); got != nil {
+		t.Errorf("matchRoute without a root route = %v; want nil", got)
+	}
+}
+
+func TestUpstreamHealth(t *testing.T) {
+	r := NewResolver(t.Logf, "ipn.dev.")
+	r.SetRoutes(map[string][]string{".": {"a:53", "b:53"}})
+	now := time.Unix(1000, 0)
+	errTimeout := errors.New("timeout")
+
+	for i := 0; i < unhealthyFailures-1; i++ {
+		r.markUpstream("a:53", errTimeout, now)
+	}
+	if got := r.upstreamsFor("example.com.", now); len(got) != 2 {
+		t.Errorf("after %d failures: upstreams = %v; want both", unhealthyFailures-1, got)
+	}
+	r.markUpstream("a:53", errTimeout, now)
+	if got := r.upstreamsFor("example.com.", now); !reflect.DeepEqual(got, []string{"b:53"}) {
+		t.Errorf("after %d failures: upstreams = %v; want [b:53]", unhealthyFailures, got)
+	}
+	if got := r.upstreamsFor("example.com.", now.Add(unhealthyDuration)); len(got) != 2 {
+		t.Errorf("after %v: upstreams = %v; want both", unhealthyDuration, got)
+	}
+
+	// With every nameserver down, all of them are tried.
+	for i := 0; i < unhealthyFailures; i++ {
+		r.markUpstream("b:53", errTimeout, now)
+	}
+	if got := r.upstreamsFor("example.com.", now); len(got) != 2 {
+		t.Errorf("all unhealthy: upstreams = %v; want both", got)
+	}
+
+	r.markUpstream("a:53", nil, now)
+	if got := r.upstreamsFor("example.com.", now); !reflect.DeepEqual(got, []string{"a:53"}) {
+		t.Errorf("after success: upstreams = %v; want [a:53]", got)
+	}
+	if got := metricUpstreamFailures.Get("a:53").Value(); got < unhealthyFailures {
+		t.Errorf("failures metric = %d; want at least %d", got, unhealthyFailures)
+	}
+}
+
+// testUpstream is a nameserver on UDP and TCP that answers every A
+// query with answers A records for ip, each with a TTL of ttl seconds.
+type testUpstream struct {
+	ip          [4]byte
+	ttl         uint32
+	answers     int  // 1 if zero
+	truncateUDP bool // answer over UDP with just the question and TC bit
+
+	pc         net.PacketConn
+	ln         net.Listener
+	queries    int32 // atomic
+	tcpQueries int32 // atomic
+}
+
+// start starts u listening on the same UDP and TCP port.
+func (u *testUpstream) start(t *testing.T) *testUpstream {
+	t.Helper()
+	for i := 0; u.pc == nil; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pc, err := net.ListenPacket("udp", ln.Addr().String())
+		if err != nil {
+			ln.Close()
+			if i == 10 {
+				t.Fatal(err)
+			}
+			continue
+		}
+		u.ln, u.pc = ln, pc
+	}
+	go u.serveUDP()
+	go u.serveTCP()
+	return u
+}
+
+func (u *testUpstream) close() {
+	u.pc.Close()
+	u.ln.Close()
+}
+
+func (u *testUpstream) addr() string { return u.pc.LocalAddr().String() }
+
+func (u *testUpstream) serveUDP() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := u.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(&u.queries, 1)
+		if resp := u.answer(buf[:n], u.truncateUDP); resp != nil {
+			u.pc.WriteTo(resp, addr)
+		}
+	}
+}
+
+func (u *testUpstream) serveTCP() {
+	for {
+		c, err := u.ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			var length [2]byte
+			if _, err := io.ReadFull(c, length[:]); err != nil {
+				return
+			}
+			query := make([]byte, binary.BigEndian.Uint16(length[:]))
+			if _, err := io.ReadFull(c, query); err != nil {
+				return
+			}
+			atomic.AddInt32(&u.tcpQueries, 1)
+			resp := u.answer(query, false)
+			binary.BigEndian.PutUint16(length[:], uint16(len(resp)))
+			c.Write(append(length[:], resp...))
+		}()
+	}
+}
+
+func (u *testUpstream) answer(query []byte, truncate bool) []byte {
+	var p dns.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil
+	}
+	h.Response = true
+	h.Truncated = truncate
+	b := dns.NewBuilder(nil, h)
+	b.StartQuestions()
+	b.Question(q)
+	if !truncate {
+		b.StartAnswers()
+		for i := 0; i < u.answers || i == 0; i++ {
+			b.AResource(dns.ResourceHeader{Name: q.Name, Type: dns.TypeA, Class: dns.ClassINET, TTL: u.ttl}, dns.AResource{A: u.ip})
+		}
+	}
+	resp, err := b.Finish()
+	if err != nil {
+		return nil
+	}
+	return resp
+}
+
+func TestDelegateRoutes(t *testing.T) {
+	corp := (&testUpstream{ip: [4]byte{10, 0, 0, 1}, ttl: 60}).start(t)
+	defer corp.close()
+	public := (&testUpstream{ip: [4]byte{1, 2, 3, 4}}).start(t)
+	defer public.close()
+
+	r := NewResolver(t.Logf, "ipn.dev.")
+	r.SetRoutes(map[string][]string{
+		"corp.example.com": {corp.addr()},
+		".":                {public.addr()},
+	})
+	r.Start()
+	defer r.Close()
+
+	tests := []struct {
+		name string
+		ip   [4]byte
+	}{
+		{"host.corp.example.com.", [4]byte{10, 0, 0, 1}},
+		{"host.corp.example.com.", [4]byte{10, 0, 0, 1}},
+		{"www.example.com.", [4]byte{1, 2, 3, 4}},
+		{"www.example.com.", [4]byte{1, 2, 3, 4}},
+	}
+	for i, tt := range tests {
+		resp, err := syncRespond(r, dnspacket(tt.name, dns.TypeA))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip, code, err := extractipcode(resp)
+		if err != nil || code != dns.RCodeSuccess {
+			t.Fatalf("%d. %s: code = %v, err = %v", i, tt.name, code, err)
+		}
+		if ip.As4() != tt.ip {
+			t.Errorf("%d. %s: ip = %v; want %v", i, tt.name, ip, tt.ip)
+		}
+	}
+
+	// The second corp query was answered from the cache; the public
+	// answers had a zero TTL, so weren't cached.
+	if n := atomic.LoadInt32(&corp.queries); n != 1 {
+		t.Errorf("corp nameserver got %d queries; want 1", n)
+	}
+	if n := atomic.LoadInt32(&public.queries); n != 2 {
+		t.Errorf("public nameserver got %d queries; want 2", n)
+	}
+
+	// Setting the same routes again keeps the cache; changing them
+	// flushes it.
+	corpQuery := func() {
+		t.Helper()
+		if _, err := syncRespond(r, dnspacket("host.corp.example.com.", dns.TypeA)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.SetRoutes(map[string][]string{
+		"corp.example.com.": {corp.addr()},
+		".":                 {public.addr()},
+	})
+	corpQuery()
+	if n := atomic.LoadInt32(&corp.queries); n != 1 {
+		t.Errorf("corp nameserver got %d queries after unchanged SetRoutes; want 1", n)
+	}
+	r.SetRoutes(map[string][]string{
+		"corp.example.com.": {corp.addr()},
+	})
+	corpQuery()
+	if n := atomic.LoadInt32(&corp.queries); n != 2 {
+		t.Errorf("corp nameserver got %d queries after changed SetRoutes; want 2", n)
+	}
+}
@@ -414,6 +414,31 @@ func (t *TUN) InjectOutbound(packet []byte) error {
 	}
 }
 
+// InjectOutboundFiltered is like InjectOutbound, except that the
+// packet passes through the outbound filter, but not PreFilterOut or
+// PostFilterOut, and counts as activity to its destination IP, as if
+// the OS sent it. It returns ErrFiltered if the filter drops it.
+func (t *TUN) InjectOutboundFiltered(pkt []byte) error {
+	p := parsedPacketPool.Get().(*packet.ParsedPacket)
+	defer parsedPacketPool.Put(p)
+	p.Decode(pkt)
+
+	if m, ok := t.destIPActivity.Load().(map[packet.IP]func()); ok {
+		if fn := m[p.DstIP]; fn != nil {
+			fn()
+		}
+	}
+
+	if !t.disableFilter {
+		filt, _ := t.filter.Load().(*filter.Filter)
+		if filt == nil || filt.RunOut(p, t.filterFlags) != filter.Accept {
+			return ErrFiltered
+		}
+	}
+
+	return t.InjectOutbound(pkt)
+}
+
 // Unwrap returns the underlying TUN device.
 func (t *TUN) Unwrap() tun.Device {
 	return t.tdev
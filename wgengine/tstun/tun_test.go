@@ -188,6 +188,40 @@ func TestWriteAndInject(t *testing.T) {
 	}
 }
 
+func TestInjectOutboundFiltered(t *testing.T) {
+	_, tun := newChannelTUN(t.Logf, true)
+	defer tun.Close()
+
+	var active int32
+	tun.SetDestIPActivityFuncs(map[packet.IP]func(){
+		0x05060708: func() { atomic.AddInt32(&active, 1) },
+	})
+
+	if err := tun.InjectOutboundFiltered([]byte("\x45not a valid IPv4 packet")); err != ErrFiltered {
+		t.Errorf("junk: got err %v; want %v", err, ErrFiltered)
+	}
+
+	want := udp(0x01020304, 0x05060708, 98, 98)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- tun.InjectOutboundFiltered(want)
+	}()
+	var buf [MaxPacketSize]byte
+	n, err := tun.Read(buf[:], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], want) {
+		t.Errorf("read %x; want %x", buf[:n], want)
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("got err %v; want nil", err)
+	}
+	if atomic.LoadInt32(&active) != 1 {
+		t.Errorf("destination activity not noted")
+	}
+}
+
 func TestFilter(t *testing.T) {
 	chtun, tun := newChannelTUN(t.Logf, true)
 	defer tun.Close()
@@ -44,6 +44,7 @@ import (
 	"tailscale.com/wgengine/router"
 	"tailscale.com/wgengine/tsdns"
 	"tailscale.com/wgengine/tstun"
+	"tailscale.com/wgengine/usertcp"
 )
 
 // minimalMTU is the MTU we set on tailscale's tuntap
@@ -92,6 +93,8 @@ type userspaceEngine struct {
 	wgdev     *device.Device
 	router    router.Router
 	resolver  *tsdns.Resolver
+	dnsTCP    *dnsTCPResponder // DNS over TCP to the MagicDNS IP, on a usertcp.Stack of its own
+	tcp       *usertcp.Stack   // TCP connections of tailscaled itself
 	magicConn *magicsock.Conn
 	linkMon   *monitor.Mon
 
@@ -118,6 +121,12 @@ type userspaceEngine struct {
 	endpoints      []string
 	pingers        map[wgcfg.Key]*pinger // legacy pingers for pre-discovery peers
 	linkState      *interfaces.State
+	dnsRoutes      map[string][]string // local DNS routes, from SetDNSRoutes
+	controlDNS     []string            // proxied nameservers from the control server, as ip:port or URLs
+	controlDomains []string            // domains to send to controlDNS even if dnsRoutes has "."
+	// conntrackCfg configures the connection tracking of the
+	// packet filters; from SetConntrackConfig.
+	conntrackCfg filter.ConntrackConfig
 
 	// Lock ordering: magicsock.Conn.mu, wgLock, then mu.
 }
@@ -164,10 +173,20 @@ func NewFakeUserspaceEngine(logf logger.Logf, listenPort uint16) (Engine, error)
 // NewUserspaceEngine creates the named tun device and returns a
 // Tailscale Engine running on it.
 func NewUserspaceEngine(logf logger.Logf, tunname string, listenPort uint16) (Engine, error) {
+	return NewUserspaceEngineWithRouterOptions(logf, tunname, listenPort, router.Options{})
+}
+
+// NewUserspaceEngineWithRouterOptions is like NewUserspaceEngine, but
+// creates the router with the given options.
+func NewUserspaceEngineWithRouterOptions(logf logger.Logf, tunname string, listenPort uint16, ropts router.Options) (Engine, error) {
 	if tunname == "" {
 		return nil, fmt.Errorf("--tun name must not be blank")
 	}
 
+	routerGen := func(logf logger.Logf, wgdev *device.Device, tundev tun.Device) (router.Router, error) {
+		return router.NewWithOptions(logf, wgdev, tundev, ropts)
+	}
+
 	logf("Starting userspace wireguard engine with tun device %q", tunname)
 
 	tun, err := tun.CreateTUN(tunname, minimalMTU)
@@ -181,7 +200,7 @@ func NewUserspaceEngine(logf logger.Logf, tunname string, listenPort uint16) (En
 	conf := EngineConfig{
 		Logf:       logf,
 		TUN:        tun,
-		RouterGen:  router.New,
+		RouterGen:  routerGen,
 		ListenPort: listenPort,
 	}
 
@@ -210,12 +229,34 @@ func newUserspaceEngineAdvanced(conf EngineConfig) (_ Engine, reterr error) {
 		resolver: tsdns.NewResolver(logf, magicDNSDomain),
 		pingers:  make(map[wgcfg.Key]*pinger),
 	}
+	dnsTCP, err := newDNSTCPResponder(logf, e.resolver.EnqueueRequest, func(b []byte) {
+		e.tundev.InjectInboundCopy(b)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("DNS TCP responder: %w", err)
+	}
+	e.dnsTCP = dnsTCP
+	e.tcp = usertcp.NewStack(logf, func(b []byte) {
+		e.tundev.InjectOutboundFiltered(b)
+	})
+	defer func() {
+		if reterr != nil {
+			e.dnsTCP.close()
+			e.tcp.Close()
+		}
+	}()
 	e.localAddrs.Store(map[packet.IP]bool{})
 	e.linkState, _ = getLinkState()
 
-	// Respond to all pings only in fake mode.
-	if conf.Fake {
-		e.tundev.PostFilterIn = echoRespondToAll
+	e.tundev.PostFilterIn = func(p *packet.ParsedPacket, t *tstun.TUN) filter.Response {
+		if e.handleTCP(p) {
+			return filter.Drop
+		}
+		// Respond to all pings only in fake mode.
+		if conf.Fake {
+			return echoRespondToAll(p, t)
+		}
+		return filter.Accept
 	}
 	e.tundev.PreFilterOut = e.handleLocalPackets
 
@@ -356,9 +397,11 @@ func newUserspaceEngineAdvanced(conf EngineConfig) (_ Engine, reterr error) {
 	return e, nil
 }
 
-// echoRespondToAll is an inbound post-filter responding to all echo requests.
+// echoRespondToAll is an inbound post-filter responding to all IPv4
+// echo requests. ICMPv6 ones pass, as the packet package can't
+// generate IPv6 replies.
 func echoRespondToAll(p *packet.ParsedPacket, t *tstun.TUN) filter.Response {
-	if p.IsEchoRequest() {
+	if p.IPVersion == 4 && p.IsEchoRequest() {
 		header := p.ICMPHeader()
 		header.ToResponse()
 		packet := packet.Generate(&header, p.Payload())
@@ -369,6 +412,15 @@ func echoRespondToAll(p *packet.ParsedPacket, t *tstun.TUN) filter.Response {
 	return filter.Accept
 }
 
+// handleTCP passes TCP packets for tailscaled's own connections and
+// listeners to its TCP stack, and reports whether it did.
+func (e *userspaceEngine) handleTCP(p *packet.ParsedPacket) bool {
+	if p.IPProto != packet.TCP || !e.isLocalAddr(p.DstIP) {
+		return false
+	}
+	return e.tcp.Handle(p)
+}
+
 // handleLocalPackets inspects packets coming from the local network
 // stack, and intercepts any packets that should be handled by
 // tailscaled directly. Other packets are allowed to proceed into the
@@ -403,6 +455,10 @@ func (e *userspaceEngine) isLocalAddr(ip packet.IP) bool {
 
 // handleDNS is an outbound pre-filter resolving Tailscale domains.
 func (e *userspaceEngine) handleDNS(p *packet.ParsedPacket, t *tstun.TUN) filter.Response {
+	if p.DstIP == magicDNSIP && p.DstPort == magicDNSPort && p.IPProto == packet.TCP {
+		e.dnsTCP.handle(p)
+		return filter.Drop
+	}
 	if p.DstIP == magicDNSIP && p.DstPort == magicDNSPort && p.IPProto == packet.UDP {
 		request := tsdns.Packet{
 			Payload: append([]byte(nil), p.Payload()...),
@@ -425,7 +481,16 @@ func (e *userspaceEngine) pollResolver() {
 			return
 		}
 		if err != nil {
+			// resp still goes to the client, with a SERVFAIL
+			// payload if there is one, so that it doesn't wait
+			// in vain.
 			e.logf("tsdns: error: %v", err)
+		}
+		if resp.TCP {
+			e.dnsTCP.respond(resp)
+			continue
+		}
+		if resp.Payload == nil {
 			continue
 		}
 
@@ -852,7 +917,28 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config)
 			for i, ip := range ips {
 				nameservers[i] = net.JoinHostPort(ip.String(), "53")
 			}
-			e.resolver.SetNameservers(nameservers)
+			// Prefer the encrypted nameservers, if any are usable.
+			var resolvers []string
+			for _, s := range routerCfg.DNS.Resolvers {
+				ns, err := tsdns.ParseUpstream(s)
+				if err != nil {
+					e.logf("wgengine: Reconfig: ignoring DNS resolver: %v", err)
+					continue
+				}
+				resolvers = append(resolvers, ns)
+			}
+			if len(resolvers) > 0 {
+				nameservers = resolvers
+			}
+			var domains []string
+			if routerCfg.DNS.PerDomain {
+				domains = routerCfg.DNS.Domains
+			}
+			e.mu.Lock()
+			e.controlDNS = nameservers
+			e.controlDomains = domains
+			e.setDNSRoutesLocked()
+			e.mu.Unlock()
 			routerCfg.DNS.Nameservers = []netaddr.IP{tsaddr.TailscaleServiceIP()}
 		}
 		e.logf("wgengine: Reconfig: configuring router")
@@ -870,13 +956,54 @@ func (e *userspaceEngine) GetFilter() *filter.Filter {
 }
 
 func (e *userspaceEngine) SetFilter(filt *filter.Filter) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if filt != nil {
+		filt.SetConntrackConfig(e.conntrackCfg)
+	}
 	e.tundev.SetFilter(filt)
 }
 
+func (e *userspaceEngine) SetConntrackConfig(cfg filter.ConntrackConfig) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.conntrackCfg = cfg
+	if filt := e.tundev.GetFilter(); filt != nil {
+		filt.SetConntrackConfig(cfg)
+	}
+}
+
 func (e *userspaceEngine) SetDNSMap(dm *tsdns.Map) {
 	e.resolver.SetMap(dm)
 }
 
+func (e *userspaceEngine) SetDNSRoutes(routes map[string][]string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.dnsRoutes = routes
+	e.setDNSRoutesLocked()
+}
+
+// setDNSRoutesLocked gives the resolver the nameservers from the
+// control server for all domains, overridden by the local routes.
+// With per-domain DNS, the control server's domains keep its
+// nameservers.
+//
+// e.mu must be held.
+func (e *userspaceEngine) setDNSRoutesLocked() {
+	routes := make(map[string][]string)
+	if len(e.controlDNS) > 0 {
+		routes["."] = e.controlDNS
+	}
+	for suffix, servers := range e.dnsRoutes {
+		routes[suffix] = servers
+	}
+	for _, domain := range e.controlDomains {
+		routes[strings.ToLower(strings.TrimSuffix(domain, "."))+"."] = e.controlDNS
+	}
+	e.resolver.SetRoutes(routes)
+}
+
 func (e *userspaceEngine) SetStatusCallback(cb StatusCallback) {
 	e.mu.Lock()
 	defer e.mu.Unlock()
@@ -1067,10 +1194,12 @@ func (e *userspaceEngine) Close() {
 	r := bufio.NewReader(strings.NewReader(""))
 	e.wgdev.IpcSetOperation(r)
 	e.resolver.Close()
+	e.dnsTCP.close()
 	e.magicConn.Close()
 	e.linkMon.Close()
 	e.router.Close()
 	e.wgdev.Close()
+	e.tcp.Close()
 
 	// Shut down pingers after tundev is closed (by e.wgdev.Close) so the
 	// synchronous close does not get stuck on InjectOutbound.
@@ -1081,6 +1210,32 @@ func (e *userspaceEngine) Close() {
 	close(e.waitCh)
 }
 
+func (e *userspaceEngine) DialTCP(ctx context.Context, dst netaddr.IPPort) (net.Conn, error) {
+	if !dst.IP.Is4() {
+		return nil, fmt.Errorf("dial %v: IPv6 is not supported by the userspace TCP stack", dst)
+	}
+	src, ok := e.localIPv4()
+	if !ok {
+		return nil, fmt.Errorf("dial %v: no local Tailscale IPv4 address", dst)
+	}
+	return e.tcp.Dial(ctx, src, packet.IPFromNetaddr(dst.IP), dst.Port)
+}
+
+// localIPv4 returns the lowest local Tailscale IPv4 address, if any.
+func (e *userspaceEngine) localIPv4() (ip packet.IP, ok bool) {
+	localAddrs, _ := e.localAddrs.Load().(map[packet.IP]bool)
+	for addr := range localAddrs {
+		if !ok || addr < ip {
+			ip, ok = addr, true
+		}
+	}
+	return ip, ok
+}
+
+func (e *userspaceEngine) ListenTCP(port uint16) (net.Listener, error) {
+	return e.tcp.Listen(port)
+}
+
 func (e *userspaceEngine) Wait() {
 	<-e.waitCh
 }
@@ -1135,6 +1290,10 @@ func (e *userspaceEngine) SetNetworkMap(nm *controlclient.NetworkMap) {
 	e.magicConn.SetNetworkMap(nm)
 }
 
+func (e *userspaceEngine) SetStaticEndpoints(eps []string) {
+	e.magicConn.SetStaticEndpoints(eps)
+}
+
 func (e *userspaceEngine) DiscoPublicKey() tailcfg.DiscoKey {
 	return e.magicConn.DiscoPublicKey()
 }
@@ -12,6 +12,8 @@ import (
 
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/key"
+	"tailscale.com/wgengine/filter"
+	"tailscale.com/wgengine/packet"
 	"tailscale.com/wgengine/tstun"
 )
 
@@ -86,3 +88,49 @@ func TestNoteReceiveActivity(t *testing.T) {
 		t.Fatalf("expected config")
 	}
 }
+
+func TestEchoRespondToAll(t *testing.T) {
+	tun := tstun.WrapTUN(t.Logf, tstun.NewFakeTUN())
+	defer tun.Close()
+
+	// An ICMPv6 echo request from fd7a:115c:a1e0::1 to
+	// fd7a:115c:a1e0::2 passes untouched.
+	echo6 := []byte{
+		0x60, 0x00, 0x00, 0x00, 0x00, 0x08, 0x3a, 0x40,
+		0xfd, 0x7a, 0x11, 0x5c, 0xa1, 0xe0, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+		0xfd, 0x7a, 0x11, 0x5c, 0xa1, 0xe0, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02,
+		0x80, 0x00, 0x00, 0x00, 0x12, 0x34, 0x00, 0x01,
+	}
+	var p packet.ParsedPacket
+	p.Decode(echo6)
+	if !p.IsEchoRequest() {
+		t.Fatalf("test packet %v is not an echo request", &p)
+	}
+	if got := echoRespondToAll(&p, tun); got != filter.Accept {
+		t.Errorf("ICMPv6 echo request: got %v; want %v", got, filter.Accept)
+	}
+
+	// An IPv4 one is answered.
+	req := packet.Generate(&packet.ICMPHeader{
+		IPHeader: packet.IPHeader{SrcIP: 0x64650001, DstIP: 0x64650002},
+		Type:     packet.ICMPEchoRequest,
+	}, []byte("ping"))
+	p.Decode(req)
+	resc := make(chan filter.Response, 1)
+	go func() { resc <- echoRespondToAll(&p, tun) }()
+	buf := make([]byte, tstun.MaxPacketSize)
+	n, err := tun.Read(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply packet.ParsedPacket
+	reply.Decode(buf[:n])
+	if !reply.IsEchoResponse() || reply.SrcIP != 0x64650002 || reply.DstIP != 0x64650001 {
+		t.Errorf("got reply %v; want an echo response to the request", &reply)
+	}
+	if got := <-resc; got != filter.Drop {
+		t.Errorf("IPv4 echo request: got %v; want %v", got, filter.Drop)
+	}
+}
@@ -0,0 +1,1242 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package usertcp is a minimal userspace TCP implementation, for the
+// connections that tailscaled makes and accepts itself over the
+// Tailscale network, without the help of a TUN device, and for
+// MagicDNS over TCP.
+//
+// It only supports IPv4. It retransmits lost segments (go-back-N),
+// does slow start and congestion avoidance, and keeps idle
+// connections alive, but it has no window scaling, SACK or
+// out-of-order reassembly: its peers are a WireGuard hop away, over
+// which segments are rarely reordered.
+package usertcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/packet"
+)
+
+const (
+	// MSS is the largest segment payload the stack sends and
+	// accepts, leaving room for the IP and TCP headers within the
+	// Tailscale MTU.
+	MSS = 1280 - 40
+	// defaultMSS is the peer's MSS if its SYN doesn't say
+	// (RFC 1122, section 4.2.2.6).
+	defaultMSS = 536
+	// rcvBufSize is the size of a connection's receive buffer,
+	// which is also the largest window it can advertise.
+	rcvBufSize = 65535
+	// sndBufSize is how much unacknowledged data a connection
+	// buffers before Write blocks.
+	sndBufSize = 256 << 10
+	// initialWindow is the initial congestion window, in
+	// segments (RFC 6928).
+	initialWindow = 10
+
+	initialRTO = time.Second
+	minRTO     = 200 * time.Millisecond
+	maxRTO     = 30 * time.Second
+	// maxSynRetries is how many times a SYN or SYN-ACK is
+	// retransmitted before the connection attempt fails.
+	maxSynRetries = 5
+	// maxRetries is how many times a segment is retransmitted
+	// without progress before the connection fails.
+	maxRetries = 10
+
+	// keepaliveIdle is how long a connection may go without
+	// hearing from the peer before it sends keepalive probes.
+	keepaliveIdle = 2 * time.Minute
+	// keepaliveInterval is the time between keepalive probes.
+	keepaliveInterval = 15 * time.Second
+	// keepaliveProbes is how many keepalive probes go unanswered
+	// before the connection fails.
+	keepaliveProbes = 5
+	// lingerTimeout is how long a connection closed by its user
+	// waits for the peer to close its side before being reset.
+	lingerTimeout = time.Minute
+	// timeWait is how long a closed connection is remembered, to
+	// acknowledge a retransmitted FIN.
+	timeWait = 10 * time.Second
+
+	// maxBacklog is the maximum number of connections a listener
+	// holds between their SYN and their Accept.
+	maxBacklog = 16
+	// outQueueLen is the number of segments queued for output
+	// before further ones are dropped.
+	outQueueLen = 512
+
+	firstEphemeralPort = 49152
+)
+
+var (
+	errClosed   = errors.New("usertcp: use of closed connection")
+	errRefused  = errors.New("usertcp: connection refused")
+	errReset    = errors.New("usertcp: connection reset by peer")
+	errTimedOut = errors.New("usertcp: connection timed out")
+	errShutdown = errors.New("usertcp: stack closed")
+	errNoPorts  = errors.New("usertcp: no free local port")
+)
+
+// timeoutError is returned by reads and writes past their deadline.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// Sequence number comparisons (RFC 793, section 3.3).
+func seqLT(a, b uint32) bool { return int32(a-b) < 0 }
+func seqGT(a, b uint32) bool { return int32(a-b) > 0 }
+
+type connKey struct {
+	localIP    packet.IP
+	localPort  uint16
+	remoteIP   packet.IP
+	remotePort uint16
+}
+
+// Stack holds the TCP connections and listeners of a node.
+// Segments reach it through Handle, and leave it through the output
+// function given to NewStack.
+type Stack struct {
+	logf   logger.Logf
+	output func([]byte)
+	outq   chan []byte
+
+	mu        sync.Mutex
+	conns     map[connKey]*Conn
+	listeners map[uint16]*Listener
+	ipID      uint16
+	closed    bool
+}
+
+// NewStack returns a new stack that sends its IP packets with output,
+// which takes ownership of them. Output is called from a single
+// goroutine, so it may block.
+func NewStack(logf logger.Logf, output func(pkt []byte)) *Stack {
+	s := &Stack{
+		logf:      logger.WithPrefix(logf, "usertcp: "),
+		output:    output,
+		outq:      make(chan []byte, outQueueLen),
+		conns:     make(map[connKey]*Conn),
+		listeners: make(map[uint16]*Listener),
+	}
+	go s.sendLoop()
+	return s
+}
+
+func (s *Stack) sendLoop() {
+	for pkt := range s.outq {
+		s.output(pkt)
+	}
+}
+
+// Close resets all connections and closes all listeners.
+func (s *Stack) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	for _, ln := range s.listeners {
+		ln.closeLocked()
+	}
+	for _, c := range s.conns {
+		c.resetLocked(errShutdown)
+	}
+	s.closed = true
+	close(s.outq)
+	return nil
+}
+
+// sendLocked queues a segment with header h and payload for output.
+// If the queue is full, the segment is dropped, to be retransmitted.
+//
+// s.mu must be held.
+func (s *Stack) sendLocked(h *packet.TCPHeader, payload []byte) {
+	if s.closed {
+		return
+	}
+	s.ipID++
+	h.IPID = s.ipID
+	select {
+	case s.outq <- packet.Generate(h, payload):
+	default:
+	}
+}
+
+// resetSegmentLocked replies to h, a segment for no connection, with
+// a reset (RFC 793, page 36).
+//
+// s.mu must be held.
+func (s *Stack) resetSegmentLocked(h *packet.TCPHeader, payloadLen int) {
+	if h.Flags&packet.TCPRst != 0 {
+		return
+	}
+	rst := packet.TCPHeader{
+		IPHeader: packet.IPHeader{SrcIP: h.DstIP, DstIP: h.SrcIP},
+		SrcPort:  h.DstPort,
+		DstPort:  h.SrcPort,
+	}
+	if h.Flags&packet.TCPAck != 0 {
+		rst.Seq = h.Ack
+		rst.Flags = packet.TCPRst
+	} else {
+		rst.Ack = h.Seq + uint32(payloadLen)
+		if h.Flags&packet.TCPSyn != 0 {
+			rst.Ack++
+		}
+		if h.Flags&packet.TCPFin != 0 {
+			rst.Ack++
+		}
+		rst.Flags = packet.TCPRst | packet.TCPAck
+	}
+	s.sendLocked(&rst, nil)
+}
+
+// Handle processes p, an inbound packet addressed to this node.
+// It reports whether p was for the stack: a segment of one of its
+// connections or to the port of one of its listeners. Other packets
+// are left to the caller.
+func (s *Stack) Handle(p *packet.ParsedPacket) bool {
+	if p.IPVersion != 4 || p.IPProto != packet.TCP {
+		return false
+	}
+	h := p.TCPHeader()
+	payload := p.Payload()
+	key := connKey{
+		localIP:    p.DstIP,
+		localPort:  p.DstPort,
+		remoteIP:   p.SrcIP,
+		remotePort: p.SrcPort,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+
+	c := s.conns[key]
+	if c != nil && c.state == stateTimeWait && h.Flags&(packet.TCPSyn|packet.TCPAck) == packet.TCPSyn {
+		// A new connection reusing the address of an old one.
+		c.removeLocked()
+		c = nil
+	}
+	if c != nil {
+		c.segmentLocked(&h, payload)
+		return true
+	}
+
+	ln := s.listeners[key.localPort]
+	if ln == nil {
+		return false
+	}
+	if h.Flags&(packet.TCPSyn|packet.TCPAck|packet.TCPRst|packet.TCPFin) != packet.TCPSyn {
+		s.resetSegmentLocked(&h, len(payload))
+		return true
+	}
+	if ln.pending >= maxBacklog {
+		// Drop the SYN; the peer will try again.
+		return true
+	}
+
+	c = s.newConnLocked(key)
+	c.state = stateSynRcvd
+	c.rcvNxt = h.Seq + 1
+	c.sndWnd = uint32(h.Window)
+	c.setMSSLocked(h.MSS)
+	c.listener = ln
+	ln.pending++
+	c.sendSynLocked()
+	return true
+}
+
+func (s *Stack) newConnLocked(key connKey) *Conn {
+	iss := rand.Uint32()
+	c := &Conn{
+		s:           s,
+		key:         key,
+		iss:         iss,
+		sndUna:      iss,
+		sndNxt:      iss,
+		sndMax:      iss,
+		mss:         MSS,
+		rto:         initialRTO,
+		lastRecv:    time.Now(),
+		established: make(chan struct{}),
+		readCh:      make(chan struct{}),
+		writeCh:     make(chan struct{}),
+	}
+	s.conns[key] = c
+	return c
+}
+
+// Dial opens a connection from port on src, chosen by the stack, to
+// dstPort on dst.
+func (s *Stack) Dial(ctx context.Context, src, dst packet.IP, dstPort uint16) (*Conn, error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, errShutdown
+	}
+	key := connKey{localIP: src, remoteIP: dst, remotePort: dstPort}
+	start := firstEphemeralPort + rand.Intn(65536-firstEphemeralPort)
+	for i := 0; i < 65536-firstEphemeralPort; i++ {
+		key.localPort = uint16(firstEphemeralPort + (start-firstEphemeralPort+i)%(65536-firstEphemeralPort))
+		if s.conns[key] == nil {
+			break
+		}
+		key.localPort = 0
+	}
+	if key.localPort == 0 {
+		s.mu.Unlock()
+		return nil, errNoPorts
+	}
+	c := s.newConnLocked(key)
+	c.state = stateSynSent
+	c.sendSynLocked()
+	s.mu.Unlock()
+
+	select {
+	case <-c.established:
+	case <-ctx.Done():
+		s.mu.Lock()
+		if c.state == stateSynSent {
+			c.failLocked(ctx.Err())
+		}
+		s.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c.state != stateEstablished {
+		return nil, fmt.Errorf("dial %v:%d: %w", dst, dstPort, c.err)
+	}
+	return c, nil
+}
+
+// Listen accepts connections to port on any of the node's addresses
+// that reach the stack.
+func (s *Stack) Listen(port uint16) (*Listener, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, errShutdown
+	}
+	if port == 0 {
+		return nil, errors.New("usertcp: listening on port 0 is not supported")
+	}
+	if s.listeners[port] != nil {
+		return nil, fmt.Errorf("usertcp: port %d already in use", port)
+	}
+	ln := &Listener{
+		s:       s,
+		port:    port,
+		acceptq: make(chan *Conn, maxBacklog),
+		done:    make(chan struct{}),
+	}
+	s.listeners[port] = ln
+	return ln, nil
+}
+
+// A Listener accepts the connections to a port. It implements
+// net.Listener.
+type Listener struct {
+	s       *Stack
+	port    uint16
+	acceptq chan *Conn    // established connections
+	done    chan struct{} // closed by Close
+
+	// Guarded by s.mu.
+	pending int // connections from their SYN until accepted
+	closed  bool
+}
+
+// Accept waits for and returns the next connection to the listener.
+func (ln *Listener) Accept() (net.Conn, error) {
+	for {
+		select {
+		case c := <-ln.acceptq:
+			ln.s.mu.Lock()
+			if c.listener != ln {
+				// It failed while waiting.
+				ln.s.mu.Unlock()
+				continue
+			}
+			c.listener = nil
+			ln.pending--
+			ln.s.mu.Unlock()
+			return c, nil
+		case <-ln.done:
+			return nil, errClosed
+		}
+	}
+}
+
+// Close stops the listener and resets the connections not accepted yet.
+func (ln *Listener) Close() error {
+	ln.s.mu.Lock()
+	defer ln.s.mu.Unlock()
+	ln.closeLocked()
+	return nil
+}
+
+func (ln *Listener) closeLocked() {
+	if ln.closed {
+		return
+	}
+	ln.closed = true
+	close(ln.done)
+	delete(ln.s.listeners, ln.port)
+	for _, c := range ln.s.conns {
+		if c.listener == ln {
+			c.resetLocked(errClosed)
+		}
+	}
+}
+
+// Addr returns the listener's port, on an unspecified address.
+func (ln *Listener) Addr() net.Addr {
+	return &net.TCPAddr{Port: int(ln.port)}
+}
+
+type state int
+
+const (
+	stateSynSent state = iota
+	stateSynRcvd
+	stateEstablished // including after either side closes
+	stateTimeWait    // both sides closed
+	stateClosed      // failed or forgotten
+)
+
+// A Conn is a TCP connection. It implements net.Conn.
+type Conn struct {
+	s   *Stack
+	key connKey
+
+	// All the following are guarded by s.mu.
+
+	state       state
+	err         error         // why the connection failed, once closed
+	established chan struct{} // closed once out of the SYN states
+	listener    *Listener     // for a passively opened connection, until accepted
+
+	// Send side.
+	iss       uint32 // initial send sequence number
+	sndUna    uint32 // oldest unacknowledged sequence number
+	sndNxt    uint32 // next sequence number to send
+	sndMax    uint32 // highest sequence number sent, plus one
+	sndWnd    uint32 // the peer's receive window
+	sndBuf    []byte // data from sndUna on
+	mss       int    // largest segment to send
+	cwnd      int    // congestion window, in bytes
+	ssthresh  int    // slow start threshold
+	dupAcks   int    // consecutive duplicate acknowledgments
+	finQueued bool   // a FIN follows sndBuf
+	finAcked  bool   // the peer acknowledged our FIN
+
+	// Receive side.
+	rcvNxt  uint32 // next sequence number expected
+	rcvBuf  []byte // data received but not read
+	rcvAdv  uint32 // last advertised window
+	finRcvd bool   // the peer closed its side
+
+	// Retransmission (RFC 6298).
+	srtt, rttvar time.Duration
+	rto          time.Duration
+	rttTiming    bool      // an RTT measurement is in progress
+	rttSeq       uint32    // the sequence number whose ACK ends it
+	rttStart     time.Time // when it started
+	retries      int       // retransmissions without progress
+	rtxTimer     *time.Timer
+	rtxGen       int // generation of rtxTimer, to ignore stale firings
+
+	// Keepalive, linger and TIME-WAIT.
+	lastRecv   time.Time
+	probes     int
+	idleTimer  *time.Timer
+	idleGen    int
+	userClosed bool // Close was called
+
+	readCh, writeCh             chan struct{} // closed and replaced to wake readers and writers
+	readDeadline, writeDeadline time.Time
+}
+
+// wakeReadersLocked wakes the goroutines blocked in Read.
+func (c *Conn) wakeReadersLocked() {
+	close(c.readCh)
+	c.readCh = make(chan struct{})
+}
+
+// wakeWritersLocked wakes the goroutines blocked in Write.
+func (c *Conn) wakeWritersLocked() {
+	close(c.writeCh)
+	c.writeCh = make(chan struct{})
+}
+
+func (c *Conn) setMSSLocked(peerMSS uint16) {
+	switch {
+	case peerMSS == 0:
+		c.mss = defaultMSS
+	case int(peerMSS) < MSS:
+		c.mss = int(peerMSS)
+	default:
+		c.mss = MSS
+	}
+}
+
+// rcvWndLocked returns the receive window to advertise.
+func (c *Conn) rcvWndLocked() uint32 {
+	return uint32(rcvBufSize - len(c.rcvBuf))
+}
+
+// sendLocked sends a segment of the connection.
+func (c *Conn) sendLocked(seq uint32, flags uint8, payload []byte) {
+	h := packet.TCPHeader{
+		IPHeader: packet.IPHeader{SrcIP: c.key.localIP, DstIP: c.key.remoteIP},
+		SrcPort:  c.key.localPort,
+		DstPort:  c.key.remotePort,
+		Seq:      seq,
+		Flags:    flags,
+		Window:   uint16(c.rcvWndLocked()),
+	}
+	if flags&packet.TCPAck != 0 {
+		h.Ack = c.rcvNxt
+		c.rcvAdv = uint32(h.Window)
+	}
+	if flags&packet.TCPSyn != 0 {
+		h.MSS = MSS
+	}
+	c.s.sendLocked(&h, payload)
+}
+
+func (c *Conn) sendAckLocked() {
+	c.sendLocked(c.sndNxt, packet.TCPAck, nil)
+}
+
+// sendSynLocked sends the SYN or SYN-ACK of the connection.
+func (c *Conn) sendSynLocked() {
+	flags := uint8(packet.TCPSyn)
+	if c.state == stateSynRcvd {
+		flags |= packet.TCPAck
+	}
+	c.sendLocked(c.iss, flags, nil)
+	if c.retries == 0 {
+		c.rttTiming = true
+		c.rttSeq = c.iss + 1
+		c.rttStart = time.Now()
+	}
+	c.armRtxLocked(true)
+}
+
+// resetLocked sends a reset and fails the connection with err.
+func (c *Conn) resetLocked(err error) {
+	switch c.state {
+	case stateSynSent, stateClosed:
+	case stateSynRcvd:
+		c.sendLocked(c.iss+1, packet.TCPRst, nil)
+	default:
+		c.sendLocked(c.sndNxt, packet.TCPRst|packet.TCPAck, nil)
+	}
+	c.failLocked(err)
+}
+
+// failLocked closes the connection with err, without telling the peer.
+func (c *Conn) failLocked(err error) {
+	if c.state == stateClosed {
+		return
+	}
+	if c.err == nil {
+		c.err = err
+	}
+	c.removeLocked()
+}
+
+// removeLocked forgets the connection.
+func (c *Conn) removeLocked() {
+	if c.state == stateSynSent || c.state == stateSynRcvd {
+		close(c.established)
+	}
+	c.state = stateClosed
+	if c.s.conns[c.key] == c {
+		delete(c.s.conns, c.key)
+	}
+	if c.listener != nil {
+		c.listener.pending--
+		c.listener = nil
+	}
+	c.stopRtxLocked()
+	c.stopIdleLocked()
+	c.wakeReadersLocked()
+	c.wakeWritersLocked()
+}
+
+func (c *Conn) establishLocked() {
+	close(c.established)
+	c.state = stateEstablished
+	c.sndUna = c.iss + 1
+	c.sndNxt = c.sndUna
+	c.sndMax = c.sndUna
+	c.cwnd = initialWindow * c.mss
+	c.ssthresh = 1 << 30
+	c.retries = 0
+	c.stopRtxLocked()
+	c.armIdleLocked(keepaliveIdle)
+	if ln := c.listener; ln != nil {
+		select {
+		case ln.acceptq <- c:
+		default:
+			// Full of connections that failed while waiting.
+			c.resetLocked(errClosed)
+		}
+	}
+}
+
+// segmentLocked processes h and payload, a segment of the connection.
+func (c *Conn) segmentLocked(h *packet.TCPHeader, payload []byte) {
+	c.lastRecv = time.Now()
+	c.probes = 0
+
+	if h.Flags&packet.TCPRst != 0 {
+		switch c.state {
+		case stateSynSent:
+			if h.Flags&packet.TCPAck != 0 && h.Ack == c.iss+1 {
+				c.failLocked(errRefused)
+			}
+		case stateSynRcvd:
+			if h.Seq == c.rcvNxt {
+				c.failLocked(errRefused)
+			}
+		default:
+			// Only an exactly matching reset is accepted
+			// (RFC 5961, section 3.2).
+			if h.Seq == c.rcvNxt {
+				c.failLocked(errReset)
+			}
+		}
+		return
+	}
+
+	switch c.state {
+	case stateSynSent:
+		if h.Flags&packet.TCPAck != 0 && h.Ack != c.iss+1 {
+			c.s.resetSegmentLocked(h, len(payload))
+			return
+		}
+		if h.Flags&packet.TCPSynAck != packet.TCPSynAck {
+			return
+		}
+		c.rcvNxt = h.Seq + 1
+		c.setMSSLocked(h.MSS)
+		c.rttSampleLocked(h.Ack)
+		c.establishLocked()
+		c.sndWnd = uint32(h.Window)
+		c.sendAckLocked()
+		return
+	case stateSynRcvd:
+		if h.Flags&packet.TCPSynAck == packet.TCPSyn {
+			// The peer didn't get our SYN-ACK.
+			if h.Seq+1 == c.rcvNxt {
+				c.sendSynLocked()
+			}
+			return
+		}
+		if h.Flags&packet.TCPAck == 0 {
+			return
+		}
+		if h.Ack != c.iss+1 {
+			c.s.resetSegmentLocked(h, len(payload))
+			return
+		}
+		c.rttSampleLocked(h.Ack)
+		c.establishLocked()
+		c.sndWnd = uint32(h.Window)
+	case stateTimeWait:
+		if h.Flags&packet.TCPFin != 0 {
+			c.sendAckLocked()
+		}
+		return
+	}
+
+	if h.Flags&packet.TCPSyn != 0 {
+		// The peer didn't get our acknowledgment of its SYN.
+		c.sendAckLocked()
+		return
+	}
+	if h.Flags&packet.TCPAck == 0 {
+		return
+	}
+	c.ackLocked(h, len(payload))
+	if c.state != stateEstablished {
+		return
+	}
+	c.receiveLocked(h, payload)
+	if c.state != stateEstablished {
+		return
+	}
+	c.pushLocked()
+	c.maybeFinishLocked()
+}
+
+// ackLocked processes the acknowledgment and window of h.
+func (c *Conn) ackLocked(h *packet.TCPHeader, payloadLen int) {
+	ack := h.Ack
+	if seqGT(ack, c.sndMax) {
+		// It acknowledges something not sent yet.
+		c.sendAckLocked()
+		return
+	}
+	wnd := uint32(h.Window)
+	switch {
+	case seqGT(ack, c.sndUna):
+		n := int(ack - c.sndUna)
+		data := n
+		if data > len(c.sndBuf) {
+			data = len(c.sndBuf)
+			c.finAcked = true
+		}
+		c.sndBuf = c.sndBuf[data:]
+		if len(c.sndBuf) == 0 {
+			c.sndBuf = nil
+		}
+		c.sndUna = ack
+		if seqLT(c.sndNxt, ack) {
+			c.sndNxt = ack
+		}
+		c.rttSampleLocked(ack)
+		if c.cwnd < c.ssthresh {
+			if n > c.mss {
+				n = c.mss
+			}
+			c.cwnd += n
+		} else {
+			inc := c.mss * c.mss / c.cwnd
+			if inc == 0 {
+				inc = 1
+			}
+			c.cwnd += inc
+		}
+		if c.cwnd > sndBufSize {
+			c.cwnd = sndBufSize
+		}
+		c.dupAcks = 0
+		c.retries = 0
+		if c.sndUna == c.sndMax {
+			c.stopRtxLocked()
+		} else {
+			c.armRtxLocked(true)
+		}
+		c.wakeWritersLocked()
+	case ack == c.sndUna && payloadLen == 0 && wnd == c.sndWnd && c.sndMax != c.sndUna:
+		c.dupAcks++
+		if c.dupAcks == 3 {
+			// Fast retransmit (RFC 5681, section 3.2), of all
+			// the outstanding data.
+			c.ssthresh = c.flightHalfLocked()
+			c.cwnd = c.ssthresh
+			c.sndNxt = c.sndUna
+			c.rttTiming = false
+		}
+	}
+	if wnd == 0 && ack == c.sndUna {
+		// The peer is alive and answering our window probes.
+		c.retries = 0
+	}
+	c.sndWnd = wnd
+}
+
+// flightHalfLocked returns the new slow start threshold after a loss.
+func (c *Conn) flightHalfLocked() int {
+	half := int(c.sndMax-c.sndUna) / 2
+	if half < 2*c.mss {
+		half = 2 * c.mss
+	}
+	return half
+}
+
+// rttSampleLocked ends the RTT measurement if ack covers it.
+func (c *Conn) rttSampleLocked(ack uint32) {
+	if !c.rttTiming || seqLT(ack, c.rttSeq) {
+		return
+	}
+	c.rttTiming = false
+	rtt := time.Since(c.rttStart)
+	if c.srtt == 0 {
+		c.srtt = rtt
+		c.rttvar = rtt / 2
+	} else {
+		delta := c.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttvar = (3*c.rttvar + delta) / 4
+		c.srtt = (7*c.srtt + rtt) / 8
+	}
+	c.rto = c.srtt + 4*c.rttvar
+	if c.rto < minRTO {
+		c.rto = minRTO
+	}
+	if c.rto > maxRTO {
+		c.rto = maxRTO
+	}
+}
+
+// receiveLocked processes the data and FIN of h.
+func (c *Conn) receiveLocked(h *packet.TCPHeader, payload []byte) {
+	fin := h.Flags&packet.TCPFin != 0
+	if len(payload) == 0 && !fin {
+		if seqLT(h.Seq, c.rcvNxt) {
+			// A keepalive probe.
+			c.sendAckLocked()
+		}
+		return
+	}
+	if c.finRcvd {
+		// A retransmission.
+		c.sendAckLocked()
+		return
+	}
+	seq := h.Seq
+	if seqLT(seq, c.rcvNxt) {
+		d := int(c.rcvNxt - seq)
+		if d > len(payload) {
+			c.sendAckLocked()
+			return
+		}
+		payload = payload[d:]
+		seq = c.rcvNxt
+	}
+	if seq != c.rcvNxt {
+		// Out of order; the peer will send it again.
+		c.sendAckLocked()
+		return
+	}
+	if c.userClosed && len(payload) > 0 {
+		// Nobody is going to read it (RFC 1122, section 4.2.2.13).
+		c.resetLocked(errClosed)
+		return
+	}
+	if space := rcvBufSize - len(c.rcvBuf); len(payload) > space {
+		payload = payload[:space]
+		fin = false
+	}
+	if len(payload) > 0 {
+		c.rcvBuf = append(c.rcvBuf, payload...)
+		c.rcvNxt += uint32(len(payload))
+	}
+	if fin {
+		c.finRcvd = true
+		c.rcvNxt++
+	}
+	c.wakeReadersLocked()
+	c.sendAckLocked()
+}
+
+// pushLocked sends what the windows allow of the unsent data, and
+// the FIN once all data is sent.
+func (c *Conn) pushLocked() {
+	if c.state != stateEstablished {
+		return
+	}
+	for {
+		inflight := int(c.sndNxt - c.sndUna)
+		if inflight > len(c.sndBuf) {
+			// The FIN is in flight.
+			return
+		}
+		if inflight == len(c.sndBuf) {
+			if c.finQueued && !c.finAcked {
+				c.sendLocked(c.sndNxt, packet.TCPFin|packet.TCPAck, nil)
+				c.advanceLocked(1)
+			}
+			return
+		}
+		wnd := int(c.sndWnd)
+		if wnd > c.cwnd {
+			wnd = c.cwnd
+		}
+		avail := wnd - inflight
+		if avail <= 0 {
+			if inflight == 0 {
+				// A zero window; probe it when the timer fires.
+				c.armRtxLocked(false)
+			}
+			return
+		}
+		n := len(c.sndBuf) - inflight
+		if n > c.mss {
+			n = c.mss
+		}
+		if n > avail {
+			n = avail
+		}
+		flags := uint8(packet.TCPAck)
+		if inflight+n == len(c.sndBuf) {
+			flags |= packet.TCPPsh
+		}
+		c.sendLocked(c.sndNxt, flags, c.sndBuf[inflight:inflight+n])
+		c.advanceLocked(n)
+	}
+}
+
+// advanceLocked moves sndNxt past n just sent sequence numbers.
+func (c *Conn) advanceLocked(n int) {
+	c.sndNxt += uint32(n)
+	if seqGT(c.sndNxt, c.sndMax) {
+		c.sndMax = c.sndNxt
+		if !c.rttTiming {
+			c.rttTiming = true
+			c.rttSeq = c.sndNxt
+			c.rttStart = time.Now()
+		}
+	}
+	c.armRtxLocked(false)
+}
+
+// maybeFinishLocked moves the connection to TIME-WAIT once both sides
+// have closed.
+func (c *Conn) maybeFinishLocked() {
+	if c.state != stateEstablished || !c.finAcked || !c.finRcvd {
+		return
+	}
+	c.state = stateTimeWait
+	c.stopRtxLocked()
+	c.armIdleLocked(timeWait)
+	c.wakeReadersLocked()
+	c.wakeWritersLocked()
+}
+
+func (c *Conn) armRtxLocked(restart bool) {
+	if c.rtxTimer != nil {
+		if !restart {
+			return
+		}
+		c.rtxTimer.Stop()
+	}
+	c.rtxGen++
+	gen := c.rtxGen
+	c.rtxTimer = time.AfterFunc(c.rto, func() { c.onRtx(gen) })
+}
+
+func (c *Conn) stopRtxLocked() {
+	if c.rtxTimer != nil {
+		c.rtxTimer.Stop()
+		c.rtxTimer = nil
+	}
+	c.rtxGen++
+}
+
+// onRtx retransmits after the retransmission timer fired.
+func (c *Conn) onRtx(gen int) {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	if gen != c.rtxGen {
+		return
+	}
+	c.rtxTimer = nil
+
+	c.rto *= 2
+	if c.rto > maxRTO {
+		c.rto = maxRTO
+	}
+	c.rttTiming = false
+
+	switch c.state {
+	case stateSynSent, stateSynRcvd:
+		if c.retries >= maxSynRetries {
+			c.resetLocked(errTimedOut)
+			return
+		}
+		c.retries++
+		c.sendSynLocked()
+		return
+	case stateEstablished:
+	default:
+		return
+	}
+
+	if c.retries >= maxRetries {
+		c.resetLocked(errTimedOut)
+		return
+	}
+	c.retries++
+	if c.sndWnd == 0 && len(c.sndBuf) > 0 {
+		// Probe the zero window with a byte.
+		c.sendLocked(c.sndUna, packet.TCPAck, c.sndBuf[:1])
+		if c.sndNxt == c.sndUna {
+			c.advanceLocked(1)
+		}
+		c.armRtxLocked(false)
+		return
+	}
+	if c.sndMax == c.sndUna {
+		return
+	}
+	// Go back to the oldest unacknowledged segment
+	// (RFC 5681, section 3.1).
+	c.ssthresh = c.flightHalfLocked()
+	c.cwnd = c.mss
+	c.dupAcks = 0
+	c.sndNxt = c.sndUna
+	c.pushLocked()
+}
+
+func (c *Conn) armIdleLocked(d time.Duration) {
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+	}
+	c.idleGen++
+	gen := c.idleGen
+	c.idleTimer = time.AfterFunc(d, func() { c.onIdle(gen) })
+}
+
+func (c *Conn) stopIdleLocked() {
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+		c.idleTimer = nil
+	}
+	c.idleGen++
+}
+
+// onIdle sends keepalives, gives up lingering or ends TIME-WAIT, after
+// the idle timer fired.
+func (c *Conn) onIdle(gen int) {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	if gen != c.idleGen {
+		return
+	}
+	c.idleTimer = nil
+
+	switch c.state {
+	case stateTimeWait:
+		c.removeLocked()
+		return
+	case stateEstablished:
+	default:
+		return
+	}
+	if c.userClosed {
+		// The peer didn't finish in time.
+		c.resetLocked(errTimedOut)
+		return
+	}
+	if idle := time.Since(c.lastRecv); idle < keepaliveIdle {
+		c.armIdleLocked(keepaliveIdle - idle)
+		return
+	}
+	if c.probes >= keepaliveProbes {
+		c.resetLocked(errTimedOut)
+		return
+	}
+	c.probes++
+	// An old sequence number, which the peer acknowledges.
+	c.sendLocked(c.sndUna-1, packet.TCPAck, nil)
+	c.armIdleLocked(keepaliveInterval)
+}
+
+// wait waits until ch is closed or the deadline, if any, passes.
+func wait(ch <-chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-ch
+		return nil
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return timeoutError{}
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ch:
+		return nil
+	case <-t.C:
+		return timeoutError{}
+	}
+}
+
+// Read reads data received from the peer. It returns io.EOF once the
+// peer has closed its side and all its data is read.
+func (c *Conn) Read(b []byte) (int, error) {
+	s := c.s
+	for {
+		s.mu.Lock()
+		if c.userClosed {
+			s.mu.Unlock()
+			return 0, errClosed
+		}
+		if len(c.rcvBuf) > 0 {
+			n := copy(b, c.rcvBuf)
+			c.rcvBuf = c.rcvBuf[n:]
+			if len(c.rcvBuf) == 0 {
+				c.rcvBuf = nil
+			}
+			c.maybeUpdateWindowLocked()
+			s.mu.Unlock()
+			return n, nil
+		}
+		var err error
+		switch {
+		case c.finRcvd:
+			err = io.EOF
+		case c.state == stateClosed:
+			err = c.err
+		}
+		ch, deadline := c.readCh, c.readDeadline
+		s.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		if err := wait(ch, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// maybeUpdateWindowLocked tells the peer that the receive window,
+// which it may think is closed or small, opened up.
+func (c *Conn) maybeUpdateWindowLocked() {
+	if c.state != stateEstablished || c.finRcvd {
+		return
+	}
+	wnd := c.rcvWndLocked()
+	if wnd <= c.rcvAdv {
+		return
+	}
+	if (c.rcvAdv < uint32(c.mss) && wnd >= uint32(c.mss)) || wnd-c.rcvAdv >= rcvBufSize/2 {
+		c.sendAckLocked()
+	}
+}
+
+// Write sends b to the peer, blocking while the send buffer is full.
+func (c *Conn) Write(b []byte) (int, error) {
+	s := c.s
+	n := 0
+	for len(b) > 0 {
+		s.mu.Lock()
+		var err error
+		switch {
+		case c.userClosed || c.finQueued:
+			err = errClosed
+		case c.state == stateClosed:
+			err = c.err
+		case c.state != stateEstablished:
+			err = errClosed
+		}
+		if err != nil {
+			s.mu.Unlock()
+			return n, err
+		}
+		if space := sndBufSize - len(c.sndBuf); space > 0 {
+			m := len(b)
+			if m > space {
+				m = space
+			}
+			c.sndBuf = append(c.sndBuf, b[:m]...)
+			b = b[m:]
+			n += m
+			c.pushLocked()
+			s.mu.Unlock()
+			continue
+		}
+		ch, deadline := c.writeCh, c.writeDeadline
+		s.mu.Unlock()
+		if err := wait(ch, deadline); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// CloseWrite closes the sending side of the connection: a FIN is sent
+// after the data already written.
+func (c *Conn) CloseWrite() error {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	if c.state != stateEstablished {
+		return nil
+	}
+	c.finQueued = true
+	c.pushLocked()
+	return nil
+}
+
+// Close closes the connection. Data already written is still sent,
+// but the connection is reset if data received isn't read.
+func (c *Conn) Close() error {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	if c.userClosed {
+		return nil
+	}
+	c.userClosed = true
+	c.wakeReadersLocked()
+	c.wakeWritersLocked()
+	switch c.state {
+	case stateTimeWait:
+		return nil
+	case stateEstablished:
+	default:
+		c.resetLocked(errClosed)
+		return nil
+	}
+	if len(c.rcvBuf) > 0 {
+		c.resetLocked(errClosed)
+		return nil
+	}
+	c.finQueued = true
+	c.pushLocked()
+	c.armIdleLocked(lingerTimeout)
+	c.maybeFinishLocked()
+	return nil
+}
+
+// LocalAddr returns the local address of the connection.
+func (c *Conn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: c.key.localIP.Netaddr().IPAddr().IP, Port: int(c.key.localPort)}
+}
+
+// RemoteAddr returns the address of the peer.
+func (c *Conn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: c.key.remoteIP.Netaddr().IPAddr().IP, Port: int(c.key.remotePort)}
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.wakeReadersLocked()
+	c.wakeWritersLocked()
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	c.readDeadline = t
+	c.wakeReadersLocked()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	c.writeDeadline = t
+	c.wakeWritersLocked()
+	return nil
+}
@@ -0,0 +1,201 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package usertcp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"tailscale.com/wgengine/packet"
+)
+
+var (
+	ipA = packet.IP(0x64400001) // 100.64.0.1
+	ipB = packet.IP(0x64400002) // 100.64.0.2
+)
+
+// link connects two stacks, dropping a fraction loss of the packets
+// between them.
+type link struct {
+	mu   sync.Mutex
+	rnd  *rand.Rand
+	loss float64
+
+	a, b *Stack
+}
+
+func newLink(t *testing.T, loss float64) *link {
+	l := &link{rnd: rand.New(rand.NewSource(1)), loss: loss}
+	l.a = NewStack(t.Logf, func(b []byte) { l.deliver(b, l.b) })
+	l.b = NewStack(t.Logf, func(b []byte) { l.deliver(b, l.a) })
+	return l
+}
+
+func (l *link) deliver(b []byte, to *Stack) {
+	l.mu.Lock()
+	drop := l.rnd.Float64() < l.loss
+	l.mu.Unlock()
+	if drop {
+		return
+	}
+	var p packet.ParsedPacket
+	p.Decode(b)
+	to.Handle(&p)
+}
+
+func (l *link) Close() {
+	l.a.Close()
+	l.b.Close()
+}
+
+func TestTransfer(t *testing.T) {
+	tests := []struct {
+		name string
+		loss float64
+		size int
+	}{
+		{"lossless", 0, 4 << 20},
+		{"lossy", 0.05, 256 << 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newLink(t, tt.loss)
+			defer l.Close()
+
+			ln, err := l.b.Listen(80)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			go func() {
+				c, err := ln.Accept()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer c.Close()
+				io.Copy(c, c)
+				c.(*Conn).CloseWrite()
+			}()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			c, err := l.a.Dial(ctx, ipA, ipB, 80)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if got, want := c.RemoteAddr().String(), "100.64.0.2:80"; got != want {
+				t.Errorf("RemoteAddr = %v; want %v", got, want)
+			}
+			c.SetDeadline(time.Now().Add(time.Minute))
+
+			want := make([]byte, tt.size)
+			rand.Read(want)
+			go func() {
+				if _, err := c.Write(want); err != nil {
+					t.Error(err)
+				}
+				c.CloseWrite()
+			}()
+			got, err := ioutil.ReadAll(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("echoed %d bytes, not the %d written", len(got), len(want))
+			}
+		})
+	}
+}
+
+func TestNoListener(t *testing.T) {
+	l := newLink(t, 0)
+	defer l.Close()
+
+	syn := packet.Generate(&packet.TCPHeader{
+		IPHeader: packet.IPHeader{SrcIP: ipA, DstIP: ipB},
+		SrcPort:  50000,
+		DstPort:  80,
+		Flags:    packet.TCPSyn,
+	}, nil)
+	var p packet.ParsedPacket
+	p.Decode(syn)
+	if l.b.Handle(&p) {
+		t.Errorf("Handle of SYN to a port without listener = true")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := l.a.Dial(ctx, ipA, ipB, 80); err == nil {
+		t.Errorf("Dial to a port without listener succeeded")
+	}
+}
+
+func TestResetOnClose(t *testing.T) {
+	l := newLink(t, 0)
+	defer l.Close()
+
+	ln, err := l.b.Listen(80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		accepted <- c
+	}()
+	c, err := l.a.Dial(context.Background(), ipA, ipB, 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	sc := <-accepted
+
+	// Closing with unread data resets the connection.
+	if _, err := c.Write([]byte("unread")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	sc.Close()
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != errReset {
+		t.Errorf("Read after reset = %v; want %v", err, errReset)
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	l := newLink(t, 0)
+	defer l.Close()
+
+	ln, err := l.b.Listen(80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ln.Accept()
+	c, err := l.a.Dial(context.Background(), ipA, ipB, 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = c.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("Read past deadline = %v; want timeout", err)
+	}
+}
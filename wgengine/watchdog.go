@@ -5,7 +5,9 @@
 package wgengine
 
 import (
+	"context"
 	"log"
+	"net"
 	"os"
 	"runtime/pprof"
 	"strconv"
@@ -13,6 +15,7 @@ import (
 	"time"
 
 	"github.com/tailscale/wireguard-go/wgcfg"
+	"inet.af/netaddr"
 	"tailscale.com/control/controlclient"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/tailcfg"
@@ -81,9 +84,15 @@ func (e *watchdogEngine) GetFilter() *filter.Filter {
 func (e *watchdogEngine) SetFilter(filt *filter.Filter) {
 	e.watchdog("SetFilter", func() { e.wrap.SetFilter(filt) })
 }
+func (e *watchdogEngine) SetConntrackConfig(cfg filter.ConntrackConfig) {
+	e.watchdog("SetConntrackConfig", func() { e.wrap.SetConntrackConfig(cfg) })
+}
 func (e *watchdogEngine) SetDNSMap(dm *tsdns.Map) {
 	e.watchdog("SetDNSMap", func() { e.wrap.SetDNSMap(dm) })
 }
+func (e *watchdogEngine) SetDNSRoutes(routes map[string][]string) {
+	e.watchdog("SetDNSRoutes", func() { e.wrap.SetDNSRoutes(routes) })
+}
 func (e *watchdogEngine) SetStatusCallback(cb StatusCallback) {
 	e.watchdog("SetStatusCallback", func() { e.wrap.SetStatusCallback(cb) })
 }
@@ -105,10 +114,25 @@ func (e *watchdogEngine) SetDERPMap(m *tailcfg.DERPMap) {
 func (e *watchdogEngine) SetNetworkMap(nm *controlclient.NetworkMap) {
 	e.watchdog("SetNetworkMap", func() { e.wrap.SetNetworkMap(nm) })
 }
+func (e *watchdogEngine) SetStaticEndpoints(eps []string) {
+	e.watchdog("SetStaticEndpoints", func() { e.wrap.SetStaticEndpoints(eps) })
+}
 func (e *watchdogEngine) DiscoPublicKey() (k tailcfg.DiscoKey) {
 	e.watchdog("DiscoPublicKey", func() { k = e.wrap.DiscoPublicKey() })
 	return k
 }
+func (e *watchdogEngine) DialTCP(ctx context.Context, dst netaddr.IPPort) (c net.Conn, err error) {
+	// Dialing may legitimately take a while, so cut it short
+	// before the watchdog fires.
+	ctx, cancel := context.WithTimeout(ctx, e.maxWait/2)
+	defer cancel()
+	e.watchdog("DialTCP", func() { c, err = e.wrap.DialTCP(ctx, dst) })
+	return c, err
+}
+func (e *watchdogEngine) ListenTCP(port uint16) (ln net.Listener, err error) {
+	e.watchdog("ListenTCP", func() { ln, err = e.wrap.ListenTCP(port) })
+	return ln, err
+}
 func (e *watchdogEngine) Close() {
 	e.watchdog("Close", e.wrap.Close)
 }
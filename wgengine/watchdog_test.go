@@ -6,10 +6,14 @@ package wgengine
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"strings"
 	"testing"
 	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/wgengine/packet"
 )
 
 func TestWatchdog(t *testing.T) {
@@ -72,4 +76,27 @@ func TestWatchdog(t *testing.T) {
 		wdEngine.fatalf = t.Fatalf
 		wdEngine.Close()
 	})
+
+	t.Run("DialTCP gives up before the watchdog fires", func(t *testing.T) {
+		t.Parallel()
+		e, err := NewFakeUserspaceEngine(t.Logf, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A local address, but no peer to answer the SYNs.
+		e.(*userspaceEngine).localAddrs.Store(map[packet.IP]bool{packet.IP(0x64400001): true})
+
+		e = NewWatchdog(e)
+		e.(*watchdogEngine).maxWait = 150 * time.Millisecond
+		e.(*watchdogEngine).logf = t.Logf
+		e.(*watchdogEngine).fatalf = t.Fatalf
+		defer e.Close()
+
+		if _, err := e.DialTCP(context.Background(), netaddr.IPPort{IP: netaddr.IPv4(100, 64, 0, 2), Port: 80}); err == nil {
+			t.Error("DialTCP to a node that doesn't answer succeeded")
+		}
+		if _, err := e.DialTCP(context.Background(), netaddr.IPPort{IP: netaddr.IPFrom16([16]byte{0xfd, 0x7a, 0x11, 0x5c, 0xa1, 0xe0, 15: 1}), Port: 80}); err == nil {
+			t.Error("DialTCP to an IPv6 address succeeded")
+		}
+	})
 }
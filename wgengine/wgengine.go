@@ -5,10 +5,13 @@
 package wgengine
 
 import (
+	"context"
 	"errors"
+	"net"
 	"time"
 
 	"github.com/tailscale/wireguard-go/wgcfg"
+	"inet.af/netaddr"
 	"tailscale.com/control/controlclient"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/tailcfg"
@@ -67,9 +70,20 @@ type Engine interface {
 	// SetFilter updates the packet filter.
 	SetFilter(*filter.Filter)
 
+	// SetConntrackConfig sets the configuration of the connection
+	// tracking tables of the packet filter, which also applies to
+	// the filters set later.
+	SetConntrackConfig(filter.ConntrackConfig)
+
 	// SetDNSMap updates the DNS map.
 	SetDNSMap(*tsdns.Map)
 
+	// SetDNSRoutes sets the local DNS routing table, which maps
+	// domain suffixes to the ip:port addresses of the nameservers
+	// that proxied DNS queries for them are sent to. Local routes
+	// take precedence over the nameservers from the control server.
+	SetDNSRoutes(map[string][]string)
+
 	// SetStatusCallback sets the function to call when the
 	// WireGuard status changes.
 	SetStatusCallback(StatusCallback)
@@ -112,6 +126,11 @@ type Engine interface {
 	// The network map should only be read from.
 	SetNetworkMap(*controlclient.NetworkMap)
 
+	// SetStaticEndpoints sets extra ip:port or host:port endpoints
+	// to advertise for this node, in addition to the ones the
+	// engine discovers itself.
+	SetStaticEndpoints([]string)
+
 	// SetNetInfoCallback sets the function to call when a
 	// new NetInfo summary is available.
 	SetNetInfoCallback(NetInfoCallback)
@@ -123,4 +142,18 @@ type Engine interface {
 	// UpdateStatus populates the network state using the provided
 	// status builder.
 	UpdateStatus(*ipnstate.StatusBuilder)
+
+	// DialTCP opens a TCP connection to dst over the Tailscale
+	// network, from this node's Tailscale IPv4 address. The
+	// connection is handled by the engine itself rather than the
+	// OS, so it works without a TUN device, but it is still
+	// subject to the packet filter. IPv6 destinations are not
+	// supported and return an error.
+	DialTCP(ctx context.Context, dst netaddr.IPPort) (net.Conn, error)
+
+	// ListenTCP accepts the TCP connections from the Tailscale
+	// network to port on this node's Tailscale IPv4 addresses,
+	// which the packet filter lets in. They are handled by the
+	// engine itself and no longer reach the OS.
+	ListenTCP(port uint16) (net.Listener, error)
 }